@@ -0,0 +1,1710 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"backup/internal/backup"
+)
+
+// 命令行退出码
+const (
+	exitOK    = 0 // 成功
+	exitError = 1 // 执行失败
+	exitUsage = 2 // 参数错误
+
+	exitInterrupted = 130 // 被 SIGINT/SIGTERM 中断
+)
+
+// cliContext 收到 SIGINT/SIGTERM 时被取消，传给打包/解包以便及时停止并清理未完成的输出
+var cliContext = context.Background()
+
+// runCLI 解析子命令并执行，返回进程退出码
+// 执行中发生 panic 时写入诊断包并返回 exitError
+func runCLI(args []string) (code int) {
+	if len(args) == 0 {
+		printUsage()
+		return exitUsage
+	}
+
+	diag.args = args
+	defer diag.recoverPanic(&code)
+
+	output = detectOutputMode()
+	args = output.parseFlags(args)
+	if len(args) == 0 {
+		printUsage()
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cliContext = ctx
+
+	switch args[0] {
+	case "pack":
+		return runPack(args[1:])
+	case "unpack":
+		return runUnpack(args[1:])
+	case "extract":
+		return runExtract(args[1:])
+	case "restore-remote":
+		return runRestoreRemote(args[1:])
+	case "test":
+		return runTest(args[1:])
+	case "verify":
+		return runVerify(args[1:])
+	case "scan":
+		return runScan(args[1:])
+	case "estimate":
+		return runEstimate(args[1:])
+	case "list":
+		return runList(args[1:])
+	case "cat":
+		return runCat(args[1:])
+	case "packages":
+		return runPackages(args[1:])
+	case "du":
+		return runDu(args[1:])
+	case "find":
+		return runFind(args[1:])
+	case "diff":
+		return runDiff(args[1:])
+	case "merge":
+		return runMerge(args[1:])
+	case "mirror":
+		return runMirror(args[1:])
+	case "status":
+		return runStatus(args[1:])
+	case "doctor":
+		return runDoctor(args[1:])
+	case "convert":
+		return runConvert(args[1:])
+	case "init-repo":
+		return runInitRepo(args[1:])
+	case "snapshot":
+		return runSnapshot(args[1:])
+	case "snapshots":
+		return runSnapshots(args[1:])
+	case "restore":
+		return runRestore(args[1:])
+	case "compat-check":
+		return runCompatCheck(args[1:])
+	case "version":
+		return runVersion(args[1:])
+	case "self-update":
+		return runSelfUpdate(args[1:])
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "未知的子命令: %s\n", args[0])
+		printUsage()
+		return exitUsage
+	}
+}
+
+// printUsage 打印命令行用法
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `用法:
+  backup                      打开图形界面
+  backup pack   -source <源路径> -output <归档文件> [选项]
+  backup pack   -import <tar/tar.gz/zip> -output <归档文件> [选项]  转换其他工具生成的归档
+  backup unpack -archive <归档文件> -target <目标目录> [过滤选项] [选项]
+  backup extract -archive <归档文件> -path <路径> -target <目标目录>  只还原指定的文件或目录
+  backup convert -input <归档文件> -output <归档文件> [-format bkup|tar|tar.gz]  在 BKUP 与 tar/tar.gz 之间转换，保留属主、时间和扩展属性
+  backup restore-remote -url <地址> -sha256 <摘要> -target <目标目录> [-spool-dir <临时目录>]  校验后写入目标目录（不带流校验的归档先保存到临时目录，需要与归档相同的磁盘空间）
+  backup test   -archive <归档文件>                    完整读取归档，检查是否损坏
+  backup verify -archive <归档文件> [-stamp]           逐个条目检查结构和数据，报告损坏或截断的条目路径
+  backup scan   -source <源路径> [-top N] [-du-mode apparent|blocks] [过滤选项]    统计将被打包的内容
+  backup estimate -source <源路径> [-compress] [-sample 0.05] [过滤选项]  抽样估算归档大小和耗时
+  backup list   -archive <归档文件>                    列出归档中的全部条目（也支持 tar、tar.gz、zip）
+  backup cat    -archive <归档文件> -path <路径>        将一个文件的内容写到标准输出（有中央索引时直接定位）
+  backup packages -archive <归档文件> [-json]          列出打包时记录的已安装软件包（pack -packages）
+  backup du     -archive <归档文件> [-top N] [-du-mode apparent|blocks]           列出归档中占用空间最大的文件和目录
+  backup find   [-mime 类型] [-name 模式] <归档文件>...  在归档中查找条目
+  backup diff   [-json] [-metadata-only] <旧归档> <新归档>  列出两个归档之间新增、删除和修改的路径（有差异时退出码为 1）
+  backup merge  -out <输出归档> [-policy newest|error] <归档>...  合并多个归档（同一路径取最新的版本或报错）
+  backup mirror -src <归档目录> -dst <目标目录> [-delete [-keep-within 720h]] [-checksum] [-dry-run]  只复制新增或有变化的归档
+  backup status [-max-age 720h] [-all] [归档或目录]...  各目标目录的最近打包和校验概况，列出需要重新校验的归档
+  backup doctor [-max-age 36h] [-min-retention 168h] [-json]  检查备份配置和历史，报告问题和建议（有严重问题时退出码为 1）
+  backup init-repo -repo <仓库目录> [-encryption random|convergent]  创建快照仓库（多次备份共享去重的块存储，可以逐块加密）
+  backup snapshot -repo <仓库目录> -source <源路径> [-tag 标签]  在仓库中创建快照，输出快照 ID
+  backup snapshots -repo <仓库目录> [-json]            列出仓库中的快照
+  backup restore -repo <仓库目录> -snapshot <ID|latest> -target <目标目录>  还原快照
+  backup compat-check                                  用内置的各版本标准归档检查读取兼容性
+  backup version [-json]                               显示版本和支持的格式、压缩、加密方式
+  backup self-update [-check] [-force]                 检查并安装新版本（验证签名后替换自身）
+
+全局选项（写在子命令之前）:
+  -q                只输出错误（不显示进度、状态和警告）
+  -no-color         不使用颜色（也可以设置环境变量 NO_COLOR）
+
+使用 "backup <子命令> -h" 查看子命令的全部选项`)
+}
+
+// filterFlags 打包（以及按过滤条件解包）相关的过滤参数
+type filterFlags struct {
+	file     string
+	include  string
+	exclude  string
+	types    string
+	names    string
+	minTime  string
+	maxTime  string
+	minSize  string
+	maxSize  string
+	sizeMode string
+	parents  bool
+}
+
+// register 在 FlagSet 上注册过滤参数
+func (f *filterFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.file, "filter-file", "", "从文件读取过滤条件（图形界面导出的 JSON，或每行一个包含路径的列表），- 表示标准输入；其他过滤参数在其基础上追加或覆盖")
+	fs.StringVar(&f.include, "include", "", "包含路径模式，多个用逗号分隔，如: *.txt,subdir/**")
+	fs.StringVar(&f.exclude, "exclude", "", "排除路径模式，多个用逗号分隔，如: *.tmp,*.log")
+	fs.StringVar(&f.types, "types", "", "包含的文件类型，如: file,dir,symlink")
+	fs.StringVar(&f.names, "names", "", "文件名模式，多个用逗号分隔，如: *.log,test*")
+	fs.StringVar(&f.minTime, "min-time", "", "最小修改时间，如: 2024-01-01 00:00:00")
+	fs.StringVar(&f.maxTime, "max-time", "", "最大修改时间，如: 2024-12-31 23:59:59")
+	fs.StringVar(&f.minSize, "min-size", "", "最小文件大小，如: 1K, 1M, 1G")
+	fs.StringVar(&f.maxSize, "max-size", "", "最大文件大小，如: 100M, 1G")
+	fs.StringVar(&f.sizeMode, "size-mode", "", "-min-size/-max-size 比较的大小: apparent（文件大小，默认）, blocks（实际占用的磁盘块，稀疏文件只计有数据的块）")
+	fs.BoolVar(&f.parents, "include-parents", false, "被包含条目的上级目录即使被排除也写入（只有元数据），解包时中间目录保留原有的权限、属主和时间")
+}
+
+// build 根据参数构建过滤条件，没有任何过滤条件时返回 nil
+func (f *filterFlags) build() (*backup.Filter, error) {
+	filter := &backup.Filter{}
+	if f.file != "" {
+		loaded, err := backup.ReadFilterFile(f.file)
+		if err != nil {
+			return nil, err
+		}
+		filter = loaded
+	}
+	filter.PathPatterns = append(filter.PathPatterns, backup.ParsePatterns(f.include)...)
+	filter.ExcludePaths = append(filter.ExcludePaths, backup.ParsePatterns(f.exclude)...)
+	filter.NamePatterns = append(filter.NamePatterns, backup.ParsePatterns(f.names)...)
+	filter.IncludeParents = filter.IncludeParents || f.parents
+
+	types, err := backup.ParseFileTypes(f.types)
+	if err != nil {
+		return nil, err
+	}
+	filter.IncludeTypes = append(filter.IncludeTypes, types...)
+
+	if f.minTime != "" {
+		if filter.MinModTime = backup.ParseTime(f.minTime); filter.MinModTime == nil {
+			return nil, fmt.Errorf("无法解析时间: %s", f.minTime)
+		}
+	}
+	if f.maxTime != "" {
+		if filter.MaxModTime = backup.ParseTime(f.maxTime); filter.MaxModTime == nil {
+			return nil, fmt.Errorf("无法解析时间: %s", f.maxTime)
+		}
+	}
+	if f.minSize != "" {
+		if filter.MinSize = backup.ParseSize(f.minSize); filter.MinSize == nil {
+			return nil, fmt.Errorf("无法解析大小: %s", f.minSize)
+		}
+	}
+	if f.maxSize != "" {
+		if filter.MaxSize = backup.ParseSize(f.maxSize); filter.MaxSize == nil {
+			return nil, fmt.Errorf("无法解析大小: %s", f.maxSize)
+		}
+	}
+	if f.sizeMode != "" {
+		if filter.SizeMode, err = backup.ParseUsageMode(f.sizeMode); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(filter.PathPatterns) == 0 && len(filter.ExcludePaths) == 0 &&
+		len(filter.IncludeTypes) == 0 && len(filter.NamePatterns) == 0 &&
+		filter.MinModTime == nil && filter.MaxModTime == nil &&
+		filter.MinSize == nil && filter.MaxSize == nil {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// limitFlags 读取归档时的资源限制参数（unpack、test 共用）
+type limitFlags struct {
+	maxEntries   int64
+	maxEntrySize string
+	maxTotalSize string
+	maxDecoder   string
+}
+
+// register 在 FlagSet 上注册资源限制参数
+func (f *limitFlags) register(fs *flag.FlagSet) {
+	fs.Int64Var(&f.maxEntries, "max-entries", 0, "最多读取的条目数，0 表示默认值（1000 万），-1 表示不限制")
+	fs.StringVar(&f.maxEntrySize, "max-entry-size", "", "单个文件的最大大小，如 10G，默认 256G，unlimited 表示不限制")
+	fs.StringVar(&f.maxTotalSize, "max-total-size", "", "所有文件内容的总大小上限，如 500G，默认 1024G，unlimited 表示不限制")
+	fs.StringVar(&f.maxDecoder, "max-decoder-memory", "", "解压缩器（zstd 窗口、xz 字典）的最大内存，如 1G，默认 256M，unlimited 表示不限制")
+}
+
+// build 根据参数构造资源限制
+func (f *limitFlags) build() (backup.ReadLimits, error) {
+	limits := backup.ReadLimits{MaxEntries: f.maxEntries}
+	for _, field := range []struct {
+		value string
+		dest  *int64
+	}{
+		{f.maxEntrySize, &limits.MaxEntrySize},
+		{f.maxTotalSize, &limits.MaxTotalSize},
+		{f.maxDecoder, &limits.MaxDecoderMemory},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if field.value == "unlimited" {
+			*field.dest = -1
+			continue
+		}
+		size := backup.ParseSize(field.value)
+		if size == nil || *size <= 0 {
+			return limits, fmt.Errorf("无法解析大小: %s", field.value)
+		}
+		*field.dest = *size
+	}
+	return limits, nil
+}
+
+// runPack 执行 pack 子命令
+func runPack(args []string) int {
+	fs := flag.NewFlagSet("pack", flag.ContinueOnError)
+	source := fs.String("source", "", "要打包的源目录或文件")
+	output := fs.String("output", "", "输出的归档文件路径")
+	format := fs.String("format", "bkup", "归档格式: bkup, zip（标准 zip，没有本程序也能打开；只保存权限、属主和修改时间，不支持加密、块存储、增量等功能，压缩只能用 flate）")
+	compress := fs.Bool("compress", false, "启用压缩")
+	encrypt := fs.Bool("encrypt", false, "启用加密")
+	password := fs.String("password", "", "加密密码（在终端上运行时可以省略，改为交互输入并确认）")
+	minPasswordBits := fs.Float64("min-password-bits", backup.MinPasswordBits(), "加密密码的最低估算强度（比特），低于时拒绝打包（默认取环境变量 BACKUP_MIN_PASSWORD_BITS）")
+	encryptCompress := fs.String("encrypt-compress", "auto", "同时压缩和加密时的策略: auto（包含 -untrusted 数据时不压缩）, compress（总是先压缩再加密）, store（加密时不压缩）")
+	untrusted := fs.String("untrusted", "", "不可信数据类别：内容可能被他人影响的文件的路径模式，逗号分隔，如 uploads/**,mail/**")
+	encryptPaths := fs.String("encrypt-paths", "", "单独加密这些路径模式匹配的文件内容（逗号分隔，如 secrets/**,*.key），需要 -entry-password")
+	entryPassword := fs.String("entry-password", "", "单独加密条目的密码（与 -password 相互独立）")
+	hardDereference := fs.Bool("hard-dereference", false, "硬链接的每个路径都保存为完整文件")
+	image := fs.String("image", "", "打包块设备的原始内容（如 /dev/sdb1），代替 -source")
+	importPath := fs.String("import", "", "将 tar、tar.gz 或 zip 归档转换为 BKUP 归档，代替 -source")
+	blockCompress := fs.Bool("block-compress", false, "分块压缩，解包时可多核并行解压（隐含 -compress）")
+	compression := fs.String("compression", "", "压缩方式: none, flate, zstd, xz（zstd 更快、压缩率更高；xz 压缩率最高但很慢，适合冷存档；两者都不能与 -block-compress 同时使用）；不指定时由 -compress 决定")
+	compressTarget := fs.String("compress-target", "", "目标压缩吞吐量，如 200MB/s，自适应调整压缩级别（隐含 -block-compress）")
+	level := fs.Int("level", 0, "压缩级别：flate、xz 为 1~9，zstd 为 1~22；0 表示默认（flate 9、zstd 3、xz 6）。大量数据时 flate 用 1~6 会快很多")
+	threads := fs.Int("threads", 0, "并行压缩的线程数（flate、zstd；xz 只使用一个线程），0 表示使用 CPU 核数")
+	bufSize := fs.String("buffer-size", "", "条目写入缓冲区大小，如 1M（默认 256K，大量小文件时可调大）")
+	readAhead := fs.Int("read-ahead", 0, "后台并行预读小文件（≤ 16K）的线程数，0 表示默认（多核时 8，单核时不预读），-1 表示不预读")
+	detectMime := fs.Bool("mime", false, "检测并记录每个文件的内容类型，便于之后用 find -mime 查找")
+	splitByDir := fs.Bool("split-by-dir", false, "为源目录的每个一级子目录分别生成归档，-output 可使用 {name} 占位符")
+	secrets := fs.String("secrets", "", "疑似敏感文件（私钥、凭据等）的处理策略: warn, exclude, deny")
+	allowSecrets := fs.Bool("allow-secrets", false, "-secrets deny 时仍允许打包敏感文件")
+	streamHash := fs.Bool("stream-hash", false, "每 16 MiB 写入一个校验值，传输或读取时可尽早发现损坏并报告位置")
+	jobs := fs.Int("jobs", 1, "-split-by-dir 时同时生成的归档数")
+	memoryBudget := fs.String("memory-budget", "", "-split-by-dir 并行打包的总内存预算，如 512M，超出时减少并行数")
+	maxArchiveSize := fs.String("max-archive-size", "", "归档大小上限，如 50G，超出时中止（-split-by-dir 时为所有归档之和）")
+	maxFiles := fs.Int("max-files", 0, "打包的条目数上限，超出时中止")
+	maxDuration := fs.Duration("max-duration", 0, "打包的最长时间，如 2h，超出时中止")
+	quotaWarn := fs.Bool("quota-warn", false, "超出 -max-* 限制时只警告，不中止")
+	summary := fs.Bool("summary", false, "在归档旁写入 <归档>.summary.json（统计、大小、耗时、SHA-256、过滤条件、程序版本）")
+	stats := fs.Bool("stats", false, "打包完成后显示各阶段的准确字节数：条目数据流（压缩前）、压缩后、加密后和归档文件，以及归档的 SHA-256")
+	entryStats := fs.Bool("entry-stats", false, "打包完成后在标准输出列出每个条目写入的字节数（压缩前、压缩后、路径，以制表符分隔），隐含 -stats；-summary 时也写入摘要文件。每个条目结束都刷新压缩器，压缩率略低；不能用于 xz")
+	index := fs.Bool("index", false, "在归档旁写入 <归档>.idx 索引（全部条目的元信息），du/find 读取远程归档时只需下载索引")
+	columnarIndex := fs.Bool("index-columnar", false, "索引按列存储且不压缩（隐含 -index）：本地 du/find 直接映射到内存，不需要解码，但索引约大 10–20 倍，旧版本程序不能读取")
+	packages := fs.Bool("packages", false, "检测源目录中的包管理器数据库（dpkg、rpm），在归档中记录已安装的软件包及版本（用于打包系统根目录）")
+	centralIndex := fs.Bool("central-index", false, "在归档末尾写入中央索引（全部条目的偏移表），list 和 cat 不必顺序读取整个归档")
+	incrementalFrom := fs.String("incremental-from", "", "增量备份：只写入相对于这个归档（可以也是增量归档）新增或有变化的文件，并记录已删除的路径")
+	differentialBase := fs.String("base", "", "差异备份：写入相对于这个完整归档新增或有变化的文件，并记录已删除的路径；解包时自动先解包基准")
+	incrementalChecksum := fs.Bool("incremental-checksum", false, "增量和差异备份按内容的 SHA-256 判断文件是否变化，不依赖修改时间（需要读取整个基准归档链和大小相同的文件）")
+	chunkStore := fs.String("chunk-store", "", "块存储目录：大于 256K 的文件按内容切分为块保存在其中，不同文件和多次备份中相同的数据只保存一次（加密的归档需要使用 init-repo -encryption 创建的加密块存储；解包时需要同一个块存储）")
+	catalogPath := fs.String("catalog", "", "记录打包结果的目录文件（默认为 $BACKUP_CATALOG 或 ~/.local/state/backup/catalog.json），status 据此显示最近一次打包")
+	noCatalog := fs.Bool("no-catalog", false, "不在目录文件中记录打包结果")
+	reportFlags := registerReportFlags(fs)
+	reproducible := fs.Bool("reproducible", false, "可重现的归档：条目按路径排序，时间不晚于 -source-date-epoch，属主记为 0，不保存 SELinux 标签，同样的目录树总是得到逐字节相同的归档（不能与加密、-compress-target、-restore-order 同时使用）")
+	sourceDateEpoch := fs.Int64("source-date-epoch", int64(envFloat("SOURCE_DATE_EPOCH")), "-reproducible 时修改时间的上限（Unix 时间戳），默认取环境变量 SOURCE_DATE_EPOCH，都没有时全部时间记为 0")
+	restoreOrder := fs.String("restore-order", "", "条目写入（即解包还原）顺序：优先路径模式和/或 smallest-first，如 etc/**,db/**,smallest-first")
+	var ff filterFlags
+	ff.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	sources := 0
+	for _, s := range []string{*source, *image, *importPath} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources == 0 || *output == "" {
+		fmt.Fprintln(os.Stderr, "pack 需要 -source（或 -image、-import）和 -output 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	if sources > 1 {
+		fmt.Fprintln(os.Stderr, "-source、-image 和 -import 只能使用其中一个")
+		return exitUsage
+	}
+	if *incrementalFrom != "" && *differentialBase != "" {
+		fmt.Fprintln(os.Stderr, "-incremental-from 和 -base 只能使用其中一个")
+		return exitUsage
+	}
+	incremental := *incrementalFrom != "" || *differentialBase != ""
+	if incremental && (*source == "" || *splitByDir) {
+		fmt.Fprintln(os.Stderr, "-incremental-from 和 -base 只能用于打包目录（-source），不能与 -split-by-dir 同时使用")
+		return exitUsage
+	}
+	if *incrementalChecksum && !incremental {
+		fmt.Fprintln(os.Stderr, "-incremental-checksum 需要 -incremental-from 或 -base")
+		return exitUsage
+	}
+	if *reproducible && (*encrypt || *encryptPaths != "" || *compressTarget != "" || *restoreOrder != "") {
+		fmt.Fprintln(os.Stderr, "-reproducible 不能与 -encrypt、-encrypt-paths、-compress-target 或 -restore-order 同时使用")
+		return exitUsage
+	}
+	if *sourceDateEpoch < 0 {
+		fmt.Fprintln(os.Stderr, "-source-date-epoch 不能为负数")
+		return exitUsage
+	}
+	switch *format {
+	case "bkup":
+	case "zip":
+		// zip 只能保存普通的文件树，BKUP 特有的功能都不可用
+		for _, opt := range []struct {
+			name string
+			set  bool
+		}{
+			{"-encrypt", *encrypt}, {"-encrypt-paths", *encryptPaths != ""}, {"-image", *image != ""}, {"-import", *importPath != ""},
+			{"-split-by-dir", *splitByDir}, {"-incremental-from 和 -base", incremental}, {"-chunk-store", *chunkStore != ""},
+			{"-block-compress", *blockCompress}, {"-compress-target", *compressTarget != ""}, {"-stream-hash", *streamHash},
+			{"-central-index", *centralIndex}, {"-index", *index}, {"-summary", *summary}, {"-packages", *packages}, {"-mime", *detectMime},
+			{"-stats 和 -entry-stats", *stats || *entryStats}, {"-reproducible", *reproducible},
+		} {
+			if opt.set {
+				fmt.Fprintf(os.Stderr, "%s 不能用于 -format zip\n", opt.name)
+				return exitUsage
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "不支持的归档格式: %s（可选 bkup, zip）\n", *format)
+		return exitUsage
+	}
+	filter, err := ff.build()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "过滤参数错误: %v\n", err)
+		return exitUsage
+	}
+	if *encrypt {
+		if *password == "" {
+			if !isTerminal(os.Stdin) {
+				fmt.Fprintln(os.Stderr, "启用加密时必须提供密码")
+				return exitUsage
+			}
+			if *password, err = promptNewPassword(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitUsage
+			}
+		}
+		if !checkPasswordStrength(*password, *minPasswordBits) {
+			return exitUsage
+		}
+	}
+	report, err := newReport(reportFlags, "pack")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	var target int64
+	if *compressTarget != "" {
+		rate := parseRate(*compressTarget)
+		if rate == nil || *rate <= 0 {
+			fmt.Fprintf(os.Stderr, "无法解析吞吐量: %s\n", *compressTarget)
+			return exitUsage
+		}
+		target = *rate
+	}
+
+	secretPolicy, err := backup.ParseSecretPolicy(*secrets)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	encryptCompressPolicy, err := backup.ParseEncryptCompressPolicy(*encryptCompress)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	codec, err := backup.ParseCodec(*compression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if *format == "zip" && (codec == backup.CodecZstd || codec == backup.CodecXz) {
+		fmt.Fprintf(os.Stderr, "-format zip 只支持 flate 压缩，不支持 %s\n", codec)
+		return exitUsage
+	}
+	if (codec == backup.CodecZstd || codec == backup.CodecXz) && (*blockCompress || *compressTarget != "") {
+		fmt.Fprintf(os.Stderr, "-compression %s 不能与 -block-compress 或 -compress-target 同时使用\n", codec)
+		return exitUsage
+	}
+	if *level != 0 && (codec == backup.CodecNone || codec == backup.CodecDefault && !*compress && !*blockCompress && *compressTarget == "") {
+		fmt.Fprintln(os.Stderr, "-level 需要启用压缩（-compress、-block-compress 或 -compression）")
+		return exitUsage
+	}
+
+	var bufferSize int
+	if *bufSize != "" {
+		size := backup.ParseSize(*bufSize)
+		if size == nil || *size <= 0 {
+			fmt.Fprintf(os.Stderr, "无法解析大小: %s\n", *bufSize)
+			return exitUsage
+		}
+		bufferSize = int(*size)
+	}
+
+	quota := backup.PackQuota{MaxFiles: *maxFiles, MaxDuration: *maxDuration, WarnOnly: *quotaWarn}
+	if *maxArchiveSize != "" {
+		size := backup.ParseSize(*maxArchiveSize)
+		if size == nil || *size <= 0 {
+			fmt.Fprintf(os.Stderr, "无法解析大小: %s\n", *maxArchiveSize)
+			return exitUsage
+		}
+		quota.MaxArchiveSize = *size
+	}
+
+	var order *backup.RestoreOrder
+	if *restoreOrder != "" {
+		order, err = backup.ParseRestoreOrder(*restoreOrder)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+
+	var budget int64
+	if *memoryBudget != "" {
+		size := backup.ParseSize(*memoryBudget)
+		if size == nil || *size <= 0 {
+			fmt.Fprintf(os.Stderr, "无法解析大小: %s\n", *memoryBudget)
+			return exitUsage
+		}
+		budget = *size
+	}
+
+	options := backup.PackOptions{
+		Compress:             *compress || *blockCompress || target > 0,
+		Compression:          codec,
+		CompressionLevel:     *level,
+		Encrypt:              *encrypt,
+		Password:             *password,
+		HardDereference:      *hardDereference,
+		BlockCompress:        *blockCompress || target > 0,
+		Threads:              *threads,
+		CompressTarget:       target,
+		BufferSize:           bufferSize,
+		ReadAhead:            *readAhead,
+		DetectMime:           *detectMime,
+		SecretPolicy:         secretPolicy,
+		AllowSecrets:         *allowSecrets,
+		EncryptCompress:      encryptCompressPolicy,
+		UntrustedPatterns:    backup.ParsePatterns(*untrusted),
+		EntryEncryptPatterns: backup.ParsePatterns(*encryptPaths),
+		EntryPassword:        *entryPassword,
+		Warn:                 printWarning,
+		Jobs:                 *jobs,
+		MemoryBudget:         budget,
+		RestoreOrder:         order,
+		Reproducible:         *reproducible,
+		SourceDateEpoch:      *sourceDateEpoch,
+		StreamHash:           *streamHash,
+		Quota:                quota,
+		Summary:              *summary,
+		Index:                *index || *columnarIndex,
+		ColumnarIndex:        *columnarIndex,
+		CentralIndex:         *centralIndex,
+		EntryStats:           *entryStats,
+		PackageInventory:     *packages,
+		IncrementalFrom:      *incrementalFrom,
+		DifferentialBase:     *differentialBase,
+		IncrementalChecksum:  *incrementalChecksum,
+		ChunkStore:           *chunkStore,
+		ToolVersion:          version,
+		Context:              cliContext,
+	}
+	if report != nil {
+		options.OnArchive = report.addArchive
+		for _, s := range []struct{ name, value string }{{"源", *source}, {"块设备", *image}, {"导入", *importPath}} {
+			if s.value != "" {
+				report.add(s.name, s.value)
+			}
+		}
+		if *streamHash {
+			report.setVerify("已写入流校验值")
+		}
+	}
+	if incremental {
+		// 打包完成后显示跳过的文件数和删除记录数
+		next := options.OnArchive
+		options.OnArchive = func(summary backup.PackSummary) {
+			if inc := summary.Incremental; inc != nil {
+				kind := "增量备份"
+				if inc.Kind == backup.KindDifferential {
+					kind = "差异备份"
+				}
+				printStatus("%s（基准 %s）：写入 %d 个条目，%d 个文件未变化，%d 个删除记录", kind, inc.Base, summary.Entries, inc.Unchanged, inc.Deleted)
+			}
+			if next != nil {
+				next(summary)
+			}
+		}
+	}
+	if *chunkStore != "" {
+		// 打包完成后显示去重的效果
+		next := options.OnArchive
+		options.OnArchive = func(summary backup.PackSummary) {
+			if d := summary.Dedup; d != nil && d.Files > 0 {
+				printStatus("块存储：%d 个文件（%s）切分为 %d 个块，新写入 %d 个块（%s，压缩后 %s）",
+					d.Files, backup.FormatSize(d.Bytes), d.Chunks, d.NewChunks, backup.FormatSize(d.NewBytes), backup.FormatSize(d.StoredBytes))
+			}
+			if next != nil {
+				next(summary)
+			}
+		}
+	}
+	if *stats || *entryStats {
+		// 打包完成后显示各阶段的字节数（-split-by-dir 时可能被并发调用）
+		var mu sync.Mutex
+		next := options.OnArchive
+		options.OnArchive = func(summary backup.PackSummary) {
+			mu.Lock()
+			for _, e := range summary.EntryBytes {
+				fmt.Printf("%d\t%d\t%s\n", e.Stream, e.Compressed, e.Path)
+			}
+			stages := fmt.Sprintf("条目数据流 %d 字节", summary.StreamBytes)
+			if summary.Compress {
+				stages += fmt.Sprintf("，压缩后 %d 字节", summary.CompressedBytes)
+			}
+			if summary.Encrypt {
+				stages += fmt.Sprintf("，加密后 %d 字节", summary.EncryptedBytes)
+			}
+			printStatus("%s：%s，归档 %d 字节，sha256 %s", summary.Archive, stages, summary.ArchiveBytes, summary.SHA256)
+			mu.Unlock()
+			if next != nil {
+				next(summary)
+			}
+		}
+	}
+	// 记录打包过程中的警告（拆分并行打包时可能被并发调用），写入目录文件
+	var warnings []string
+	var warningsMu sync.Mutex
+	options.Warn = func(msg string) {
+		warningsMu.Lock()
+		warnings = append(warnings, msg)
+		warningsMu.Unlock()
+		printWarning(msg)
+	}
+	run := backup.RunRecord{Source: *source + *image + *importPath, Archive: *output, Start: time.Now()}
+	diag.setOptions(options)
+	prefix := "打包失败"
+	switch {
+	case *image != "":
+		options.Progress = printProgress
+		err = backup.PackImage(*image, *output, options)
+		endProgress()
+		prefix = "打包镜像失败"
+	case *importPath != "":
+		options.Progress = printProgress
+		err = backup.ImportArchive(*importPath, *output, filter, options)
+		endProgress()
+		prefix = "导入失败"
+	case *format == "zip":
+		options.Progress = printProgress
+		err = backup.PackZip(*source, *output, filter, options)
+		endProgress()
+	case *splitByDir:
+		options.Progress = printProgress
+		var paths []string
+		paths, err = backup.PackSplitByDir(*source, *output, filter, options)
+		endProgress()
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+	default:
+		err = backup.PackWithOptions(*source, *output, filter, options)
+	}
+	if !*noCatalog {
+		run.End, run.OK, run.Warnings = time.Now(), err == nil, warnings
+		if err != nil {
+			run.Error = err.Error()
+		}
+		recordRun(*catalogPath, run)
+	}
+	code := exitOK
+	if err != nil {
+		code = failure(prefix, err)
+	}
+	report.finish(err)
+	return code
+}
+
+// runUnpack 执行 unpack 子命令
+func runUnpack(args []string) int {
+	fs := flag.NewFlagSet("unpack", flag.ContinueOnError)
+	archive := fs.String("archive", "", "归档文件路径或 http(s):// 地址")
+	target := fs.String("target", "", "解包的目标目录")
+	password := fs.String("password", "", "解密密码")
+	entryPassword := fs.String("entry-password", "", "单独加密条目的密码（不提供时跳过这些条目）")
+	chunkStore := fs.String("chunk-store", "", "块存储目录（打包时使用了 -chunk-store 的归档需要）")
+	threads := fs.Int("threads", 0, "并行解压的线程数（仅分块压缩的归档），0 表示使用 CPU 核数")
+	digest := fs.String("sha256", "", "校验整个归档文件的 SHA-256 摘要")
+	policyPath := fs.String("policy", "", "还原策略文件（YAML）：按路径模式调整属主、权限或跳过条目")
+	postEntryHook := fs.String("post-entry-hook", "", "每个条目还原后执行的命令，还原后的路径作为最后一个参数，如 \"restorecon -F\"；命令失败时中止解包")
+	noBase := fs.Bool("no-base", false, "解包差异归档时不先解包其基准（目标目录中已经是基准的内容时使用）")
+	noSELinux := fs.Bool("no-selinux", false, "不还原归档中记录的 SELinux 安全上下文（由目标系统的 restorecon 重新标记）")
+	reportFlags := registerReportFlags(fs)
+	var lf limitFlags
+	lf.register(fs)
+	var ff filterFlags
+	ff.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *archive == "" || *target == "" {
+		fmt.Fprintln(os.Stderr, "unpack 需要 -archive 和 -target 参数")
+		fs.Usage()
+		return exitUsage
+	}
+
+	limits, err := lf.build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	filter, err := ff.build()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "过滤参数错误: %v\n", err)
+		return exitUsage
+	}
+	report, err := newReport(reportFlags, "unpack")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	report.add("归档", *archive)
+	if size := archiveSize(*archive); size != "" {
+		report.add("大小", size)
+	}
+	report.add("目标目录", *target)
+
+	options := backup.PackOptions{Password: *password, EntryPassword: *entryPassword, ChunkStore: *chunkStore, Threads: *threads, SHA256: *digest, Context: cliContext, Limits: limits, Warn: printWarning, SkipBase: *noBase, NoSELinux: *noSELinux, RestoreFilter: filter}
+	if *policyPath != "" {
+		if options.RestorePolicy, err = backup.LoadRestorePolicy(*policyPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		report.add("还原策略", *policyPath)
+	}
+	if filter != nil {
+		report.add("过滤", "只还原匹配过滤条件的条目")
+	}
+	if *postEntryHook != "" {
+		hook, err := newPostEntryHook(*postEntryHook)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		options.OnEntryRestored = hook
+		report.add("还原后命令", *postEntryHook)
+	}
+	diag.setOptions(options)
+	code := exitOK
+	err = backup.UnpackWithOptions(*archive, *target, options)
+	if err != nil {
+		code = failure("解包失败", err)
+	} else if *digest != "" {
+		report.setVerify("SHA-256 匹配")
+	}
+	report.finish(err)
+	return code
+}
+
+// newPostEntryHook 创建 -post-entry-hook 的回调：按空白拆分命令，将还原后的路径作为最后一个参数执行
+// 命令的环境变量中另有 BACKUP_ENTRY_PATH（条目在归档中的路径）和 BACKUP_ENTRY_TYPE（条目类型）
+func newPostEntryHook(command string) (func(entry backup.FileEntry, path string) error, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("-post-entry-hook 的命令为空")
+	}
+	return func(entry backup.FileEntry, path string) error {
+		cmd := exec.CommandContext(cliContext, fields[0], append(fields[1:], path)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), "BACKUP_ENTRY_PATH="+entry.RelPath, "BACKUP_ENTRY_TYPE="+entry.Type.String())
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("执行 %s 失败: %v", fields[0], err)
+		}
+		return nil
+	}, nil
+}
+
+// runTest 执行 test 子命令：完整读取归档检查是否损坏，不写入任何文件
+func runTest(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	archive := fs.String("archive", "", "归档文件路径或 http(s):// 地址")
+	password := fs.String("password", "", "解密密码")
+	entryPassword := fs.String("entry-password", "", "单独加密条目的密码（不提供时跳过这些条目）")
+	chunkStore := fs.String("chunk-store", "", "块存储目录（打包时使用了 -chunk-store 的归档需要）")
+	digest := fs.String("sha256", "", "校验整个归档文件的 SHA-256 摘要")
+	threads := fs.Int("threads", 0, "并行解压的线程数（仅分块压缩的归档），0 表示使用 CPU 核数")
+	reportFlags := registerReportFlags(fs)
+	var lf limitFlags
+	lf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *archive == "" {
+		fmt.Fprintln(os.Stderr, "test 需要 -archive 参数")
+		fs.Usage()
+		return exitUsage
+	}
+
+	limits, err := lf.build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	report, err := newReport(reportFlags, "test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	report.add("归档", *archive)
+	if size := archiveSize(*archive); size != "" {
+		report.add("大小", size)
+	}
+
+	options := backup.PackOptions{Password: *password, EntryPassword: *entryPassword, ChunkStore: *chunkStore, Threads: *threads, SHA256: *digest, Context: cliContext, Limits: limits}
+	diag.setOptions(options)
+	count, err := backup.TestArchive(*archive, options)
+	report.add("条目", fmt.Sprint(count))
+	code := exitOK
+	if err != nil {
+		code = failure(fmt.Sprintf("检查失败（已读取 %d 个条目）", count), err)
+	} else {
+		printStatus("%s: 完好，%d 个条目", *archive, count)
+		if *digest != "" {
+			report.setVerify("完整读取通过，SHA-256 匹配")
+		} else {
+			report.setVerify("完整读取通过")
+		}
+	}
+	report.finish(err)
+	return code
+}
+
+// runVerify 执行 verify 子命令：逐个条目读取并解密、解压全部内容，检查结构，在标准输出列出发现的问题
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	archive := fs.String("archive", "", "归档文件路径或 http(s):// 地址")
+	password := fs.String("password", "", "解密密码")
+	entryPassword := fs.String("entry-password", "", "单独加密条目的密码（不提供时跳过这些条目）")
+	chunkStore := fs.String("chunk-store", "", "块存储目录（打包时使用了 -chunk-store 的归档需要）")
+	digest := fs.String("sha256", "", "同时校验整个归档文件的 SHA-256 摘要")
+	threads := fs.Int("threads", 0, "并行解压的线程数（仅分块压缩的归档），0 表示使用 CPU 核数")
+	catalogPath := fs.String("catalog", "", "记录校验结果的目录文件（默认为 $BACKUP_CATALOG 或 ~/.local/state/backup/catalog.json）")
+	noCatalog := fs.Bool("no-catalog", false, "不在目录文件中记录校验结果")
+	stamp := fs.Bool("stamp", false, "校验通过后在归档旁写入校验记录 <归档>.verified.json（随归档一起复制）")
+	reportFlags := registerReportFlags(fs)
+	var lf limitFlags
+	lf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *archive == "" {
+		fmt.Fprintln(os.Stderr, "verify 需要 -archive 参数")
+		fs.Usage()
+		return exitUsage
+	}
+
+	limits, err := lf.build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	report, err := newReport(reportFlags, "verify")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	report.add("归档", *archive)
+	if size := archiveSize(*archive); size != "" {
+		report.add("大小", size)
+	}
+
+	options := backup.PackOptions{Password: *password, EntryPassword: *entryPassword, ChunkStore: *chunkStore, Threads: *threads, SHA256: *digest, Context: cliContext, Limits: limits}
+	diag.setOptions(options)
+	result, err := backup.VerifyArchive(*archive, options)
+	if !*noCatalog {
+		recordVerification(*catalogPath, *archive, result, err)
+	}
+	if err != nil {
+		code := failure("校验失败", err)
+		report.finish(err)
+		return code
+	}
+	report.add("条目", fmt.Sprint(result.Entries))
+	report.add("内容", backup.FormatSize(result.ContentBytes))
+	report.add("压缩", describeCompression(result.Compression, result.Level))
+
+	for _, p := range result.Problems {
+		kind := "结构"
+		if p.Fatal {
+			kind = "损坏"
+		}
+		fmt.Printf("%s\t%s\n", kind, p)
+	}
+	if result.OK() {
+		printStatus("%s: 完好，%d 个条目，内容 %s，%s", *archive, result.Entries, backup.FormatSize(result.ContentBytes), describeCompression(result.Compression, result.Level))
+		if *stamp {
+			if err := backup.WriteVerifyStamp(*archive, result); err != nil {
+				printWarning(err.Error())
+			}
+		}
+		report.setVerify("逐条目校验通过")
+		report.finish(nil)
+		return exitOK
+	}
+	err = fmt.Errorf("发现 %d 个问题（已完整读取 %d 个条目）", len(result.Problems), result.Entries)
+	report.setVerify(err.Error())
+	code := failure("校验失败", err)
+	report.finish(err)
+	return code
+}
+
+// recordVerification 将校验结果记录到目录文件中，记录失败只警告，不影响校验的结果
+func recordVerification(catalogPath, archive string, result *backup.VerifyResult, verifyErr error) {
+	if catalogPath == "" {
+		path, err := backup.DefaultCatalogPath()
+		if err != nil {
+			printWarning(err.Error())
+			return
+		}
+		catalogPath = path
+	}
+	if err := backup.RecordVerification(catalogPath, archive, result, verifyErr); err != nil {
+		printWarning(fmt.Sprintf("记录校验结果失败: %v", err))
+	}
+}
+
+// recordRun 将打包结果记录到目录文件中，记录失败只警告，不影响打包的结果
+func recordRun(catalogPath string, run backup.RunRecord) {
+	if catalogPath == "" {
+		path, err := backup.DefaultCatalogPath()
+		if err != nil {
+			printWarning(err.Error())
+			return
+		}
+		catalogPath = path
+	}
+	if err := backup.RecordRun(catalogPath, run); err != nil {
+		printWarning(fmt.Sprintf("记录打包结果失败: %v", err))
+	}
+}
+
+// recordMirror 将镜像结果记录到目录文件中，记录失败只警告，不影响镜像的结果
+func recordMirror(catalogPath string, record backup.MirrorRecord) {
+	if catalogPath == "" {
+		path, err := backup.DefaultCatalogPath()
+		if err != nil {
+			printWarning(err.Error())
+			return
+		}
+		catalogPath = path
+	}
+	if err := backup.RecordMirror(catalogPath, record); err != nil {
+		printWarning(fmt.Sprintf("记录镜像结果失败: %v", err))
+	}
+}
+
+// describeCompression 描述归档的压缩方式和级别，如 "zstd 压缩（级别 3）"
+func describeCompression(codec backup.Codec, level int) string {
+	switch {
+	case codec == backup.CodecNone:
+		return "未压缩"
+	case level == 0:
+		return fmt.Sprintf("%s 压缩（级别未记录）", codec)
+	default:
+		return fmt.Sprintf("%s 压缩（级别 %d）", codec, level)
+	}
+}
+
+// runCompatCheck 执行 compat-check 子命令：读取内置的各格式版本标准归档，检查兼容性
+func runCompatCheck(args []string) int {
+	fs := flag.NewFlagSet("compat-check", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	results, err := backup.CheckCompatibility()
+	if err != nil {
+		return failure("兼容性检查失败", err)
+	}
+	code := exitOK
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Printf("失败  v%d %s: %v\n", r.Version, r.File, r.Err)
+			code = exitError
+			continue
+		}
+		fmt.Printf("通过  v%d %s\n", r.Version, r.File)
+	}
+	return code
+}
+
+// runVersion 执行 version 子命令：显示版本和支持的功能
+func runVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	caps := backup.SupportedCapabilities()
+	if *asJSON {
+		out := struct {
+			Version string `json:"version"`
+			OS      string `json:"os"`
+			Arch    string `json:"arch"`
+			backup.Capabilities
+		}{version, runtime.GOOS, runtime.GOARCH, caps}
+		data, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return failure("输出失败", err)
+		}
+		fmt.Println(string(data))
+		return exitOK
+	}
+
+	fmt.Printf("backup %s (%s/%s)\n", version, runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("格式版本: 读取 %v，写入 %d\n", caps.FormatVersions, caps.WriteVersion)
+	fmt.Printf("压缩: %s\n", strings.Join(caps.Codecs, ", "))
+	fmt.Printf("加密: %s\n", strings.Join(caps.Ciphers, ", "))
+	fmt.Printf("存储位置: %s\n", strings.Join(caps.Backends, ", "))
+	fmt.Printf("功能: %s\n", strings.Join(caps.Features, ", "))
+	return exitOK
+}
+
+// runRestoreRemote 执行 restore-remote 子命令：下载、校验并解包
+// 带流校验的归档边下载边解包；其他归档先保存到临时目录，校验失败时不在目标目录留下任何文件
+func runRestoreRemote(args []string) int {
+	fs := flag.NewFlagSet("restore-remote", flag.ContinueOnError)
+	url := fs.String("url", "", "归档的 http(s):// 地址（也可以是本地路径）")
+	digest := fs.String("sha256", "", "归档文件的 SHA-256 摘要")
+	target := fs.String("target", "", "解包的目标目录")
+	password := fs.String("password", "", "解密密码")
+	threads := fs.Int("threads", 0, "并行解压的线程数（仅分块压缩的归档），0 表示使用 CPU 核数")
+	noSELinux := fs.Bool("no-selinux", false, "不还原归档中记录的 SELinux 安全上下文（由目标系统的 restorecon 重新标记）")
+	spoolDir := fs.String("spool-dir", "", "不带流校验的归档在校验前保存到这个目录（需要与归档大小相同的空间），默认为系统临时目录")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *url == "" || *digest == "" || *target == "" {
+		fmt.Fprintln(os.Stderr, "restore-remote 需要 -url、-sha256 和 -target 参数")
+		fs.Usage()
+		return exitUsage
+	}
+
+	options := backup.PackOptions{Password: *password, Threads: *threads, SHA256: *digest, SpoolDir: *spoolDir, Context: cliContext, NoSELinux: *noSELinux}
+	diag.setOptions(options)
+	if err := backup.RestoreRemote(*url, *target, options); err != nil {
+		return failure("恢复失败", err)
+	}
+	return exitOK
+}
+
+// runMirror 执行 mirror 子命令：将归档目录同步到另一个目录（通常是挂载的异地存储）
+func runMirror(args []string) int {
+	fs := flag.NewFlagSet("mirror", flag.ContinueOnError)
+	src := fs.String("src", "", "源归档目录")
+	dst := fs.String("dst", "", "目标目录")
+	del := fs.Bool("delete", false, "删除目标目录中源目录已不存在的文件")
+	keepWithin := fs.Duration("keep-within", 0, "-delete 时保留目标目录中修改时间在这段时间之内的文件（例如 720h），即使源目录中已删除")
+	checksum := fs.Bool("checksum", false, "大小和修改时间相同的文件再比较 SHA-256（需要读取两侧的全部内容）")
+	dryRun := fs.Bool("dry-run", false, "只列出将要执行的操作，不修改目标目录")
+	catalogPath := fs.String("catalog", "", "记录镜像结果的目录文件（默认为 $BACKUP_CATALOG 或 ~/.local/state/backup/catalog.json），doctor 据此检查异地副本")
+	noCatalog := fs.Bool("no-catalog", false, "不在目录文件中记录镜像结果")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *src == "" || *dst == "" {
+		fmt.Fprintln(os.Stderr, "mirror 需要 -src 和 -dst 参数")
+		fs.Usage()
+		return exitUsage
+	}
+
+	actions, err := backup.Mirror(*src, *dst, backup.MirrorOptions{Delete: *del, KeepWithin: *keepWithin, Checksum: *checksum, DryRun: *dryRun, Context: cliContext})
+	record := backup.MirrorRecord{Source: *src, Destination: *dst, Time: time.Now(), OK: err == nil}
+	for _, action := range actions {
+		fmt.Printf("%-6s  %10s  %s\n", action.Action, backup.FormatSize(action.Size), action.Path)
+		if action.Action != "delete" {
+			record.Copied += action.Size
+		}
+	}
+	if !*noCatalog && !*dryRun {
+		if err != nil {
+			record.Error = err.Error()
+		}
+		recordMirror(*catalogPath, record)
+	}
+	if err != nil {
+		return failure("同步失败", err)
+	}
+	if len(actions) == 0 {
+		printStatus("目标目录已是最新")
+	}
+	return exitOK
+}
+
+// runStatus 执行 status 子命令：不指定归档时先按目标目录显示概况（最近一次打包的时间、结果和警告，归档数量和大小，校验情况），
+// 然后按目录文件和归档旁的校验记录，列出超过期限没有校验、校验失败或校验后被改变的归档
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	catalogPath := fs.String("catalog", "", "记录打包和校验结果的目录文件（默认为 $BACKUP_CATALOG 或 ~/.local/state/backup/catalog.json）")
+	maxAge := fs.Duration("max-age", 30*24*time.Hour, "校验的策略期限，超过期限没有校验通过的归档需要重新校验")
+	all := fs.Bool("all", false, "同时列出期限内校验通过的归档")
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出目标目录的概况和全部归档的状态")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *catalogPath == "" {
+		path, err := backup.DefaultCatalogPath()
+		if err != nil {
+			return failure("读取目录文件失败", err)
+		}
+		*catalogPath = path
+	}
+	catalog, err := backup.LoadCatalog(*catalogPath)
+	if err != nil {
+		return failure("读取目录文件失败", err)
+	}
+	var destinations []backup.DestinationStatus
+	paths := fs.Args()
+	if len(paths) == 0 {
+		if destinations, err = backup.DestinationOverview(catalog, *maxAge); err != nil {
+			return failure("汇总目标目录失败", err)
+		}
+		// 目标目录中的全部归档（包括从未校验的）和目录文件中记录的其他归档
+		for _, destination := range destinations {
+			if !destination.Missing {
+				paths = append(paths, destination.Directory)
+			}
+		}
+		for _, record := range catalog.Records() {
+			paths = append(paths, record.Archive)
+		}
+	}
+	statuses, err := backup.ArchiveStatuses(catalog, paths, *maxAge)
+	if err != nil {
+		return failure("列出归档失败", err)
+	}
+
+	attention := 0
+	for _, status := range statuses {
+		if status.NeedsAttention() {
+			attention++
+		}
+	}
+	failedRuns := 0
+	for _, destination := range destinations {
+		if destination.LastRun != nil && !destination.LastRun.OK {
+			failedRuns++
+		}
+	}
+	if *asJSON {
+		out := struct {
+			Destinations []backup.DestinationStatus `json:"destinations,omitempty"`
+			Archives     []backup.ArchiveStatus     `json:"archives"`
+		}{destinations, statuses}
+		if out.Archives == nil {
+			out.Archives = []backup.ArchiveStatus{}
+		}
+		data, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return failure("输出失败", err)
+		}
+		fmt.Println(string(data))
+	} else {
+		now := time.Now()
+		for _, destination := range destinations {
+			printDestination(destination, now)
+		}
+		for _, status := range statuses {
+			if !*all && !status.NeedsAttention() {
+				continue
+			}
+			verified, note := "-", ""
+			if status.LastVerified != nil {
+				verified = status.LastVerified.Local().Format("2006-01-02 15:04")
+				note = backup.FormatAge(now.Sub(*status.LastVerified)) + "前校验通过"
+			}
+			if status.LastError != "" {
+				note = status.LastError
+			}
+			line := fmt.Sprintf("%-8s  %-16s  %10s  %s", status.State, verified, backup.FormatSize(status.Size), status.Archive)
+			if note != "" {
+				line += "  (" + note + ")"
+			}
+			fmt.Println(line)
+		}
+	}
+	if len(statuses) == 0 && len(destinations) == 0 {
+		printStatus("没有找到归档（目录文件 %s 中没有记录）", *catalogPath)
+		return exitOK
+	}
+	if attention > 0 || failedRuns > 0 {
+		var problems []string
+		if attention > 0 {
+			problems = append(problems, fmt.Sprintf("%d 个归档需要处理（共 %d 个，策略期限 %s）", attention, len(statuses), *maxAge))
+		}
+		if failedRuns > 0 {
+			problems = append(problems, fmt.Sprintf("%d 个目标目录最近一次打包失败", failedRuns))
+		}
+		return failure("状态", errors.New(strings.Join(problems, "，")))
+	}
+	printStatus("%d 个归档都在 %s 内校验通过", len(statuses), *maxAge)
+	return exitOK
+}
+
+// printDestination 打印一个目标目录的概况
+func printDestination(d backup.DestinationStatus, now time.Time) {
+	fmt.Printf("目标目录 %s\n", d.Directory)
+	if run := d.LastRun; run != nil {
+		result := "成功"
+		if !run.OK {
+			result = "失败: " + run.Error
+		}
+		fmt.Printf("  最近打包  %s（%s前，用时 %s）  源 %s  %s\n", run.Start.Local().Format("2006-01-02 15:04"),
+			backup.FormatAge(now.Sub(run.Start)), run.End.Sub(run.Start).Round(time.Second), run.Source, result)
+		for _, warning := range run.Warnings {
+			fmt.Printf("  警告      %s\n", warning)
+		}
+	} else {
+		fmt.Println("  最近打包  没有记录")
+	}
+	if d.Missing {
+		fmt.Println("  归档      目录已不存在或无法访问")
+		return
+	}
+	line := fmt.Sprintf("  归档      %d 个，共 %s；%d 个在期限内校验通过", d.Archives, backup.FormatSize(d.Bytes), d.Verified)
+	if d.OldestVerified != nil {
+		line += fmt.Sprintf("（最早 %s前）", backup.FormatAge(now.Sub(*d.OldestVerified)))
+	}
+	if d.NeedsAttention > 0 {
+		line += fmt.Sprintf("，%d 个需要处理", d.NeedsAttention)
+	}
+	fmt.Println(line)
+}
+
+// failure 打印失败信息并返回退出码；因收到中断信号而失败时返回 exitInterrupted
+func failure(prefix string, err error) int {
+	diag.logf("%s: %v", prefix, err)
+	endProgress()
+	if cliContext.Err() != nil {
+		fmt.Fprintln(os.Stderr, "已中断")
+		return exitInterrupted
+	}
+	fmt.Fprintln(os.Stderr, output.paint(colorRed, fmt.Sprintf("%s: %v", prefix, err)))
+	return exitError
+}
+
+// checkPasswordStrength 检查新加密密码的强度（pack、convert、init-repo 共用）：低于最低强度时打印错误并返回 false，弱密码只警告
+func checkPasswordStrength(password string, minBits float64) bool {
+	warning, err := backup.CheckPasswordStrength(password, minBits)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	if warning != "" {
+		printWarning(warning)
+	}
+	return true
+}
+
+// envFloat 读取数值型环境变量，未设置或无法解析时返回 0
+func envFloat(name string) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// parseRate 解析吞吐量字符串，例如 "200MB/s"、"50M"，返回字节/秒
+func parseRate(s string) *int64 {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "/S")
+	if len(s) > 1 && strings.HasSuffix(s, "B") {
+		s = strings.TrimSuffix(s, "B")
+	}
+	return backup.ParseSize(s)
+}
+
+// runScan 执行 scan 子命令：扫描源路径并打印汇总统计
+func runScan(args []string) int {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	source := fs.String("source", "", "要扫描的源目录或文件")
+	top := fs.Int("top", 0, "只列出最大的 N 个文件和目录")
+	duMode := fs.String("du-mode", "apparent", "文件大小的统计方式: apparent（文件大小，同 du --apparent-size）, blocks（占用的磁盘块，同 du）")
+	var ff filterFlags
+	ff.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *source == "" {
+		fmt.Fprintln(os.Stderr, "scan 需要 -source 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	filter, err := ff.build()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "过滤参数错误: %v\n", err)
+		return exitUsage
+	}
+	mode, err := backup.ParseUsageMode(*duMode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if *top > 0 {
+		entries, err := backup.ScanPath(*source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "扫描失败: %v\n", err)
+			return exitError
+		}
+		if filter != nil {
+			entries = backup.ApplyFilter(entries, filter)
+		}
+		printTopUsage(backup.TopUsage(entries, *top, mode))
+		return exitOK
+	}
+
+	summary, err := backup.ScanSummaryOf(*source, filter, mode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "扫描失败: %v\n", err)
+		return exitError
+	}
+	printSummary(summary)
+	return exitOK
+}
+
+// runEstimate 执行 estimate 子命令：抽样压缩文件内容，估算归档大小和打包耗时
+func runEstimate(args []string) int {
+	fs := flag.NewFlagSet("estimate", flag.ContinueOnError)
+	source := fs.String("source", "", "要打包的源目录或文件")
+	compress := fs.Bool("compress", false, "按启用压缩估算")
+	blockCompress := fs.Bool("block-compress", false, "按分块压缩估算（隐含 -compress）")
+	compression := fs.String("compression", "", "按指定的压缩方式估算: none, flate, zstd, xz")
+	level := fs.Int("level", 0, "按指定的压缩级别估算，0 表示默认级别")
+	threads := fs.Int("threads", 0, "按指定的并行压缩线程数估算耗时，0 表示使用 CPU 核数")
+	encrypt := fs.Bool("encrypt", false, "计入加密开销")
+	streamHash := fs.Bool("stream-hash", false, "计入流校验开销")
+	detectMime := fs.Bool("mime", false, "计入内容类型字段")
+	fraction := fs.Float64("sample", 0.05, "抽样的文件比例（0~1），每个抽样文件最多读取 4MB")
+	var ff filterFlags
+	ff.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *source == "" {
+		fmt.Fprintln(os.Stderr, "estimate 需要 -source 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	filter, err := ff.build()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "过滤参数错误: %v\n", err)
+		return exitUsage
+	}
+
+	codec, err := backup.ParseCodec(*compression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	options := backup.PackOptions{
+		Compress:         *compress || *blockCompress,
+		Compression:      codec,
+		CompressionLevel: *level,
+		BlockCompress:    *blockCompress,
+		Threads:          *threads,
+		Encrypt:          *encrypt,
+		StreamHash:       *streamHash,
+		DetectMime:       *detectMime,
+		Warn:             printWarning,
+	}
+	est, err := backup.EstimatePack(*source, filter, options, *fraction)
+	if err != nil {
+		return failure("估算失败", err)
+	}
+
+	fmt.Printf("条目数:     %d\n", est.Entries)
+	if est.HoleBytes > 0 {
+		fmt.Printf("内容大小:   %s（稀疏文件的空洞 %s 不保存）\n", backup.FormatSize(est.ContentBytes), backup.FormatSize(est.HoleBytes))
+	} else {
+		fmt.Printf("内容大小:   %s\n", backup.FormatSize(est.ContentBytes))
+	}
+	fmt.Printf("抽样:       %d 个文件，%s -> %s（压缩率 %.1f%%）\n",
+		est.SampledFiles, backup.FormatSize(est.SampledBytes), backup.FormatSize(est.SampledOutput), est.Ratio*100)
+	fmt.Printf("估算归档:   %s\n", backup.FormatSize(est.EstimatedSize))
+	fmt.Printf("估算耗时:   %v\n", est.EstimatedDuration.Round(10*time.Millisecond))
+	return exitOK
+}
+
+// runDu 执行 du 子命令：列出归档中占用空间最大的文件和目录
+func runDu(args []string) int {
+	fs := flag.NewFlagSet("du", flag.ContinueOnError)
+	archive := fs.String("archive", "", "归档文件路径或 http(s):// 地址")
+	password := fs.String("password", "", "解密密码")
+	digest := fs.String("sha256", "", "校验整个归档文件的 SHA-256 摘要")
+	top := fs.Int("top", 20, "列出最大的 N 个文件和目录")
+	duMode := fs.String("du-mode", "apparent", "文件大小的统计方式: apparent（文件大小）, blocks（按 4KB 的块估算解包后占用的磁盘空间）")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *archive == "" {
+		fmt.Fprintln(os.Stderr, "du 需要 -archive 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	mode, err := backup.ParseUsageMode(*duMode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	table, err := backup.ArchiveEntryTable(*archive, backup.PackOptions{Password: *password, SHA256: *digest})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "读取归档失败: %v\n", err)
+		return exitError
+	}
+	defer table.Close()
+	printTopUsage(backup.TopUsageTable(table, *top, mode))
+	return exitOK
+}
+
+// runList 执行 list 子命令：列出归档中每个条目的类型、权限、属主、大小和修改时间
+func runList(args []string) int {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	archive := fs.String("archive", "", "归档文件路径或 http(s):// 地址（BKUP，本地文件也可以是 tar、tar.gz、zip）")
+	password := fs.String("password", "", "解密密码")
+	digest := fs.String("sha256", "", "校验整个归档文件的 SHA-256 摘要（仅 BKUP 归档）")
+	asJSON := fs.Bool("json", false, "每行输出一个条目的 JSON 对象（JSON Lines，边读边输出，可直接交给 jq 处理）")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *archive == "" {
+		fmt.Fprintln(os.Stderr, "list 需要 -archive 参数")
+		fs.Usage()
+		return exitUsage
+	}
+
+	// 逐个条目输出，不在内存中保留整个列表
+	out := bufio.NewWriter(os.Stdout)
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	err := backup.WalkArchive(*archive, backup.PackOptions{Password: *password, SHA256: *digest}, func(entry backup.FileEntry) error {
+		if *asJSON {
+			return encoder.Encode(newListRecord(entry))
+		}
+		_, err := fmt.Fprintln(out, formatListLine(entry))
+		return err
+	})
+	if flushErr := out.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return failure("读取归档失败", err)
+	}
+	return exitOK
+}
+
+// listRecord list -json 输出的一行
+type listRecord struct {
+	Path       string          `json:"path"`
+	Type       backup.FileType `json:"type"`
+	Mode       string          `json:"mode"` // 八进制权限，如 "0644"
+	UID        int             `json:"uid"`
+	GID        int             `json:"gid"`
+	Size       int64           `json:"size"`
+	ModTime    int64           `json:"mtime"` // Unix 时间戳（秒）
+	LinkTarget string          `json:"link_target,omitempty"`
+	LinkName   string          `json:"link_name,omitempty"`
+	DevMajor   *int64          `json:"dev_major,omitempty"`
+	DevMinor   *int64          `json:"dev_minor,omitempty"`
+	Mime       string          `json:"mime,omitempty"`
+	Encrypted  bool            `json:"encrypted,omitempty"`
+	SELinux    string          `json:"selinux,omitempty"`      // SELinux 安全上下文
+	Caps       string          `json:"capabilities,omitempty"` // 文件能力，格式与 getcap 相同
+}
+
+// unixPerm 返回 chmod 使用的权限位（包括 setuid、setgid 和 sticky 位）
+func unixPerm(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
+// newListRecord 由条目生成 list -json 的一行
+func newListRecord(entry backup.FileEntry) listRecord {
+	record := listRecord{
+		Path:       entry.RelPath,
+		Type:       entry.Type,
+		Mode:       fmt.Sprintf("%04o", unixPerm(os.FileMode(entry.Mode))),
+		UID:        entry.UID,
+		GID:        entry.GID,
+		Size:       entry.Size,
+		ModTime:    entry.ModTime,
+		LinkTarget: entry.LinkTarget,
+		LinkName:   entry.LinkName,
+		Mime:       entry.Mime,
+		Encrypted:  entry.Encrypt,
+		SELinux:    entry.SELinuxContext(),
+		Caps:       entry.FileCapabilities(),
+	}
+	if entry.Type == backup.TypeCharDevice || entry.Type == backup.TypeBlockDevice {
+		record.DevMajor, record.DevMinor = &entry.DevMajor, &entry.DevMinor
+	}
+	return record
+}
+
+// runCat 执行 cat 子命令：将归档中一个普通文件的内容写到标准输出
+func runCat(args []string) int {
+	fs := flag.NewFlagSet("cat", flag.ContinueOnError)
+	archive := fs.String("archive", "", "归档文件路径或 http(s):// 地址")
+	entryPath := fs.String("path", "", "条目在归档中的路径，如 etc/hosts")
+	password := fs.String("password", "", "解密密码")
+	entryPassword := fs.String("entry-password", "", "单独加密条目的密码（不提供时跳过这些条目）")
+	chunkStore := fs.String("chunk-store", "", "块存储目录（打包时使用了 -chunk-store 的归档需要）")
+	digest := fs.String("sha256", "", "校验整个归档文件的 SHA-256 摘要（需要顺序读取整个归档）")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *archive == "" || *entryPath == "" {
+		fmt.Fprintln(os.Stderr, "cat 需要 -archive 和 -path 参数")
+		fs.Usage()
+		return exitUsage
+	}
+
+	options := backup.PackOptions{Password: *password, EntryPassword: *entryPassword, ChunkStore: *chunkStore, SHA256: *digest, Context: cliContext, Warn: printWarning}
+	ar, entry, err := backup.OpenEntry(*archive, strings.TrimPrefix(*entryPath, "./"), options)
+	if err != nil {
+		return failure("读取归档失败", err)
+	}
+	defer ar.Close()
+	if entry.Type != backup.TypeFile && entry.Type != backup.TypeImage {
+		return failure("读取归档失败", fmt.Errorf("%s 不是普通文件", entry.RelPath))
+	}
+	if _, err := io.Copy(os.Stdout, ar); err != nil {
+		return failure("读取文件内容失败", err)
+	}
+	return exitOK
+}
+
+// runPackages 执行 packages 子命令：列出打包时记录的软件包清单
+func runPackages(args []string) int {
+	fs := flag.NewFlagSet("packages", flag.ContinueOnError)
+	archive := fs.String("archive", "", "归档文件路径或 http(s):// 地址")
+	password := fs.String("password", "", "解密密码")
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *archive == "" {
+		fmt.Fprintln(os.Stderr, "packages 需要 -archive 参数")
+		fs.Usage()
+		return exitUsage
+	}
+
+	packages, err := backup.ReadPackages(*archive, backup.PackOptions{Password: *password, Context: cliContext})
+	if err != nil {
+		return failure("读取软件包清单失败", err)
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(packages, "", "  ")
+		if err != nil {
+			return failure("输出失败", err)
+		}
+		fmt.Println(string(data))
+		return exitOK
+	}
+	for _, p := range packages {
+		fmt.Printf("%s\t%s\t%s\t%s\n", p.Manager, p.Name, p.Version, p.Arch)
+	}
+	return exitOK
+}
+
+// listTypeChars 列表中每种条目类型的首字符（与 ls -l 相同，硬链接为 h、块设备镜像为 i）
+var listTypeChars = map[backup.FileType]byte{
+	backup.TypeFile:        '-',
+	backup.TypeDir:         'd',
+	backup.TypeSymlink:     'l',
+	backup.TypeHardlink:    'h',
+	backup.TypeFifo:        'p',
+	backup.TypeCharDevice:  'c',
+	backup.TypeBlockDevice: 'b',
+	backup.TypeSocket:      's',
+	backup.TypeImage:       'i',
+}
+
+// formatListLine 将条目格式化为类似 ls -l 的一行：类型和权限、属主/属组、大小、修改时间、路径
+func formatListLine(entry backup.FileEntry) string {
+	mode := []byte(os.FileMode(entry.Mode).Perm().String())
+	if c, ok := listTypeChars[entry.Type]; ok {
+		mode[0] = c
+	}
+	size := strconv.FormatInt(entry.Size, 10)
+	if entry.Type == backup.TypeCharDevice || entry.Type == backup.TypeBlockDevice {
+		size = fmt.Sprintf("%d,%d", entry.DevMajor, entry.DevMinor)
+	}
+	line := fmt.Sprintf("%s  %5d/%-5d  %12s  %s  %s", mode, entry.UID, entry.GID, size,
+		time.Unix(entry.ModTime, 0).Format("2006-01-02 15:04"), entry.RelPath)
+	switch entry.Type {
+	case backup.TypeSymlink:
+		line += " -> " + entry.LinkTarget
+	case backup.TypeHardlink:
+		line += " => " + entry.LinkName
+	case backup.TypeImage:
+		line += " (" + entry.LinkTarget + ")"
+	}
+	return line
+}
+
+// printTopUsage 打印最大的 n 个文件和目录
+func printTopUsage(files []backup.FileUsage, dirs []backup.DirUsage) {
+	fmt.Printf("最大的 %d 个目录:\n", len(dirs))
+	for _, dir := range dirs {
+		fmt.Printf("  %10s  %8d 个文件  %s\n", backup.FormatSize(dir.Size), dir.Files, dir.Path)
+	}
+
+	fmt.Printf("\n最大的 %d 个文件:\n", len(files))
+	for _, file := range files {
+		fmt.Printf("  %10s  %s\n", backup.FormatSize(file.Size), file.Path)
+	}
+}
+
+// printSummary 打印扫描汇总统计
+func printSummary(summary backup.ScanSummary) {
+	fmt.Printf("条目总数: %d\n", summary.TotalEntries)
+	if summary.Mode == backup.UsageBlocks {
+		fmt.Printf("占用磁盘: %s (%d 字节)\n", backup.FormatSize(summary.TotalBytes), summary.TotalBytes)
+	} else {
+		fmt.Printf("文件总大小: %s (%d 字节)\n", backup.FormatSize(summary.TotalBytes), summary.TotalBytes)
+	}
+	fmt.Printf("最大深度: %d\n", summary.MaxDepth)
+
+	fmt.Println("\n按类型统计:")
+	for t := backup.TypeFile; t <= backup.TypeImage; t++ {
+		if n := summary.TypeCounts[t]; n > 0 {
+			fmt.Printf("  %-10s %d\n", t, n)
+		}
+	}
+
+	if len(summary.LargestFiles) > 0 {
+		fmt.Println("\n最大的文件:")
+		for _, file := range summary.LargestFiles {
+			fmt.Printf("  %10s  %s\n", backup.FormatSize(file.Size), file.Path)
+		}
+	}
+
+	if len(summary.DeepestPaths) > 0 {
+		fmt.Println("\n最深的路径:")
+		for _, path := range summary.DeepestPaths {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+}
+
+// runFind 执行 find 子命令：在一个或多个归档中按内容类型和文件名查找条目
+func runFind(args []string) int {
+	fs := flag.NewFlagSet("find", flag.ContinueOnError)
+	archive := fs.String("archive", "", "归档文件路径或 http(s):// 地址（也可以在参数末尾列出多个归档）")
+	password := fs.String("password", "", "解密密码")
+	mime := fs.String("mime", "", "内容类型，如 application/x-pem-file 或 image/（需要打包时启用 -mime）")
+	name := fs.String("name", "", "文件名模式，如 *.key")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	archives := fs.Args()
+	if *archive != "" {
+		archives = append([]string{*archive}, archives...)
+	}
+	if len(archives) == 0 {
+		fmt.Fprintln(os.Stderr, "find 需要至少一个归档文件")
+		fs.Usage()
+		return exitUsage
+	}
+
+	code := exitOK
+	for _, path := range archives {
+		table, err := backup.ArchiveEntryTable(path, backup.PackOptions{Password: *password})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "读取归档失败 (%s): %v\n", path, err)
+			code = exitError
+			continue
+		}
+		for i := 0; i < table.Len(); i++ {
+			entryMime := table.Mime(i)
+			if *mime != "" && !backup.MatchMime(entryMime, *mime) {
+				continue
+			}
+			relPath := table.Path(i)
+			if *name != "" {
+				if ok, _ := filepath.Match(*name, filepath.Base(relPath)); !ok {
+					continue
+				}
+			}
+			fmt.Printf("%s\t%s\t%s\n", path, relPath, entryMime)
+		}
+		table.Close()
+	}
+	return code
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"backup/internal/backup"
+)
+
+// runConvert 执行 convert 子命令：在 BKUP 归档与 tar/tar.gz（及只读的 zip）之间转换
+// BKUP 归档转换为 tar 或 tar.gz；tar、tar.gz、zip 转换为 BKUP 归档（与 pack -import 相同）
+func runConvert(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	input := fs.String("input", "", "要转换的归档（BKUP、tar、tar.gz 或 zip，按文件内容识别）")
+	output := fs.String("output", "", "输出的归档文件路径")
+	format := fs.String("format", "", "输出格式: bkup, tar, tar.gz；不指定时 BKUP 归档转换为 tar.gz（-output 以 .tar 结尾时为 tar），其他归档转换为 BKUP")
+	password := fs.String("password", "", "BKUP 归档的密码：输入为加密归档时用于解密；输出为 BKUP 且指定 -encrypt 时用于加密")
+	encrypt := fs.Bool("encrypt", false, "加密输出的 BKUP 归档")
+	minPasswordBits := fs.Float64("min-password-bits", backup.MinPasswordBits(), "加密密码的最低估算强度（比特），低于时拒绝转换（默认取环境变量 BACKUP_MIN_PASSWORD_BITS）")
+	entryPassword := fs.String("entry-password", "", "输入中单独加密条目的密码")
+	chunkStore := fs.String("chunk-store", "", "块存储目录（输入的归档打包时使用了 -chunk-store 时需要）")
+	compression := fs.String("compression", "zstd", "输出 BKUP 归档的压缩方式: none, flate, zstd, xz")
+	level := fs.Int("level", 0, "输出 BKUP 归档的压缩级别，0 表示默认")
+	detectMime := fs.Bool("mime", false, "输出为 BKUP 时检测并记录每个文件的内容类型（tar 中不保存内容类型）")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *input == "" || *output == "" {
+		fmt.Fprintln(os.Stderr, "convert 需要 -input 和 -output 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	inputFormat, err := backup.ArchiveFormat(*input)
+	if err != nil {
+		return failure("读取归档失败", err)
+	}
+	if *format == "" {
+		switch {
+		case inputFormat != "bkup":
+			*format = "bkup"
+		case strings.HasSuffix(*output, ".tar"):
+			*format = "tar"
+		default:
+			*format = "tar.gz"
+		}
+	}
+	switch {
+	case *format != "bkup" && *format != "tar" && *format != "tar.gz":
+		fmt.Fprintf(os.Stderr, "不支持的输出格式: %s（可选 bkup, tar, tar.gz）\n", *format)
+		return exitUsage
+	case (*format == "bkup") == (inputFormat == "bkup"):
+		fmt.Fprintf(os.Stderr, "%s 已经是 %s 归档，convert 只在 BKUP 与 tar/tar.gz/zip 之间转换\n", *input, inputFormat)
+		return exitUsage
+	case (*encrypt || *detectMime) && *format != "bkup":
+		fmt.Fprintln(os.Stderr, "-encrypt 和 -mime 只能用于输出 BKUP 归档")
+		return exitUsage
+	}
+
+	if *format != "bkup" {
+		options := backup.PackOptions{Password: *password, EntryPassword: *entryPassword, ChunkStore: *chunkStore, Warn: printWarning, Context: cliContext}
+		diag.setOptions(options)
+		count, err := backup.ExportArchive(*input, *output, *format == "tar.gz", options)
+		if err != nil {
+			return failure("转换失败", err)
+		}
+		printStatus("已将 %d 个条目转换为 %s: %s", count, *format, *output)
+		return exitOK
+	}
+
+	codec, err := backup.ParseCodec(*compression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if *encrypt && *password == "" {
+		if !isTerminal(os.Stdin) {
+			fmt.Fprintln(os.Stderr, "-encrypt 需要 -password 参数")
+			return exitUsage
+		}
+		if *password, err = promptNewPassword(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+	if *encrypt && !checkPasswordStrength(*password, *minPasswordBits) {
+		return exitUsage
+	}
+	options := backup.PackOptions{
+		Password:         *password,
+		Encrypt:          *encrypt,
+		Compress:         codec != backup.CodecNone,
+		Compression:      codec,
+		CompressionLevel: *level,
+		DetectMime:       *detectMime,
+		Warn:             printWarning,
+		Progress:         printProgress,
+		ToolVersion:      version,
+		Context:          cliContext,
+	}
+	diag.setOptions(options)
+	err = backup.ImportArchive(*input, *output, nil, options)
+	endProgress()
+	if err != nil {
+		return failure("转换失败", err)
+	}
+	printStatus("已将 %s 归档转换为 BKUP: %s", inputFormat, *output)
+	return exitOK
+}
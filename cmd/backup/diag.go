@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"backup/internal/backup"
+)
+
+// diagLogLines 诊断包中保留的最近日志行数
+const diagLogLines = 50
+
+// diagnostics 记录命令执行过程中的状态，程序崩溃（panic）时写入诊断包
+type diagnostics struct {
+	mu      sync.Mutex
+	args    []string
+	options *backup.PackOptions
+	lines   []string // 最近的日志行（环形保留最后 diagLogLines 行）
+	done    int64    // 已处理的字节数
+	total   int64
+}
+
+// diag 当前命令的诊断信息
+var diag diagnostics
+
+// logf 记录一行日志
+func (d *diagnostics) logf(format string, args ...interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	line := time.Now().Format("15:04:05.000 ") + fmt.Sprintf(format, args...)
+	d.lines = append(d.lines, line)
+	if len(d.lines) > diagLogLines {
+		d.lines = d.lines[len(d.lines)-diagLogLines:]
+	}
+}
+
+// setOptions 记录当前命令使用的选项（写入诊断包时隐去密码）
+func (d *diagnostics) setOptions(options backup.PackOptions) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.options = &options
+}
+
+// setProgress 记录处理进度
+func (d *diagnostics) setProgress(done, total int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.done, d.total = done, total
+}
+
+// recoverPanic 捕获 panic，写入诊断包并打印其路径，将退出码设为 exitError
+// 用法: defer diag.recoverPanic(&code)
+func (d *diagnostics) recoverPanic(code *int) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	fmt.Fprintf(os.Stderr, "\n程序内部错误: %v\n", r)
+	path, err := d.writeBundle(r, stack)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "写入诊断信息失败: %v\n%s", err, stack)
+	} else {
+		fmt.Fprintf(os.Stderr, "诊断信息已写入: %s\n请在报告问题时附上该文件\n", path)
+	}
+	*code = exitError
+}
+
+// writeBundle 将崩溃信息写入临时目录中的诊断文件，返回文件路径
+func (d *diagnostics) writeBundle(r interface{}, stack []byte) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, err := os.CreateTemp("", "backup-panic-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "时间: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "命令: %s\n", strings.Join(redactArgs(d.args), " "))
+	fmt.Fprintf(&b, "错误: %v\n", r)
+	fmt.Fprintf(&b, "进度: %d / %d 字节\n", d.done, d.total)
+	if d.options != nil {
+		fmt.Fprintf(&b, "选项: %s\n", describeOptions(*d.options))
+	}
+	fmt.Fprintf(&b, "\n最近 %d 行日志:\n", len(d.lines))
+	for _, line := range d.lines {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	fmt.Fprintf(&b, "\n调用栈:\n%s", stack)
+
+	if _, err := f.WriteString(b.String()); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// redactArgs 隐去命令行参数中的密码和通知地址（Webhook 地址本身就是凭据）
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i, arg := range redacted {
+		name := strings.TrimLeft(arg, "-")
+		switch {
+		case (name == "password" || name == "notify") && i+1 < len(redacted):
+			redacted[i+1] = "***"
+		case strings.HasPrefix(name, "password="), strings.HasPrefix(name, "notify="):
+			redacted[i] = arg[:strings.Index(arg, "=")+1] + "***"
+		}
+	}
+	return redacted
+}
+
+// describeOptions 描述选项内容，密码只记录是否设置
+func describeOptions(o backup.PackOptions) string {
+	password := ""
+	if o.Password != "" {
+		password = "***"
+	}
+	return fmt.Sprintf("Compress=%v Compression=%v CompressionLevel=%d Encrypt=%v Password=%q HardDereference=%v BlockCompress=%v Threads=%d "+
+		"CompressTarget=%d BufferSize=%d ReadAhead=%d DetectMime=%v SecretPolicy=%d Jobs=%d MemoryBudget=%d StreamHash=%v SHA256=%q",
+		o.Compress, o.Compression, o.CompressionLevel, o.Encrypt, password, o.HardDereference, o.BlockCompress, o.Threads,
+		o.CompressTarget, o.BufferSize, o.ReadAhead, o.DetectMime, o.SecretPolicy, o.Jobs, o.MemoryBudget, o.StreamHash, o.SHA256)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"backup/internal/backup"
+)
+
+// diffFieldNames diff 文本输出中修改项的名称
+var diffFieldNames = map[string]string{
+	"type":    "类型",
+	"mode":    "权限",
+	"owner":   "属主",
+	"size":    "大小",
+	"mtime":   "修改时间",
+	"link":    "链接",
+	"content": "内容",
+}
+
+// runDiff 执行 diff 子命令：列出两个归档之间新增、删除和修改的路径
+// 与 diff(1) 相同，没有差异时返回 exitOK，有差异时返回 exitError，便于在脚本中判断
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	password := fs.String("password", "", "解密密码（两个归档相同）")
+	entryPassword := fs.String("entry-password", "", "单独加密条目的密码（不提供时这些文件只按大小比较）")
+	chunkStore := fs.String("chunk-store", "", "块存储目录（打包时使用了 -chunk-store 的归档需要，否则这些文件只按大小比较）")
+	metadataOnly := fs.Bool("metadata-only", false, "只比较元数据，不读取文件内容（有索引时不需要解码归档）")
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出比较结果")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "diff 需要两个归档文件: backup diff [选项] <旧归档> <新归档>")
+		fs.Usage()
+		return exitUsage
+	}
+
+	options := backup.PackOptions{Password: *password, EntryPassword: *entryPassword, ChunkStore: *chunkStore, Context: cliContext}
+	diff, err := backup.DiffArchives(fs.Arg(0), fs.Arg(1), *metadataOnly, options)
+	if err != nil {
+		return failure("比较失败", err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if *asJSON {
+		data, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return failure("输出失败", err)
+		}
+		fmt.Fprintln(out, string(data))
+	} else {
+		for _, change := range diff.Changes {
+			fmt.Fprintln(out, formatDiffLine(change))
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return failure("输出失败", err)
+	}
+	printStatus("新增 %d，删除 %d，修改 %d", diff.Added, diff.Removed, diff.Modified)
+	if !diff.Empty() {
+		return exitError
+	}
+	return exitOK
+}
+
+// formatDiffLine 格式化 diff 文本输出的一行，如 "修改  etc/hosts  (权限, 内容)"
+func formatDiffLine(change backup.DiffEntry) string {
+	switch change.Change {
+	case backup.DiffAdded:
+		return "新增  " + change.Path
+	case backup.DiffRemoved:
+		return "删除  " + change.Path
+	}
+	names := make([]string, len(change.Fields))
+	for i, field := range change.Fields {
+		names[i] = diffFieldNames[field]
+	}
+	return fmt.Sprintf("修改  %s  (%s)", change.Path, strings.Join(names, ", "))
+}
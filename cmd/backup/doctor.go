@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"backup/internal/backup"
+)
+
+// runDoctor 执行 doctor 子命令：按目录文件中的记录检查各目标目录的备份配置和历史，报告问题和建议
+// 有严重问题时返回 exitError，便于在监控中使用
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	catalogPath := fs.String("catalog", "", "记录打包、校验和镜像结果的目录文件（默认为 $BACKUP_CATALOG 或 ~/.local/state/backup/catalog.json）")
+	maxAge := fs.Duration("max-age", 36*time.Hour, "最近一次成功打包的最长间隔")
+	verifyMaxAge := fs.Duration("verify-max-age", 30*24*time.Hour, "校验的策略期限，超过期限没有校验通过的归档需要重新校验")
+	minRetention := fs.Duration("min-retention", 7*24*time.Hour, "目标目录中最早和最新的归档至少相隔的时间")
+	minFreeDays := fs.Int("min-free-days", 30, "按最近的写入量，可用空间至少还能维持的天数")
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出检查结果")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *catalogPath == "" {
+		path, err := backup.DefaultCatalogPath()
+		if err != nil {
+			return failure("读取目录文件失败", err)
+		}
+		*catalogPath = path
+	}
+	catalog, err := backup.LoadCatalog(*catalogPath)
+	if err != nil {
+		return failure("读取目录文件失败", err)
+	}
+	policy := backup.DoctorPolicy{MaxAge: *maxAge, VerifyMaxAge: *verifyMaxAge, MinRetention: *minRetention, MinFreeDays: *minFreeDays}
+	report, err := backup.Diagnose(catalog, policy)
+	if err != nil {
+		return failure("检查失败", err)
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return failure("输出失败", err)
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, issue := range report.Issues {
+			printHealthIssue(issue)
+		}
+		for _, destination := range report.Destinations {
+			fmt.Printf("目标目录 %s  得分 %d\n", destination.Directory, destination.Score)
+			if len(destination.Issues) == 0 {
+				fmt.Println("  没有发现问题")
+			}
+			for _, issue := range destination.Issues {
+				printHealthIssue(issue)
+			}
+		}
+	}
+	if report.Critical() {
+		return failure("检查", fmt.Errorf("发现严重问题，得分 %d", report.Score))
+	}
+	printStatus("得分 %d（目录文件 %s）", report.Score, *catalogPath)
+	return exitOK
+}
+
+// printHealthIssue 打印一个问题及建议
+func printHealthIssue(issue backup.HealthIssue) {
+	label := map[backup.HealthSeverity]string{
+		backup.SeverityCritical: "严重",
+		backup.SeverityWarning:  "警告",
+		backup.SeverityInfo:     "提示",
+	}[issue.Severity]
+	fmt.Printf("  %s  [%s] %s\n", label, issue.Check, issue.Message)
+	fmt.Printf("        建议: %s\n", issue.Suggestion)
+}
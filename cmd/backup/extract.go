@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"backup/internal/backup"
+)
+
+// runExtract 执行 extract 子命令：只还原归档中指定的文件或目录，不解包整个归档
+func runExtract(args []string) int {
+	fs := flag.NewFlagSet("extract", flag.ContinueOnError)
+	archive := fs.String("archive", "", "归档文件路径或 http(s):// 地址")
+	entryPath := fs.String("path", "", "要提取的文件或目录在归档中的路径，如 etc/hosts、home/user/（更多路径写在参数末尾）")
+	target := fs.String("target", "", "目标目录，提取的条目写在其中与归档中相同的相对路径下")
+	password := fs.String("password", "", "解密密码")
+	entryPassword := fs.String("entry-password", "", "单独加密条目的密码（不提供时跳过这些条目）")
+	chunkStore := fs.String("chunk-store", "", "块存储目录（打包时使用了 -chunk-store 的归档需要）")
+	threads := fs.Int("threads", 0, "并行解压的线程数（仅分块压缩的归档），0 表示使用 CPU 核数")
+	digest := fs.String("sha256", "", "校验整个归档文件的 SHA-256 摘要")
+	policyPath := fs.String("policy", "", "还原策略文件（YAML）：按路径模式调整属主、权限或跳过条目")
+	noBase := fs.Bool("no-base", false, "提取差异归档时不先从其基准中提取（目标目录中已经是基准的内容时使用）")
+	noSELinux := fs.Bool("no-selinux", false, "不还原归档中记录的 SELinux 安全上下文")
+	var lf limitFlags
+	lf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	paths := fs.Args()
+	if *entryPath != "" {
+		paths = append([]string{*entryPath}, paths...)
+	}
+	if *archive == "" || *target == "" || len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "extract 需要 -archive、-path 和 -target 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	limits, err := lf.build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	options := backup.PackOptions{Password: *password, EntryPassword: *entryPassword, ChunkStore: *chunkStore, Threads: *threads, SHA256: *digest, Context: cliContext, Limits: limits, Warn: printWarning, SkipBase: *noBase, NoSELinux: *noSELinux}
+	if *policyPath != "" {
+		if options.RestorePolicy, err = backup.LoadRestorePolicy(*policyPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+	diag.setOptions(options)
+	count, err := backup.ExtractPaths(*archive, paths, *target, options)
+	if err != nil {
+		return failure("提取失败", err)
+	}
+	printStatus("已提取 %d 个条目到 %s", count, *target)
+	return exitOK
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"os"
 	"runtime"
 
 	"backup/internal/backup"
 )
 
 func main() {
+	// 带参数时作为命令行工具运行
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
 	runtime.LockOSThread() 	// 锁定OS线程以确保GUI正常工作
 
 	backup.Opengui() 	// 打开GUI窗口
 }
-
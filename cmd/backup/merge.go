@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"backup/internal/backup"
+)
+
+// runMerge 执行 merge 子命令：把多个 BKUP 归档合并为一个，例如整理每周的完整备份
+func runMerge(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	var output string
+	fs.StringVar(&output, "output", "", "输出的归档文件路径")
+	fs.StringVar(&output, "out", "", "同 -output")
+	policy := fs.String("policy", string(backup.MergeNewest), "同一路径在多个归档中版本不同时: newest（取修改时间最新的，相同时取靠后的归档）, error（报错）")
+	password := fs.String("password", "", "输入归档的密码（各归档相同）；指定 -encrypt 时也用于加密输出")
+	encrypt := fs.Bool("encrypt", false, "加密输出的归档")
+	entryPassword := fs.String("entry-password", "", "输入中单独加密条目的密码")
+	chunkStore := fs.String("chunk-store", "", "块存储目录（输入的归档打包时使用了 -chunk-store 时需要）")
+	compression := fs.String("compression", "zstd", "输出归档的压缩方式: none, flate, zstd, xz")
+	level := fs.Int("level", 0, "输出归档的压缩级别，0 表示默认")
+	index := fs.Bool("index", false, "在输出的归档旁写入 <归档>.idx 索引")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if output == "" || fs.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, "merge 需要 -out 参数和至少两个归档: backup merge -out <输出归档> <归档>...")
+		fs.Usage()
+		return exitUsage
+	}
+	codec, err := backup.ParseCodec(*compression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if *encrypt && *password == "" {
+		if !isTerminal(os.Stdin) {
+			fmt.Fprintln(os.Stderr, "-encrypt 需要 -password 参数")
+			return exitUsage
+		}
+		if *password, err = promptNewPassword(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+
+	options := backup.PackOptions{
+		Password:         *password,
+		Encrypt:          *encrypt,
+		EntryPassword:    *entryPassword,
+		ChunkStore:       *chunkStore,
+		Compress:         codec != backup.CodecNone,
+		Compression:      codec,
+		CompressionLevel: *level,
+		Index:            *index,
+		Warn:             printWarning,
+		Progress:         printProgress,
+		ToolVersion:      version,
+		Context:          cliContext,
+	}
+	diag.setOptions(options)
+	stats, err := backup.MergeArchives(fs.Args(), output, backup.MergePolicy(*policy), options)
+	endProgress()
+	if err != nil {
+		return failure("合并失败", err)
+	}
+	printStatus("已合并 %d 个归档：%d 个条目，%d 个路径有多个版本: %s", fs.NArg(), stats.Entries, stats.Replaced, output)
+	return exitOK
+}
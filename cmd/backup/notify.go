@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// notifyTimeout 发送一条通知的超时时间
+const notifyTimeout = 15 * time.Second
+
+// 通知的颜色：成功为绿色，失败为红色
+const (
+	notifyColorOK   = "#2EB886"
+	notifyColorFail = "#D00000"
+)
+
+// notifier 将报告发送到聊天频道
+// 配置格式为 "<类型>:<地址>"：
+//
+//	slack:<Incoming Webhook 地址>
+//	teams:<Incoming Webhook 地址>
+//	matrix:<服务器地址>/<房间 ID>，访问令牌从环境变量 BACKUP_MATRIX_TOKEN 读取
+type notifier struct {
+	kind string // "slack"、"teams" 或 "matrix"
+	url  string
+}
+
+// parseNotifiers 解析 -notify 参数和环境变量 BACKUP_NOTIFY（每行或逗号分隔一个）中的通知配置
+func parseNotifiers(flagValue string) ([]notifier, error) {
+	var notifiers []notifier
+	specs := strings.FieldsFunc(flagValue+"\n"+os.Getenv("BACKUP_NOTIFY"), func(r rune) bool {
+		return r == ',' || r == '\n'
+	})
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.IndexByte(spec, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("无效的通知配置: %s（格式为 类型:地址）", spec)
+		}
+		n := notifier{kind: strings.ToLower(spec[:i]), url: spec[i+1:]}
+		switch n.kind {
+		case "slack", "teams", "matrix":
+		default:
+			return nil, fmt.Errorf("未知的通知类型: %s（支持 slack、teams、matrix）", n.kind)
+		}
+		if !strings.HasPrefix(n.url, "https://") && !strings.HasPrefix(n.url, "http://") {
+			return nil, fmt.Errorf("通知地址必须是 http(s):// 地址: %s", n.url)
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// send 发送报告
+// ok: 命令是否成功，决定消息的颜色
+func (n notifier) send(r *runReport, title string, fields [][2]string, ok bool) error {
+	color := notifyColorOK
+	if !ok {
+		color = notifyColorFail
+	}
+	// 报告正文：Slack 和 Teams 使用 Markdown 风格的纯文本，Matrix 同时发送 HTML
+	var lines []string
+	for _, f := range fields {
+		lines = append(lines, fmt.Sprintf("*%s*: %s", f[0], f[1]))
+	}
+	for _, a := range r.archives {
+		row := archiveRow(a)
+		lines = append(lines, fmt.Sprintf("%s: %s 个条目，内容 %s，大小 %s，sha256 `%s`", row[0], row[1], row[2], row[3], row[4]))
+	}
+	text := strings.Join(lines, "\n")
+
+	switch n.kind {
+	case "slack":
+		return postJSON(http.MethodPost, n.url, nil, map[string]interface{}{
+			"text": title,
+			"attachments": []map[string]interface{}{
+				{"color": color, "text": text, "mrkdwn_in": []string{"text"}},
+			},
+		})
+	case "teams":
+		return postJSON(http.MethodPost, n.url, nil, map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"themeColor": strings.TrimPrefix(color, "#"),
+			"title":      title,
+			"text":       strings.ReplaceAll(text, "\n", "\n\n"),
+		})
+	default:
+		return n.sendMatrix(r, title, fields, color)
+	}
+}
+
+// sendMatrix 发送到 Matrix 房间
+func (n notifier) sendMatrix(r *runReport, title string, fields [][2]string, color string) error {
+	token := os.Getenv("BACKUP_MATRIX_TOKEN")
+	if token == "" {
+		return fmt.Errorf("需要设置环境变量 BACKUP_MATRIX_TOKEN")
+	}
+	i := strings.LastIndexByte(n.url, '/')
+	if i < 0 || !strings.HasPrefix(n.url[i+1:], "!") {
+		return fmt.Errorf("Matrix 地址格式为 <服务器地址>/<房间 ID>，如 https://matrix.example.org/!abc:example.org")
+	}
+	server, room := n.url[:i], n.url[i+1:]
+	txnID := fmt.Sprintf("backup-%d", time.Now().UnixNano())
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", server, url.PathEscape(room), txnID)
+
+	// 标题按结果着色
+	formatted := r.html(title, fields)
+	formatted = strings.Replace(formatted, "<h3>", fmt.Sprintf("<h3><font color=\"%s\">", color), 1)
+	formatted = strings.Replace(formatted, "</h3>", "</font></h3>", 1)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	return postJSON(http.MethodPut, endpoint, header, map[string]interface{}{
+		"msgtype":        "m.notice",
+		"body":           r.text(title, fields),
+		"format":         "org.matrix.custom.html",
+		"formatted_body": formatted,
+	})
+}
+
+// postJSON 以 JSON 发送请求，非 2xx 响应视为失败
+func postJSON(method, endpoint string, header http.Header, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
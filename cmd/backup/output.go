@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// 终端颜色
+const (
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// outputMode 命令行的输出方式
+type outputMode struct {
+	quiet bool // 只输出错误：不显示进度、状态和警告
+	color bool // 错误和警告使用颜色
+	tty   bool // 标准错误输出是终端：进度在同一行刷新；否则每 10% 输出一行，适合写入日志和 cron 邮件
+}
+
+// output 当前命令的输出方式
+var output outputMode
+
+// detectOutputMode 根据标准错误输出是否为终端和环境变量 NO_COLOR 确定默认的输出方式
+func detectOutputMode() outputMode {
+	mode := outputMode{tty: isTerminal(os.Stderr)}
+	_, noColor := os.LookupEnv("NO_COLOR")
+	mode.color = mode.tty && !noColor && os.Getenv("TERM") != "dumb"
+	return mode
+}
+
+// isTerminal 判断文件是否为终端（能读取终端设置；/dev/null 等其他字符设备不算）
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
+// parseFlags 解析子命令之前的全局选项（-q、-no-color），返回剩余的参数
+func (o *outputMode) parseFlags(args []string) []string {
+	for len(args) > 0 {
+		switch args[0] {
+		case "-q", "--q", "-quiet", "--quiet":
+			o.quiet = true
+		case "-no-color", "--no-color":
+			o.color = false
+		default:
+			return args
+		}
+		args = args[1:]
+	}
+	return args
+}
+
+// paint 启用颜色时为文字加上颜色
+func (o outputMode) paint(color, s string) string {
+	if !o.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// printStatus 在标准错误输出上打印状态信息（-q 时不打印）
+// 标准输出只用于数据（列表、统计、JSON），脚本通过管道读取时不会混入状态信息
+func printStatus(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	diag.logf("%s", msg)
+	if output.quiet {
+		return
+	}
+	endProgress()
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// printWarning 在标准错误输出上打印警告（-q 时不打印）
+func printWarning(msg string) {
+	diag.logf("警告: %s", msg)
+	if output.quiet {
+		return
+	}
+	endProgress()
+	fmt.Fprintln(os.Stderr, output.paint(colorYellow, "警告: "+msg))
+}
+
+// progressStep 非终端输出时每隔多少个百分点输出一行进度
+const progressStep = 10
+
+// lastPercent 上次显示的进度百分比
+var lastPercent int64 = -1
+
+// progressLine 终端上是否有尚未换行的进度行
+var progressLine bool
+
+// printProgress 在标准错误输出上显示进度
+// 终端上每个百分点在同一行刷新一次；输出被重定向时每 10% 输出一行；-q 时不显示
+func printProgress(done, total int64) {
+	diag.setProgress(done, total)
+	if output.quiet || total <= 0 {
+		return
+	}
+	percent := done * 100 / total
+	if !output.tty {
+		percent -= percent % progressStep
+	}
+	if percent == lastPercent {
+		return
+	}
+	lastPercent = percent
+	if output.tty {
+		fmt.Fprintf(os.Stderr, "\r已读取 %d / %d 字节 (%d%%)", done, total, percent)
+		progressLine = true
+		return
+	}
+	fmt.Fprintf(os.Stderr, "已读取 %d / %d 字节 (%d%%)\n", done, total, percent)
+}
+
+// endProgress 结束终端上的进度行，之后的输出从新的一行开始
+func endProgress() {
+	if progressLine {
+		fmt.Fprintln(os.Stderr)
+		progressLine = false
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"backup/internal/backup"
+)
+
+// runInitRepo 执行 init-repo 子命令：创建快照仓库
+func runInitRepo(args []string) int {
+	fs := flag.NewFlagSet("init-repo", flag.ContinueOnError)
+	repoDir := fs.String("repo", "", "仓库目录（不存在时创建，存在时必须为空）")
+	encryption := fs.String("encryption", "none", "块加密方式: none, random（不去重，看不出哪些数据相同）, convergent（收敛加密，照常去重，但块 ID 暴露哪些数据相同）")
+	password := fs.String("password", "", "加密仓库的密码（在终端上运行时可以省略，改为交互输入并确认）")
+	minPasswordBits := fs.Float64("min-password-bits", backup.MinPasswordBits(), "仓库密码的最低估算强度（比特），低于时拒绝创建（默认取环境变量 BACKUP_MIN_PASSWORD_BITS）")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *repoDir == "" {
+		fmt.Fprintln(os.Stderr, "init-repo 需要 -repo 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	if *encryption != "none" {
+		if *password == "" {
+			if !isTerminal(os.Stdin) {
+				fmt.Fprintln(os.Stderr, "加密的仓库必须提供密码")
+				return exitUsage
+			}
+			var err error
+			if *password, err = promptNewPassword(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitUsage
+			}
+		}
+		if !checkPasswordStrength(*password, *minPasswordBits) {
+			return exitUsage
+		}
+	}
+	if _, err := backup.InitRepositoryWithOptions(*repoDir, backup.RepositoryOptions{Encryption: *encryption, Password: *password}); err != nil {
+		return failure("创建仓库失败", err)
+	}
+	if *encryption != "none" {
+		printStatus("已创建加密仓库 %s（%s），创建和还原快照时需要仓库密码，密码丢失后数据无法恢复", *repoDir, *encryption)
+		return exitOK
+	}
+	printStatus("已创建仓库 %s", *repoDir)
+	return exitOK
+}
+
+// repositoryPassword 加密的仓库需要密码：未通过 -password 提供时在终端上提示输入
+func repositoryPassword(repo *backup.Repository, password string) (string, error) {
+	if !repo.Encrypted() || password != "" {
+		return password, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return "", fmt.Errorf("仓库已加密，需要 -password 参数")
+	}
+	return readPassword("仓库密码: ")
+}
+
+// runSnapshot 执行 snapshot 子命令：打包源目录，在仓库中创建一个新快照
+func runSnapshot(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	repoDir := fs.String("repo", "", "仓库目录（init-repo 创建）")
+	source := fs.String("source", "", "要备份的源目录")
+	tags := fs.String("tag", "", "快照的标签，逗号分隔")
+	compression := fs.String("compression", "zstd", "快照归档（元数据和小文件）的压缩方式: none, flate, zstd, xz；块存储中的块总是使用 zstd")
+	level := fs.Int("level", 0, "压缩级别，0 表示默认")
+	threads := fs.Int("threads", 0, "并行压缩的线程数，0 表示使用 CPU 核数")
+	password := fs.String("password", "", "加密仓库的密码（在终端上运行时可以省略，改为交互输入）")
+	var ff filterFlags
+	ff.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *repoDir == "" || *source == "" {
+		fmt.Fprintln(os.Stderr, "snapshot 需要 -repo 和 -source 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	codec, err := backup.ParseCodec(*compression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	filter, err := ff.build()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "过滤参数错误: %v\n", err)
+		return exitUsage
+	}
+	repo, err := backup.OpenRepository(*repoDir)
+	if err != nil {
+		return failure("打开仓库失败", err)
+	}
+	if *password, err = repositoryPassword(repo, *password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	options := backup.PackOptions{
+		Password:         *password,
+		Compress:         codec != backup.CodecNone,
+		Compression:      codec,
+		CompressionLevel: *level,
+		Threads:          *threads,
+		Warn:             printWarning,
+		Progress:         printProgress,
+		ToolVersion:      version,
+		Context:          cliContext,
+	}
+	diag.setOptions(options)
+	snapshot, err := repo.CreateSnapshot(*source, filter, backup.ParsePatterns(*tags), options)
+	endProgress()
+	if err != nil {
+		return failure("创建快照失败", err)
+	}
+	fmt.Println(snapshot.ID)
+	stored := snapshot.ArchiveBytes
+	if d := snapshot.Dedup; d != nil {
+		stored += d.StoredBytes
+	}
+	printStatus("快照 %s：%d 个条目，内容 %s，新增数据 %s", snapshot.ID, snapshot.Entries, backup.FormatSize(snapshot.ContentBytes), backup.FormatSize(stored))
+	return exitOK
+}
+
+// runSnapshots 执行 snapshots 子命令：列出仓库中的快照
+func runSnapshots(args []string) int {
+	fs := flag.NewFlagSet("snapshots", flag.ContinueOnError)
+	repoDir := fs.String("repo", "", "仓库目录")
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *repoDir == "" {
+		fmt.Fprintln(os.Stderr, "snapshots 需要 -repo 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	repo, err := backup.OpenRepository(*repoDir)
+	if err != nil {
+		return failure("打开仓库失败", err)
+	}
+	snapshots, err := repo.Snapshots()
+	if err != nil {
+		return failure("读取快照列表失败", err)
+	}
+	if *asJSON {
+		if snapshots == nil {
+			snapshots = []backup.Snapshot{}
+		}
+		data, err := json.MarshalIndent(snapshots, "", "  ")
+		if err != nil {
+			return failure("生成 JSON 失败", err)
+		}
+		fmt.Println(string(data))
+		return exitOK
+	}
+	for _, s := range snapshots {
+		fmt.Printf("%s  %s  %-12s  %8s  %s", s.ID, s.Time.Local().Format(time.DateTime), s.Hostname, backup.FormatSize(s.ContentBytes), s.Source)
+		if len(s.Tags) > 0 {
+			fmt.Printf("  [%s]", strings.Join(s.Tags, ","))
+		}
+		fmt.Println()
+	}
+	return exitOK
+}
+
+// runRestore 执行 restore 子命令：将仓库中的快照还原到目标目录
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	repoDir := fs.String("repo", "", "仓库目录")
+	snapshotID := fs.String("snapshot", "", "快照 ID（可以是唯一的前缀），latest 表示最近的快照")
+	target := fs.String("target", "", "还原的目标目录")
+	threads := fs.Int("threads", 0, "并行解压的线程数，0 表示使用 CPU 核数")
+	password := fs.String("password", "", "加密仓库的密码（在终端上运行时可以省略，改为交互输入）")
+	policyPath := fs.String("policy", "", "还原策略文件（YAML）：按路径模式调整属主、权限或跳过条目")
+	noSELinux := fs.Bool("no-selinux", false, "不还原快照中记录的 SELinux 安全上下文（由目标系统的 restorecon 重新标记）")
+	var lf limitFlags
+	lf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *repoDir == "" || *snapshotID == "" || *target == "" {
+		fmt.Fprintln(os.Stderr, "restore 需要 -repo、-snapshot 和 -target 参数")
+		fs.Usage()
+		return exitUsage
+	}
+	limits, err := lf.build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	repo, err := backup.OpenRepository(*repoDir)
+	if err != nil {
+		return failure("打开仓库失败", err)
+	}
+	if *password, err = repositoryPassword(repo, *password); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	options := backup.PackOptions{Password: *password, Threads: *threads, Context: cliContext, Limits: limits, Warn: printWarning, NoSELinux: *noSELinux}
+	if *policyPath != "" {
+		if options.RestorePolicy, err = backup.LoadRestorePolicy(*policyPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+	diag.setOptions(options)
+	snapshot, err := repo.RestoreSnapshot(*snapshotID, *target, options)
+	if err != nil {
+		return failure("还原快照失败", err)
+	}
+	printStatus("已还原快照 %s（%s，%s）到 %s", snapshot.ID, snapshot.Source, snapshot.Time.Local().Format(time.DateTime), *target)
+	return exitOK
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"backup/internal/backup"
+)
+
+// reportFormats 支持的报告格式
+var reportFormats = []string{"text", "markdown", "html"}
+
+// runReport 命令结束时打印的简短报告（-report），可以直接放入 cron 邮件或聊天机器人消息
+type runReport struct {
+	mu        sync.Mutex
+	format    string
+	command   string
+	start     time.Time
+	fields    [][2]string          // 参数和统计（名称、值）
+	archives  []backup.PackSummary // 生成的归档
+	verify    string               // 校验状态
+	notifiers []notifier           // 结束时发送报告的聊天通知
+}
+
+// reportFlags 报告相关的命令行参数
+type reportFlags struct {
+	format string
+	notify string
+}
+
+// registerReportFlags 在 FlagSet 上注册 -report 和 -notify 参数
+func registerReportFlags(fs *flag.FlagSet) *reportFlags {
+	f := &reportFlags{}
+	fs.StringVar(&f.format, "report", "", "结束时在标准输出打印报告: "+strings.Join(reportFormats, ", "))
+	fs.StringVar(&f.notify, "notify", "", "结束时将报告发送到聊天频道，多个用逗号分隔，如 slack:https://hooks.slack.com/...（另见环境变量 BACKUP_NOTIFY）")
+	return f
+}
+
+// newReport 创建报告，既不打印报告也没有通知时返回 nil（nil 上的方法都不做任何事）
+func newReport(flags *reportFlags, command string) (*runReport, error) {
+	notifiers, err := parseNotifiers(flags.notify)
+	if err != nil {
+		return nil, err
+	}
+	if flags.format == "" && len(notifiers) == 0 {
+		return nil, nil
+	}
+	report := &runReport{format: flags.format, command: command, start: time.Now(), notifiers: notifiers}
+	if flags.format == "" {
+		return report, nil
+	}
+	for _, f := range reportFormats {
+		if flags.format == f {
+			return report, nil
+		}
+	}
+	return nil, fmt.Errorf("未知的报告格式: %s（支持 %s）", flags.format, strings.Join(reportFormats, ", "))
+}
+
+// add 添加一项参数或统计
+func (r *runReport) add(name, value string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fields = append(r.fields, [2]string{name, value})
+}
+
+// setVerify 设置校验状态
+func (r *runReport) setVerify(status string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.verify = status
+}
+
+// addArchive 记录一个生成的归档（作为 PackOptions.OnArchive 回调，可能被并发调用）
+func (r *runReport) addArchive(summary backup.PackSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.archives = append(r.archives, summary)
+}
+
+// finish 在标准输出打印报告，并发送到配置的聊天频道
+// err: 命令的执行结果，nil 表示成功
+func (r *runReport) finish(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := "成功"
+	if err != nil {
+		status = "失败"
+		if cliContext.Err() != nil {
+			status = "已中断"
+		}
+	}
+	fields := [][2]string{
+		{"开始时间", r.start.Format("2006-01-02 15:04:05")},
+		{"耗时", time.Since(r.start).Round(time.Millisecond).String()},
+	}
+	fields = append(fields, r.fields...)
+	if r.verify != "" {
+		fields = append(fields, [2]string{"校验", r.verify})
+	}
+	if err != nil {
+		fields = append(fields, [2]string{"错误", err.Error()})
+	}
+	title := fmt.Sprintf("backup %s: %s", r.command, status)
+
+	if r.format != "" {
+		fmt.Print(r.render(r.format, title, fields))
+	}
+	for _, n := range r.notifiers {
+		if sendErr := n.send(r, title, fields, err == nil); sendErr != nil {
+			printWarning(fmt.Sprintf("发送通知失败 (%s): %v", n.kind, sendErr))
+		}
+	}
+}
+
+// render 按格式生成报告
+func (r *runReport) render(format string, title string, fields [][2]string) string {
+	switch format {
+	case "markdown":
+		return r.markdown(title, fields)
+	case "html":
+		return r.html(title, fields)
+	default:
+		return r.text(title, fields)
+	}
+}
+
+// archiveRow 返回归档在报告中的各列：路径、条目数、内容大小、归档大小、SHA-256
+func archiveRow(a backup.PackSummary) []string {
+	return []string{a.Archive, fmt.Sprint(a.Entries), backup.FormatSize(a.ContentBytes), backup.FormatSize(a.ArchiveBytes), a.SHA256}
+}
+
+// archiveColumns 归档表格的列名
+var archiveColumns = []string{"归档", "条目", "内容", "大小", "SHA-256"}
+
+// text 生成纯文本报告
+func (r *runReport) text(title string, fields [][2]string) string {
+	var b strings.Builder
+	b.WriteString(title + "\n")
+	for _, f := range fields {
+		fmt.Fprintf(&b, "  %s: %s\n", f[0], f[1])
+	}
+	if len(r.archives) > 0 {
+		b.WriteString("  归档:\n")
+		for _, a := range r.archives {
+			row := archiveRow(a)
+			fmt.Fprintf(&b, "    %s  %s 个条目  内容 %s  大小 %s  sha256 %s\n", row[0], row[1], row[2], row[3], row[4])
+		}
+	}
+	return b.String()
+}
+
+// markdown 生成 Markdown 报告
+func (r *runReport) markdown(title string, fields [][2]string) string {
+	escape := func(s string) string { return strings.ReplaceAll(s, "|", "\\|") }
+	var b strings.Builder
+	fmt.Fprintf(&b, "### %s\n\n| 项目 | 值 |\n| --- | --- |\n", title)
+	for _, f := range fields {
+		fmt.Fprintf(&b, "| %s | %s |\n", escape(f[0]), escape(f[1]))
+	}
+	if len(r.archives) > 0 {
+		fmt.Fprintf(&b, "\n| %s |\n|%s\n", strings.Join(archiveColumns, " | "), strings.Repeat(" --- |", len(archiveColumns)))
+		for _, a := range r.archives {
+			row := archiveRow(a)
+			for i := range row {
+				row[i] = escape(row[i])
+			}
+			row[4] = "`" + row[4] + "`"
+			fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+		}
+	}
+	return b.String()
+}
+
+// html 生成 HTML 片段
+func (r *runReport) html(title string, fields [][2]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<h3>%s</h3>\n<table>\n", html.EscapeString(title))
+	for _, f := range fields {
+		fmt.Fprintf(&b, "<tr><th align=\"left\">%s</th><td>%s</td></tr>\n", html.EscapeString(f[0]), html.EscapeString(f[1]))
+	}
+	b.WriteString("</table>\n")
+	if len(r.archives) > 0 {
+		b.WriteString("<table>\n<tr>")
+		for _, c := range archiveColumns {
+			fmt.Fprintf(&b, "<th>%s</th>", html.EscapeString(c))
+		}
+		b.WriteString("</tr>\n")
+		for _, a := range r.archives {
+			b.WriteString("<tr>")
+			for _, cell := range archiveRow(a) {
+				fmt.Fprintf(&b, "<td>%s</td>", html.EscapeString(cell))
+			}
+			b.WriteString("</tr>\n")
+		}
+		b.WriteString("</table>\n")
+	}
+	return b.String()
+}
+
+// archiveSize 返回本地归档文件的大小描述，远程地址或无法访问时返回空字符串
+func archiveSize(path string) string {
+	if backup.IsURL(path) {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return backup.FormatSize(info.Size())
+}
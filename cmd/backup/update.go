@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 构建时通过 -ldflags "-X main.version=... -X main.updateURL=... -X main.updatePublicKey=..." 设置
+var (
+	version         = "dev" // 程序版本
+	updateURL       = ""    // 默认的发布信息地址
+	updatePublicKey = ""    // 验证发布文件签名的 Ed25519 公钥（base64）
+)
+
+// releaseInfo 发布信息地址返回的 JSON，地址加上 .sig 是对这段 JSON 原始内容的 Ed25519 签名（base64）
+//
+//	{"version": "1.3.0", "binaries": {"linux/amd64": {"url": "...", "signature": "<base64>"}}}
+type releaseInfo struct {
+	Version  string                   `json:"version"`
+	Binaries map[string]releaseBinary `json:"binaries"`
+}
+
+// releaseBinary 某个平台的可执行文件
+type releaseBinary struct {
+	URL       string `json:"url"`
+	Signature string `json:"signature"` // 对文件内容的 Ed25519 签名（base64）
+}
+
+const (
+	maxBinarySize   = 512 * 1024 * 1024 // 下载的可执行文件大小上限
+	maxReleaseSize  = 1024 * 1024       // 发布信息大小上限
+	releaseTimeout  = 30 * time.Second  // 下载发布信息和签名的超时时间
+	downloadTimeout = 10 * time.Minute  // 下载可执行文件的超时时间
+)
+
+// runSelfUpdate 执行 self-update 子命令：检查新版本，验证签名后原子替换当前可执行文件
+func runSelfUpdate(args []string) int {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	url := fs.String("url", updateURL, "发布信息地址")
+	check := fs.Bool("check", false, "只检查是否有新版本，不更新")
+	force := fs.Bool("force", false, "版本相同时也重新安装；当前版本号无法比较（如 dev 构建）时仍然更新")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *url == "" {
+		fmt.Fprintln(os.Stderr, "self-update 需要 -url 参数（此版本构建时未设置默认发布地址）")
+		return exitUsage
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		fmt.Fprintln(os.Stderr, "此版本构建时未设置有效的签名公钥，无法安全地自动更新")
+		return exitError
+	}
+
+	release, err := fetchRelease(*url, ed25519.PublicKey(publicKey))
+	if err != nil {
+		return failure("检查更新失败", err)
+	}
+	// 发布信息被替换为旧版本（签名有效的旧发布信息）时拒绝降级
+	cmp, err := compareVersions(release.Version, version)
+	if err != nil && !*force {
+		fmt.Fprintf(os.Stderr, "无法比较版本 %s 和 %s: %v（确认要更新请加 -force）\n", version, release.Version, err)
+		return exitError
+	}
+	if err == nil && cmp < 0 {
+		fmt.Fprintf(os.Stderr, "发布信息中的版本 %s 比当前版本 %s 旧，拒绝降级\n", release.Version, version)
+		return exitError
+	}
+	if err == nil && cmp == 0 && !*force {
+		printStatus("已是最新版本 %s", version)
+		return exitOK
+	}
+	printStatus("当前版本 %s，最新版本 %s", version, release.Version)
+	if *check {
+		return exitOK
+	}
+
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	binary, ok := release.Binaries[platform]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "发布中没有 %s 平台的可执行文件\n", platform)
+		return exitError
+	}
+	if err := installRelease(binary, ed25519.PublicKey(publicKey)); err != nil {
+		return failure("更新失败", err)
+	}
+	printStatus("已更新到 %s", release.Version)
+	return exitOK
+}
+
+// fetchRelease 下载发布信息和签名，验证签名后解析
+func fetchRelease(url string, publicKey ed25519.PublicKey) (*releaseInfo, error) {
+	data, err := httpGet(url, maxReleaseSize, releaseTimeout)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := httpGet(url+".sig", 4096, releaseTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("下载发布信息的签名失败: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("无效的发布信息签名: %v", err)
+	}
+	if !ed25519.Verify(publicKey, data, signature) {
+		return nil, fmt.Errorf("发布信息签名验证失败，拒绝更新")
+	}
+	var release releaseInfo
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("解析发布信息失败: %v", err)
+	}
+	if release.Version == "" {
+		return nil, fmt.Errorf("发布信息缺少版本号")
+	}
+	return &release, nil
+}
+
+// compareVersions 比较形如 1.3.0 或 v1.3.0 的版本号，返回 -1、0、1
+// 预发布后缀（如 1.3.0-rc1）低于对应的正式版本，两个预发布版本按 comparePrerelease 比较
+func compareVersions(a, b string) (int, error) {
+	aNums, aPre, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bNums, bPre, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(aNums) || i < len(bNums); i++ {
+		var x, y int
+		if i < len(aNums) {
+			x = aNums[i]
+		}
+		if i < len(bNums) {
+			y = bNums[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0, nil
+	case aPre == "":
+		return 1, nil
+	case bPre == "":
+		return -1, nil
+	default:
+		return comparePrerelease(aPre, bPre), nil
+	}
+}
+
+// comparePrerelease 按语义化版本（semver §11）比较预发布后缀，返回 -1、0、1
+// 后缀按 "." 分为标识符逐个比较：数字标识符按数值比较且低于非数字标识符，其余按字符串比较，前面都相同时标识符多的较高。
+// 非数字标识符中的数字部分也按数值比较，使不带点的 rc2 低于 rc10
+func comparePrerelease(a, b string) int {
+	aIDs, bIDs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		if c := compareIdentifier(aIDs[i], bIDs[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(aIDs) < len(bIDs):
+		return -1
+	case len(aIDs) > len(bIDs):
+		return 1
+	}
+	return 0
+}
+
+// compareIdentifier 比较两个预发布标识符：依次比较其中的数字段（按数值）和非数字段（按字符串），数字段低于非数字段
+func compareIdentifier(a, b string) int {
+	for a != "" && b != "" {
+		aPart, aNum := leadingRun(a)
+		bPart, bNum := leadingRun(b)
+		a, b = a[len(aPart):], b[len(bPart):]
+		switch {
+		case aNum && bNum:
+			// 先比较去掉前导零后的长度，避免超出整数范围
+			x, y := strings.TrimLeft(aPart, "0"), strings.TrimLeft(bPart, "0")
+			if len(x) != len(y) {
+				return sign(len(x) - len(y))
+			}
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		case aNum:
+			return -1
+		case bNum:
+			return 1
+		default:
+			if c := strings.Compare(aPart, bPart); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(a) - len(b))
+}
+
+// leadingRun 返回开头连续的数字或非数字部分，以及它是否为数字
+func leadingRun(s string) (string, bool) {
+	digit := func(c byte) bool { return c >= '0' && c <= '9' }
+	num := digit(s[0])
+	i := 1
+	for i < len(s) && digit(s[i]) == num {
+		i++
+	}
+	return s[:i], num
+}
+
+// sign 返回 n 的符号：-1、0、1
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// parseVersion 解析版本号的数字部分和预发布后缀
+func parseVersion(v string) ([]int, string, error) {
+	s := strings.TrimPrefix(v, "v")
+	s, _, _ = strings.Cut(s, "+") // 构建元数据不参与比较
+	s, pre, _ := strings.Cut(s, "-")
+	var nums []int
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("无效的版本号 %q", v)
+		}
+		nums = append(nums, n)
+	}
+	return nums, pre, nil
+}
+
+// installRelease 下载可执行文件，验证签名后替换当前可执行文件
+// 新文件先写入同一目录下的临时文件，再重命名覆盖，替换过程是原子的
+func installRelease(binary releaseBinary, publicKey ed25519.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(binary.Signature)
+	if err != nil {
+		return fmt.Errorf("无效的签名: %v", err)
+	}
+	data, err := httpGet(binary.URL, maxBinarySize, downloadTimeout)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, data, signature) {
+		return fmt.Errorf("签名验证失败，拒绝安装")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("获取可执行文件路径失败: %v", err)
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return fmt.Errorf("获取可执行文件路径失败: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".backup-update-")
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("写入临时文件失败: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("写入临时文件失败: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("写入临时文件失败: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return fmt.Errorf("设置权限失败: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return fmt.Errorf("替换可执行文件失败: %v", err)
+	}
+	return nil
+}
+
+// httpGet 下载地址的内容，超过 limit 字节或 timeout 时报错
+func httpGet(url string, limit int64, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("下载 %s 失败: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("下载 %s 失败: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("下载 %s 失败: %v", url, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("下载 %s 失败: 文件过大", url)
+	}
+	return data, nil
+}
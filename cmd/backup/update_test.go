@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+// TestCompareVersions 版本号按数字逐段比较，预发布版本低于正式版本，预发布后缀按语义化版本的规则比较
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.3.0", "1.3.0", 0},
+		{"v1.3.0", "1.3.0", 0},
+		{"1.3.0", "1.10.0", -1},
+		{"1.3", "1.3.1", -1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.3.0-rc1", "1.3.0", -1},
+		{"1.3.0", "1.3.0-rc1", 1},
+		{"1.3.0-rc2", "1.3.0-rc10", -1},
+		{"1.3.0-rc.2", "1.3.0-rc.10", -1},
+		{"1.3.0-rc10", "1.3.0-rc2", 1},
+		{"1.3.0-alpha", "1.3.0-beta", -1},
+		{"1.3.0-beta", "1.3.0-alpha", 1},
+		{"1.3.0-alpha", "1.3.0-alpha.1", -1},
+		{"1.3.0-alpha.1", "1.3.0-alpha.beta", -1},
+		{"1.3.0-beta.2", "1.3.0-beta.11", -1},
+		{"1.3.0-beta.11", "1.3.0-rc.1", -1},
+		{"1.3.0-rc.1", "1.3.0-rc.1", 0},
+		{"1.3.0-rc.1+build.5", "1.3.0-rc.1", 0},
+		{"1.3.0-1", "1.3.0-alpha", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"_"+tt.b, func(t *testing.T) {
+			got, err := compareVersions(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("compareVersions(%q, %q) = %d，期望 %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+
+	for _, v := range []string{"", "1.x", "1.-3", "latest"} {
+		if _, err := compareVersions(v, "1.0.0"); err == nil {
+			t.Errorf("无效的版本号 %q 被接受", v)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package backup
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// 分块压缩格式：
+// 数据被切分为最多 blockCompressSize 字节的明文块，每块独立用 flate 压缩，
+// 每块结构为 压缩后长度(4字节) + 明文长度(4字节) + 压缩数据，
+// 以压缩后长度为 0 的块作为结束标记。
+// 由于各块互不依赖，解包时可以由多个 worker 并行解压，再按顺序交给条目解码器。
+const blockCompressSize = 1024 * 1024 // 1MB 明文
+
+// blockCompressWriter 实现分块压缩写入，各块由多个 worker 并行压缩（见 parallelcompress.go）
+type blockCompressWriter struct {
+	pc      *parallelCompressor
+	writer  io.Writer
+	level   atomic.Int32 // 下一块使用的压缩级别（自适应调整时由写出协程修改）
+	buffer  []byte
+	target  int64 // 目标压缩吞吐量（字节/秒），> 0 时根据实测速度自适应调整压缩级别
+	workers int
+}
+
+// newBlockCompressWriter 创建分块压缩写入器，workers 个块同时压缩
+func newBlockCompressWriter(w io.Writer, level int, target int64, workers int) *blockCompressWriter {
+	bw := &blockCompressWriter{writer: w, target: target, workers: workers}
+	bw.level.Store(int32(level))
+	bw.pc = newParallelCompressor(workers, compressBlock, bw.emit)
+	return bw
+}
+
+func (bw *blockCompressWriter) Write(p []byte) (n int, err error) {
+	bw.buffer = append(bw.buffer, p...)
+	for len(bw.buffer) >= blockCompressSize {
+		if err := bw.flushBlock(bw.buffer[:blockCompressSize]); err != nil {
+			return 0, err
+		}
+		bw.buffer = bw.buffer[blockCompressSize:]
+	}
+	return len(p), nil
+}
+
+// flushBlock 复制一块数据并提交压缩（缓冲区之后会被覆盖）
+func (bw *blockCompressWriter) flushBlock(block []byte) error {
+	return bw.pc.submit(compressJob{block: append([]byte(nil), block...), level: int(bw.level.Load())})
+}
+
+// compressBlock 独立压缩一个块
+func compressBlock(job compressJob) ([]byte, error) {
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, job.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(job.block); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// emit 按顺序写出一个压缩块（在写出协程中调用）
+func (bw *blockCompressWriter) emit(result compressResult) error {
+	if bw.target > 0 {
+		bw.adjustLevel(result.rawLen, result.elapsed)
+	}
+	return writeBlockFrame(bw.writer, result.data, result.rawLen)
+}
+
+// adjustLevel 根据刚完成的块的压缩速度调整之后提交的块的压缩级别
+// 压缩速度低于目标时降低级别；明显高于目标（压缩器有余力，瓶颈在 I/O）时提高级别
+// 多个 worker 同时压缩时，总吞吐量按单块速度乘以 worker 数估算
+// 每个块独立压缩，因此解包端不需要知道每块使用的级别
+func (bw *blockCompressWriter) adjustLevel(n int, elapsed time.Duration) {
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	rate := float64(n) / elapsed.Seconds() * float64(bw.workers)
+	level := bw.level.Load()
+	switch {
+	case rate < float64(bw.target) && level > flate.BestSpeed:
+		bw.level.Store(level - 1)
+	case rate > float64(bw.target)*1.5 && level < flate.BestCompression:
+		bw.level.Store(level + 1)
+	}
+}
+
+// flush 把缓冲的数据作为一块（可能不满 1MB）提交，等待之前的全部数据写出
+func (bw *blockCompressWriter) flush() error {
+	if len(bw.buffer) > 0 {
+		if err := bw.flushBlock(bw.buffer); err != nil {
+			return err
+		}
+		bw.buffer = bw.buffer[:0]
+	}
+	return bw.pc.wait()
+}
+
+// Close 写出剩余数据和结束标记（不关闭底层写入器）
+func (bw *blockCompressWriter) Close() error {
+	if len(bw.buffer) > 0 {
+		if err := bw.flushBlock(bw.buffer); err != nil {
+			bw.pc.abort()
+			return err
+		}
+		bw.buffer = nil
+	}
+	if err := bw.pc.Close(); err != nil {
+		return err
+	}
+	return binary.Write(bw.writer, binary.LittleEndian, uint32(0))
+}
+
+// abort 打包出错时停止后台协程
+func (bw *blockCompressWriter) abort() {
+	bw.pc.abort()
+}
+
+// writeBlockFrame 写出一个压缩块的帧头和数据
+func writeBlockFrame(w io.Writer, compressed []byte, rawLen int) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(compressed))); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(rawLen)); err != nil {
+		return err
+	}
+	_, err := w.Write(compressed)
+	return err
+}
+
+// blockResult 一个块的解压结果
+type blockResult struct {
+	data []byte
+	err  error
+}
+
+// blockJob 一个待解压的块
+type blockJob struct {
+	compressed []byte
+	rawLen     int
+	result     chan blockResult
+}
+
+// blockDecompressReader 实现分块数据的并行解压读取
+// 一个读取协程按顺序读出压缩块并分发给 worker 池，
+// 各块的结果通道按原始顺序排队，Read 按顺序取出解压后的数据
+type blockDecompressReader struct {
+	results chan chan blockResult // 按块顺序排列的结果通道
+	done    chan struct{}         // 关闭时通知后台协程退出
+	current []byte                // 当前块尚未读取的数据
+	err     error                 // 已发生的错误（之后的读取都返回它）
+}
+
+// newBlockDecompressReader 创建并行解压读取器
+// workers: 并行解压的 worker 数量，<= 0 表示使用 CPU 核数
+func newBlockDecompressReader(r io.Reader, workers int) *blockDecompressReader {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	br := &blockDecompressReader{
+		// 限制预读的块数，避免内存无限增长
+		results: make(chan chan blockResult, workers*2),
+		done:    make(chan struct{}),
+	}
+	jobs := make(chan blockJob, workers)
+	for i := 0; i < workers; i++ {
+		go decompressWorker(jobs)
+	}
+	go br.readBlocks(r, jobs)
+	return br
+}
+
+// readBlocks 按顺序读取压缩块，分发给 worker
+func (br *blockDecompressReader) readBlocks(r io.Reader, jobs chan<- blockJob) {
+	defer close(br.results)
+	defer close(jobs)
+
+	for {
+		result := make(chan blockResult, 1)
+		job, end, err := readBlockFrame(r)
+		if err != nil {
+			result <- blockResult{err: err}
+		}
+		if end {
+			return
+		}
+
+		select {
+		case br.results <- result:
+		case <-br.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		job.result = result
+		select {
+		case jobs <- job:
+		case <-br.done:
+			return
+		}
+	}
+}
+
+// readBlockFrame 读取一个压缩块的帧，end 表示遇到结束标记
+func readBlockFrame(r io.Reader) (job blockJob, end bool, err error) {
+	var compressedLen, rawLen uint32
+	if err := binary.Read(r, binary.LittleEndian, &compressedLen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return job, false, fmt.Errorf("读取压缩块长度失败: %v", err)
+	}
+	if compressedLen == 0 {
+		return job, true, nil
+	}
+	if err := binary.Read(r, binary.LittleEndian, &rawLen); err != nil {
+		return job, false, fmt.Errorf("读取压缩块长度失败: %v", err)
+	}
+	// 压缩块不会超过明文块大小太多，防止损坏的长度字段导致超大内存分配
+	if rawLen > blockCompressSize || compressedLen > blockCompressSize*2 {
+		return job, false, fmt.Errorf("压缩块长度异常: %d/%d", compressedLen, rawLen)
+	}
+	job.compressed = make([]byte, compressedLen)
+	if _, err := io.ReadFull(r, job.compressed); err != nil {
+		return job, false, fmt.Errorf("读取压缩块失败: %v", err)
+	}
+	job.rawLen = int(rawLen)
+	return job, false, nil
+}
+
+// decompressWorker 解压 worker
+func decompressWorker(jobs <-chan blockJob) {
+	for job := range jobs {
+		fr := flate.NewReader(bytes.NewReader(job.compressed))
+		data := make([]byte, job.rawLen)
+		_, err := io.ReadFull(fr, data)
+		fr.Close()
+		if err != nil {
+			err = fmt.Errorf("解压数据块失败: %v", err)
+		}
+		job.result <- blockResult{data: data, err: err}
+	}
+}
+
+func (br *blockDecompressReader) Read(p []byte) (int, error) {
+	for len(br.current) == 0 {
+		if br.err != nil {
+			return 0, br.err
+		}
+		result, ok := <-br.results
+		if !ok {
+			br.err = io.EOF
+			continue
+		}
+		res := <-result
+		if res.err != nil {
+			br.err = res.err
+			continue
+		}
+		br.current = res.data
+	}
+	n := copy(p, br.current)
+	br.current = br.current[n:]
+	return n, nil
+}
+
+// Close 停止后台读取和解压协程
+func (br *blockDecompressReader) Close() error {
+	select {
+	case <-br.done:
+	default:
+		close(br.done)
+	}
+	return nil
+}
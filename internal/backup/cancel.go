@@ -0,0 +1,41 @@
+package backup
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrCanceled 打包或解包被取消（例如收到中断信号）
+var ErrCanceled = errors.New("操作已取消")
+
+// partialSuffix 正在写入的归档文件的后缀，写入完成后才重命名为最终文件名
+const partialSuffix = ".partial"
+
+// checkCanceled 检查选项中的 Context 是否已被取消
+func checkCanceled(options PackOptions) error {
+	if options.Context != nil && options.Context.Err() != nil {
+		return ErrCanceled
+	}
+	return nil
+}
+
+// cancelReader 每次读取前检查是否已取消，使大文件的复制可以及时中断
+type cancelReader struct {
+	reader  io.Reader
+	options PackOptions
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	if err := checkCanceled(cr.options); err != nil {
+		return 0, err
+	}
+	return cr.reader.Read(p)
+}
+
+// withCancel 在选项带有 Context 时为读取器添加取消检查
+func withCancel(r io.Reader, options PackOptions) io.Reader {
+	if options.Context == nil {
+		return r
+	}
+	return &cancelReader{reader: r, options: options}
+}
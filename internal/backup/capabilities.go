@@ -0,0 +1,37 @@
+package backup
+
+// Capabilities 本程序支持的归档格式和功能，供调度程序在分派任务前检查
+type Capabilities struct {
+	FormatVersions []int    `json:"format_versions"` // 可以读取的归档格式版本
+	WriteVersion   int      `json:"write_version"`   // 打包时写入的格式版本
+	Codecs         []string `json:"codecs"`          // 压缩方式
+	Ciphers        []string `json:"ciphers"`         // 加密算法
+	Backends       []string `json:"backends"`        // 可以读取归档的位置
+	Features       []string `json:"features"`        // 可选功能
+}
+
+// SupportedCapabilities 返回本程序支持的格式版本、压缩、加密、存储位置和可选功能
+func SupportedCapabilities() Capabilities {
+	versions := make([]int, 0, formatVersion)
+	for v := 1; v <= int(formatVersion); v++ {
+		versions = append(versions, v)
+	}
+	return Capabilities{
+		FormatVersions: versions,
+		WriteVersion:   int(formatVersion),
+		Codecs:         []string{"flate", "flate-block", "zstd", "xz"},
+		Ciphers:        []string{"aes-256-gcm"},
+		Backends:       []string{"file", "http", "https"},
+		Features: []string{
+			"mime",
+			"image",
+			"stream-hash",
+			"central-index",
+			"entry-encryption",
+			"split-by-dir",
+			"restore-order",
+			"secrets",
+			"xattrs",
+		},
+	}
+}
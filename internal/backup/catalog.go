@@ -0,0 +1,431 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// 归档目录（catalog）：记录本机上校验过的归档及最近一次校验的结果和时间，
+// status 据此列出超过策略期限没有校验、校验失败或校验后被改变的归档。
+// 目录是一个 JSON 文件，多个进程同时更新时用文件锁串行化，写入临时文件后重命名。
+//
+// 归档本身写完后不再修改（摘要文件、镜像和 -sha256 校验都依赖归档的内容不变，中央索引的尾部也必须在文件末尾），
+// 所以校验结果不追加到归档中；需要随归档一起复制的记录可以用 verify -stamp 写在归档旁的 "<归档>.verified.json" 中
+
+// verifiedSuffix 校验记录文件的后缀，写在归档文件旁边
+const verifiedSuffix = ".verified.json"
+
+// CatalogRecord 目录中一个归档的校验记录
+type CatalogRecord struct {
+	Archive      string     `json:"archive"`                 // 归档的绝对路径或 http(s):// 地址
+	LastCheck    time.Time  `json:"last_check"`              // 最近一次校验的时间
+	LastOK       bool       `json:"last_ok"`                 // 最近一次校验是否通过
+	LastError    string     `json:"last_error,omitempty"`    // 最近一次校验失败的原因
+	LastVerified *time.Time `json:"last_verified,omitempty"` // 最近一次校验通过的时间
+	Size         int64      `json:"size,omitempty"`          // 校验通过时的归档大小，之后大小变化说明归档被改变
+	Entries      int        `json:"entries,omitempty"`       // 校验通过时的条目数
+}
+
+// RunRecord 一次打包的记录：时间、结果和打包过程中的警告
+type RunRecord struct {
+	Source    string    `json:"source"`             // 源路径
+	Archive   string    `json:"archive"`            // 输出的归档路径（-split-by-dir 时为带占位符的模式）
+	Start     time.Time `json:"start"`              // 开始时间
+	End       time.Time `json:"end"`                // 结束时间
+	OK        bool      `json:"ok"`                 // 是否成功
+	Error     string    `json:"error,omitempty"`    // 失败的原因
+	Warnings  []string  `json:"warnings,omitempty"` // 打包过程中的警告
+	Directory string    `json:"directory"`          // 归档所在目录的绝对路径
+}
+
+// MirrorRecord 一次镜像（mirror）的记录：把归档目录复制到另一个位置，doctor 据此判断是否有异地副本
+type MirrorRecord struct {
+	Source      string    `json:"source"`          // 源归档目录的绝对路径
+	Destination string    `json:"destination"`     // 镜像目标目录的绝对路径
+	Time        time.Time `json:"time"`            // 完成（或失败）的时间
+	OK          bool      `json:"ok"`              // 是否成功
+	Error       string    `json:"error,omitempty"` // 失败的原因
+	Copied      int64     `json:"copied"`          // 复制的字节数
+}
+
+// Catalog 归档目录的内容
+type Catalog struct {
+	Archives map[string]*CatalogRecord `json:"archives"`          // 归档的绝对路径或地址 -> 校验记录
+	Runs     map[string]*RunRecord     `json:"runs,omitempty"`    // 目标目录的绝对路径 -> 最近一次打包
+	Mirrors  map[string]*MirrorRecord  `json:"mirrors,omitempty"` // 源归档目录的绝对路径 -> 最近一次镜像
+}
+
+// Records 返回按归档路径排序的全部记录
+func (c *Catalog) Records() []*CatalogRecord {
+	records := make([]*CatalogRecord, 0, len(c.Archives))
+	for _, record := range c.Archives {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Archive < records[j].Archive })
+	return records
+}
+
+// DefaultCatalogPath 返回目录文件的默认位置：环境变量 BACKUP_CATALOG，
+// 否则为 $XDG_STATE_HOME/backup/catalog.json（未设置时为 ~/.local/state/backup/catalog.json）
+func DefaultCatalogPath() (string, error) {
+	if path := os.Getenv("BACKUP_CATALOG"); path != "" {
+		return path, nil
+	}
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("无法确定目录文件的位置: %v", err)
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(state, "backup", "catalog.json"), nil
+}
+
+// catalogKey 返回归档在目录中的键：本地路径转换为绝对路径
+func catalogKey(archivePath string) string {
+	if IsURL(archivePath) {
+		return archivePath
+	}
+	if abs, err := filepath.Abs(archivePath); err == nil {
+		return abs
+	}
+	return archivePath
+}
+
+// LoadCatalog 读取目录文件，文件不存在时返回空目录
+func LoadCatalog(path string) (*Catalog, error) {
+	catalog := &Catalog{Archives: make(map[string]*CatalogRecord), Runs: make(map[string]*RunRecord), Mirrors: make(map[string]*MirrorRecord)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取目录文件失败: %v", err)
+	}
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, fmt.Errorf("目录文件已损坏 (%s): %v", path, err)
+	}
+	if catalog.Archives == nil {
+		catalog.Archives = make(map[string]*CatalogRecord)
+	}
+	if catalog.Runs == nil {
+		catalog.Runs = make(map[string]*RunRecord)
+	}
+	if catalog.Mirrors == nil {
+		catalog.Mirrors = make(map[string]*MirrorRecord)
+	}
+	return catalog, nil
+}
+
+// UpdateCatalog 在文件锁保护下读取目录、调用 update 修改后写回
+func UpdateCatalog(path string, update func(catalog *Catalog) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("创建目录文件所在目录失败: %v", err)
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("打开目录锁文件失败: %v", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("锁定目录文件失败: %v", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	catalog, err := LoadCatalog(path)
+	if err != nil {
+		return err
+	}
+	if err := update(catalog); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return fmt.Errorf("生成目录文件失败: %v", err)
+	}
+	partialPath := path + partialSuffix
+	if err := os.WriteFile(partialPath, append(data, '\n'), 0644); err != nil {
+		os.Remove(partialPath)
+		return fmt.Errorf("写入目录文件失败: %v", err)
+	}
+	if err := os.Rename(partialPath, path); err != nil {
+		os.Remove(partialPath)
+		return fmt.Errorf("重命名目录文件失败: %v", err)
+	}
+	return nil
+}
+
+// RecordVerification 将一次校验的结果记录到目录文件中
+// result 为 nil 或 verifyErr 不为 nil 时记录为失败；通过时同时记录归档的大小和条目数
+func RecordVerification(catalogPath, archivePath string, result *VerifyResult, verifyErr error) error {
+	now := time.Now().UTC()
+	record := CatalogRecord{Archive: catalogKey(archivePath), LastCheck: now}
+	switch {
+	case verifyErr != nil:
+		record.LastError = verifyErr.Error()
+	case result == nil:
+		record.LastError = "没有校验结果"
+	case !result.OK():
+		record.LastError = fmt.Sprintf("发现 %d 个问题", len(result.Problems))
+	default:
+		record.LastOK = true
+		record.LastVerified = &now
+		record.Entries = result.Entries
+		if !IsURL(archivePath) {
+			if info, err := os.Stat(archivePath); err == nil {
+				record.Size = info.Size()
+			}
+		}
+	}
+	return UpdateCatalog(catalogPath, func(catalog *Catalog) error {
+		if previous, ok := catalog.Archives[record.Archive]; ok && !record.LastOK {
+			// 校验失败时保留上一次校验通过的记录
+			record.LastVerified, record.Size, record.Entries = previous.LastVerified, previous.Size, previous.Entries
+		}
+		catalog.Archives[record.Archive] = &record
+		return nil
+	})
+}
+
+// maxRunWarnings 打包记录中保留的警告条数
+const maxRunWarnings = 20
+
+// RecordRun 将一次打包的结果记录到目录文件中（每个目标目录只保留最近一次，警告最多保留 maxRunWarnings 条）
+func RecordRun(catalogPath string, run RunRecord) error {
+	if n := len(run.Warnings); n > maxRunWarnings {
+		run.Warnings = append(run.Warnings[:maxRunWarnings:maxRunWarnings], fmt.Sprintf("另有 %d 条警告", n-maxRunWarnings))
+	}
+	run.Directory = catalogKey(filepath.Dir(run.Archive))
+	run.Archive = catalogKey(run.Archive)
+	if run.Source != "" {
+		run.Source = catalogKey(run.Source)
+	}
+	return UpdateCatalog(catalogPath, func(catalog *Catalog) error {
+		catalog.Runs[run.Directory] = &run
+		return nil
+	})
+}
+
+// RecordMirror 将一次镜像的结果记录到目录文件中（每个源目录只保留最近一次）
+func RecordMirror(catalogPath string, mirror MirrorRecord) error {
+	mirror.Source = catalogKey(mirror.Source)
+	mirror.Destination = catalogKey(mirror.Destination)
+	return UpdateCatalog(catalogPath, func(catalog *Catalog) error {
+		catalog.Mirrors[mirror.Source] = &mirror
+		return nil
+	})
+}
+
+// WriteVerifyStamp 校验通过后在归档旁写入校验记录（"<归档>.verified.json"），随归档一起复制或镜像
+func WriteVerifyStamp(archivePath string, result *VerifyResult) error {
+	if IsURL(archivePath) {
+		return fmt.Errorf("只能为本地归档写入校验记录")
+	}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return fmt.Errorf("读取归档文件信息失败: %v", err)
+	}
+	now := time.Now().UTC()
+	stamp := CatalogRecord{
+		Archive:      filepath.Base(archivePath),
+		LastCheck:    now,
+		LastOK:       true,
+		LastVerified: &now,
+		Size:         info.Size(),
+		Entries:      result.Entries,
+	}
+	data, err := json.MarshalIndent(stamp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("生成校验记录失败: %v", err)
+	}
+	if err := os.WriteFile(archivePath+verifiedSuffix, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("写入校验记录失败: %v", err)
+	}
+	return nil
+}
+
+// ReadVerifyStamp 读取归档旁的校验记录，Archive 字段替换为归档的绝对路径；没有记录时返回的错误满足 os.IsNotExist
+func ReadVerifyStamp(archivePath string) (*CatalogRecord, error) {
+	data, err := os.ReadFile(archivePath + verifiedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var stamp CatalogRecord
+	if err := json.Unmarshal(data, &stamp); err != nil {
+		return nil, fmt.Errorf("校验记录已损坏 (%s): %v", archivePath+verifiedSuffix, err)
+	}
+	stamp.Archive = catalogKey(archivePath)
+	return &stamp, nil
+}
+
+// VerificationState 归档相对于校验策略的状态
+type VerificationState string
+
+const (
+	StateVerified VerificationState = "verified" // 在策略期限内校验通过，之后没有变化
+	StateStale    VerificationState = "stale"    // 上次校验通过已超过策略期限
+	StateNever    VerificationState = "never"    // 从未校验通过
+	StateFailed   VerificationState = "failed"   // 最近一次校验失败
+	StateChanged  VerificationState = "changed"  // 校验通过后归档的大小发生了变化
+	StateMissing  VerificationState = "missing"  // 归档文件已不存在
+)
+
+// ArchiveStatus 一个归档的校验状态
+type ArchiveStatus struct {
+	Archive      string            `json:"archive"`
+	State        VerificationState `json:"state"`
+	LastVerified *time.Time        `json:"last_verified,omitempty"`
+	LastCheck    *time.Time        `json:"last_check,omitempty"`
+	LastError    string            `json:"last_error,omitempty"`
+	Size         int64             `json:"size,omitempty"` // 当前的归档大小（本地归档）
+}
+
+// NeedsAttention 归档是否需要处理（重新校验或检查失败原因）
+func (s ArchiveStatus) NeedsAttention() bool {
+	return s.State != StateVerified
+}
+
+// EvaluateVerification 按校验记录和策略期限 maxAge 判断归档的状态，record 为 nil 表示没有记录
+func EvaluateVerification(archive string, record *CatalogRecord, maxAge time.Duration, now time.Time) ArchiveStatus {
+	status := ArchiveStatus{Archive: archive}
+	if !IsURL(archive) {
+		info, err := os.Stat(archive)
+		if err != nil {
+			status.State = StateMissing
+			return status
+		}
+		status.Size = info.Size()
+	}
+	if record == nil {
+		status.State = StateNever
+		return status
+	}
+	status.LastVerified = record.LastVerified
+	status.LastCheck = &record.LastCheck
+	status.LastError = record.LastError
+	switch {
+	case !record.LastOK && record.LastError != "":
+		status.State = StateFailed
+	case record.LastVerified == nil:
+		status.State = StateNever
+	case status.Size != 0 && record.Size != 0 && status.Size != record.Size:
+		status.State = StateChanged
+	case now.Sub(*record.LastVerified) > maxAge:
+		status.State = StateStale
+	default:
+		status.State = StateVerified
+	}
+	return status
+}
+
+// ArchiveStatuses 按目录和归档旁的校验记录列出归档的校验状态（按路径排序）
+// paths 为空时列出目录中记录的全部归档；否则只列出 paths 中的归档，以及其中的目录下的 *.bkup 文件（不递归）。
+// 目录和归档旁都有记录时使用较新的一个
+func ArchiveStatuses(catalog *Catalog, paths []string, maxAge time.Duration) ([]ArchiveStatus, error) {
+	var archives []string
+	if len(paths) == 0 {
+		for _, record := range catalog.Records() {
+			archives = append(archives, record.Archive)
+		}
+	}
+	for _, path := range paths {
+		if IsURL(path) {
+			archives = append(archives, path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			// 不存在的归档也列出，状态为 missing
+			archives = append(archives, catalogKey(path))
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.bkup"))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			archives = append(archives, catalogKey(match))
+		}
+	}
+	sort.Strings(archives)
+
+	now := time.Now()
+	var statuses []ArchiveStatus
+	for i, archive := range archives {
+		if i > 0 && archive == archives[i-1] {
+			continue
+		}
+		record := catalog.Archives[archive]
+		if !IsURL(archive) {
+			if stamp, err := ReadVerifyStamp(archive); err == nil && (record == nil || stamp.LastCheck.After(record.LastCheck)) {
+				record = stamp
+			}
+		}
+		statuses = append(statuses, EvaluateVerification(archive, record, maxAge, now))
+	}
+	return statuses, nil
+}
+
+// DestinationStatus 一个目标目录的概况：最近一次打包、归档数量和大小、校验状态
+type DestinationStatus struct {
+	Directory      string     `json:"directory"`
+	Missing        bool       `json:"missing,omitempty"` // 目录已不存在或无法访问
+	LastRun        *RunRecord `json:"last_run,omitempty"`
+	Archives       int        `json:"archives"`
+	Bytes          int64      `json:"bytes"`
+	Verified       int        `json:"verified"`                  // 在策略期限内校验通过的归档数
+	NeedsAttention int        `json:"needs_attention"`           // 需要处理的归档数
+	OldestVerified *time.Time `json:"oldest_verified,omitempty"` // 校验通过的归档中最早一次校验通过的时间
+}
+
+// DestinationOverview 按目标目录汇总：打包记录和校验记录中出现过的本地目录，统计其中的 *.bkup 归档（按目录排序）
+func DestinationOverview(catalog *Catalog, maxAge time.Duration) ([]DestinationStatus, error) {
+	dirs := make(map[string]bool)
+	for dir := range catalog.Runs {
+		dirs[dir] = true
+	}
+	for archive := range catalog.Archives {
+		if !IsURL(archive) {
+			dirs[filepath.Dir(archive)] = true
+		}
+	}
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+
+	var overview []DestinationStatus
+	for _, dir := range names {
+		status := DestinationStatus{Directory: dir, LastRun: catalog.Runs[dir]}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			status.Missing = true
+			overview = append(overview, status)
+			continue
+		}
+		archives, err := ArchiveStatuses(catalog, []string{dir}, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		for _, archive := range archives {
+			status.Archives++
+			status.Bytes += archive.Size
+			if archive.NeedsAttention() {
+				status.NeedsAttention++
+				continue
+			}
+			status.Verified++
+			if status.OldestVerified == nil || archive.LastVerified.Before(*status.OldestVerified) {
+				status.OldestVerified = archive.LastVerified
+			}
+		}
+		overview = append(overview, status)
+	}
+	return overview, nil
+}
@@ -0,0 +1,397 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// 中央索引（格式版本 versionCentralIndex 起，文件头标志 flagCentralIndex）：
+//   [文件头][条目数据流（与没有中央索引时相同）][索引块][尾部 32 字节]
+//   索引块：与 .idx 索引文件的内容相同的编码（归档加密时用条目数据流的密钥加密，没有派生参数和密码校验值），
+//   flate 压缩的 JSON 行，每行一个 IndexedEntry
+//   尾部：魔数 "BKCI"(4) + 索引块偏移(8) + 索引块长度(8) + 索引块 CRC32(4) + 保留(8)
+// 索引块偏移同时是条目数据流的结束位置。索引块和尾部写在流校验层之下，不参与流校验，
+// 但计入整个归档文件的 SHA-256 摘要
+//
+// 索引中的偏移是解密、解压缩之后的条目数据流中的偏移。压缩流（flate、zstd、xz，包括分块压缩）没有记录
+// 压缩块的边界，流校验层的校验值也是链式的，都不能从中间开始解码，所以压缩或带流校验的归档的中央索引只用于列目录，
+// 读取单个文件时仍顺序读取到该文件（OpenEntry 退回顺序读取时给出警告，打包时同时指定也给出警告）
+
+const (
+	centralIndexMagic  = "BKCI"
+	centralTrailerSize = 32
+
+	// encryptChunkSize 加密层每块明文的大小（与 encryptWriter 一致），随机读取时据此计算密文块的位置
+	encryptChunkSize = 64 * 1024
+)
+
+// ErrNoCentralIndex 归档没有中央索引（打包时没有启用，或者是旧版本的归档）
+var ErrNoCentralIndex = errors.New("归档没有中央索引")
+
+// errNotSeekable 归档不能直接定位到条目（没有中央索引，或者压缩、带流校验），需要顺序读取
+var errNotSeekable = errors.New("归档不支持随机读取")
+
+// warnNotSeekable 有中央索引的压缩或带流校验的归档不能直接定位到条目
+const warnNotSeekable = "归档已压缩或带流校验，中央索引只能用于列目录，读取单个文件需要顺序解码到该文件"
+
+// IndexedEntry 中央索引中的一个条目
+type IndexedEntry struct {
+	FileEntry
+	Offset int64 `json:"offset"` // 条目在解密、解压缩之后的条目数据流中的偏移
+}
+
+// centralTrailer 归档末尾的尾部
+type centralTrailer struct {
+	indexOffset int64  // 索引块在归档文件中的偏移（即条目数据流的结束位置）
+	indexLength int64  // 索引块的字节数
+	crc         uint32 // 索引块的 CRC32
+}
+
+// offsetWriter 记录写入位置的写入器
+type offsetWriter struct {
+	writer io.Writer
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.writer.Write(p)
+	ow.offset += int64(n)
+	return n, err
+}
+
+// writeCentralIndex 在条目数据流之后写入索引块和尾部
+// streamEnd: 条目数据流结束（索引块开始）的位置
+// offsets: 每个条目在条目数据流中的偏移，与 entries 一一对应
+func writeCentralIndex(w io.Writer, streamEnd int64, entries []FileEntry, offsets []int64, options PackOptions) error {
+	crc := crc32.NewIEEE()
+	block := &offsetWriter{writer: io.MultiWriter(w, crc)}
+	var encrypt writeLayer
+	if options.Encrypt {
+		encrypt = encryptLayer(options.archiveKey.gcm, nil)
+	}
+	err := writeIndexPayload(block, encrypt, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for i, entry := range entries {
+			if entry.Type == TypeSocket {
+				continue
+			}
+			// 与从归档中读取的条目保持一致
+			entry.Compress = false
+			if err := encoder.Encode(IndexedEntry{FileEntry: entry, Offset: offsets[i]}); err != nil {
+				return fmt.Errorf("写入中央索引失败 (%s): %v", entry.RelPath, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	trailer := make([]byte, centralTrailerSize)
+	copy(trailer, centralIndexMagic)
+	binary.LittleEndian.PutUint64(trailer[4:], uint64(streamEnd))
+	binary.LittleEndian.PutUint64(trailer[12:], uint64(block.offset))
+	binary.LittleEndian.PutUint32(trailer[20:], crc.Sum32())
+	if _, err := w.Write(trailer); err != nil {
+		return fmt.Errorf("写入中央索引尾部失败: %v", err)
+	}
+	return nil
+}
+
+// sourceReaderAt 返回归档数据源的随机读取接口和总字节数（本地文件，或支持 Range 请求的 HTTP 地址）
+func sourceReaderAt(source io.Reader) (io.ReaderAt, int64, error) {
+	switch s := source.(type) {
+	case *httpReader:
+		if s.size < 0 {
+			return nil, 0, fmt.Errorf("服务器没有返回归档大小，无法读取中央索引")
+		}
+		return s, s.size, nil
+	case interface {
+		io.ReaderAt
+		Stat() (fs.FileInfo, error)
+	}:
+		info, err := s.Stat()
+		if err != nil {
+			return nil, 0, fmt.Errorf("读取归档文件信息失败: %v", err)
+		}
+		return s, info.Size(), nil
+	}
+	return nil, 0, fmt.Errorf("归档数据源不支持随机读取，无法读取中央索引")
+}
+
+// readCentralTrailer 读取并检查归档末尾的尾部
+func readCentralTrailer(at io.ReaderAt, size int64) (centralTrailer, error) {
+	var trailer centralTrailer
+	if size < headerSize+centralTrailerSize {
+		return trailer, fmt.Errorf("归档过短，缺少中央索引尾部")
+	}
+	buf := make([]byte, centralTrailerSize)
+	if _, err := at.ReadAt(buf, size-centralTrailerSize); err != nil && err != io.EOF {
+		return trailer, fmt.Errorf("读取中央索引尾部失败: %v", err)
+	}
+	if string(buf[:4]) != centralIndexMagic {
+		return trailer, fmt.Errorf("中央索引尾部的魔数不匹配，归档可能被截断或已损坏")
+	}
+	trailer.indexOffset = int64(binary.LittleEndian.Uint64(buf[4:]))
+	trailer.indexLength = int64(binary.LittleEndian.Uint64(buf[12:]))
+	trailer.crc = binary.LittleEndian.Uint32(buf[20:])
+	if trailer.indexOffset < headerSize || trailer.indexLength < 0 ||
+		trailer.indexLength > size-centralTrailerSize-trailer.indexOffset ||
+		trailer.indexOffset+trailer.indexLength != size-centralTrailerSize {
+		return trailer, fmt.Errorf("中央索引的位置异常（偏移 %d，长度 %d，归档 %d 字节），归档可能已损坏",
+			trailer.indexOffset, trailer.indexLength, size)
+	}
+	return trailer, nil
+}
+
+// errStopWalk 遍历回调返回它时提前结束遍历（不作为错误返回）
+var errStopWalk = errors.New("停止遍历")
+
+// walkCentralEntries 读取索引块，逐个解码条目并调用 fn，不在内存中保留全部条目
+// aesGCM: 加密归档的条目数据流的密钥（openDecryption 的结果），nil 表示未加密；fn 返回 errStopWalk 时提前结束
+func walkCentralEntries(at io.ReaderAt, trailer centralTrailer, aesGCM cipher.AEAD, options PackOptions, fn func(entry IndexedEntry) error) error {
+	// 先完整读取一遍计算 CRC，确认索引块完好后再解码
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(at, trailer.indexOffset, trailer.indexLength)); err != nil {
+		return fmt.Errorf("读取中央索引失败: %v", err)
+	}
+	if crc.Sum32() != trailer.crc {
+		return fmt.Errorf("中央索引校验失败，归档可能已损坏")
+	}
+
+	block := bufio.NewReader(io.NewSectionReader(at, trailer.indexOffset, trailer.indexLength))
+	var decrypt readLayer
+	if aesGCM != nil {
+		decrypt = decryptLayer(aesGCM)
+	}
+	payload, flateReader, err := newIndexPayloadReader(block, decrypt)
+	if err != nil {
+		return err
+	}
+	defer flateReader.Close()
+
+	decoder := json.NewDecoder(payload)
+	for count := 1; ; count++ {
+		var entry IndexedEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("读取中央索引失败（第 %d 个条目）: %v", count, err)
+		}
+		if len(entry.RelPath) > int(options.Limits.maxPathLen()) {
+			return fmt.Errorf("路径长度异常 (%d 字节)，中央索引可能已损坏", len(entry.RelPath))
+		}
+		if entry.Offset < 0 {
+			return fmt.Errorf("条目偏移异常 (%s: %d)，中央索引可能已损坏", entry.RelPath, entry.Offset)
+		}
+		if err := fn(entry); err == errStopWalk {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadCentralIndex 读取归档末尾的中央索引，返回全部条目的元信息和它们在条目数据流中的偏移
+// 只读取文件头、尾部和索引块，不需要读取条目数据；http(s):// 地址需要服务器支持 Range 请求
+// 归档没有中央索引时返回 ErrNoCentralIndex；条目很多时使用 WalkCentralIndex，不必在内存中保留全部条目
+func ReadCentralIndex(archivePath string, options PackOptions) ([]IndexedEntry, error) {
+	var entries []IndexedEntry
+	err := WalkCentralIndex(archivePath, options, func(entry IndexedEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// WalkCentralIndex 与 ReadCentralIndex 相同，但逐个条目调用 fn，fn 返回错误时停止遍历并返回该错误
+func WalkCentralIndex(archivePath string, options PackOptions, fn func(entry IndexedEntry) error) error {
+	var source io.ReadCloser
+	if IsURL(archivePath) {
+		hr, err := openURL(archivePath)
+		if err != nil {
+			return err
+		}
+		source = hr
+	} else {
+		inFile, err := os.Open(archivePath)
+		if err != nil {
+			return fmt.Errorf("打开归档文件失败: %v", err)
+		}
+		source = inFile
+	}
+	defer source.Close()
+
+	version, flags, _, err := readHeaderWithFlags(source)
+	if err != nil {
+		return fmt.Errorf("读取文件头失败: %w", err)
+	}
+	if flags&flagCentralIndex == 0 {
+		return ErrNoCentralIndex
+	}
+	var aesGCM cipher.AEAD
+	if flags&flagEncrypt != 0 {
+		// 先用文件头之后的密码校验值检查密码，密码错误时给出明确的错误；索引块与条目数据流使用同一密钥
+		if aesGCM, _, err = openDecryption(source, version, options); err != nil {
+			return err
+		}
+	}
+	at, size, err := sourceReaderAt(source)
+	if err != nil {
+		return err
+	}
+	trailer, err := readCentralTrailer(at, size)
+	if err != nil {
+		return err
+	}
+	return walkCentralEntries(at, trailer, aesGCM, options, fn)
+}
+
+// OpenEntry 打开归档中路径为 relPath 的条目，返回定位在该条目上的读取器：
+// 从读取器读到的是该条目的内容，之后还可以继续调用 Next 读取后面的条目
+// 本地归档带有中央索引、且没有压缩和流校验时直接定位到条目（加密归档从条目所在的密文块开始解密），
+// 不需要读取前面的数据；其他情况（包括需要校验整个归档的 SHA-256 时）顺序读取到该条目
+// relPath 必须与归档中的路径完全一致（目录以 "/" 结尾）
+func OpenEntry(archivePath string, relPath string, options PackOptions) (*ArchiveReader, *FileEntry, error) {
+	if !IsURL(archivePath) && options.SHA256 == "" {
+		ar, entry, err := seekEntry(archivePath, relPath, options)
+		if err != errNotSeekable {
+			return ar, entry, err
+		}
+	}
+
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			ar.Close()
+			return nil, nil, fmt.Errorf("归档中没有该条目: %s", relPath)
+		}
+		if err != nil {
+			ar.Close()
+			return nil, nil, err
+		}
+		if entry.RelPath == relPath {
+			return ar, entry, nil
+		}
+	}
+}
+
+// seekEntry 按中央索引直接定位到条目，归档不支持时返回 errNotSeekable
+func seekEntry(archivePath string, relPath string, options PackOptions) (ar *ArchiveReader, fileEntry *FileEntry, err error) {
+	inFile, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开归档文件失败: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			inFile.Close()
+		}
+	}()
+	info, err := inFile.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取归档文件信息失败: %v", err)
+	}
+
+	version, flags, level, err := readHeaderWithFlags(inFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取文件头失败: %w", err)
+	}
+	if flags&flagCentralIndex == 0 {
+		return nil, nil, errNotSeekable
+	}
+	if flags&(flagCompress|flagStreamHash) != 0 {
+		warn(options, "%s", warnNotSeekable)
+		return nil, nil, errNotSeekable
+	}
+	chunks, err := openChunkStore(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	options.chunkStore = chunks
+	var aesGCM cipher.AEAD
+	var nonce []byte
+	if flags&flagEncrypt != 0 {
+		if aesGCM, nonce, err = openDecryption(inFile, version, options); err != nil {
+			return nil, nil, err
+		}
+	}
+	trailer, err := readCentralTrailer(inFile, info.Size())
+	if err != nil {
+		return nil, nil, err
+	}
+	offset := int64(-1)
+	err = walkCentralEntries(inFile, trailer, aesGCM, options, func(entry IndexedEntry) error {
+		if entry.RelPath != relPath {
+			return nil
+		}
+		offset = entry.Offset
+		return errStopWalk
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset < 0 {
+		return nil, nil, fmt.Errorf("归档中没有该条目: %s", relPath)
+	}
+
+	var finalReader io.Reader
+	if flags&flagEncrypt != 0 {
+		// 文件头之后是初始 nonce、派生参数和密码校验值，然后是等长的密文块：nonce + 64KB 明文的密文 + 认证标签
+		first := headerSize + int64(len(nonce)) + passwordPreambleSize(version)
+		chunkSize := int64(aesGCM.NonceSize() + encryptChunkSize + aesGCM.Overhead())
+		start := first + offset/encryptChunkSize*chunkSize
+		if start > trailer.indexOffset {
+			return nil, nil, fmt.Errorf("条目偏移异常 (%s: %d)，中央索引可能已损坏", relPath, offset)
+		}
+		finalReader = &decryptReader{
+			reader: io.NewSectionReader(inFile, start, trailer.indexOffset-start),
+			gcm:    aesGCM,
+			nonce:  nonce,
+		}
+		if _, err := io.CopyN(io.Discard, finalReader, offset%encryptChunkSize); err != nil {
+			return nil, nil, fmt.Errorf("定位条目失败 (%s): %v", relPath, err)
+		}
+	} else {
+		start := headerSize + offset
+		finalReader = io.NewSectionReader(inFile, start, trailer.indexOffset-start)
+	}
+
+	entryKey, err := readEntryKey(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	ar = &ArchiveReader{
+		file:     inFile,
+		reader:   bufio.NewReaderSize(finalReader, bufferSize(options)),
+		version:  version,
+		flags:    flags,
+		level:    level,
+		limits:   limitCounter{limits: options.Limits},
+		entryKey: entryKey,
+		chunks:   chunks,
+	}
+	entry, err := ar.next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取条目失败 (%s): %v", relPath, err)
+	}
+	if entry.RelPath != relPath {
+		return nil, nil, fmt.Errorf("中央索引与条目数据不一致（期望 %s，实际 %s），归档可能已损坏", relPath, entry.RelPath)
+	}
+	found := entry.fileEntry()
+	return ar, &found, nil
+}
@@ -0,0 +1,269 @@
+package backup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// 块加密：加密的块存储（快照仓库 init-repo -encryption）中每个块单独加密，文件内容为
+//
+//	nonce(12) + AES-256-GCM(zstd 压缩后的块)，附加数据为块 ID
+//
+// 仓库的主密钥是随机生成的 32 字节，用由仓库密码派生的密钥以 AES-GCM 加密后保存在 repo.json 中，
+// 各用途的子密钥为 HMAC-SHA256(主密钥, 用途标签)。包装密钥由 scrypt 从密码派生，每个仓库的盐随机生成，
+// 盐和代价参数与密钥派生方式的版本号一起记录在 repo.json 中（RepositoryKDF）。以后更换派生方式或提高代价时增加版本号，
+// 旧仓库按记录的版本和参数照常打开。
+//
+// 使用加密块存储的归档（快照）不直接由密码派生密钥：每个归档随机生成盐，密钥为 HMAC-SHA256(快照子密钥, 盐)，
+// 派生方式记为 kdfRepository（见 password.go 中归档的派生参数）。读取时先用仓库密码解开 repo.json 中的主密钥。
+// 两种块加密方式可以按仓库选择：
+//
+//   - random：块 ID 是随机数，用数据密钥和随机 nonce 加密。同样的数据每次都保存为新的块，不去重；
+//     块存储中看不出哪些数据相同，快照之间也看不出有多少数据没有变化。
+//   - convergent（收敛加密）：块 ID 为 HMAC-SHA256(ID 密钥, 明文)，每个块的密钥由块 ID 和仓库密钥派生
+//     （即由明文的摘要和仓库秘密决定），nonce 固定为 0。同样的数据总是得到同样的块 ID 和密文，去重照常有效；
+//     代价是块 ID 暴露了哪些数据相同，知道仓库密码的人可以确认仓库中是否有某个已知的文件。
+//
+// 块 ID 作为附加数据参与认证，块文件被改名或调换时解密失败；收敛加密的块解密后还核对 HMAC。
+
+// 块加密方式
+const (
+	ChunkEncryptionRandom     = "random"
+	ChunkEncryptionConvergent = "convergent"
+)
+
+// ErrChunkStoreLocked 使用加密的块存储时没有提供仓库密码
+var ErrChunkStoreLocked = errors.New("块存储已加密，需要提供仓库密码")
+
+// chunkKeyLabel 包装主密钥时的附加数据前缀（之后是加密方式，防止被改为另一种方式）
+const chunkKeyLabel = "BKUP repository key "
+
+// 密钥派生方式的版本：1 为 scrypt；2 只用于归档，密钥由仓库主密钥和盐派生（没有代价参数）
+const (
+	kdfScrypt     = 1
+	kdfRepository = 2
+)
+
+// 新仓库的 scrypt 参数（N=2^15, r=8：约 32MB 内存，普通机器上约 0.1 秒）
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 16
+)
+
+// 打开仓库或归档时接受的 scrypt 代价上限：内存（128·N·r 字节）和计算量（N·r·p，默认参数的 128 倍），
+// 防止被改动的 repo.json 或归档耗尽内存、长时间占用 CPU
+const (
+	maxScryptMemory = 1 << 30
+	maxScryptWork   = scryptN * scryptR * scryptP * 128
+)
+
+// RepositoryKDF 由仓库密码派生包装密钥的方式和参数
+type RepositoryKDF struct {
+	Version int    `json:"version"` // 派生方式的版本（kdfScrypt）
+	Salt    []byte `json:"salt"`    // 每个仓库随机生成的盐
+	N       int    `json:"n"`       // scrypt 的 CPU/内存代价（2 的幂）
+	R       int    `json:"r"`       // scrypt 的块大小
+	P       int    `json:"p"`       // scrypt 的并行度
+}
+
+// chunkCipher 加密块存储使用的密钥
+type chunkCipher struct {
+	mode   string
+	data   cipher.AEAD // random：加密块的数据密钥
+	idKey  []byte      // convergent：计算块 ID
+	keyKey []byte      // convergent：由块 ID 派生每个块的密钥
+
+	snapshotKey []byte // 由盐派生使用该块存储的归档的密钥
+}
+
+// newChunkMasterKey 生成新的主密钥和密钥派生参数，返回仓库的块加密设置（主密钥为用密码包装后的形式：nonce + 密文）
+func newChunkMasterKey(mode, password string) (*RepositoryEncryption, error) {
+	master := make([]byte, 32)
+	if _, err := rand.Read(master); err != nil {
+		return nil, fmt.Errorf("生成随机数失败: %v", err)
+	}
+	kdf, err := newScryptKDF()
+	if err != nil {
+		return nil, err
+	}
+	key, err := passwordKey(kdf, password)
+	if err != nil {
+		return nil, err
+	}
+	wrap, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, wrap.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("生成随机数失败: %v", err)
+	}
+	return &RepositoryEncryption{Mode: mode, KDF: kdf, Key: wrap.Seal(nonce, nonce, master, []byte(chunkKeyLabel+mode))}, nil
+}
+
+// openChunkCipher 用密码解开包装的主密钥，生成块加密的子密钥
+func openChunkCipher(encryption *RepositoryEncryption, password string) (*chunkCipher, error) {
+	mode, wrapped := encryption.Mode, encryption.Key
+	if mode != ChunkEncryptionRandom && mode != ChunkEncryptionConvergent {
+		return nil, fmt.Errorf("不支持的块加密方式: %s", mode)
+	}
+	key, err := passwordKey(encryption.KDF, password)
+	if err != nil {
+		return nil, err
+	}
+	wrap, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < wrap.NonceSize() {
+		return nil, fmt.Errorf("仓库密钥已损坏")
+	}
+	master, err := wrap.Open(nil, wrapped[:wrap.NonceSize()], wrapped[wrap.NonceSize():], []byte(chunkKeyLabel+mode))
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+	data, err := newGCM(subKey(master, "chunk data"))
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCipher{
+		mode:   mode,
+		data:   data,
+		idKey:  subKey(master, "chunk id"),
+		keyKey: subKey(master, "chunk key"),
+
+		snapshotKey: subKey(master, "snapshot"),
+	}, nil
+}
+
+// newScryptKDF 生成新仓库或新归档的密钥派生参数（随机盐）
+func newScryptKDF() (*RepositoryKDF, error) {
+	kdf := &RepositoryKDF{Version: kdfScrypt, Salt: make([]byte, scryptSaltLen), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := rand.Read(kdf.Salt); err != nil {
+		return nil, fmt.Errorf("生成随机数失败: %v", err)
+	}
+	return kdf, nil
+}
+
+// passwordKey 按记录的派生方式和参数由密码生成密钥：仓库的包装密钥，以及 versionKDF 起加密归档的密钥
+// 参数来自 repo.json 或归档，超出上限时拒绝，防止被改动的文件耗尽内存
+func passwordKey(kdf *RepositoryKDF, password string) ([]byte, error) {
+	if kdf == nil {
+		return nil, fmt.Errorf("仓库配置中没有密钥派生参数，需要更新版本的程序或重新创建仓库")
+	}
+	if kdf.Version != kdfScrypt {
+		return nil, fmt.Errorf("不支持的密钥派生方式版本 %d，需要更新版本的程序", kdf.Version)
+	}
+	if kdf.N < 2 || kdf.N&(kdf.N-1) != 0 || kdf.R < 1 || kdf.P < 1 || kdf.R*kdf.P >= 1<<30 ||
+		int64(128)*int64(kdf.N)*int64(kdf.R) > maxScryptMemory ||
+		int64(kdf.N)*int64(kdf.R)*int64(kdf.P) > maxScryptWork || len(kdf.Salt) < scryptSaltLen {
+		return nil, fmt.Errorf("密钥派生参数无效（N=%d, r=%d, p=%d, 盐 %d 字节）", kdf.N, kdf.R, kdf.P, len(kdf.Salt))
+	}
+	key, err := scrypt.Key([]byte(password), kdf.Salt, kdf.N, kdf.R, kdf.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("派生密钥失败: %v", err)
+	}
+	return key, nil
+}
+
+// subKey 由主密钥派生一个用途的子密钥
+func subKey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// newGCM 创建 AES-256-GCM
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("创建加密器失败: %v", err)
+	}
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("创建GCM失败: %v", err)
+	}
+	return aesGCM, nil
+}
+
+// archiveKey 返回使用该块存储的归档的密钥（kdfRepository），salt 为归档随机生成的盐
+func (c *chunkCipher) archiveKey(salt []byte) []byte {
+	mac := hmac.New(sha256.New, c.snapshotKey)
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+// chunkID 返回块的 ID：random 为随机数，convergent 为明文的 HMAC
+func (c *chunkCipher) chunkID(data []byte) ([sha256.Size]byte, error) {
+	var id [sha256.Size]byte
+	if c.mode == ChunkEncryptionRandom {
+		if _, err := rand.Read(id[:]); err != nil {
+			return id, fmt.Errorf("生成随机数失败: %v", err)
+		}
+		return id, nil
+	}
+	mac := hmac.New(sha256.New, c.idKey)
+	mac.Write(data)
+	copy(id[:], mac.Sum(nil))
+	return id, nil
+}
+
+// aead 返回加密块 id 使用的 AEAD：convergent 为由块 ID 派生的密钥
+func (c *chunkCipher) aead(id [sha256.Size]byte) (cipher.AEAD, error) {
+	if c.mode == ChunkEncryptionRandom {
+		return c.data, nil
+	}
+	mac := hmac.New(sha256.New, c.keyKey)
+	mac.Write(id[:])
+	return newGCM(mac.Sum(nil))
+}
+
+// seal 加密压缩后的块
+func (c *chunkCipher) seal(id [sha256.Size]byte, compressed []byte) ([]byte, error) {
+	aead, err := c.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if c.mode == ChunkEncryptionRandom {
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("生成随机数失败: %v", err)
+		}
+	}
+	return aead.Seal(nonce, nonce, compressed, id[:]), nil
+}
+
+// open 解密块文件，返回压缩后的块
+func (c *chunkCipher) open(id [sha256.Size]byte, sealed []byte) ([]byte, error) {
+	aead, err := c.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("块 %x 已损坏: 长度不足", id)
+	}
+	compressed, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], id[:])
+	if err != nil {
+		return nil, fmt.Errorf("块 %x 解密失败，块存储可能已损坏或密码错误", id)
+	}
+	return compressed, nil
+}
+
+// matches 解密后的明文是否与块 ID 相符（random 的块 ID 与内容无关，由 GCM 认证保证完整）
+func (c *chunkCipher) matches(id [sha256.Size]byte, data []byte) bool {
+	if c.mode == ChunkEncryptionRandom {
+		return true
+	}
+	mac := hmac.New(sha256.New, c.idKey)
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), id[:])
+}
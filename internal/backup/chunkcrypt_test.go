@@ -0,0 +1,197 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newTestChunkCipher 创建指定加密方式的主密钥并用同一密码解开
+func newTestChunkCipher(t *testing.T, mode string) (*RepositoryEncryption, *chunkCipher) {
+	t.Helper()
+	encryption, err := newChunkMasterKey(mode, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := openChunkCipher(encryption, "secret")
+	if err != nil {
+		t.Fatalf("解开主密钥失败: %v", err)
+	}
+	return encryption, c
+}
+
+// TestChunkCipherRoundTrip 两种块加密方式加密后能解密，块 ID 与内容的关系符合各自的定义
+func TestChunkCipherRoundTrip(t *testing.T) {
+	tests := []struct {
+		mode          string
+		deterministic bool // 同样的数据是否得到同样的块 ID 和密文
+	}{
+		{ChunkEncryptionRandom, false},
+		{ChunkEncryptionConvergent, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			_, c := newTestChunkCipher(t, tt.mode)
+			data := []byte("chunk content")
+
+			id1, err := c.chunkID(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id2, err := c.chunkID(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (id1 == id2) != tt.deterministic {
+				t.Errorf("同样数据的块 ID 相同: %v，期望 %v", id1 == id2, tt.deterministic)
+			}
+			if id1 == sha256.Sum256(data) {
+				t.Error("块 ID 等于明文的 SHA-256")
+			}
+
+			sealed1, err := c.seal(id1, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sealed2, err := c.seal(id1, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(sealed1, sealed2) != tt.deterministic {
+				t.Errorf("同样数据的密文相同: %v，期望 %v", bytes.Equal(sealed1, sealed2), tt.deterministic)
+			}
+			if bytes.Contains(sealed1, data) {
+				t.Error("密文中包含明文")
+			}
+			opened, err := c.open(id1, sealed1)
+			if err != nil {
+				t.Fatalf("解密失败: %v", err)
+			}
+			if !bytes.Equal(opened, data) {
+				t.Errorf("解密结果为 %q", opened)
+			}
+			if !c.matches(id1, data) {
+				t.Error("块 ID 与内容不符")
+			}
+		})
+	}
+}
+
+// TestChunkCipherWrongPassword 密码错误或加密方式被改动时不能解开主密钥
+func TestChunkCipherWrongPassword(t *testing.T) {
+	encryption, _ := newTestChunkCipher(t, ChunkEncryptionConvergent)
+	tests := []struct {
+		name     string
+		password string
+		mode     string
+		want     error
+	}{
+		{"错误的密码", "wrong", ChunkEncryptionConvergent, ErrWrongPassword},
+		{"空密码", "", ChunkEncryptionConvergent, ErrWrongPassword},
+		{"改为另一种加密方式", "secret", ChunkEncryptionRandom, ErrWrongPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := *encryption
+			changed.Mode = tt.mode
+			if _, err := openChunkCipher(&changed, tt.password); !errors.Is(err, tt.want) {
+				t.Errorf("错误为 %v，期望 %v", err, tt.want)
+			}
+		})
+	}
+
+	changed := *encryption
+	changed.Mode = "none"
+	if _, err := openChunkCipher(&changed, "secret"); err == nil || !strings.Contains(err.Error(), "不支持的块加密方式") {
+		t.Errorf("未知的加密方式: %v", err)
+	}
+}
+
+// TestChunkCipherTampered 块的密文、块 ID（附加数据）或长度被改动时解密失败
+func TestChunkCipherTampered(t *testing.T) {
+	for _, mode := range []string{ChunkEncryptionRandom, ChunkEncryptionConvergent} {
+		_, c := newTestChunkCipher(t, mode)
+		data := []byte("chunk content")
+		id, err := c.chunkID(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := c.seal(id, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherID, err := c.chunkID([]byte("other chunk"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name   string
+			id     [sha256.Size]byte
+			sealed func() []byte
+		}{
+			{"块 ID 不符", otherID, func() []byte { return sealed }},
+			{"密文被改动", id, func() []byte {
+				b := bytes.Clone(sealed)
+				b[len(b)-1] ^= 1
+				return b
+			}},
+			{"nonce 被改动", id, func() []byte {
+				b := bytes.Clone(sealed)
+				b[0] ^= 1
+				return b
+			}},
+			{"截断", id, func() []byte { return sealed[:len(sealed)-1] }},
+			{"短于 nonce", id, func() []byte { return sealed[:4] }},
+		}
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				if _, err := c.open(tt.id, tt.sealed()); err == nil {
+					t.Error("被改动的块解密成功")
+				}
+			})
+		}
+
+		if mode == ChunkEncryptionConvergent && c.matches(id, []byte("other chunk")) {
+			t.Error("收敛加密的块 ID 与不同的内容相符")
+		}
+	}
+}
+
+// TestPasswordKeyLimits 密钥派生参数来自不可信的文件，超出上限或无效时在计算 scrypt 之前拒绝
+func TestPasswordKeyLimits(t *testing.T) {
+	salt := make([]byte, scryptSaltLen)
+	tests := []struct {
+		name string
+		kdf  *RepositoryKDF
+		ok   bool
+	}{
+		{"有效的参数", &RepositoryKDF{Version: kdfScrypt, Salt: salt, N: 1 << 10, R: 8, P: 1}, true},
+		{"没有参数", nil, false},
+		{"未知的版本", &RepositoryKDF{Version: kdfRepository, Salt: salt, N: 1 << 10, R: 8, P: 1}, false},
+		{"N 不是 2 的幂", &RepositoryKDF{Version: kdfScrypt, Salt: salt, N: 1000, R: 8, P: 1}, false},
+		{"N 太小", &RepositoryKDF{Version: kdfScrypt, Salt: salt, N: 1, R: 8, P: 1}, false},
+		{"r 为 0", &RepositoryKDF{Version: kdfScrypt, Salt: salt, N: 1 << 10, R: 0, P: 1}, false},
+		{"p 为 0", &RepositoryKDF{Version: kdfScrypt, Salt: salt, N: 1 << 10, R: 8, P: 0}, false},
+		{"内存超过上限", &RepositoryKDF{Version: kdfScrypt, Salt: salt, N: 1 << 21, R: 8, P: 1}, false},
+		{"计算量超过上限", &RepositoryKDF{Version: kdfScrypt, Salt: salt, N: scryptN, R: scryptR, P: 129}, false},
+		{"r·p 溢出", &RepositoryKDF{Version: kdfScrypt, Salt: salt, N: 2, R: 1 << 15, P: 1 << 15}, false},
+		{"盐太短", &RepositoryKDF{Version: kdfScrypt, Salt: salt[:scryptSaltLen-1], N: 1 << 10, R: 8, P: 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := passwordKey(tt.kdf, "secret")
+			if tt.ok {
+				if err != nil || len(key) != 32 {
+					t.Fatalf("派生失败: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("无效的参数被接受")
+			}
+		})
+	}
+}
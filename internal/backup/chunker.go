@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"io"
+)
+
+// 内容定义分块（content-defined chunking）：按内容而不是固定偏移切分文件，
+// 在文件中间插入或删除数据时只有附近的块改变，其余块与之前的版本相同，可以在块存储中去重。
+// 使用 FastCDC 的 gear 滚动哈希：每个字节更新一次哈希（移位加查表），哈希的高位满足掩码时切分；
+// 块长度达到平均值之前使用更严格的掩码、之后使用更宽松的掩码，使块长度集中在平均值附近。
+// 切分点只由数据决定，同样的数据总是得到同样的块。
+
+const (
+	chunkMinSize = 256 * 1024      // 块的最小长度（前 chunkMinSize 字节内不切分）
+	chunkAvgSize = 1024 * 1024     // 块的平均长度
+	chunkMaxSize = 4 * 1024 * 1024 // 块的最大长度（到达时强制切分）
+
+	chunkMaskStrict = uint64(0xFFFFFC0000000000) // 块长度小于平均值时的掩码：最高 22 位（比平均值多 2 位）
+	chunkMaskLoose  = uint64(0xFFFFC00000000000) // 块长度超过平均值后的掩码：最高 18 位（比平均值少 2 位）
+)
+
+// gearTable gear 哈希每个字节值对应的随机数（由固定种子生成，改变它会改变所有切分点）
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x626b7570636463) // "bkupcdc"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunkBoundary 返回 data 中第一个块的长度（data 不足 chunkMaxSize 字节时表示数据已经结束）
+func chunkBoundary(data []byte) int {
+	n := len(data)
+	if n <= chunkMinSize {
+		return n
+	}
+	if n > chunkMaxSize {
+		n = chunkMaxSize
+	}
+	normal := chunkAvgSize
+	if normal > n {
+		normal = n
+	}
+	var hash uint64
+	i := chunkMinSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMaskStrict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMaskLoose == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunker 从数据流中依次切分出块
+type chunker struct {
+	reader io.Reader
+	buffer []byte // 容量为 2 * chunkMaxSize，未切分的数据为 buffer[start:end]
+	start  int
+	end    int
+	eof    bool
+}
+
+// newChunker 创建分块器
+func newChunker(r io.Reader) *chunker {
+	return &chunker{reader: r, buffer: make([]byte, 2*chunkMaxSize)}
+}
+
+// next 返回下一个块，数据结束时返回 io.EOF
+// 返回的切片在下一次调用 next 之前有效
+func (c *chunker) next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := chunkBoundary(c.buffer[c.start:c.end])
+	chunk := c.buffer[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill 读取数据，直到缓冲区中至少有 chunkMaxSize 字节或数据结束
+func (c *chunker) fill() error {
+	if c.eof || c.end-c.start >= chunkMaxSize {
+		return nil
+	}
+	if c.start+chunkMaxSize > len(c.buffer) {
+		c.end = copy(c.buffer, c.buffer[c.start:c.end])
+		c.start = 0
+	}
+	for c.end-c.start < chunkMaxSize {
+		n, err := c.reader.Read(c.buffer[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 块存储去重：较大的普通文件按内容切分为块（chunker.go），每个块以明文的 SHA-256 命名、zstd 压缩后
+// 保存在块存储目录中，同样的数据（不同文件之间、多次备份之间）只保存一次。
+// 归档中这样的条目不包含文件内容，而是块列表：每个块 32 字节 SHA-256 + 4 字节长度（uint32），
+// 条目的大小字段为块列表的长度，明文大小记录在必需的 tlvChunked 元数据中（旧版本程序会报错，而不是把块列表当作内容还原）。
+// 内容之后的 SHA-256 校验的是块列表；读取时每个块解压后都校验其 SHA-256 和长度。
+//
+// 块存储目录的布局：chunks/<SHA-256 前两个十六进制字符>/<SHA-256>。
+// 块先写入同一目录中的临时文件再重命名，写入同一个块是幂等的，多个打包进程可以同时使用同一个块存储。
+// 块存储中的数据默认不加密，不能与整体加密（-password）同时使用；单独加密的条目不切分块。
+// 快照仓库可以在创建时选择加密块（chunkcrypt.go），这时块 ID 不再是明文的 SHA-256，使用它的归档也必须整体加密，
+// 归档的密钥由仓库的主密钥派生，读取时需要同一个块存储和仓库密码。
+
+// tlvChunked 条目内容保存在块存储中：值为明文大小（uint64），内容为块列表
+const tlvChunked = uint16(5) | tlvCritical
+
+// chunkRefSize 块列表中每个块的长度：SHA-256 + uint32 长度
+const chunkRefSize = sha256.Size + 4
+
+// ErrNoChunkStore 读取内容保存在块存储中的条目时没有指定块存储
+var ErrNoChunkStore = errors.New("条目的内容保存在块存储中，需要指定块存储")
+
+// ChunkStore 保存去重数据块的目录
+type ChunkStore struct {
+	dir     string
+	mu      sync.Mutex
+	known   map[[sha256.Size]byte]bool // 块索引：已经存在的块（第一次写入时由目录内容建立）
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	cipher  *chunkCipher // 加密的块存储的密钥（unlock 之后），nil 表示块不加密
+}
+
+// DedupStats 块存储去重的统计（写入摘要文件）
+type DedupStats struct {
+	Files       int   `json:"files"`        // 切分为块的文件数
+	Chunks      int   `json:"chunks"`       // 这些文件引用的块数
+	NewChunks   int   `json:"new_chunks"`   // 新写入块存储的块数
+	Bytes       int64 `json:"bytes"`        // 这些文件的内容总字节数
+	NewBytes    int64 `json:"new_bytes"`    // 新写入的块的明文字节数
+	StoredBytes int64 `json:"stored_bytes"` // 新写入的块压缩后占用的字节数
+}
+
+// OpenChunkStore 打开块存储目录；create 为 true 时目录不存在则创建（打包），否则目录必须存在（读取）
+func OpenChunkStore(dir string, create bool) (*ChunkStore, error) {
+	chunksDir := filepath.Join(dir, "chunks")
+	if create {
+		if err := os.MkdirAll(chunksDir, 0755); err != nil {
+			return nil, fmt.Errorf("创建块存储目录失败: %v", err)
+		}
+	} else if info, err := os.Stat(chunksDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s 不是块存储目录（没有 chunks 子目录）", dir)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(2*chunkMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkStore{dir: dir, encoder: encoder, decoder: decoder}, nil
+}
+
+// openChunkStore 按选项打开块存储（用于读取），未指定时返回 nil；加密的块存储用 options.Password 解锁
+func openChunkStore(options PackOptions) (*ChunkStore, error) {
+	if options.chunkStore != nil {
+		return options.chunkStore, nil
+	}
+	if options.ChunkStore == "" {
+		return nil, nil
+	}
+	store, err := OpenChunkStore(options.ChunkStore, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.unlock(options.Password); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// unlock 块存储属于加密的仓库时，用仓库密码生成块加密的密钥
+func (s *ChunkStore) unlock(password string) error {
+	if s.cipher != nil {
+		return nil
+	}
+	encryption, err := readRepositoryEncryption(s.dir)
+	if err != nil || encryption == nil {
+		return err
+	}
+	if password == "" {
+		return ErrChunkStoreLocked
+	}
+	s.cipher, err = openChunkCipher(encryption, password)
+	if err == ErrWrongPassword {
+		return fmt.Errorf("仓库密码错误")
+	}
+	return err
+}
+
+// chunkID 返回块的 ID：不加密时为明文的 SHA-256
+func (s *ChunkStore) chunkID(data []byte) ([sha256.Size]byte, error) {
+	if s.cipher != nil {
+		return s.cipher.chunkID(data)
+	}
+	return sha256.Sum256(data), nil
+}
+
+// chunkPath 返回块的文件路径
+func (s *ChunkStore) chunkPath(id [sha256.Size]byte) string {
+	name := hex.EncodeToString(id[:])
+	return filepath.Join(s.dir, "chunks", name[:2], name)
+}
+
+// loadIndex 由目录内容建立块索引
+func (s *ChunkStore) loadIndex() error {
+	s.known = make(map[[sha256.Size]byte]bool)
+	prefixes, err := os.ReadDir(filepath.Join(s.dir, "chunks"))
+	if err != nil {
+		return fmt.Errorf("读取块存储目录失败: %v", err)
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() {
+			continue
+		}
+		names, err := os.ReadDir(filepath.Join(s.dir, "chunks", prefix.Name()))
+		if err != nil {
+			return fmt.Errorf("读取块存储目录失败: %v", err)
+		}
+		for _, name := range names {
+			var id [sha256.Size]byte
+			if n, err := hex.Decode(id[:], []byte(name.Name())); err == nil && n == len(id) {
+				s.known[id] = true
+			}
+		}
+	}
+	return nil
+}
+
+// put 保存一个块（已经存在时不重复写入）
+// 返回: 是否新写入，以及新写入时压缩后的字节数
+func (s *ChunkStore) put(id [sha256.Size]byte, data []byte) (bool, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.known == nil {
+		if err := s.loadIndex(); err != nil {
+			return false, 0, err
+		}
+	}
+	if s.known[id] {
+		return false, 0, nil
+	}
+	path := s.chunkPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, 0, fmt.Errorf("创建块存储目录失败: %v", err)
+	}
+	compressed := s.encoder.EncodeAll(data, nil)
+	if s.cipher != nil {
+		sealed, err := s.cipher.seal(id, compressed)
+		if err != nil {
+			return false, 0, err
+		}
+		compressed = sealed
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".chunk-*")
+	if err != nil {
+		return false, 0, fmt.Errorf("写入块失败: %v", err)
+	}
+	_, err = tmp.Write(compressed)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return false, 0, fmt.Errorf("写入块失败: %v", err)
+	}
+	s.known[id] = true
+	return true, int64(len(compressed)), nil
+}
+
+// get 读取一个块，校验其长度和 SHA-256（加密的块存储解密后核对块 ID）
+func (s *ChunkStore) get(id [sha256.Size]byte, size int) ([]byte, error) {
+	compressed, err := os.ReadFile(s.chunkPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("块存储中缺少块 %x", id)
+		}
+		return nil, fmt.Errorf("读取块失败: %v", err)
+	}
+	if s.cipher != nil {
+		if compressed, err = s.cipher.open(id, compressed); err != nil {
+			return nil, err
+		}
+	}
+	data, err := s.decoder.DecodeAll(compressed, make([]byte, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("块 %x 已损坏: %v", id, err)
+	}
+	if len(data) != size || !s.matches(id, data) {
+		return nil, fmt.Errorf("块 %x 的内容与摘要不符，块存储可能已损坏", id)
+	}
+	return data, nil
+}
+
+// matches 块的内容是否与块 ID 相符
+func (s *ChunkStore) matches(id [sha256.Size]byte, data []byte) bool {
+	if s.cipher != nil {
+		return s.cipher.matches(id, data)
+	}
+	return sha256.Sum256(data) == id
+}
+
+// storeChunks 把数据流切分为块写入块存储（去重写入），返回块列表
+// size: 数据流的长度，实际读取的数据不足时报错
+func (s *ChunkStore) storeChunks(r io.Reader, size int64, stats *DedupStats) ([]byte, error) {
+	recipe := make([]byte, 0, (size/chunkAvgSize+1)*chunkRefSize)
+	c := newChunker(io.LimitReader(r, size))
+	var total int64
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := s.chunkID(chunk)
+		if err != nil {
+			return nil, err
+		}
+		added, stored, err := s.put(id, chunk)
+		if err != nil {
+			return nil, err
+		}
+		recipe = append(recipe, id[:]...)
+		recipe = binary.LittleEndian.AppendUint32(recipe, uint32(len(chunk)))
+		total += int64(len(chunk))
+		stats.Chunks++
+		if added {
+			stats.NewChunks++
+			stats.NewBytes += int64(len(chunk))
+			stats.StoredBytes += stored
+		}
+	}
+	if total != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	stats.Files++
+	stats.Bytes += size
+	return recipe, nil
+}
+
+// chunkedEntry 条目的内容是否切分为块保存在块存储中
+func chunkedEntry(entry FileEntry, options PackOptions) bool {
+	return options.chunkStore != nil && entry.Type == TypeFile && entry.Size >= chunkMinSize &&
+		!(entry.Encrypt && options.entryCipher != nil)
+}
+
+// applyChunkStore 打包时打开块存储：不加密的块存储不能与整体加密同时使用，加密的块存储只能用于整体加密的归档
+func applyChunkStore(options PackOptions) (PackOptions, error) {
+	if options.ChunkStore == "" {
+		return options, nil
+	}
+	if options.chunkStore == nil {
+		store, err := OpenChunkStore(options.ChunkStore, true)
+		if err != nil {
+			return options, err
+		}
+		options.chunkStore = store
+	}
+	if options.Encrypt {
+		if err := options.chunkStore.unlock(options.Password); err != nil {
+			return options, err
+		}
+	} else if encryption, err := readRepositoryEncryption(options.ChunkStore); err != nil {
+		return options, err
+	} else if encryption != nil {
+		return options, fmt.Errorf("块存储已加密，使用它的归档也必须加密（同时指定 -encrypt 和仓库密码）")
+	}
+	if options.Encrypt && options.chunkStore.cipher == nil {
+		return options, fmt.Errorf("块存储中的数据不加密，不能与整体加密同时使用")
+	}
+	options.dedupStats = &DedupStats{}
+	return options, nil
+}
+
+// chunkReader 按块列表从块存储中读取条目的内容（还原）
+type chunkReader struct {
+	recipe    io.Reader // 归档中的块列表
+	store     *ChunkStore
+	remaining int64  // 尚未读取的明文字节数
+	chunk     []byte // 当前块未读取的部分
+}
+
+// newChunkReader 创建按块列表读取内容的读取器，size 为明文大小
+func newChunkReader(recipe io.Reader, store *ChunkStore, size int64) *chunkReader {
+	return &chunkReader{recipe: recipe, store: store, remaining: size}
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.chunk) == 0 {
+		var ref [chunkRefSize]byte
+		if _, err := io.ReadFull(cr.recipe, ref[:]); err != nil {
+			if err == io.EOF && cr.remaining == 0 {
+				return 0, io.EOF
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		var id [sha256.Size]byte
+		copy(id[:], ref[:])
+		size := int64(binary.LittleEndian.Uint32(ref[sha256.Size:]))
+		if size == 0 || size > chunkMaxSize || size > cr.remaining {
+			return 0, fmt.Errorf("块列表中的块长度异常 (%d 字节)，归档可能已损坏", size)
+		}
+		data, err := cr.store.get(id, int(size))
+		if err != nil {
+			return 0, err
+		}
+		cr.chunk = data
+		cr.remaining -= size
+	}
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
@@ -0,0 +1,214 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestChunkStore 创建块存储：encryption 不为空时先创建该加密方式的仓库，再用密码解锁
+func newTestChunkStore(t *testing.T, encryption string) *ChunkStore {
+	t.Helper()
+	dir := t.TempDir()
+	if encryption != "" {
+		if _, err := InitRepositoryWithOptions(dir, RepositoryOptions{Encryption: encryption, Password: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := OpenChunkStore(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.unlock("secret"); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// encryptionName 块加密方式在子测试名称中的写法
+func encryptionName(encryption string) string {
+	if encryption == "" {
+		return "none"
+	}
+	return encryption
+}
+
+// chunkTestData 生成可以切分为多个块的随机数据
+func chunkTestData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// recipeIDs 块列表中的块 ID 和长度
+func recipeIDs(recipe []byte) ([][sha256.Size]byte, []int) {
+	var ids [][sha256.Size]byte
+	var sizes []int
+	for len(recipe) >= chunkRefSize {
+		var id [sha256.Size]byte
+		copy(id[:], recipe)
+		ids = append(ids, id)
+		sizes = append(sizes, int(binary.LittleEndian.Uint32(recipe[sha256.Size:])))
+		recipe = recipe[chunkRefSize:]
+	}
+	return ids, sizes
+}
+
+// TestChunkStoreRoundTrip 写入块存储的内容能按块列表原样读出；random 加密不去重，其他方式去重
+func TestChunkStoreRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption string
+		dedup      bool
+	}{
+		{"不加密", "", true},
+		{"random", ChunkEncryptionRandom, false},
+		{"convergent", ChunkEncryptionConvergent, true},
+	}
+	data := chunkTestData(3 * chunkAvgSize)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestChunkStore(t, tt.encryption)
+			var stats DedupStats
+			recipe, err := store.storeChunks(bytes.NewReader(data), int64(len(data)), &stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Chunks < 2 || stats.NewChunks != stats.Chunks || stats.Bytes != int64(len(data)) {
+				t.Errorf("第一次写入的统计: %+v", stats)
+			}
+
+			// 重新打开块存储读取，不依赖写入时的块索引
+			reader, err := OpenChunkStore(store.dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := reader.unlock("secret"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(newChunkReader(bytes.NewReader(recipe), reader, int64(len(data))))
+			if err != nil {
+				t.Fatalf("读取失败: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("读出的内容与写入的不同")
+			}
+
+			var again DedupStats
+			if _, err := store.storeChunks(bytes.NewReader(data), int64(len(data)), &again); err != nil {
+				t.Fatal(err)
+			}
+			if (again.NewChunks == 0) != tt.dedup {
+				t.Errorf("再次写入同样的内容时新写入 %d 个块（共 %d 个）", again.NewChunks, again.Chunks)
+			}
+		})
+	}
+}
+
+// TestChunkStoreTampered 块文件被改动、调换、删除或长度不符时读取失败
+func TestChunkStoreTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, store *ChunkStore, ids [][sha256.Size]byte, sizes []int) int // 返回读取时使用的长度
+	}{
+		{"内容被改动", func(t *testing.T, store *ChunkStore, ids [][sha256.Size]byte, sizes []int) int {
+			path := store.chunkPath(ids[0])
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b[len(b)/2] ^= 1
+			if err := os.WriteFile(path, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+			return sizes[0]
+		}},
+		{"与另一个块调换", func(t *testing.T, store *ChunkStore, ids [][sha256.Size]byte, sizes []int) int {
+			b, err := os.ReadFile(store.chunkPath(ids[1]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(store.chunkPath(ids[0]), b, 0644); err != nil {
+				t.Fatal(err)
+			}
+			return sizes[0]
+		}},
+		{"块被删除", func(t *testing.T, store *ChunkStore, ids [][sha256.Size]byte, sizes []int) int {
+			if err := os.Remove(store.chunkPath(ids[0])); err != nil {
+				t.Fatal(err)
+			}
+			return sizes[0]
+		}},
+		{"长度不符", func(t *testing.T, store *ChunkStore, ids [][sha256.Size]byte, sizes []int) int {
+			return sizes[0] - 1
+		}},
+	}
+	data := chunkTestData(3 * chunkAvgSize)
+	for _, encryption := range []string{"", ChunkEncryptionRandom, ChunkEncryptionConvergent} {
+		for _, tt := range tests {
+			t.Run(encryptionName(encryption)+"/"+tt.name, func(t *testing.T) {
+				store := newTestChunkStore(t, encryption)
+				recipe, err := store.storeChunks(bytes.NewReader(data), int64(len(data)), &DedupStats{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids, sizes := recipeIDs(recipe)
+				if len(ids) < 2 {
+					t.Fatalf("只切分出 %d 个块", len(ids))
+				}
+				size := tt.tamper(t, store, ids, sizes)
+				if _, err := store.get(ids[0], size); err == nil {
+					t.Error("被改动的块读取成功")
+				}
+			})
+		}
+	}
+}
+
+// TestChunkStoreUnlock 加密的块存储没有密码或密码错误时不能解锁，不加密的块存储不需要密码
+func TestChunkStoreUnlock(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := InitRepositoryWithOptions(dir, RepositoryOptions{Encryption: ChunkEncryptionRandom, Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		password string
+		wantErr  string
+	}{
+		{"正确的密码", "secret", ""},
+		{"没有密码", "", ErrChunkStoreLocked.Error()},
+		{"错误的密码", "wrong", "仓库密码错误"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := openChunkStore(PackOptions{ChunkStore: dir, Password: tt.password})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("错误为 %v，期望 %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	plain := t.TempDir()
+	if _, err := InitRepository(plain); err != nil {
+		t.Fatal(err)
+	}
+	if store, err := openChunkStore(PackOptions{ChunkStore: plain}); err != nil || store.cipher != nil {
+		t.Errorf("不加密的块存储: %v", err)
+	}
+	if _, err := openChunkStore(PackOptions{ChunkStore: t.TempDir()}); err == nil || errors.Is(err, ErrChunkStoreLocked) {
+		t.Errorf("不是块存储的目录: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Codec 归档的压缩方式
+type Codec int
+
+const (
+	CodecDefault Codec = iota // 未指定：由 Compress 决定，启用压缩时使用 flate
+	CodecNone                 // 不压缩
+	CodecFlate                // flate（可以分块压缩、自适应压缩级别）
+	CodecZstd                 // zstd：速度和压缩率都明显优于 flate 的最高级别（格式版本 versionCodec）
+	CodecXz                   // xz (LZMA2)：压缩率最高但很慢，适合长期冷存档（格式版本 versionCodec）
+)
+
+// ParseCodec 解析压缩方式名称: none, flate, zstd, xz
+func ParseCodec(s string) (Codec, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return CodecDefault, nil
+	case "none":
+		return CodecNone, nil
+	case "flate":
+		return CodecFlate, nil
+	case "zstd":
+		return CodecZstd, nil
+	case "xz":
+		return CodecXz, nil
+	default:
+		return CodecDefault, fmt.Errorf("未知的压缩方式: %s（支持 none、flate、zstd、xz）", s)
+	}
+}
+
+// String 返回压缩方式名称（与命令行 -compression 参数使用的名称一致）
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecFlate:
+		return "flate"
+	case CodecZstd:
+		return "zstd"
+	case CodecXz:
+		return "xz"
+	default:
+		return "default"
+	}
+}
+
+// resolveCompression 统一 Compression 和 Compress 两个选项：
+// 指定了压缩方式时按其设置 Compress，否则按 Compress 选择 flate 或不压缩
+func resolveCompression(options PackOptions) PackOptions {
+	switch options.Compression {
+	case CodecNone:
+		options.Compress = false
+	case CodecFlate, CodecZstd, CodecXz:
+		options.Compress = true
+	default:
+		if options.Compress {
+			options.Compression = CodecFlate
+		} else {
+			options.Compression = CodecNone
+		}
+	}
+	if options.Compress && options.CompressionLevel == 0 {
+		options.CompressionLevel = options.Compression.defaultLevel()
+	}
+	return options
+}
+
+// defaultLevel 未指定压缩级别时使用的级别
+func (c Codec) defaultLevel() int {
+	switch c {
+	case CodecFlate:
+		return flate.BestCompression
+	case CodecZstd:
+		return 3 // zstd 命令行工具的默认级别
+	case CodecXz:
+		return 6 // xz 命令行工具的默认级别
+	default:
+		return 0
+	}
+}
+
+// checkLevel 检查压缩级别是否在压缩方式支持的范围内：flate 和 xz 为 1~9，zstd 为 1~22
+func (c Codec) checkLevel(level int) error {
+	max := 9
+	if c == CodecZstd {
+		max = 22
+	}
+	if level < 1 || level > max {
+		return fmt.Errorf("%s 的压缩级别必须在 1~%d 之间: %d", c, max, level)
+	}
+	return nil
+}
+
+// xzDictCap 返回 xz 压缩级别对应的字典大小（与 xz 命令行工具的预设一致），级别越高，能找到的重复内容越远，占用的内存也越多
+func xzDictCap(level int) int {
+	caps := []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+	return caps[level]
+}
+
+// newXzWriter 按压缩级别创建 xz 压缩器
+func newXzWriter(w io.Writer, level int) (*xz.Writer, error) {
+	return xz.WriterConfig{DictCap: xzDictCap(level)}.NewWriter(w)
+}
+
+// zstdCloser 将 zstd 解码器适配为 io.Closer，关闭时释放解码器的后台 goroutine
+type zstdCloser struct {
+	decoder *zstd.Decoder
+}
+
+func (zc zstdCloser) Close() error {
+	zc.decoder.Close()
+	return nil
+}
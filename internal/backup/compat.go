@@ -0,0 +1,195 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// 兼容性策略：
+//   - 本程序读取 minReadVersion 到 formatVersion 之间的所有格式版本，新版本的程序不能放弃对旧版本归档的支持；
+//   - 遇到比 formatVersion 更新的归档时，在读取文件头时立即失败，返回的错误包装 *NewerFormatError（可用 errors.As 判断），
+//     提示需要升级程序，而不是尝试按旧格式解析；
+//   - 每个格式版本在 compat/ 中至少有一个标准归档，由 CheckCompatibility（backup compat-check）验证。
+//     修改格式时需要增加新版本的标准归档，已有的标准归档不能修改。
+//
+// 标准归档命名为 v<版本>[-压缩][-encrypt][-mime][-hash][-central-index][-entry-encrypt].bkup，
+// 压缩为 compress（整体 gzip）、block（分块压缩）、zstd 或 xz，其余各项按上面的顺序出现；
+// future.bkup 的文件头版本为 0xFFFFFFFF，代表任何更新的版本，不随 formatVersion 改名（见 compat_test.go）。
+
+// minReadVersion 能读取的最旧格式版本
+const minReadVersion = 1
+
+// NewerFormatError 归档格式版本比本程序支持的更新
+type NewerFormatError struct {
+	Version uint32 // 归档的格式版本
+}
+
+func (e *NewerFormatError) Error() string {
+	return fmt.Sprintf("归档格式版本 %d 比本程序支持的最高版本 %d 新，请升级程序后再读取", e.Version, formatVersion)
+}
+
+// compatFixtures 各格式版本的标准归档和期望内容
+//
+//go:embed compat
+var compatFixtures embed.FS
+
+// compatManifest compat/manifest.json 的内容
+type compatManifest struct {
+	Password string          `json:"password"` // 加密标准归档的密码，也是单独加密条目的密码
+	Entries  []compatEntry   `json:"entries"`
+	Fixtures []compatFixture `json:"fixtures"`
+}
+
+// compatEntry 标准归档中一个条目的期望值
+type compatEntry struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Perm   string `json:"perm"`   // 八进制权限，空表示不检查
+	Size   int64  `json:"size"`   // 普通文件的大小
+	SHA256 string `json:"sha256"` // 普通文件内容的摘要
+	Link   string `json:"link"`   // 符号链接目标或硬链接指向的路径
+	Mime   string `json:"mime"`   // 内容类型（仅检查记录了内容类型的归档）
+}
+
+// compatFixture 一个标准归档
+type compatFixture struct {
+	File    string `json:"file"`
+	Version int    `json:"version"`
+	Mime    bool   `json:"mime"`  // 是否记录了内容类型
+	Newer   bool   `json:"newer"` // 比本程序支持的版本更新，期望读取时报 NewerFormatError
+}
+
+// CompatResult 一个标准归档的检查结果
+type CompatResult struct {
+	File    string // 标准归档文件名
+	Version int    // 格式版本
+	Err     error  // nil 表示符合兼容性策略
+}
+
+// CheckCompatibility 用本程序读取所有内置的标准归档，检查是否符合兼容性策略
+func CheckCompatibility() ([]CompatResult, error) {
+	data, err := compatFixtures.ReadFile("compat/manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("读取标准归档清单失败: %v", err)
+	}
+	var manifest compatManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("解析标准归档清单失败: %v", err)
+	}
+
+	// 每个支持的版本都必须有标准归档
+	covered := make(map[int]bool)
+	for _, fixture := range manifest.Fixtures {
+		covered[fixture.Version] = true
+	}
+
+	var results []CompatResult
+	for v := minReadVersion; v <= int(formatVersion); v++ {
+		if !covered[v] {
+			results = append(results, CompatResult{Version: v, Err: fmt.Errorf("格式版本 %d 没有标准归档", v)})
+		}
+	}
+	for _, fixture := range manifest.Fixtures {
+		results = append(results, CompatResult{
+			File:    fixture.File,
+			Version: fixture.Version,
+			Err:     checkFixture(manifest, fixture),
+		})
+	}
+	return results, nil
+}
+
+// checkFixture 检查一个标准归档
+func checkFixture(manifest compatManifest, fixture compatFixture) error {
+	f, err := compatFixtures.Open("compat/" + fixture.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if fixture.Newer {
+		_, _, _, err := readHeaderWithFlags(f)
+		var newer *NewerFormatError
+		if !errors.As(err, &newer) {
+			return fmt.Errorf("更新版本的归档应当报告需要升级，实际: %v", err)
+		}
+		return nil
+	}
+
+	ar, err := newArchiveReader(f, PackOptions{Password: manifest.Password, EntryPassword: manifest.Password})
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+
+	for i := 0; ; i++ {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			if i != len(manifest.Entries) {
+				return fmt.Errorf("条目数 %d，期望 %d", i, len(manifest.Entries))
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if i >= len(manifest.Entries) {
+			return fmt.Errorf("多余的条目: %s", entry.RelPath)
+		}
+		if err := checkFixtureEntry(ar, entry, manifest.Entries[i], fixture.Mime); err != nil {
+			return fmt.Errorf("%s: %v", entry.RelPath, err)
+		}
+	}
+}
+
+// checkFixtureEntry 比较条目与期望值
+func checkFixtureEntry(ar *ArchiveReader, entry *FileEntry, want compatEntry, checkMime bool) error {
+	if entry.RelPath != want.Path {
+		return fmt.Errorf("路径不符，期望 %s", want.Path)
+	}
+	if entry.Type.String() != want.Type {
+		return fmt.Errorf("类型为 %s，期望 %s", entry.Type, want.Type)
+	}
+	if want.Perm != "" {
+		perm, err := strconv.ParseUint(want.Perm, 8, 32)
+		if err != nil {
+			return fmt.Errorf("清单中的权限无效: %s", want.Perm)
+		}
+		if entry.Mode&0777 != uint32(perm) {
+			return fmt.Errorf("权限为 %o，期望 %s", entry.Mode&0777, want.Perm)
+		}
+	}
+
+	switch entry.Type {
+	case TypeFile:
+		if entry.Size != want.Size {
+			return fmt.Errorf("大小为 %d，期望 %d", entry.Size, want.Size)
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, ar); err != nil {
+			return fmt.Errorf("读取内容失败: %v", err)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != want.SHA256 {
+			return fmt.Errorf("内容摘要为 %s，期望 %s", sum, want.SHA256)
+		}
+	case TypeSymlink:
+		if entry.LinkTarget != want.Link {
+			return fmt.Errorf("链接目标为 %s，期望 %s", entry.LinkTarget, want.Link)
+		}
+	case TypeHardlink:
+		if entry.LinkName != want.Link {
+			return fmt.Errorf("硬链接指向 %s，期望 %s", entry.LinkName, want.Link)
+		}
+	}
+
+	if checkMime && entry.Mime != want.Mime {
+		return fmt.Errorf("内容类型为 %q，期望 %q", entry.Mime, want.Mime)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fixtureName 标准归档的命名规则（见 compat.go）
+var fixtureName = regexp.MustCompile(`^v(\d+)(-(compress|block|zstd|xz))?(-encrypt)?(-mime)?(-hash)?(-central-index)?(-entry-encrypt)?\.bkup$`)
+
+// legacyFixtureNames 命名规则确定之前加入的标准归档：已有的标准归档不能修改或改名，这些名称不检查命名规则
+var legacyFixtureNames = map[string]bool{
+	"v10-central-index-block-encrypt-hash.bkup": true, // 各项的顺序与命名规则不同
+	"v13-future.bkup": true, // 更新版本的归档，future.bkup 之前的名称（文件头版本为 13）
+}
+
+// readCompatManifest 读取内置的标准归档清单
+func readCompatManifest(t *testing.T) compatManifest {
+	t.Helper()
+	data, err := compatFixtures.ReadFile("compat/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest compatManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+// TestCompatFixtures 清单中的每个标准归档都符合兼容性策略：旧版本归档的内容与清单一致，更新版本的归档报告需要升级
+func TestCompatFixtures(t *testing.T) {
+	manifest := readCompatManifest(t)
+	for _, fixture := range manifest.Fixtures {
+		fixture := fixture
+		t.Run(fixture.File, func(t *testing.T) {
+			if err := checkFixture(manifest, fixture); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	results, err := CheckCompatibility()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil && r.File == "" {
+			t.Errorf("v%d: %v", r.Version, r.Err)
+		}
+	}
+}
+
+// TestCompatFutureFixture 更新版本的归档在打开时就失败，错误说明版本并提示升级
+func TestCompatFutureFixture(t *testing.T) {
+	f, err := compatFixtures.Open("compat/future.bkup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newArchiveReader(f, PackOptions{Password: "compat"})
+	var newer *NewerFormatError
+	if !errors.As(err, &newer) {
+		t.Fatalf("期望 NewerFormatError，实际: %v", err)
+	}
+	if newer.Version != 0xFFFFFFFF {
+		t.Errorf("版本为 %d", newer.Version)
+	}
+	if !strings.Contains(err.Error(), "请升级程序") {
+		t.Errorf("错误没有提示升级: %v", err)
+	}
+}
+
+// TestCompatFixtureNames compat/ 中的归档都在清单中，名称符合命名规则并与清单中的版本和内容类型标记一致
+func TestCompatFixtureNames(t *testing.T) {
+	manifest := readCompatManifest(t)
+	listed := make(map[string]compatFixture)
+	for _, fixture := range manifest.Fixtures {
+		if _, ok := listed[fixture.File]; ok {
+			t.Errorf("%s 在清单中重复", fixture.File)
+		}
+		listed[fixture.File] = fixture
+	}
+
+	names, err := fs.Glob(compatFixtures, "compat/*.bkup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != len(listed) {
+		t.Errorf("compat/ 中有 %d 个归档，清单中有 %d 个", len(names), len(listed))
+	}
+	for _, name := range names {
+		name = path.Base(name)
+		fixture, ok := listed[name]
+		if !ok {
+			t.Errorf("%s 不在清单中", name)
+			continue
+		}
+		if legacyFixtureNames[name] {
+			continue
+		}
+		if fixture.Newer {
+			if name != "future.bkup" {
+				t.Errorf("%s: 更新版本的归档应命名为 future.bkup", name)
+			}
+			continue
+		}
+		m := fixtureName.FindStringSubmatch(name)
+		if m == nil {
+			t.Errorf("%s 不符合命名规则", name)
+			continue
+		}
+		if v, _ := strconv.Atoi(m[1]); v != fixture.Version {
+			t.Errorf("%s: 清单中的版本为 %d", name, fixture.Version)
+		}
+		if (m[5] != "") != fixture.Mime {
+			t.Errorf("%s: 清单中的内容类型标记为 %v", name, fixture.Mime)
+		}
+	}
+}
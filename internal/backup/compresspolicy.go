@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EncryptCompressPolicy 同时启用压缩和加密时的处理策略
+//
+// 先压缩再加密时，密文长度随明文的可压缩程度变化。如果攻击者能影响部分被打包的内容
+// （如上传目录、邮件、共享目录中他人写入的文件），又能观察归档大小，就可能通过反复
+// 注入猜测值并比较大小推断出同一归档中其他内容（CRIME/BREACH 类攻击）。
+// 这类数据用 UntrustedPatterns 标记为“不可信数据类别”，加密时不压缩。
+type EncryptCompressPolicy int
+
+const (
+	EncryptCompressAuto   EncryptCompressPolicy = iota // 默认：归档包含不可信数据类别的条目时不压缩，否则先压缩再加密
+	EncryptCompressAlways                              // 总是先压缩再加密（包含不可信数据时只警告）
+	EncryptCompressNever                               // 加密时总是不压缩
+)
+
+// ParseEncryptCompressPolicy 解析加密时的压缩策略名称: auto, compress, store
+func ParseEncryptCompressPolicy(s string) (EncryptCompressPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "auto":
+		return EncryptCompressAuto, nil
+	case "compress":
+		return EncryptCompressAlways, nil
+	case "store":
+		return EncryptCompressNever, nil
+	default:
+		return EncryptCompressAuto, fmt.Errorf("未知的加密压缩策略: %s（支持 auto、compress、store）", s)
+	}
+}
+
+// String 返回策略名称（与命令行 -encrypt-compress 参数使用的名称一致）
+func (p EncryptCompressPolicy) String() string {
+	switch p {
+	case EncryptCompressAlways:
+		return "compress"
+	case EncryptCompressNever:
+		return "store"
+	default:
+		return "auto"
+	}
+}
+
+// untrustedEntries 返回属于不可信数据类别（匹配 UntrustedPatterns）的条目路径
+func untrustedEntries(entries []FileEntry, patterns []string) []string {
+	if len(patterns) == 0 {
+		return nil
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.Type != TypeFile && entry.Type != TypeImage {
+			continue
+		}
+		for _, pattern := range patterns {
+			if matchPathPattern(pattern, entry.RelPath, false) {
+				paths = append(paths, entry.RelPath)
+				break
+			}
+		}
+	}
+	return paths
+}
+
+// applyEncryptCompressPolicy 按策略决定一个加密归档是否压缩，返回调整后的选项
+// 拆分打包时每个归档分别决定，只有包含不可信数据的归档不压缩
+func applyEncryptCompressPolicy(archivePath string, entries []FileEntry, options PackOptions) PackOptions {
+	if !options.Encrypt || !options.Compress {
+		return options
+	}
+	store := false
+	switch options.EncryptCompress {
+	case EncryptCompressNever:
+		store = true
+	case EncryptCompressAlways:
+		if untrusted := untrustedEntries(entries, options.UntrustedPatterns); len(untrusted) > 0 {
+			warn(options, "%s 包含 %d 个不可信数据类别的文件（如 %s），仍按要求先压缩再加密，归档大小可能泄露内容信息",
+				archivePath, len(untrusted), untrusted[0])
+		}
+	default:
+		if untrusted := untrustedEntries(entries, options.UntrustedPatterns); len(untrusted) > 0 {
+			warn(options, "%s 包含 %d 个不可信数据类别的文件（如 %s），加密时不压缩", archivePath, len(untrusted), untrusted[0])
+			store = true
+		}
+	}
+	if store {
+		options.Compress = false
+		options.Compression = CodecNone
+		options.BlockCompress = false
+		options.CompressTarget = 0
+	}
+	return options
+}
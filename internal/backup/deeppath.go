@@ -0,0 +1,320 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// 很深的目录树：完整路径可能超过 PATH_MAX（4096 字节），直接用完整路径调用系统调用会失败（ENAMETOOLONG）。
+// 扫描时按目录的文件描述符逐层遍历（见 scanpath.go），不拼接绝对路径；
+// 打包读取时，超长的路径分段打开父目录：每段不超过 PATH_MAX，相对于上一段打开的目录，
+// 再对父目录的文件描述符使用 *at 系统调用。没有超长的路径仍使用原来的系统调用，行为不变。
+// 解包写入时逐级打开父目录且不跟随符号链接（见 walkParentNoFollow），与路径长度无关。
+//
+// 相邻条目通常在同一个目录或其子目录中：最近打开的目录保留在缓存中，
+// 下一次只需相对于它打开剩余的路径，否则每个条目都要重新解析整条路径，耗时与深度的平方成正比。
+
+// atPath 相对于目录文件描述符的路径
+type atPath struct {
+	dirfd int    // 父目录的文件描述符，或 unix.AT_FDCWD（name 为完整路径）
+	name  string // 最后一个路径分量；dirfd 为 AT_FDCWD 时为完整路径
+}
+
+// close 关闭打开的父目录
+func (p atPath) close() {
+	if p.dirfd != unix.AT_FDCWD {
+		unix.Close(p.dirfd)
+	}
+}
+
+// isLongPath 路径是否超过 PATH_MAX，需要分段处理
+func isLongPath(path string) bool {
+	return len(path) >= unix.PathMax
+}
+
+// deepDirCache 最近打开的深层目录（只缓存超过 PATH_MAX 的路径）
+var deepDirCache struct {
+	sync.Mutex
+	path string
+	fd   int
+}
+
+// releaseDeepDirs 关闭缓存的目录，打包或解包结束时调用
+func releaseDeepDirs() {
+	deepDirCache.Lock()
+	defer deepDirCache.Unlock()
+	if deepDirCache.path != "" {
+		unix.Close(deepDirCache.fd)
+		deepDirCache.path = ""
+	}
+	parentDirCache.Lock()
+	defer parentDirCache.Unlock()
+	if parentDirCache.path != "" {
+		unix.Close(parentDirCache.fd)
+		parentDirCache.path = ""
+	}
+}
+
+// openDeepDir 打开目录（路径可以超过 PATH_MAX），返回其文件描述符
+func openDeepDir(path string) (int, error) {
+	if !isLongPath(path) {
+		return openDirSegments(unix.AT_FDCWD, path, path)
+	}
+	deepDirCache.Lock()
+	defer deepDirCache.Unlock()
+	cache := &deepDirCache
+	var fd int
+	var err error
+	if cache.path != "" && strings.HasPrefix(path, cache.path) && (len(path) == len(cache.path) || path[len(cache.path)] == '/') {
+		// 缓存的目录或其子目录：相对于缓存的目录打开
+		rel := strings.TrimPrefix(path[len(cache.path):], "/")
+		if rel == "" {
+			rel = "."
+		}
+		fd, err = openDirSegments(cache.fd, rel, path)
+	} else {
+		fd, err = openDirSegments(unix.AT_FDCWD, path, path)
+	}
+	if err != nil {
+		return -1, err
+	}
+	if cached, err := unix.Dup(fd); err == nil {
+		if cache.path != "" {
+			unix.Close(cache.fd)
+		}
+		unix.CloseOnExec(cached)
+		cache.path, cache.fd = path, cached
+	}
+	return fd, nil
+}
+
+// openDirSegments 相对于 base 打开目录 rel，rel 超过 PATH_MAX 时分段打开；full 用于错误信息
+func openDirSegments(base int, rel string, full string) (int, error) {
+	fd := base
+	rest := rel
+	for {
+		segment := rest
+		rest = ""
+		if isLongPath(segment) {
+			// 在 PATH_MAX 之内的最后一个 / 处分段
+			cut := strings.LastIndexByte(segment[:unix.PathMax-1], '/')
+			if cut <= 0 {
+				return -1, &os.PathError{Op: "open", Path: full, Err: syscall.ENAMETOOLONG}
+			}
+			segment, rest = segment[:cut], segment[cut+1:]
+		}
+		next, err := unix.Openat(fd, segment, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if fd != base {
+			unix.Close(fd)
+		}
+		if err != nil {
+			return -1, &os.PathError{Op: "open", Path: full, Err: err}
+		}
+		fd = next
+		if rest == "" {
+			return fd, nil
+		}
+	}
+}
+
+// resolveDeep 返回可用于 *at 系统调用的路径，超长时打开父目录，用完后调用 close
+func resolveDeep(path string) (atPath, error) {
+	if !isLongPath(path) {
+		return atPath{dirfd: unix.AT_FDCWD, name: path}, nil
+	}
+	fd, err := openDeepDir(filepath.Dir(path))
+	if err != nil {
+		return atPath{}, err
+	}
+	return atPath{dirfd: fd, name: filepath.Base(path)}, nil
+}
+
+// openDeep 与 os.OpenFile 相同，但路径可以超过 PATH_MAX
+func openDeep(path string, flag int, perm os.FileMode) (*os.File, error) {
+	if !isLongPath(path) {
+		return os.OpenFile(path, flag, perm)
+	}
+	at, err := resolveDeep(path)
+	if err != nil {
+		return nil, err
+	}
+	defer at.close()
+	fd, err := unix.Openat(at.dirfd, at.name, flag|unix.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// deepAt 对路径执行一个 *at 系统调用（路径可以超过 PATH_MAX），op 用于错误信息
+func deepAt(op string, path string, call func(dirfd int, name string) error) error {
+	at, err := resolveDeep(path)
+	if err != nil {
+		return err
+	}
+	defer at.close()
+	if err := call(at.dirfd, at.name); err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+	return nil
+}
+
+// chmodBits 将 os.FileMode 转换为 chmod 的权限位（包括 setuid、setgid 和 sticky 位）
+func chmodBits(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= unix.S_ISVTX
+	}
+	return perm
+}
+
+// errSymlinkComponent 路径的某一级父目录是符号链接（见 openParentNoFollow）
+var errSymlinkComponent = errors.New("路径经过符号链接")
+
+// openParentNoFollow 相对于目录 root 逐级打开 rel 的父目录，不跟随任何一级符号链接，
+// 返回父目录的文件描述符和最后一个路径分量，用完后调用 close。
+// 某一级是符号链接时返回错误；某一级不存在或不是目录时返回 os.ErrNotExist（rel 不可能存在）
+func openParentNoFollow(root string, rel string) (atPath, error) {
+	return walkParentNoFollow(root, rel, false)
+}
+
+// createParentNoFollow 与 openParentNoFollow 相同，但以 0755 创建缺少的各级目录（解包时写入条目之前调用）；
+// 某一级是符号链接时同样返回错误，是其他非目录文件时返回 ENOTDIR
+func createParentNoFollow(root string, rel string) (atPath, error) {
+	return walkParentNoFollow(root, rel, true)
+}
+
+// walkParentNoFollow 逐级打开 rel 的父目录；rel 按 root 之内的路径处理（开头的 / 和逃逸的 .. 被去掉），
+// 每一级用 fstatat 和 openat(O_NOFOLLOW) 打开，与路径长度无关（每个分量都很短）
+func walkParentNoFollow(root string, rel string, create bool) (atPath, error) {
+	parts := strings.Split(strings.TrimPrefix(filepath.Clean("/"+rel), "/"), "/")
+	dir := filepath.Join(root, filepath.Join(parts[:len(parts)-1]...))
+	fd, start, err := cachedParent(root, dir, len(parts)-1)
+	if err != nil {
+		return atPath{}, err
+	}
+	for i := start; i < len(parts)-1; i++ {
+		part := parts[i]
+		partial := func() string { return filepath.Join(root, filepath.Join(parts[:i+1]...)) }
+		var st unix.Stat_t
+		err := unix.Fstatat(fd, part, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == unix.ENOENT && create {
+			if err = unix.Mkdirat(fd, part, 0755); err == nil || err == unix.EEXIST {
+				err = unix.Fstatat(fd, part, &st, unix.AT_SYMLINK_NOFOLLOW)
+			}
+		}
+		if err != nil || st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			unix.Close(fd)
+			switch {
+			case err == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK:
+				err = errSymlinkComponent
+			case !create && (err == nil || err == unix.ENOENT):
+				err = os.ErrNotExist
+			case err == nil:
+				err = unix.ENOTDIR
+			}
+			return atPath{}, &os.PathError{Op: "open", Path: partial(), Err: err}
+		}
+		// O_NOFOLLOW：检查之后被替换成符号链接时同样失败
+		next, err := unix.Openat(fd, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return atPath{}, &os.PathError{Op: "open", Path: partial(), Err: err}
+		}
+		fd = next
+	}
+	if start < len(parts)-1 {
+		storeParent(root, dir, fd)
+	}
+	return atPath{dirfd: fd, name: parts[len(parts)-1]}, nil
+}
+
+// parentDirCache walkParentNoFollow 最近打开的父目录：按条目顺序解包时，下一个条目的父目录通常是它或它的子目录，
+// 只需从它开始打开剩余的分量。缓存的目录是逐级不跟随符号链接打开的；删除目录时与 deepDirCache 一起释放
+var parentDirCache struct {
+	sync.Mutex
+	root string
+	path string // 目录的完整路径（root 与相对路径拼接）
+	fd   int
+}
+
+// cachedParent 返回开始逐级打开 dir 的目录（由调用方关闭）和 dir 的 depth 个分量中已经打开的分量数
+func cachedParent(root, dir string, depth int) (int, int, error) {
+	cache := &parentDirCache
+	cache.Lock()
+	if cache.path != "" && cache.root == root && (dir == cache.path || strings.HasPrefix(dir, cache.path+"/")) {
+		rest := strings.TrimPrefix(dir[len(cache.path):], "/")
+		remaining := 0
+		if rest != "" {
+			remaining = strings.Count(rest, "/") + 1
+		}
+		fd, err := unix.Dup(cache.fd)
+		cache.Unlock()
+		if err == nil {
+			unix.CloseOnExec(fd)
+			return fd, depth - remaining, nil
+		}
+	} else {
+		cache.Unlock()
+	}
+	fd, err := openDeepDir(root)
+	return fd, 0, err
+}
+
+// storeParent 缓存逐级打开的目录
+func storeParent(root, dir string, fd int) {
+	cached, err := unix.Dup(fd)
+	if err != nil {
+		return
+	}
+	unix.CloseOnExec(cached)
+	cache := &parentDirCache
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.path != "" {
+		unix.Close(cache.fd)
+	}
+	cache.root, cache.path, cache.fd = root, dir, cached
+}
+
+// removeAllAt 删除目录 dirfd 中的 name 及其全部内容（与 os.RemoveAll 相同），不跟随符号链接
+func removeAllAt(dirfd int, name string) error {
+	err := unix.Unlinkat(dirfd, name, 0)
+	if err == nil || err == unix.ENOENT {
+		return nil
+	}
+	if err != unix.EISDIR {
+		return err
+	}
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	names, err := dir.Readdirnames(-1)
+	for _, child := range names {
+		if err != nil {
+			break
+		}
+		err = removeAllAt(fd, child)
+	}
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	// 缓存的文件描述符可能指向刚删除的目录
+	releaseDeepDirs()
+	return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+}
@@ -0,0 +1,358 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 健康检查（doctor）：按目录文件中的打包、校验和镜像记录，以及目标目录中的归档，逐个目标目录检查备份配置和历史，
+// 报告问题并给出可以直接执行的建议：最近一次打包失败或过旧、归档从未校验或校验过期、没有异地副本、
+// 保留的时间跨度太短、归档未加密、可用空间按最近的增长速度即将耗尽。
+// 每个目标目录得到一个 0-100 的分数（每个严重问题扣 30 分，每个警告扣 10 分），总分为各目标目录的最低分。
+
+// HealthSeverity 问题的严重程度
+type HealthSeverity string
+
+const (
+	SeverityCritical HealthSeverity = "critical" // 备份已经不可靠，需要立即处理
+	SeverityWarning  HealthSeverity = "warning"  // 存在风险，应当处理
+	SeverityInfo     HealthSeverity = "info"     // 提示，不扣分
+)
+
+// HealthIssue 检查发现的一个问题
+type HealthIssue struct {
+	Severity   HealthSeverity `json:"severity"`
+	Check      string         `json:"check"`      // 检查项: last-run、verification、offsite、retention、encryption、free-space
+	Message    string         `json:"message"`    // 问题的描述
+	Suggestion string         `json:"suggestion"` // 建议的处理方法
+}
+
+// DestinationHealth 一个目标目录的检查结果
+type DestinationHealth struct {
+	Directory string        `json:"directory"`
+	Score     int           `json:"score"`
+	Issues    []HealthIssue `json:"issues"`
+}
+
+// HealthReport 健康检查的结果
+type HealthReport struct {
+	Score        int                 `json:"score"`            // 各目标目录的最低分
+	Destinations []DestinationHealth `json:"destinations"`     // 按目录排序
+	Issues       []HealthIssue       `json:"issues,omitempty"` // 与具体目标目录无关的问题
+}
+
+// Critical 是否有严重问题
+func (r *HealthReport) Critical() bool {
+	for _, issue := range r.Issues {
+		if issue.Severity == SeverityCritical {
+			return true
+		}
+	}
+	for _, destination := range r.Destinations {
+		for _, issue := range destination.Issues {
+			if issue.Severity == SeverityCritical {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DoctorPolicy 健康检查使用的策略
+type DoctorPolicy struct {
+	MaxAge       time.Duration // 最近一次成功打包的最长间隔，镜像也应在这个间隔内跟上
+	VerifyMaxAge time.Duration // 校验的策略期限（与 status -max-age 相同）
+	MinRetention time.Duration // 目标目录中最早和最新的归档至少相隔的时间
+	MinFreeDays  int           // 按最近的增长速度，可用空间至少还能维持的天数
+}
+
+// doctorGrowthWindow 估算增长速度时统计的时间范围
+const doctorGrowthWindow = 30 * 24 * time.Hour
+
+// doctorMinFreeRatio 可用空间低于文件系统容量的这个比例时报警（不论增长速度）
+const doctorMinFreeRatio = 0.05
+
+// Diagnose 检查目录文件中记录的全部目标目录
+func Diagnose(catalog *Catalog, policy DoctorPolicy) (*HealthReport, error) {
+	overview, err := DestinationOverview(catalog, policy.VerifyMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	report := &HealthReport{Score: 100, Destinations: []DestinationHealth{}}
+	if len(overview) == 0 {
+		report.Score = 0
+		report.Issues = append(report.Issues, HealthIssue{
+			Severity:   SeverityCritical,
+			Check:      "last-run",
+			Message:    "目录文件中没有任何打包或校验记录",
+			Suggestion: "使用 backup pack 打包（不要指定 -no-catalog），或用 -catalog 指定打包时使用的目录文件",
+		})
+		return report, nil
+	}
+	now := time.Now()
+	for _, destination := range overview {
+		health, err := diagnoseDestination(catalog, destination, policy, now)
+		if err != nil {
+			return nil, err
+		}
+		if health.Score < report.Score {
+			report.Score = health.Score
+		}
+		report.Destinations = append(report.Destinations, health)
+	}
+	return report, nil
+}
+
+// doctorArchive 目标目录中的一个归档
+type doctorArchive struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// diagnoseDestination 检查一个目标目录
+func diagnoseDestination(catalog *Catalog, d DestinationStatus, policy DoctorPolicy, now time.Time) (DestinationHealth, error) {
+	health := DestinationHealth{Directory: d.Directory, Issues: []HealthIssue{}}
+	add := func(severity HealthSeverity, check, suggestion, format string, args ...interface{}) {
+		health.Issues = append(health.Issues, HealthIssue{Severity: severity, Check: check, Message: fmt.Sprintf(format, args...), Suggestion: suggestion})
+	}
+
+	if d.Missing {
+		add(SeverityCritical, "last-run", "检查目标磁盘是否已挂载；目录已经废弃时从目录文件中删除它的记录",
+			"目标目录已不存在或无法访问")
+		health.Score = healthScore(health.Issues)
+		return health, nil
+	}
+	archives, err := listDoctorArchives(d.Directory)
+	if err != nil {
+		return health, err
+	}
+	var newest *doctorArchive
+	if len(archives) > 0 {
+		newest = &archives[len(archives)-1]
+	}
+
+	// 最近一次打包
+	switch run := d.LastRun; {
+	case run != nil && !run.OK:
+		add(SeverityCritical, "last-run", "查看错误原因并重新打包；backup status 显示最近一次打包的警告",
+			"最近一次打包（%s前）失败: %s", FormatAge(now.Sub(run.Start)), run.Error)
+	case run != nil && now.Sub(run.End) > policy.MaxAge:
+		add(SeverityCritical, "last-run", "检查定时任务（cron、systemd timer）是否仍在运行，并手动运行一次 backup pack",
+			"最近一次打包在 %s前，超过策略期限 %s", FormatAge(now.Sub(run.End)), FormatAge(policy.MaxAge))
+	case run == nil && newest == nil:
+		add(SeverityCritical, "last-run", "运行 backup pack 打包到这个目录",
+			"目录中没有归档，也没有打包记录")
+	case run == nil && now.Sub(newest.modTime) > policy.MaxAge:
+		add(SeverityCritical, "last-run", "检查定时任务是否仍在运行，并手动运行一次 backup pack",
+			"没有打包记录，最新的归档是 %s前写入的，超过策略期限 %s", FormatAge(now.Sub(newest.modTime)), FormatAge(policy.MaxAge))
+	case run == nil:
+		add(SeverityInfo, "last-run", "打包时不要指定 -no-catalog，或用 -catalog 指定与 doctor 相同的目录文件",
+			"目录文件中没有这个目录的打包记录，只能按归档的修改时间判断")
+	}
+
+	// 校验
+	switch {
+	case d.Archives > 0 && d.Verified == 0 && d.NeedsAttention == d.Archives && neverVerified(catalog, archives):
+		add(SeverityWarning, "verification", "在打包之后运行 backup verify -archive <归档>（可以加入定时任务），结果会记录在目录文件中",
+			"%d 个归档从未校验过，无法确认备份可以还原", d.Archives)
+	case d.NeedsAttention > 0:
+		severity := SeverityWarning
+		if failedVerifications(catalog, archives) > 0 {
+			severity = SeverityCritical
+		}
+		add(severity, "verification", fmt.Sprintf("运行 backup status %s 查看具体的归档，逐个运行 backup verify", d.Directory),
+			"%d 个归档校验失败、校验后被改变或超过 %s没有校验", d.NeedsAttention, FormatAge(policy.VerifyMaxAge))
+	}
+
+	// 异地副本
+	mirror := catalog.Mirrors[d.Directory]
+	switch {
+	case mirror == nil:
+		add(SeverityWarning, "offsite", fmt.Sprintf("定期运行 backup mirror -src %s -dst <另一块磁盘或网络存储上的目录>", d.Directory),
+			"没有镜像记录，归档只有这一份，目标磁盘损坏时全部丢失")
+	case !mirror.OK:
+		add(SeverityWarning, "offsite", "查看错误原因后重新运行 backup mirror",
+			"最近一次镜像到 %s（%s前）失败: %s", mirror.Destination, FormatAge(now.Sub(mirror.Time)), mirror.Error)
+	case sameDevice(d.Directory, mirror.Destination):
+		add(SeverityWarning, "offsite", "把镜像目标改为另一块磁盘、另一台机器或网络存储上的目录",
+			"镜像目标 %s 与目标目录在同一个文件系统上，不能防止磁盘损坏", mirror.Destination)
+	case newest != nil && newest.modTime.After(mirror.Time) && now.Sub(mirror.Time) > policy.MaxAge:
+		add(SeverityWarning, "offsite", fmt.Sprintf("运行 backup mirror -src %s -dst %s，并把它加入打包之后的定时任务", d.Directory, mirror.Destination),
+			"最近一次镜像在 %s前，之后的归档还没有异地副本", FormatAge(now.Sub(mirror.Time)))
+	}
+
+	// 保留时间
+	switch {
+	case len(archives) == 1:
+		add(SeverityWarning, "retention", "每次打包使用不同的输出文件名（例如带日期），保留多个版本",
+			"目录中只有一个归档，误删或损坏的文件在下一次打包后就无法找回")
+	case len(archives) > 1 && newest.modTime.Sub(archives[0].modTime) < policy.MinRetention:
+		span := newest.modTime.Sub(archives[0].modTime)
+		add(SeverityWarning, "retention", fmt.Sprintf("保留至少 %s 的归档，再删除更早的归档", FormatAge(policy.MinRetention)),
+			"最早和最新的归档只相隔 %s，少于 %s，较早发现的问题可能已经无法恢复", FormatAge(span), FormatAge(policy.MinRetention))
+	}
+
+	// 加密
+	if newest != nil {
+		if encrypted, err := archiveEncrypted(newest.path); err == nil && !encrypted {
+			add(SeverityWarning, "encryption", "打包时使用 -encrypt 加密，尤其是镜像到异地或网络存储时",
+				"最新的归档 %s 没有加密，拿到文件的人可以读取全部内容", filepath.Base(newest.path))
+		}
+	}
+
+	// 可用空间
+	checkFreeSpace(d.Directory, archives, policy, now, add)
+
+	health.Score = healthScore(health.Issues)
+	return health, nil
+}
+
+// listDoctorArchives 列出目录中的 *.bkup 归档（不递归），按修改时间排序
+func listDoctorArchives(dir string) ([]doctorArchive, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.bkup"))
+	if err != nil {
+		return nil, err
+	}
+	var archives []doctorArchive
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		archives = append(archives, doctorArchive{path: match, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].modTime.Before(archives[j].modTime) })
+	return archives, nil
+}
+
+// neverVerified 归档是否都没有任何校验记录（目录文件和归档旁都没有）
+func neverVerified(catalog *Catalog, archives []doctorArchive) bool {
+	for _, archive := range archives {
+		if _, ok := catalog.Archives[archive.path]; ok {
+			return false
+		}
+		if _, err := ReadVerifyStamp(archive.path); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// failedVerifications 返回最近一次校验失败的归档数
+func failedVerifications(catalog *Catalog, archives []doctorArchive) int {
+	failed := 0
+	for _, archive := range archives {
+		if record, ok := catalog.Archives[archive.path]; ok && !record.LastOK && record.LastError != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// sameDevice 两个路径是否在同一个文件系统上（无法判断时返回 false）
+func sameDevice(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	statA, okA := infoA.Sys().(*syscall.Stat_t)
+	statB, okB := infoB.Sys().(*syscall.Stat_t)
+	return okA && okB && statA.Dev == statB.Dev
+}
+
+// archiveEncrypted 读取归档的文件头，判断是否整体加密
+func archiveEncrypted(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	_, flags, _, err := readHeaderWithFlags(file)
+	if err != nil {
+		return false, err
+	}
+	return flags&flagEncrypt != 0, nil
+}
+
+// checkFreeSpace 检查目标目录所在文件系统的可用空间：
+// 按最近 doctorGrowthWindow 内写入的归档估算每天写入的字节数（不扣除删除的旧归档，估算偏保守），
+// 可用空间维持不到 policy.MinFreeDays 天时报警，不到 7 天时为严重问题
+func checkFreeSpace(dir string, archives []doctorArchive, policy DoctorPolicy, now time.Time,
+	add func(severity HealthSeverity, check, suggestion, format string, args ...interface{})) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	total := int64(stat.Blocks) * int64(stat.Bsize)
+	const suggestion = "删除不再需要的旧归档、打包时使用更高的压缩级别或 -chunk-store 去重，或者换用更大的磁盘"
+
+	var written int64
+	oldest := now
+	for _, archive := range archives {
+		if now.Sub(archive.modTime) <= doctorGrowthWindow {
+			written += archive.size
+			if archive.modTime.Before(oldest) {
+				oldest = archive.modTime
+			}
+		}
+	}
+	span := now.Sub(oldest)
+	if span < 24*time.Hour {
+		span = 24 * time.Hour
+	}
+	if perDay := float64(written) / (float64(span) / float64(24*time.Hour)); perDay > 0 {
+		days := int(float64(free) / perDay)
+		switch {
+		case days < 7:
+			add(SeverityCritical, "free-space", suggestion,
+				"可用空间 %s，按最近每天约 %s 的写入量只够 %d 天", FormatSize(free), FormatSize(int64(perDay)), days)
+			return
+		case days < policy.MinFreeDays:
+			add(SeverityWarning, "free-space", suggestion,
+				"可用空间 %s，按最近每天约 %s 的写入量约 %d 天后耗尽（策略要求至少 %d 天）", FormatSize(free), FormatSize(int64(perDay)), days, policy.MinFreeDays)
+			return
+		}
+	}
+	if total > 0 && float64(free) < float64(total)*doctorMinFreeRatio {
+		add(SeverityWarning, "free-space", suggestion,
+			"可用空间 %s，不到文件系统容量 %s 的 %d%%", FormatSize(free), FormatSize(total), int(doctorMinFreeRatio*100))
+	}
+}
+
+// healthScore 计算分数：每个严重问题扣 30 分，每个警告扣 10 分，最低 0 分
+func healthScore(issues []HealthIssue) int {
+	score := 100
+	for _, issue := range issues {
+		switch issue.Severity {
+		case SeverityCritical:
+			score -= 30
+		case SeverityWarning:
+			score -= 10
+		}
+	}
+	if score < 0 {
+		score = 0
+	}
+	return score
+}
+
+// FormatAge 将时长格式化为 "3 天"、"5 小时" 或 "12 分钟"（doctor 报告和命令行共用）
+func FormatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%d 天", int(d/(24*time.Hour)))
+	case d >= time.Hour:
+		return fmt.Sprintf("%d 小时", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%d 分钟", int(d/time.Minute))
+	}
+}
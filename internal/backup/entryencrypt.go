@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 单独加密的条目：匹配 EntryEncryptPatterns 的普通文件，内容用单独的条目密码加密，
+// 归档的其余部分可以不加密（或用另一个密码加密）。只知道归档密码的操作人员能还原其他数据，
+// 但无法读取这部分内容。
+//
+// 条目的大小字段记录密文长度，TLV tlvEntryCipher（必需标签）记录明文大小、密钥派生参数和条目密码的校验值；
+// 密钥与 versionKDF 起的归档相同，由 scrypt 从条目密码派生，盐每次打包随机生成，同一归档的条目使用同一个盐。
+// 内容之后的 SHA-256 按密文计算，没有条目密码也能校验这部分数据是否完好。
+// 密文由等长的块组成：nonce(12) + AES-GCM(64KB 明文) + 认证标签(16)，最后一块保存剩余的明文（可能为空）。
+// 附加数据为条目路径、块序号和是否最后一块，块被调换、截断或移到其他条目时解密失败。
+
+// tlvEntryCipher 单独加密的条目：明文大小(8) + 密钥派生参数(kdfRecordSize) + 条目密码校验值(32)
+const tlvEntryCipher = uint16(2) | tlvCritical
+
+// tlvEntryCipher 值的长度：entryCipherLegacyLen 为较早的程序写入的值，没有派生参数，密钥是条目密码的 SHA-256
+const (
+	entryCipherLen       = 8 + kdfRecordSize + verifierSize
+	entryCipherLegacyLen = 8 + verifierSize
+)
+
+// ErrEntryLocked 读取单独加密的条目内容时没有提供条目密码
+var ErrEntryLocked = errors.New("条目已单独加密，需要提供条目密码")
+
+// entryCipher 单独加密条目使用的密钥
+type entryCipher struct {
+	password string // 读取时的条目密码，按条目记录的派生参数生成密钥
+	gcm      cipher.AEAD
+	record   []byte // 派生参数和密码校验值：写入时为生成的值；读取时为已核对过的值
+}
+
+// newEntryCipher 为打包由条目密码派生密钥（随机盐）
+func newEntryCipher(password string) (*entryCipher, error) {
+	key, record, err := newPasswordKey(password)
+	if err != nil {
+		return nil, err
+	}
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &entryCipher{gcm: aesGCM, record: record}, nil
+}
+
+// readEntryKey 按解包选项的条目密码准备解密，没有条目密码时返回 nil；密钥在读到第一个加密条目时派生
+func readEntryKey(options PackOptions) (*entryCipher, error) {
+	if options.EntryPassword == "" {
+		return nil, nil
+	}
+	return &entryCipher{password: options.EntryPassword}, nil
+}
+
+// check 按条目记录的派生参数生成密钥并核对密码校验值；同一归档的条目记录相同，只需派生和核对一次
+func (ec *entryCipher) check(record []byte) error {
+	if ec.record != nil && string(ec.record) == string(record) {
+		return nil
+	}
+	var key []byte
+	if len(record) == verifierSize {
+		sum := sha256.Sum256([]byte(ec.password))
+		key = sum[:]
+	} else {
+		var err error
+		if key, err = passwordKey(decodeKDF(record[:kdfRecordSize]), ec.password); err != nil {
+			return err
+		}
+	}
+	if err := checkPasswordVerifier(key, record[len(record)-verifierSize:]); err != nil {
+		return fmt.Errorf("条目密码错误")
+	}
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	ec.gcm, ec.record = aesGCM, record
+	return nil
+}
+
+// encryptedContentSize 返回 size 字节明文加密后的长度
+func encryptedContentSize(size int64) int64 {
+	return size + (size/encryptChunkSize+1)*int64(12+16)
+}
+
+// applyEntryEncryption 标记需要单独加密的条目，并生成条目密钥
+func applyEntryEncryption(entries []FileEntry, options PackOptions) ([]FileEntry, PackOptions, error) {
+	if len(options.EntryEncryptPatterns) == 0 {
+		return entries, options, nil
+	}
+	if options.EntryPassword == "" {
+		return nil, options, fmt.Errorf("单独加密条目时必须提供条目密码")
+	}
+	ec, err := newEntryCipher(options.EntryPassword)
+	if err != nil {
+		return nil, options, err
+	}
+	options.entryCipher = ec
+
+	marked := make([]FileEntry, len(entries))
+	for i, entry := range entries {
+		if entry.Type == TypeFile {
+			for _, pattern := range options.EntryEncryptPatterns {
+				if matchPathPattern(pattern, entry.RelPath, false) {
+					entry.Encrypt = true
+					break
+				}
+			}
+		}
+		marked[i] = entry
+	}
+	return marked, options, nil
+}
+
+// tlv 返回明文大小为 size 的条目的 tlvEntryCipher 值
+func (ec *entryCipher) tlv(size int64) []byte {
+	value := make([]byte, 8, entryCipherLen)
+	binary.LittleEndian.PutUint64(value, uint64(size))
+	return append(value, ec.record...)
+}
+
+// chunkAD 块的附加数据：条目路径 + 块序号 + 是否最后一块
+func chunkAD(relPath string, index uint64, final bool) []byte {
+	ad := make([]byte, 0, len(relPath)+9)
+	ad = append(ad, relPath...)
+	ad = binary.LittleEndian.AppendUint64(ad, index)
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// entryEncryptWriter 加密一个条目的内容
+type entryEncryptWriter struct {
+	writer  io.Writer
+	gcm     cipher.AEAD
+	relPath string
+	buffer  []byte
+	index   uint64
+}
+
+func (ec *entryCipher) writer(w io.Writer, relPath string) *entryEncryptWriter {
+	return &entryEncryptWriter{writer: w, gcm: ec.gcm, relPath: relPath}
+}
+
+func (ew *entryEncryptWriter) Write(p []byte) (int, error) {
+	ew.buffer = append(ew.buffer, p...)
+	for len(ew.buffer) >= encryptChunkSize {
+		if err := ew.seal(ew.buffer[:encryptChunkSize], false); err != nil {
+			return 0, err
+		}
+		ew.buffer = ew.buffer[encryptChunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close 写入最后一块（不关闭底层写入器）
+func (ew *entryEncryptWriter) Close() error {
+	err := ew.seal(ew.buffer, true)
+	ew.buffer = nil
+	return err
+}
+
+// seal 加密并写入一块
+func (ew *entryEncryptWriter) seal(chunk []byte, final bool) error {
+	nonce := make([]byte, ew.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := ew.writer.Write(nonce); err != nil {
+		return err
+	}
+	ew.index++
+	_, err := ew.writer.Write(ew.gcm.Seal(nil, nonce, chunk, chunkAD(ew.relPath, ew.index-1, final)))
+	return err
+}
+
+// entryDecryptReader 解密一个条目的内容
+type entryDecryptReader struct {
+	reader    io.Reader
+	gcm       cipher.AEAD
+	relPath   string
+	remaining int64 // 尚未解密的明文字节数
+	index     uint64
+	block     []byte
+	done      bool
+}
+
+func (ec *entryCipher) reader(r io.Reader, relPath string, size int64) *entryDecryptReader {
+	return &entryDecryptReader{reader: r, gcm: ec.gcm, relPath: relPath, remaining: size}
+}
+
+func (dr *entryDecryptReader) Read(p []byte) (int, error) {
+	for len(dr.block) == 0 {
+		if dr.done {
+			// 读完底层的密文（应当已没有剩余数据），使内容之后的摘要得到校验
+			if _, err := io.Copy(io.Discard, dr.reader); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.block)
+	dr.block = dr.block[n:]
+	return n, nil
+}
+
+// open 读取并解密下一块，块的长度由剩余的明文大小决定
+func (dr *entryDecryptReader) open() error {
+	size := int64(encryptChunkSize)
+	final := dr.remaining < encryptChunkSize
+	if final {
+		size = dr.remaining
+	}
+	buf := make([]byte, int64(dr.gcm.NonceSize())+size+int64(dr.gcm.Overhead()))
+	if _, err := io.ReadFull(dr.reader, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	nonce, ciphertext := buf[:dr.gcm.NonceSize()], buf[dr.gcm.NonceSize():]
+	plaintext, err := dr.gcm.Open(ciphertext[:0], nonce, ciphertext, chunkAD(dr.relPath, dr.index, final))
+	if err != nil {
+		return fmt.Errorf("解密条目内容失败: %v", err)
+	}
+	dr.index++
+	dr.remaining -= size
+	dr.block = plaintext
+	dr.done = final
+	return nil
+}
@@ -0,0 +1,250 @@
+package backup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// EntryTable 按列存储的条目元信息，用于列出、统计条目数很多的归档。
+// 定长字段各占一列，路径和链接目标分别连续存放在一个字节区中，内容类型按取值编号（取值很少）；
+// 每个条目约 70 字节加路径长度，没有逐个条目的内存分配，数千万条目时内存占用只有 []FileEntry 的几分之一。
+// 各列以小端字节序保存在 []byte 中，与 v2 索引文件中的布局相同：未加密的索引文件直接映射到内存（mmap）使用，
+// 条目数据由操作系统按需读入，不需要先解码到内存中
+type EntryTable struct {
+	n      int
+	types  []byte // FileType
+	flags  []byte // entryFlagEncrypt、entryFlagSparse
+	modes  []byte // uint32
+	sizes  []byte // int64
+	mtimes []byte // int64
+	atimes []byte // int64
+	ctimes []byte // int64
+	uids   []byte // uint32
+	gids   []byte // uint32
+	majors []byte // uint32
+	minors []byte // uint32
+	// pathEnds 第 i 个路径在 paths 中的结束位置（uint64），开始位置为前一个路径的结束位置
+	pathEnds []byte
+	paths    []byte
+	// linkEnds 与 pathEnds 相同，符号链接和块设备镜像为 LinkTarget，硬链接为 LinkName
+	linkEnds []byte
+	links    []byte
+	mimeIDs  []byte // uint32：mimeNames 中的序号 + 1，0 表示没有内容类型
+	// mimeNames 出现过的内容类型，以 0 字节分隔
+	mimeNames []byte
+
+	mimes     []string          // 由 mimeNames 解析出的内容类型
+	mimeIndex map[string]uint32 // 追加条目时内容类型的序号
+	mapped    []byte            // 映射到内存的索引文件，Close 时解除映射
+}
+
+const (
+	entryFlagEncrypt = byte(0x01) // 条目单独加密（FileEntry.Encrypt）
+	entryFlagSparse  = byte(0x02) // 稀疏文件（FileEntry.Sparse）
+)
+
+// tableColumn 一列的字段和每个条目占用的字节数（0 表示变长）
+type tableColumn struct {
+	data  *[]byte
+	width int
+}
+
+// columns 返回全部列，顺序即索引文件中的顺序
+func (t *EntryTable) columns() []tableColumn {
+	return []tableColumn{
+		{&t.types, 1}, {&t.flags, 1}, {&t.modes, 4}, {&t.sizes, 8},
+		{&t.mtimes, 8}, {&t.atimes, 8}, {&t.ctimes, 8},
+		{&t.uids, 4}, {&t.gids, 4}, {&t.majors, 4}, {&t.minors, 4},
+		{&t.pathEnds, 8}, {&t.paths, 0}, {&t.linkEnds, 8}, {&t.links, 0},
+		{&t.mimeIDs, 4}, {&t.mimeNames, 0},
+	}
+}
+
+// NewEntryTable 由条目列表创建按列存储的表
+func NewEntryTable(entries []FileEntry) *EntryTable {
+	t := &EntryTable{}
+	for _, entry := range entries {
+		t.Append(entry)
+	}
+	return t
+}
+
+// Append 在表的末尾追加一个条目（不能用于映射到内存的表）
+func (t *EntryTable) Append(entry FileEntry) {
+	le := binary.LittleEndian
+	var flags byte
+	if entry.Encrypt {
+		flags |= entryFlagEncrypt
+	}
+	if entry.Sparse {
+		flags |= entryFlagSparse
+	}
+	t.types = append(t.types, byte(entry.Type))
+	t.flags = append(t.flags, flags)
+	t.modes = le.AppendUint32(t.modes, entry.Mode)
+	t.sizes = le.AppendUint64(t.sizes, uint64(entry.Size))
+	t.mtimes = le.AppendUint64(t.mtimes, uint64(entry.ModTime))
+	t.atimes = le.AppendUint64(t.atimes, uint64(entry.AccessTime))
+	t.ctimes = le.AppendUint64(t.ctimes, uint64(entry.ChangeTime))
+	t.uids = le.AppendUint32(t.uids, uint32(entry.UID))
+	t.gids = le.AppendUint32(t.gids, uint32(entry.GID))
+	t.majors = le.AppendUint32(t.majors, uint32(entry.DevMajor))
+	t.minors = le.AppendUint32(t.minors, uint32(entry.DevMinor))
+	t.paths = append(t.paths, entry.RelPath...)
+	t.pathEnds = le.AppendUint64(t.pathEnds, uint64(len(t.paths)))
+	link := entry.LinkTarget
+	if entry.Type == TypeHardlink {
+		link = entry.LinkName
+	}
+	t.links = append(t.links, link...)
+	t.linkEnds = le.AppendUint64(t.linkEnds, uint64(len(t.links)))
+	t.mimeIDs = le.AppendUint32(t.mimeIDs, t.mimeID(entry.Mime))
+	t.n++
+}
+
+// mimeID 返回内容类型的编号，新的内容类型加入 mimeNames
+func (t *EntryTable) mimeID(mime string) uint32 {
+	if mime == "" {
+		return 0
+	}
+	if t.mimeIndex == nil {
+		t.mimeIndex = make(map[string]uint32, len(t.mimes))
+		for i, name := range t.mimes {
+			t.mimeIndex[name] = uint32(i + 1)
+		}
+	}
+	if id, ok := t.mimeIndex[mime]; ok {
+		return id
+	}
+	t.mimes = append(t.mimes, mime)
+	t.mimeNames = append(append(t.mimeNames, mime...), 0)
+	id := uint32(len(t.mimes))
+	t.mimeIndex[mime] = id
+	return id
+}
+
+// Len 返回条目数
+func (t *EntryTable) Len() int {
+	return t.n
+}
+
+// span 返回变长字段第 i 个值在字节区中的范围
+func span(ends []byte, i int) (int, int) {
+	start := 0
+	if i > 0 {
+		start = int(binary.LittleEndian.Uint64(ends[(i-1)*8:]))
+	}
+	return start, int(binary.LittleEndian.Uint64(ends[i*8:]))
+}
+
+// Path 返回第 i 个条目的路径
+func (t *EntryTable) Path(i int) string {
+	start, end := span(t.pathEnds, i)
+	return string(t.paths[start:end])
+}
+
+// Type 返回第 i 个条目的类型
+func (t *EntryTable) Type(i int) FileType {
+	return FileType(t.types[i])
+}
+
+// Size 返回第 i 个条目的大小
+func (t *EntryTable) Size(i int) int64 {
+	return int64(binary.LittleEndian.Uint64(t.sizes[i*8:]))
+}
+
+// Mime 返回第 i 个条目的内容类型
+func (t *EntryTable) Mime(i int) string {
+	if id := binary.LittleEndian.Uint32(t.mimeIDs[i*4:]); id > 0 {
+		return t.mimes[id-1]
+	}
+	return ""
+}
+
+// Entry 返回第 i 个条目的全部元信息
+func (t *EntryTable) Entry(i int) FileEntry {
+	le := binary.LittleEndian
+	entry := FileEntry{
+		RelPath:    t.Path(i),
+		Type:       t.Type(i),
+		Mode:       le.Uint32(t.modes[i*4:]),
+		Size:       t.Size(i),
+		ModTime:    int64(le.Uint64(t.mtimes[i*8:])),
+		AccessTime: int64(le.Uint64(t.atimes[i*8:])),
+		ChangeTime: int64(le.Uint64(t.ctimes[i*8:])),
+		UID:        int(le.Uint32(t.uids[i*4:])),
+		GID:        int(le.Uint32(t.gids[i*4:])),
+		DevMajor:   int64(le.Uint32(t.majors[i*4:])),
+		DevMinor:   int64(le.Uint32(t.minors[i*4:])),
+		Mime:       t.Mime(i),
+		Encrypt:    t.flags[i]&entryFlagEncrypt != 0,
+		Sparse:     t.flags[i]&entryFlagSparse != 0,
+	}
+	if entry.Type == TypeFile {
+		entry.Blocks = estimatedBlocks(entry.Size)
+	}
+	start, end := span(t.linkEnds, i)
+	if link := string(t.links[start:end]); entry.Type == TypeHardlink {
+		entry.LinkName = link
+	} else {
+		entry.LinkTarget = link
+	}
+	return entry
+}
+
+// Entries 返回全部条目（每个条目一个 FileEntry，条目很多时占用大量内存）
+func (t *EntryTable) Entries() []FileEntry {
+	entries := make([]FileEntry, t.n)
+	for i := range entries {
+		entries[i] = t.Entry(i)
+	}
+	return entries
+}
+
+// Close 解除索引文件的内存映射；之后不能再访问表
+func (t *EntryTable) Close() error {
+	if t.mapped == nil {
+		return nil
+	}
+	err := syscall.Munmap(t.mapped)
+	t.mapped = nil
+	return err
+}
+
+// check 检查各列的长度与条目数一致、变长字段的结束位置递增且不超过字节区，
+// 以及路径长度不超过限制。从索引文件读取的表在使用前必须检查，Entry 等方法不再检查边界
+func (t *EntryTable) check(limits ReadLimits) error {
+	for _, column := range t.columns() {
+		if column.width > 0 && len(*column.data) != t.n*column.width {
+			return fmt.Errorf("索引的列长度与条目数 (%d) 不一致，索引可能已损坏", t.n)
+		}
+	}
+	maxLen := uint64(limits.maxPathLen())
+	for _, field := range []struct {
+		ends []byte
+		data []byte
+	}{{t.pathEnds, t.paths}, {t.linkEnds, t.links}} {
+		var prev uint64
+		for i := 0; i < t.n; i++ {
+			end := binary.LittleEndian.Uint64(field.ends[i*8:])
+			if end < prev || end > uint64(len(field.data)) || end-prev > maxLen {
+				return fmt.Errorf("索引中第 %d 个条目的路径位置异常，索引可能已损坏", i+1)
+			}
+			prev = end
+		}
+	}
+	if len(t.mimeNames) > 0 {
+		if t.mimeNames[len(t.mimeNames)-1] != 0 {
+			return fmt.Errorf("索引中的内容类型表已损坏")
+		}
+		t.mimes = strings.Split(string(t.mimeNames[:len(t.mimeNames)-1]), "\x00")
+	}
+	for i := 0; i < t.n; i++ {
+		if id := binary.LittleEndian.Uint32(t.mimeIDs[i*4:]); id > uint32(len(t.mimes)) {
+			return fmt.Errorf("索引中第 %d 个条目的内容类型编号异常，索引可能已损坏", i+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package backup
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// estimateSampleLimit 每个抽样文件最多读取的字节数
+const estimateSampleLimit = 4 * 1024 * 1024
+
+// PackEstimate 打包结果的估算
+type PackEstimate struct {
+	Entries           int           // 条目数
+	ContentBytes      int64         // 打包时读取的文件内容总字节数（稀疏文件只计有数据的区域）
+	HoleBytes         int64         // 稀疏文件中不保存的空洞的总字节数
+	SampledFiles      int           // 抽样的文件数
+	SampledBytes      int64         // 抽样读取的原始字节数
+	SampledOutput     int64         // 抽样内容经过压缩后的字节数
+	Ratio             float64       // 抽样得到的压缩率（输出/原始）
+	EstimatedSize     int64         // 估算的归档大小
+	EstimatedDuration time.Duration // 估算的打包耗时
+}
+
+// EstimatePack 不写入归档，估算打包后的大小和耗时
+// 按 fraction（0~1）的比例抽样文件，将其内容（每个文件最多 4MB）经过选项指定的压缩方式得到压缩率和吞吐量，
+// 再按全部文件内容推算；条目元数据和加密开销按格式直接计算。
+// 稀疏文件与打包时一样用 SEEK_DATA/SEEK_HOLE 找出有数据的区域，只计入并抽样这些区域：
+// 按表观大小计算时，大量空洞会让内容大小偏大，抽样读到的全是 0，压缩率也偏低。
+// 透明压缩的文件系统上占用的块同样少于文件大小，但没有空洞，仍按完整大小计算（打包时读取的就是完整内容）
+func EstimatePack(root string, filter *Filter, options PackOptions, fraction float64) (PackEstimate, error) {
+	var est PackEstimate
+	options = resolveCompression(options)
+	if fraction <= 0 || fraction > 1 {
+		return est, fmt.Errorf("抽样比例必须在 (0, 1] 之间: %v", fraction)
+	}
+	absRoot, entries, err := collectEntries(root, filter, options)
+	if err != nil {
+		return est, err
+	}
+	est.Entries = len(entries)
+
+	var metadata int64
+	var files []FileEntry
+	extents := make(map[string][]sparseExtent) // 稀疏文件的数据区域
+	for _, entry := range entries {
+		metadata += entryOverhead(entry, options)
+		if entry.Type != TypeFile {
+			continue
+		}
+		size := entry.Size
+		if ranges, err := sparseEntryExtents(entry, absRoot, options); err == nil && ranges != nil {
+			extents[entry.RelPath] = ranges
+			size = sparseDataSize(ranges)
+			est.HoleBytes += entry.Size - size
+			// tlvSparse：标签(2) + 长度(4) + 文件大小(8) + 数据区域表
+			metadata += 6 + 8 + 16*int64(len(ranges))
+		}
+		est.ContentBytes += size
+		if size > 0 {
+			files = append(files, entry)
+		}
+	}
+
+	// 抽样：按路径哈希确定性地选择文件，重复估算的结果一致
+	var sample []FileEntry
+	for _, entry := range files {
+		if sampled(entry.RelPath, fraction) {
+			sample = append(sample, entry)
+		}
+	}
+	if len(sample) == 0 && len(files) > 0 {
+		sample = files[:1]
+	}
+
+	start := time.Now()
+	counter := &countingWriter{}
+	compressor, err := newCompressWriter(counter, options)
+	if err != nil {
+		return est, err
+	}
+	var sink io.Writer = counter
+	if compressor != nil {
+		sink = compressor
+	}
+	for _, entry := range sample {
+		n, err := sampleFile(sink, filepath.Join(absRoot, entry.RelPath), extents[entry.RelPath])
+		if err != nil {
+			warn(options, "抽样读取 %s 失败: %v", entry.RelPath, err)
+			continue
+		}
+		est.SampledFiles++
+		est.SampledBytes += n
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return est, fmt.Errorf("压缩抽样数据失败: %v", err)
+		}
+	}
+	elapsed := time.Since(start)
+	est.SampledOutput = counter.n
+
+	est.Ratio = 1
+	if est.SampledBytes > 0 {
+		est.Ratio = float64(est.SampledOutput) / float64(est.SampledBytes)
+		scale := float64(est.ContentBytes) / float64(est.SampledBytes)
+		est.EstimatedDuration = time.Duration(float64(elapsed) * scale)
+	}
+
+	size := headerSize + int64(float64(est.ContentBytes+metadata)*est.Ratio)
+	if options.Encrypt {
+		// 每 64KB 明文一个 nonce(12) 和认证标签(16)，以及文件头之后的初始 nonce、派生参数和密码校验值
+		size += 12 + passwordPreambleSize(formatVersion) + (size/(64*1024)+1)*(12+16)
+	}
+	if options.StreamHash {
+		size += (size/streamHashInterval + 1) * streamHashSize
+	}
+	est.EstimatedSize = size
+	return est, nil
+}
+
+// entryOverhead 计算条目在归档中除文件内容以外的字节数
+func entryOverhead(entry FileEntry, options PackOptions) int64 {
+	// 类型(1) + 路径长度(4) + 路径 + 权限(4) + 三个时间(24) + UID/GID(8) + TLV 结束标签(2)
+	n := int64(1 + 4 + len(entry.RelPath) + 4 + 24 + 8 + 2)
+	switch entry.Type {
+	case TypeFile:
+		// 大小(8) + 内容之后的 SHA-256
+		n += 8 + contentChecksumSize
+	case TypeSymlink:
+		n += 4 + int64(len(entry.LinkTarget))
+	case TypeHardlink:
+		n += 4 + int64(len(entry.LinkName))
+	case TypeCharDevice, TypeBlockDevice:
+		n += 16
+	}
+	if options.DetectMime && entry.Type == TypeFile {
+		// 内容类型 TLV：标签(2) + 长度(4) + 常见类型字符串
+		n += 6 + 24
+	}
+	return n
+}
+
+// sampled 按路径哈希决定文件是否被抽样
+func sampled(relPath string, fraction float64) bool {
+	h := fnv.New32a()
+	h.Write([]byte(relPath))
+	return float64(h.Sum32())/float64(1<<32) < fraction
+}
+
+// sampleFile 将文件开头最多 estimateSampleLimit 字节写入 w，返回读取的字节数
+// extents 不为 nil 时为稀疏文件的数据区域，只读取这些区域（按顺序拼接）
+func sampleFile(w io.Writer, path string, extents []sparseExtent) (int64, error) {
+	f, err := openSourceFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var content io.Reader = f
+	if extents != nil {
+		sections := make([]io.Reader, len(extents))
+		for i, extent := range extents {
+			sections[i] = io.NewSectionReader(f, extent.offset, extent.length)
+		}
+		content = io.MultiReader(sections...)
+	}
+	return io.Copy(w, io.LimitReader(content, estimateSampleLimit))
+}
+
+// countingWriter 只统计写入的字节数
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
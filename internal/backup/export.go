@@ -0,0 +1,177 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// 导出：把 BKUP 归档转换为 PAX 格式的 tar 或 tar.gz，是 ImportArchive 的反方向。
+// 权限（包括 setuid/setgid/sticky）、属主、修改/访问/变更时间、链接、设备号按 tar 的字段保存，
+// 扩展属性写为 SCHILY.xattr.* 记录（GNU tar --xattrs、bsdtar 和 ImportArchive 都能读取）。
+// 稀疏文件、块存储中的文件和单独加密的文件写出完整内容；块设备镜像条目写为普通文件。
+// 内容类型和软件包清单没有对应的 tar 字段（自定义的 PAX 记录会让 GNU tar 对每个条目警告），不导出，
+// 转换回 BKUP 时可以重新检测内容类型；增量归档只记录了变化，拒绝导出。
+
+// ExportArchive 将 BKUP 归档转换为 tar 归档
+// archivePath: BKUP 归档路径或 http(s):// 地址
+// outputPath: 输出的 tar 文件路径，写完后才从 .partial 重命名
+// gzipped: 是否用 gzip 压缩输出
+// options: 读取选项（密码、条目密码、块存储、摘要等与 unpack 相同）
+// 返回: 写入的条目数
+func ExportArchive(archivePath string, outputPath string, gzipped bool, options PackOptions) (count int, err error) {
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return 0, err
+	}
+	defer ar.Close()
+
+	partialPath := outputPath + partialSuffix
+	outFile, err := os.Create(partialPath)
+	if err != nil {
+		return 0, fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	defer func() {
+		outFile.Close()
+		if err != nil {
+			os.Remove(partialPath)
+		}
+	}()
+
+	var w io.Writer = outFile
+	var gz *gzip.Writer
+	if gzipped {
+		gz = gzip.NewWriter(outFile)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	for {
+		entry, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if entry.incremental != nil {
+			return count, fmt.Errorf("增量归档只记录了相对于基准的变化，不能导出；请先解包到目录再打包为 tar")
+		}
+		if entry.packages != nil {
+			warn(options, "tar 中没有保存软件包清单的位置，导出时忽略")
+		}
+		hdr, err := exportHeader(entry.fileEntry())
+		if err != nil {
+			return count, err
+		}
+		if hdr == nil {
+			warn(options, "tar 不支持套接字，跳过: %s", entry.RelPath)
+			continue
+		}
+		if entry.Type == TypeImage {
+			warn(options, "块设备镜像 %s（%s）导出为普通文件", entry.RelPath, entry.LinkTarget)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return count, fmt.Errorf("写入 tar 头部失败 (%s): %v", entry.RelPath, err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if ar.locked != nil {
+				return count, fmt.Errorf("%v (%s)", ar.locked, entry.RelPath)
+			}
+			if _, err := io.Copy(tw, withCancel(ar, options)); err != nil {
+				return count, fmt.Errorf("写入文件内容失败 (%s): %v", entry.RelPath, err)
+			}
+		}
+		count++
+	}
+
+	if err := tw.Close(); err != nil {
+		return count, fmt.Errorf("写入 tar 结尾失败: %v", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return count, fmt.Errorf("写入 gzip 数据失败: %v", err)
+		}
+	}
+	if err := outFile.Sync(); err != nil {
+		return count, fmt.Errorf("写入输出文件失败: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		return count, fmt.Errorf("写入输出文件失败: %v", err)
+	}
+	if err := os.Rename(partialPath, outputPath); err != nil {
+		return count, fmt.Errorf("重命名输出文件失败: %v", err)
+	}
+	return count, nil
+}
+
+// exportHeader 生成条目的 tar 头部，tar 不支持的类型（套接字）返回 nil
+func exportHeader(entry FileEntry) (*tar.Header, error) {
+	mode := os.FileMode(entry.Mode)
+	hdr := &tar.Header{
+		Name:    entry.RelPath,
+		Mode:    tarMode(mode),
+		Uid:     entry.UID,
+		Gid:     entry.GID,
+		ModTime: time.Unix(entry.ModTime, 0),
+		Format:  tar.FormatPAX,
+	}
+	if entry.AccessTime != 0 {
+		hdr.AccessTime = time.Unix(entry.AccessTime, 0)
+	}
+	if entry.ChangeTime != 0 {
+		hdr.ChangeTime = time.Unix(entry.ChangeTime, 0)
+	}
+	switch entry.Type {
+	case TypeFile, TypeImage:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = entry.Size
+	case TypeDir:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name = strings.TrimSuffix(hdr.Name, "/") + "/"
+	case TypeSymlink:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = entry.LinkTarget
+	case TypeHardlink:
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = entry.LinkName
+	case TypeFifo:
+		hdr.Typeflag = tar.TypeFifo
+	case TypeCharDevice:
+		hdr.Typeflag = tar.TypeChar
+		hdr.Devmajor, hdr.Devminor = entry.DevMajor, entry.DevMinor
+	case TypeBlockDevice:
+		hdr.Typeflag = tar.TypeBlock
+		hdr.Devmajor, hdr.Devminor = entry.DevMajor, entry.DevMinor
+	case TypeSocket:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("未知的文件类型: %d (%s)", entry.Type, entry.RelPath)
+	}
+	if len(entry.Xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(entry.Xattrs))
+		for name, value := range entry.Xattrs {
+			hdr.PAXRecords["SCHILY.xattr."+name] = string(value)
+		}
+	}
+	return hdr, nil
+}
+
+// tarMode 返回 tar 头部的权限字段（权限位加 setuid、setgid 和 sticky 位）
+func tarMode(mode os.FileMode) int64 {
+	perm := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
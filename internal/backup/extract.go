@@ -0,0 +1,186 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 提取：只还原归档中指定的文件或目录（目录包括其下的全部内容），其他条目的数据顺序读过而不写入，
+// 不必为了一个文件解包整个归档。提取的条目写在目标目录中与归档中相同的相对路径下；
+// 选中路径的上级目录只还原目录本身（权限、属主和时间，与 Filter.IncludeParents 相同）。
+// 选中的硬链接链接到没有选中的文件时，它的内容在读到硬链接时已经过去：解包结束后重新读取一遍归档，
+// 把那个文件的内容还原到第一个这样的硬链接，其余的硬链接链接到它（没有这种硬链接时只读取一遍）。
+// 增量和差异归档的删除记录只应用到选中的路径；差异归档的基准同样只提取选中的路径。
+
+// pathSelector 提取时选中的路径
+type pathSelector struct {
+	paths    []string        // 规范化的路径，不以 "/" 结尾
+	matched  []bool          // 每个路径是否在归档中出现
+	restored map[string]bool // 已还原的条目（差异归档的基准和差异归档中的同一路径只计一次）
+}
+
+// newPathSelector 规范化要提取的路径，如 "./etc/hosts"、"home/user/"
+func newPathSelector(paths []string) (*pathSelector, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("没有指定要提取的路径")
+	}
+	s := &pathSelector{matched: make([]bool, len(paths)), restored: make(map[string]bool)}
+	for _, p := range paths {
+		clean := strings.TrimPrefix(path.Clean("/"+p), "/")
+		if clean == "" {
+			return nil, fmt.Errorf("要提取的路径无效: %q（提取全部内容请使用 unpack）", p)
+		}
+		s.paths = append(s.paths, clean)
+	}
+	return s, nil
+}
+
+// match 条目是否被选中（路径本身或其下的条目），同时记录匹配的路径
+func (s *pathSelector) match(relPath string) bool {
+	selected := false
+	for i, p := range s.paths {
+		if isUnder(relPath, p) {
+			s.matched[i] = true
+			selected = true
+		}
+	}
+	return selected
+}
+
+// ancestor 目录条目是否为某个选中路径的上级目录
+func (s *pathSelector) ancestor(relPath string) bool {
+	for _, p := range s.paths {
+		if strings.HasPrefix(p, strings.TrimSuffix(relPath, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// deletions 返回删除记录中影响选中路径的部分：选中路径下被删除的路径，以及被删除的上级目录下的选中路径
+func (s *pathSelector) deletions(deleted []string) []string {
+	var result []string
+	for _, d := range deleted {
+		matched := false
+		for _, p := range s.paths {
+			if isUnder(d, p) {
+				matched = true
+			}
+		}
+		if matched {
+			result = append(result, d)
+			continue
+		}
+		for _, p := range s.paths {
+			if isUnder(p, d) {
+				result = append(result, p)
+			}
+		}
+	}
+	return result
+}
+
+// isUnder relPath 是否为 dir 本身或其下的路径（两者都可以以 "/" 结尾）
+func isUnder(relPath, dir string) bool {
+	relPath, dir = strings.TrimSuffix(relPath, "/"), strings.TrimSuffix(dir, "/")
+	return relPath == dir || strings.HasPrefix(relPath, dir+"/")
+}
+
+// ExtractPaths 从归档中提取指定的文件或目录
+// paths: 归档中的路径，如 "etc/hosts"、"home/user/"（目录包括其下的全部内容）
+// restoreRoot: 目标目录，提取的条目写在其中与归档中相同的相对路径下
+// options: 解包选项（与 UnpackWithOptions 相同）
+// 返回还原的条目数（包括上级目录）；有路径在归档中不存在时返回错误，其他路径照常提取
+func ExtractPaths(archivePath string, paths []string, restoreRoot string, options PackOptions) (int, error) {
+	selector, err := newPathSelector(paths)
+	if err != nil {
+		return 0, err
+	}
+	options.selector = selector
+	if err := UnpackWithOptions(archivePath, restoreRoot, options); err != nil {
+		return len(selector.restored), err
+	}
+	var missing []string
+	for i, p := range selector.paths {
+		if !selector.matched[i] {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return len(selector.restored), fmt.Errorf("归档中没有 %s", strings.Join(missing, ", "))
+	}
+	return len(selector.restored), nil
+}
+
+// restorePromotedLinks 重新读取归档，把没有选中的文件的内容还原到链接到它的第一个选中的硬链接，
+// 其余的硬链接链接到这个文件（提取指定路径和按过滤条件还原共用）
+// links: 没有选中的文件 -> 链接到它的选中的硬链接（按归档中的顺序，已经过路径安全检查）
+func restorePromotedLinks(archivePath, absRestoreRoot string, links map[string][]string, options PackOptions) error {
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+	for remaining := len(links); remaining > 0; {
+		if err := checkCanceled(options); err != nil {
+			return err
+		}
+		entry, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		paths, ok := links[entry.RelPath]
+		if !ok || ar.entryType != entryTypeFile {
+			continue
+		}
+		remaining--
+		if ar.locked != nil {
+			warn(options, "跳过硬链接 %s：链接的文件 %s 无法读取（%v）", strings.Join(paths, ", "), entry.RelPath, ar.locked)
+			continue
+		}
+
+		// 按第一个硬链接的路径还原（还原策略按这个路径调整属主和权限，硬链接已确认不跳过）
+		entry.RelPath = paths[0]
+		if options.RestorePolicy != nil {
+			options.RestorePolicy.apply(entry)
+		}
+		first := filepath.Join(absRestoreRoot, paths[0])
+		content := withCancel(ar, options)
+		if entry.sparse != nil {
+			content = withCancel(ar.stored, options)
+		}
+		if err := restoreFile(content, absRestoreRoot, entry); err != nil {
+			return err
+		}
+		if err := restoreXattrs(first, restoredXattrs(entry.xattrs, options)); err != nil {
+			warn(options, "%s: %v", entry.RelPath, err)
+		}
+		for i, p := range paths {
+			targetPath := filepath.Join(absRestoreRoot, p)
+			if i > 0 {
+				link := *entry
+				link.RelPath, link.Type, link.LinkName = p, TypeHardlink, paths[0]
+				if err := restoreHardlink(absRestoreRoot, &link); err != nil {
+					return err
+				}
+			}
+			if options.selector != nil {
+				options.selector.restored[p] = true
+			}
+			if options.OnEntryRestored != nil {
+				restored := entry.fileEntry()
+				restored.RelPath = p
+				if err := options.OnEntryRestored(restored, targetPath); err != nil {
+					return fmt.Errorf("条目还原后的回调失败 (%s): %v", p, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// 文件能力：ping、mtr 等程序不用 setuid，而是在 security.capability 扩展属性中记录所需的能力（如 cap_net_raw）。
+// 这个属性随其他扩展属性一起保存和还原（见 xattr.go），解包时在恢复属主之后设置，还原的程序不需要再手动 setcap；
+// 设置它需要 CAP_SETFCAP，普通用户解包时只警告。这里只负责把属性值解析为 getcap 的格式，供列表显示。
+
+// securityCapabilityXattr 记录文件能力的扩展属性
+const securityCapabilityXattr = "security.capability"
+
+// vfs_cap_data 的版本和标志（linux/capability.h）
+const (
+	vfsCapRevisionMask   = 0xFF000000
+	vfsCapRevision1      = 0x01000000 // 32 位能力集
+	vfsCapRevision2      = 0x02000000 // 64 位能力集
+	vfsCapRevision3      = 0x03000000 // 64 位能力集 + 用户名字空间的 root UID
+	vfsCapFlagsEffective = 0x000001
+)
+
+// capabilityNames 能力编号对应的名称，编号更大的能力显示为 cap_<编号>
+var capabilityNames = []string{
+	"cap_chown", "cap_dac_override", "cap_dac_read_search", "cap_fowner", "cap_fsetid",
+	"cap_kill", "cap_setgid", "cap_setuid", "cap_setpcap", "cap_linux_immutable",
+	"cap_net_bind_service", "cap_net_broadcast", "cap_net_admin", "cap_net_raw", "cap_ipc_lock",
+	"cap_ipc_owner", "cap_sys_module", "cap_sys_rawio", "cap_sys_chroot", "cap_sys_ptrace",
+	"cap_sys_pacct", "cap_sys_admin", "cap_sys_boot", "cap_sys_nice", "cap_sys_resource",
+	"cap_sys_time", "cap_sys_tty_config", "cap_mknod", "cap_lease", "cap_audit_write",
+	"cap_audit_control", "cap_setfcap", "cap_mac_override", "cap_mac_admin", "cap_syslog",
+	"cap_wake_alarm", "cap_block_suspend", "cap_audit_read", "cap_perfmon", "cap_bpf",
+	"cap_checkpoint_restore",
+}
+
+// FileCapabilities 返回条目记录的文件能力，格式与 getcap 相同（如 "cap_net_raw=ep"），没有记录时返回空字符串
+func (e FileEntry) FileCapabilities() string {
+	value := e.Xattrs[securityCapabilityXattr]
+	if value == nil {
+		return ""
+	}
+	text, err := formatFileCapabilities(value)
+	if err != nil {
+		return fmt.Sprintf("(%v)", err)
+	}
+	return text
+}
+
+// formatFileCapabilities 将 security.capability 的值（vfs_cap_data）格式化为 getcap 的文本：
+// 标志相同的能力合为一组，如 "cap_chown=ei cap_net_admin,cap_net_raw=ep"
+func formatFileCapabilities(value []byte) (string, error) {
+	if len(value) < 4 {
+		return "", fmt.Errorf("文件能力数据无效")
+	}
+	magic := binary.LittleEndian.Uint32(value)
+	words, size := 0, 0
+	switch magic & vfsCapRevisionMask {
+	case vfsCapRevision1:
+		words, size = 1, 12
+	case vfsCapRevision2:
+		words, size = 2, 20
+	case vfsCapRevision3:
+		words, size = 2, 24
+	default:
+		return "", fmt.Errorf("不支持的文件能力版本 %#x", magic&vfsCapRevisionMask)
+	}
+	if len(value) != size {
+		return "", fmt.Errorf("文件能力数据长度无效 (%d 字节)", len(value))
+	}
+	var permitted, inheritable uint64
+	for i := 0; i < words; i++ {
+		permitted |= uint64(binary.LittleEndian.Uint32(value[4+8*i:])) << (32 * i)
+		inheritable |= uint64(binary.LittleEndian.Uint32(value[8+8*i:])) << (32 * i)
+	}
+
+	// 按 e、i、p 标志分组，组按第一个能力的编号排列；有效标志作用于 permitted 和 inheritable 中的全部能力
+	var order []string
+	groups := make(map[string][]string)
+	for bit := 0; bit < 32*words; bit++ {
+		flags := ""
+		if magic&vfsCapFlagsEffective != 0 && (permitted|inheritable)&(1<<bit) != 0 {
+			flags += "e"
+		}
+		if inheritable&(1<<bit) != 0 {
+			flags += "i"
+		}
+		if permitted&(1<<bit) != 0 {
+			flags += "p"
+		}
+		if flags == "" {
+			continue
+		}
+		name := fmt.Sprintf("cap_%d", bit)
+		if bit < len(capabilityNames) {
+			name = capabilityNames[bit]
+		}
+		if groups[flags] == nil {
+			order = append(order, flags)
+		}
+		groups[flags] = append(groups[flags], name)
+	}
+	parts := make([]string, 0, len(order)+1)
+	for _, flags := range order {
+		parts = append(parts, strings.Join(groups[flags], ",")+"="+flags)
+	}
+	if magic&vfsCapRevisionMask == vfsCapRevision3 {
+		if rootID := binary.LittleEndian.Uint32(value[20:]); rootID != 0 {
+			parts = append(parts, fmt.Sprintf("[rootid=%d]", rootID))
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
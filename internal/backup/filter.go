@@ -1,7 +1,9 @@
 package backup
 
 import (
+	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -9,42 +11,42 @@ import (
 // Filter 定义文件过滤条件
 type Filter struct {
 	// 路径过滤：支持通配符模式，例如 "*.txt", "subdir/**"
-	PathPatterns []string // 包含的路径模式（白名单）
-	ExcludePaths []string // 排除的路径模式（黑名单）
+	PathPatterns []string `json:"include,omitempty"` // 包含的路径模式（白名单）
+	ExcludePaths []string `json:"exclude,omitempty"` // 排除的路径模式（黑名单）
 	
 	// 类型过滤：指定要包含的文件类型
-	IncludeTypes []FileType // 如果为空，则包含所有类型
+	IncludeTypes []FileType `json:"types,omitempty"` // 如果为空，则包含所有类型
 	
 	// 名字过滤：基于文件名（不含路径）
-	NamePatterns []string // 文件名模式，例如 "*.log", "test*"
+	NamePatterns []string `json:"names,omitempty"` // 文件名模式，例如 "*.log", "test*"
 	
 	// 时间过滤：基于修改时间
-	MinModTime *time.Time // 最小修改时间
-	MaxModTime *time.Time // 最大修改时间
+	MinModTime *time.Time `json:"min_time,omitempty"` // 最小修改时间
+	MaxModTime *time.Time `json:"max_time,omitempty"` // 最大修改时间
 	
 	// 尺寸过滤：基于文件大小
-	MinSize *int64 // 最小文件大小（字节）
-	MaxSize *int64 // 最大文件大小（字节）
+	MinSize *int64 `json:"min_size,omitempty"` // 最小文件大小（字节）
+	MaxSize *int64 `json:"max_size,omitempty"` // 最大文件大小（字节）
+	// 尺寸过滤的统计方式：空或 apparent 按文件大小，blocks 按实际占用的磁盘块（FileEntry.Blocks），
+	// 稀疏文件和透明压缩的文件系统上的文件按占用的空间而不是表观大小过滤
+	SizeMode UsageMode `json:"size_mode,omitempty"`
+	
+	// 保留上级目录：被包含条目的上级目录即使不匹配过滤条件也写入（只有元数据），
+	// 解包时中间目录按归档中的权限、属主和时间还原，而不是临时以 0755 创建
+	IncludeParents bool `json:"include_parents,omitempty"`
 }
 
 // Match 检查文件条目是否匹配过滤条件
 func (f *Filter) Match(entry FileEntry) bool {
 	// 路径过滤
+	isDir := entry.Type == TypeDir
 	if len(f.PathPatterns) > 0 {
 		matched := false
 		for _, pattern := range f.PathPatterns {
-			if match, _ := filepath.Match(pattern, entry.RelPath); match {
+			if matchPathPattern(pattern, entry.RelPath, isDir) {
 				matched = true
 				break
 			}
-			// 支持目录通配符匹配
-			if strings.Contains(pattern, "**") {
-				// 简单的递归匹配
-				if strings.HasPrefix(entry.RelPath, strings.Replace(pattern, "**", "", 1)) {
-					matched = true
-					break
-				}
-			}
 		}
 		if !matched {
 			return false
@@ -54,15 +56,9 @@ func (f *Filter) Match(entry FileEntry) bool {
 	// 排除路径过滤
 	if len(f.ExcludePaths) > 0 {
 		for _, pattern := range f.ExcludePaths {
-			if match, _ := filepath.Match(pattern, entry.RelPath); match {
+			if matchPathPattern(pattern, entry.RelPath, isDir) {
 				return false
 			}
-			// 支持目录通配符匹配
-			if strings.Contains(pattern, "**") {
-				if strings.HasPrefix(entry.RelPath, strings.Replace(pattern, "**", "", 1)) {
-					return false
-				}
-			}
 		}
 	}
 	
@@ -111,10 +107,14 @@ func (f *Filter) Match(entry FileEntry) bool {
 	
 	// 尺寸过滤（只对普通文件有效）
 	if entry.Type == TypeFile {
-		if f.MinSize != nil && entry.Size < *f.MinSize {
+		size := entry.Size
+		if f.SizeMode == UsageBlocks {
+			size = entry.Blocks
+		}
+		if f.MinSize != nil && size < *f.MinSize {
 			return false
 		}
-		if f.MaxSize != nil && entry.Size > *f.MaxSize {
+		if f.MaxSize != nil && size > *f.MaxSize {
 			return false
 		}
 	}
@@ -122,18 +122,250 @@ func (f *Filter) Match(entry FileEntry) bool {
 	return true
 }
 
+// matchPathPattern 用路径模式匹配条目路径
+// 两侧都先规范化为不带结尾 "/" 的形式再比较，因此 "logs" 同时匹配文件 logs 和目录 logs/；
+// 以 "/" 结尾的模式（如 "logs/"）只匹配目录。
+// 包含 "**" 的模式按前缀递归匹配，例如 "subdir/**" 匹配 subdir/ 及其下所有条目
+func matchPathPattern(pattern, relPath string, isDir bool) bool {
+	pattern = filepath.ToSlash(pattern)
+	dirOnly := strings.HasSuffix(pattern, "/")
+	if dirOnly && !isDir {
+		return false
+	}
+	pattern = strings.TrimSuffix(pattern, "/")
+	path := strings.TrimSuffix(relPath, "/")
+	
+	if match, _ := filepath.Match(pattern, path); match {
+		return true
+	}
+	
+	// 支持目录通配符匹配（简单的递归匹配）
+	if strings.Contains(pattern, "**") {
+		if isDir {
+			path += "/"
+		}
+		return strings.HasPrefix(path, strings.Replace(pattern, "**", "", 1))
+	}
+	return false
+}
+
 // ApplyFilter 对文件条目列表应用过滤条件
+// 返回的条目按路径排列、硬链接在目标之后（见 order.go），与输入的顺序无关；filter 为 nil 时只排序
 func ApplyFilter(entries []FileEntry, filter *Filter) []FileEntry {
+	// 先排序再过滤：硬链接的修正按顺序进行，需要目标在链接之前
+	return filterEntries(sortByPath(entries), filter)
+}
+
+// filterEntries 按输入的顺序应用过滤条件；硬链接需要在目标之后，IncludeParents 需要父目录在其内容之前
+func filterEntries(entries []FileEntry, filter *Filter) []FileEntry {
 	if filter == nil {
 		return entries
 	}
 	
 	var filtered []FileEntry
+	var parents parentKeeper
 	for _, entry := range entries {
+		parents.leave(entry.RelPath)
 		if filter.Match(entry) {
+			filtered = append(filtered, parents.take()...)
 			filtered = append(filtered, entry)
+		} else if filter.IncludeParents && entry.Type == TypeDir {
+			parents.hold(entry)
+		}
+	}
+	return fixHardlinks(filtered)
+}
+
+// parentKeeper 按路径顺序（父目录在其内容之前）逐个处理条目时，记录当前路径上被排除的目录，
+// 遇到被包含的条目时把它们作为上级目录一起包含（Filter.IncludeParents，ApplyFilter 和 WalkFilterEffect 共用）
+type parentKeeper struct {
+	pending []FileEntry // 被排除、尚未确定是否需要的目录，从外到内
+}
+
+// leave 处理路径为 path 的条目之前调用：返回不是 path 上级的待定目录（其中已经没有被包含的条目，确定被排除）
+func (k *parentKeeper) leave(path string) []FileEntry {
+	i := len(k.pending)
+	for i > 0 && !isParentDir(k.pending[i-1].RelPath, path) {
+		i--
+	}
+	if i == len(k.pending) {
+		return nil
+	}
+	done := append([]FileEntry(nil), k.pending[i:]...)
+	k.pending = k.pending[:i]
+	return done
+}
+
+// hold 记录一个被排除的目录
+func (k *parentKeeper) hold(dir FileEntry) {
+	k.pending = append(k.pending, dir)
+}
+
+// take 返回当前路径上全部待定的目录（被包含的条目需要它们）并清空
+func (k *parentKeeper) take() []FileEntry {
+	dirs := k.pending
+	k.pending = nil
+	return dirs
+}
+
+// isParentDir 目录 dir 是否是路径 path 的上级（根目录 "." 是所有路径的上级）
+func isParentDir(dir, path string) bool {
+	return dir == "." || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// fixHardlinks 修正过滤后的硬链接关系
+// 如果硬链接指向的第一个文件被过滤掉，则将第一个被保留的硬链接提升为普通文件，
+// 后续同一 inode 的硬链接改为指向它，保证归档中的硬链接目标一定存在
+func fixHardlinks(entries []FileEntry) []FileEntry {
+	var links hardlinkFixer
+	for i := range entries {
+		links.fix(&entries[i])
+	}
+	return entries
+}
+
+// hardlinkFixer 按条目顺序逐个修正硬链接关系（fixHardlinks 和流式的 WalkFilterEffect 共用）
+type hardlinkFixer struct {
+	// 已保留的普通文件路径
+	included map[string]bool
+	// 被过滤掉的原始目标 -> 提升后的新目标
+	redirect map[string]string
+}
+
+// fix 处理下一个被保留的条目
+func (h *hardlinkFixer) fix(entry *FileEntry) {
+	if h.included == nil {
+		h.included = make(map[string]bool)
+		h.redirect = make(map[string]string)
+	}
+	switch entry.Type {
+	case TypeFile:
+		h.included[entry.RelPath] = true
+		
+	case TypeHardlink:
+		if h.included[entry.LinkName] {
+			return
+		}
+		if newTarget, exists := h.redirect[entry.LinkName]; exists {
+			entry.LinkName = newTarget
+			return
+		}
+		// 第一个被保留的硬链接：提升为普通文件
+		h.redirect[entry.LinkName] = entry.RelPath
+		entry.Type = TypeFile
+		entry.LinkName = ""
+		h.included[entry.RelPath] = true
+	}
+}
+
+// ParsePatterns 将逗号分隔的模式串拆分为模式列表（忽略空项）
+func ParsePatterns(s string) []string {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// fileTypeNames 文件类型名称（用于命令行参数和列表输出）
+var fileTypeNames = map[string]FileType{
+	"file":     TypeFile,
+	"dir":      TypeDir,
+	"symlink":  TypeSymlink,
+	"hardlink": TypeHardlink,
+	"fifo":     TypeFifo,
+	"chardev":  TypeCharDevice,
+	"blockdev": TypeBlockDevice,
+	"socket":   TypeSocket,
+	"image":    TypeImage,
+}
+
+// ParseFileTypes 解析逗号分隔的文件类型列表，例如 "file,dir,symlink"
+func ParseFileTypes(s string) ([]FileType, error) {
+	var types []FileType
+	for _, name := range ParsePatterns(s) {
+		t, ok := fileTypeNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("未知的文件类型: %s", name)
 		}
+		types = append(types, t)
 	}
-	return filtered
+	return types, nil
 }
 
+// ParseTime 解析时间字符串（支持 Unix 时间戳和常见日期时间格式），无法解析时返回 nil
+func ParseTime(timeStr string) *time.Time {
+	timeStr = strings.TrimSpace(timeStr)
+	if timeStr == "" {
+		return nil
+	}
+	
+	// 尝试解析为 Unix 时间戳
+	if ts, err := strconv.ParseInt(timeStr, 10, 64); err == nil {
+		t := time.Unix(ts, 0)
+		return &t
+	}
+	
+	// 尝试解析为常见时间格式
+	formats := []string{
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05",
+		"2006-01-02",
+		time.RFC3339,
+		time.RFC3339Nano,
+	}
+	
+	for _, format := range formats {
+		if t, err := time.Parse(format, timeStr); err == nil {
+			return &t
+		}
+	}
+	
+	return nil
+}
+
+// ParseSize 解析大小字符串（支持 K/M/G 后缀），无法解析时返回 nil
+func ParseSize(sizeStr string) *int64 {
+	sizeStr = strings.TrimSpace(sizeStr)
+	if sizeStr == "" {
+		return nil
+	}
+	
+	var multiplier int64 = 1
+	sizeStr = strings.ToUpper(sizeStr)
+	
+	if strings.HasSuffix(sizeStr, "K") {
+		multiplier = 1024
+		sizeStr = sizeStr[:len(sizeStr)-1]
+	} else if strings.HasSuffix(sizeStr, "M") {
+		multiplier = 1024 * 1024
+		sizeStr = sizeStr[:len(sizeStr)-1]
+	} else if strings.HasSuffix(sizeStr, "G") {
+		multiplier = 1024 * 1024 * 1024
+		sizeStr = sizeStr[:len(sizeStr)-1]
+	}
+	
+	if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil {
+		result := size * multiplier
+		return &result
+	}
+	
+	return nil
+}
+
+// FormatSize 将字节数格式化为 "1.5G" 这样的易读形式（1024 进制，命令行、图形界面和 doctor 报告共用）
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,64 @@
+package backup
+
+import "fmt"
+
+// 过滤预览：图形界面和服务端前端在打包之前显示哪些条目会被打包、哪些被过滤掉。
+// 结果与 pack 使用同一过滤条件时相同（同样的扫描、匹配和硬链接修正），调用方不需要自己组合 ScanPath 和 ApplyFilter；
+// 敏感文件策略、-hard-dereference 等打包选项不在这里处理。
+
+// EvaluateFilter 扫描源路径，返回过滤条件包含和排除的条目（按 WalkFilterEffect 回调的顺序）
+// filter 为 nil 时全部包含；included 与 ApplyFilter 的结果相同：目标被排除的硬链接已提升为普通文件
+func EvaluateFilter(root string, filter *Filter) (included, excluded []FileEntry, err error) {
+	err = WalkFilterEffect(root, filter, func(entry FileEntry, include bool) error {
+		if include {
+			included = append(included, entry)
+		} else {
+			excluded = append(excluded, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return included, excluded, nil
+}
+
+// WalkFilterEffect 扫描源路径，按扫描顺序对每个条目调用 fn，include 表示条目是否会被打包
+// 包含的条目已按 ApplyFilter 修正硬链接；只需要统计数量和大小时不必像 EvaluateFilter 那样再复制一份条目列表，
+// 界面也可以边收到边显示。Filter.IncludeParents 时不匹配的目录要到确定其中是否有被包含的条目之后才回调
+// （作为上级目录包含时在第一个被包含的条目之前，否则在离开该目录时）。fn 返回错误时停止并返回该错误
+func WalkFilterEffect(root string, filter *Filter, fn func(entry FileEntry, include bool) error) error {
+	entries, err := ScanPath(root)
+	if err != nil {
+		return fmt.Errorf("扫描路径失败: %v", err)
+	}
+	var links hardlinkFixer
+	var parents parentKeeper
+	report := func(dirs []FileEntry, include bool) error {
+		for _, dir := range dirs {
+			if err := fn(dir, include); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, entry := range entries {
+		if err := report(parents.leave(entry.RelPath), false); err != nil {
+			return err
+		}
+		include := filter == nil || filter.Match(entry)
+		if include {
+			if err := report(parents.take(), true); err != nil {
+				return err
+			}
+			links.fix(&entry)
+		} else if filter.IncludeParents && entry.Type == TypeDir {
+			parents.hold(entry)
+			continue
+		}
+		if err := fn(entry, include); err != nil {
+			return err
+		}
+	}
+	return report(parents.take(), false)
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// 过滤文件：保存一组过滤条件，图形界面中选好的条件导出后可以在命令行（-filter-file）中原样复用
+// 支持两种格式：
+//   - JSON：与摘要文件中的 "filter" 字段相同，如 {"include": ["docs/**"], "types": ["file"], "min_size": 1024}；
+//   - 路径列表：每行一个包含路径（或路径模式），空行和以 "#" 开头的行被忽略，
+//     适合由其他程序生成后通过标准输入传入（-filter-file -）
+// 以 "{" 开头的内容按 JSON 解析，否则按路径列表解析
+
+// ReadFilterFile 读取过滤文件，path 为 "-" 时从标准输入读取
+func ReadFilterFile(path string) (*Filter, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取过滤文件失败: %v", err)
+	}
+	filter, err := ParseFilterFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("解析过滤文件失败 (%s): %v", path, err)
+	}
+	return filter, nil
+}
+
+// ParseFilterFile 解析过滤文件的内容（JSON 或路径列表）
+func ParseFilterFile(data []byte) (*Filter, error) {
+	filter := &Filter{}
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(filter); err != nil {
+			return nil, err
+		}
+		return filter, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		filter.PathPatterns = append(filter.PathPatterns, strings.TrimPrefix(line, "./"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// WriteFilterFile 将过滤条件写入 JSON 格式的过滤文件
+func WriteFilterFile(path string, filter *Filter) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("创建过滤文件失败: %v", err)
+	}
+	if err := writeFilter(f, filter); err != nil {
+		f.Close()
+		return fmt.Errorf("写入过滤文件失败: %v", err)
+	}
+	return f.Close()
+}
+
+// writeFilter 以缩进的 JSON 写出过滤条件，nil 写出空对象（不过滤）
+func writeFilter(w io.Writer, filter *Filter) error {
+	if filter == nil {
+		filter = &Filter{}
+	}
+	data, err := json.MarshalIndent(filter, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
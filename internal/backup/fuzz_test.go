@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+// fuzzLimits 模糊测试时的资源限制
+var fuzzLimits = ReadLimits{
+	MaxEntries:   10000,
+	MaxEntrySize: 1 << 20,
+	MaxTotalSize: 16 << 20,
+}
+
+// FuzzReadArchive 读取任意字节作为归档，不能崩溃或无限制地分配内存
+// 初始语料为 compat/ 中各版本的标准归档（加密归档的密码为 "compat"）：
+//
+//	go test -run '^$' -fuzz FuzzReadArchive ./internal/backup
+func FuzzReadArchive(f *testing.F) {
+	names, err := fs.Glob(compatFixtures, "compat/*.bkup")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range names {
+		data, err := compatFixtures.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// versionKDF 起的加密归档每次都要计算 scrypt，执行太慢；解密层由更早版本的加密归档覆盖
+		if len(data) >= headerSize && data[8]&flagEncrypt != 0 && binary.LittleEndian.Uint32(data[4:]) >= versionKDF {
+			t.Skip("scrypt 派生的密钥")
+		}
+		ar, err := newArchiveReader(io.NopCloser(bytes.NewReader(data)), PackOptions{
+			Password: "compat",
+			Threads:  1,
+			Limits:   fuzzLimits,
+		})
+		if err != nil {
+			return
+		}
+		defer ar.Close()
+
+		for {
+			if _, err := ar.Next(); err != nil {
+				return
+			}
+			if _, err := io.Copy(io.Discard, ar); err != nil {
+				return
+			}
+		}
+	})
+}
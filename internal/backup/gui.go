@@ -3,9 +3,7 @@ package backup
 import (
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
-	"time"
 	
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -28,13 +26,18 @@ func Opengui() {
 	encryptCheck := widget.NewCheck("启用加密", nil)
 	passwordEntry := widget.NewPasswordEntry()
 	passwordEntry.SetPlaceHolder("在此输入加密密码")
+	confirmEntry := widget.NewPasswordEntry()
+	confirmEntry.SetPlaceHolder("再次输入加密密码")
 	encryptCheck.OnChanged = func(checked bool) {
 		passwordEntry.Disable()
+		confirmEntry.Disable()
 		if checked {
 			passwordEntry.Enable()
+			confirmEntry.Enable()
 		}
 	}
 	passwordEntry.Disable()
+	confirmEntry.Disable()
 
 	// 过滤选项
 	// 路径过滤
@@ -64,6 +67,11 @@ func Opengui() {
 	minSizeEntry.SetPlaceHolder("最小文件大小，如: 1K, 1M, 1G")
 	maxSizeEntry := widget.NewEntry()
 	maxSizeEntry.SetPlaceHolder("最大文件大小，如: 100M, 1G")
+	// 按实际占用的磁盘块比较，稀疏文件不按表观大小计算
+	sizeBlocksCheck := widget.NewCheck("按占用的磁盘块", nil)
+	
+	// 被包含条目的上级目录即使被排除也写入，解包时保留中间目录的权限和属主
+	includeParentsCheck := widget.NewCheck("保留上级目录", nil)
 	
 	// 创建可折叠的过滤选项容器
 	filterForm := container.NewVBox(
@@ -92,19 +100,13 @@ func Opengui() {
 		minSizeEntry,
 		widget.NewLabel("最大大小:"),
 		maxSizeEntry,
+		sizeBlocksCheck,
+		widget.NewSeparator(),
+		includeParentsCheck,
 	)
 	
-	filterAccordion := widget.NewAccordion(
-		widget.NewAccordionItem("过滤选项", filterForm),
-	)
-
-	// 打包按钮
-	packBtn := widget.NewButton("打包", func() {
-		opt := PackOptions{
-			Compress: compressCheck.Checked,
-			Encrypt:  encryptCheck.Checked,
-			Password: passwordEntry.Text,
-		}
+	// 导出过滤条件：在命令行中用 -filter-file 复用同样的选择
+	currentFilter := func() *Filter {
 		filter := buildFilterFromGUI(
 			includePathsEntry.Text,
 			excludePathsEntry.Text,
@@ -118,6 +120,57 @@ func Opengui() {
 			minSizeEntry.Text,
 			maxSizeEntry.Text,
 		)
+		if filter != nil {
+			filter.IncludeParents = includeParentsCheck.Checked
+			if sizeBlocksCheck.Checked {
+				filter.SizeMode = UsageBlocks
+			}
+		}
+		return filter
+	}
+	exportFilterBtn := widget.NewButton("导出过滤条件…", func() {
+		ExportFilterClicked(w, currentFilter())
+	})
+	// 预览过滤结果：选择源目录后显示会被打包和被排除的条目数
+	previewFilterBtn := widget.NewButton("预览过滤结果…", func() {
+		PreviewFilterClicked(w, currentFilter())
+	})
+	filterForm.Add(widget.NewSeparator())
+	filterForm.Add(container.NewHBox(previewFilterBtn, exportFilterBtn))
+
+	filterAccordion := widget.NewAccordion(
+		widget.NewAccordionItem("过滤选项", filterForm),
+	)
+
+	// 打包按钮
+	packBtn := widget.NewButton("打包", func() {
+		opt := PackOptions{
+			Compress: compressCheck.Checked,
+			Encrypt:  encryptCheck.Checked,
+			Password: passwordEntry.Text,
+		}
+		filter := currentFilter()
+		// 加密时检查两次输入的密码是否一致，强度不足的密码拒绝，弱密码需要确认后才继续
+		if opt.Encrypt && opt.Password != "" {
+			if confirmEntry.Text != opt.Password {
+				dialog.ShowError(fmt.Errorf("两次输入的密码不一致"), w)
+				return
+			}
+			// 与命令行相同：设置了 BACKUP_MIN_PASSWORD_BITS 时，低于最低强度的密码直接拒绝
+			warning, err := CheckPasswordStrength(opt.Password, MinPasswordBits())
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			if warning != "" {
+				dialog.ShowConfirm("弱密码", warning+"\n仍然继续打包？", func(ok bool) {
+					if ok {
+						PackClicked(w, opt, filter)
+					}
+				}, w)
+				return
+			}
+		}
 		PackClicked(w, opt, filter)
 	})
 	packBtn.Importance = widget.HighImportance
@@ -139,6 +192,7 @@ func Opengui() {
 		compressCheck,
 		encryptCheck,
 		passwordEntry,
+		confirmEntry,
 		widget.NewSeparator(),
 		filterAccordion,
 	)
@@ -221,6 +275,54 @@ func UnpackClicked(w fyne.Window, options PackOptions) {
 	}, w)
 }
 
+// previewListLimit 预览对话框中最多列出的被排除条目数
+const previewListLimit = 20
+
+// PreviewFilterClicked 选择源目录，显示当前过滤条件会打包和排除的条目（不打包）
+func PreviewFilterClicked(w fyne.Window, filter *Filter) {
+	dialog.ShowFolderOpen(func(rootURI fyne.ListableURI, err error) {
+		if err != nil || rootURI == nil {
+			return
+		}
+		included, excluded, err := EvaluateFilter(rootURI.Path(), filter)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		var size int64
+		for _, entry := range included {
+			if entry.Type == TypeFile {
+				size += entry.Size
+			}
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "将打包 %d 个条目（文件内容 %s），排除 %d 个条目", len(included), FormatSize(size), len(excluded))
+		for i, entry := range excluded {
+			if i == previewListLimit {
+				fmt.Fprintf(&b, "\n……等 %d 个", len(excluded))
+				break
+			}
+			b.WriteString("\n  - " + entry.RelPath)
+		}
+		dialog.ShowInformation("过滤结果", b.String(), w)
+	}, w)
+}
+
+// ExportFilterClicked 将当前的过滤条件保存为过滤文件（JSON），供命令行 -filter-file 使用
+func ExportFilterClicked(w fyne.Window, filter *Filter) {
+	dialog.ShowFileSave(func(save fyne.URIWriteCloser, err error) {
+		if err != nil || save == nil {
+			return
+		}
+		defer save.Close()
+		if err := writeFilter(save, filter); err != nil {
+			dialog.ShowError(fmt.Errorf("写入过滤文件失败: %v", err), w)
+			return
+		}
+		dialog.ShowInformation("导出成功", "过滤条件已保存到 "+save.URI().Path()+"\n命令行中使用: -filter-file "+save.URI().Path(), w)
+	}, w)
+}
+
 // buildFilterFromGUI 从 GUI 输入构建过滤条件
 func buildFilterFromGUI(
 	includePaths, excludePaths string,
@@ -276,24 +378,24 @@ func buildFilterFromGUI(
 	
 	// 时间过滤
 	if minTime != "" {
-		if t := parseTime(minTime); t != nil {
+		if t := ParseTime(minTime); t != nil {
 			filter.MinModTime = t
 		}
 	}
 	if maxTime != "" {
-		if t := parseTime(maxTime); t != nil {
+		if t := ParseTime(maxTime); t != nil {
 			filter.MaxModTime = t
 		}
 	}
 	
 	// 尺寸过滤
 	if minSize != "" {
-		if s := parseSize(minSize); s != nil {
+		if s := ParseSize(minSize); s != nil {
 			filter.MinSize = s
 		}
 	}
 	if maxSize != "" {
-		if s := parseSize(maxSize); s != nil {
+		if s := ParseSize(maxSize); s != nil {
 			filter.MaxSize = s
 		}
 	}
@@ -308,63 +410,3 @@ func buildFilterFromGUI(
 	
 	return filter
 }
-
-// parseTime 解析时间字符串
-func parseTime(timeStr string) *time.Time {
-	timeStr = strings.TrimSpace(timeStr)
-	if timeStr == "" {
-		return nil
-	}
-	
-	// 尝试解析为 Unix 时间戳
-	if ts, err := strconv.ParseInt(timeStr, 10, 64); err == nil {
-		t := time.Unix(ts, 0)
-		return &t
-	}
-	
-	// 尝试解析为常见时间格式
-	formats := []string{
-		"2006-01-02 15:04:05",
-		"2006-01-02T15:04:05",
-		"2006-01-02",
-		time.RFC3339,
-		time.RFC3339Nano,
-	}
-	
-	for _, format := range formats {
-		if t, err := time.Parse(format, timeStr); err == nil {
-			return &t
-		}
-	}
-	
-	return nil
-}
-
-// parseSize 解析大小字符串（支持 K/M/G 后缀）
-func parseSize(sizeStr string) *int64 {
-	sizeStr = strings.TrimSpace(sizeStr)
-	if sizeStr == "" {
-		return nil
-	}
-	
-	var multiplier int64 = 1
-	sizeStr = strings.ToUpper(sizeStr)
-	
-	if strings.HasSuffix(sizeStr, "K") {
-		multiplier = 1024
-		sizeStr = sizeStr[:len(sizeStr)-1]
-	} else if strings.HasSuffix(sizeStr, "M") {
-		multiplier = 1024 * 1024
-		sizeStr = sizeStr[:len(sizeStr)-1]
-	} else if strings.HasSuffix(sizeStr, "G") {
-		multiplier = 1024 * 1024 * 1024
-		sizeStr = sizeStr[:len(sizeStr)-1]
-	}
-	
-	if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil {
-		result := size * multiplier
-		return &result
-	}
-	
-	return nil
-}
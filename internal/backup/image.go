@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PackImage 将块设备的原始内容打包为归档中的一个镜像条目
+// devicePath: 块设备路径，例如 /dev/sdb1
+// archivePath: 输出的归档文件路径（自定义格式）
+// options: 打包选项（压缩、加密、进度回调等）
+// 返回: 可能的错误
+// 解包时镜像条目被还原为普通文件 "<设备名>.img"
+func PackImage(devicePath string, archivePath string, options PackOptions) error {
+	start := time.Now()
+	info, err := os.Stat(devicePath)
+	if err != nil {
+		return fmt.Errorf("访问设备失败: %v", err)
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("不是块设备: %s", devicePath)
+	}
+	
+	size, err := deviceSize(devicePath)
+	if err != nil {
+		return fmt.Errorf("获取设备大小失败: %v", err)
+	}
+	
+	entry := createFileEntry(devicePath, filepath.Base(devicePath)+".img", info)
+	entry.Type = TypeImage
+	entry.Mode = uint32(0644)
+	entry.Size = size
+	entry.LinkTarget = devicePath
+	
+	return writeArchiveWithSidecars(archivePath, filepath.Dir(devicePath), []FileEntry{entry}, nil, options, start)
+}
+
+// deviceSize 获取块设备的大小（块设备的 Stat 大小为 0，需要通过 Seek 获取）
+func deviceSize(devicePath string) (int64, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
@@ -0,0 +1,474 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportArchive 将其他工具生成的 tar、tar.gz 或 zip 归档转换为 BKUP 归档
+// foreignPath: 外部归档路径（按文件内容识别格式，与扩展名无关）
+// archivePath: 输出的归档文件路径
+// filter: 可选的过滤条件
+// options: 打包选项（压缩、加密、流校验、摘要、索引等与 pack 相同）
+// 条目的权限、时间、属主和链接关系取自外部归档，与打包相同按路径排列（见 order.go）；
+// 文件内容从外部归档流式写入，tar 中顺序与路径顺序不同的内容暂存到临时目录（见 tarSource）
+func ImportArchive(foreignPath string, archivePath string, filter *Filter, options PackOptions) error {
+	start := time.Now()
+	format, err := detectForeignFormat(foreignPath)
+	if err != nil {
+		return err
+	}
+
+	var entries []FileEntry
+	var contentSource interface{}
+	switch format {
+	case "zip":
+		zr, err := zip.OpenReader(foreignPath)
+		if err != nil {
+			return fmt.Errorf("打开 zip 归档失败: %v", err)
+		}
+		defer zr.Close()
+		var files map[string]*zip.File
+		entries, files, err = zipEntries(zr, options)
+		if err != nil {
+			return err
+		}
+		options.openContent = func(entry FileEntry) (io.ReadCloser, error) {
+			return files[entry.RelPath].Open()
+		}
+	default:
+		source := &tarSource{path: foreignPath, gzip: format == "tar.gz"}
+		defer source.cleanup()
+		entries, err = source.entries(options)
+		if err != nil {
+			return err
+		}
+		options.openContent = source.open
+		contentSource = source
+	}
+
+	// 外部归档中的条目可以是任意顺序（目录可能在其内容之后），ApplyFilter 按路径排列，
+	// IncludeParents 和硬链接的修正都依赖这个顺序
+	entries = ApplyFilter(entries, filter)
+	if options.HardDereference {
+		entries = dereferenceHardlinks(entries)
+	}
+	if options.RestoreOrder != nil {
+		entries = options.RestoreOrder.Sort(entries)
+	}
+	if source, ok := contentSource.(*tarSource); ok {
+		source.plan(entries)
+	}
+	options.quota = newQuotaTracker(options)
+	if options.quota != nil {
+		if err := options.quota.checkFiles(len(entries)); err != nil {
+			return err
+		}
+	}
+
+	absForeign, err := filepath.Abs(foreignPath)
+	if err != nil {
+		return fmt.Errorf("无法解析路径: %v", err)
+	}
+	return writeArchiveWithSidecars(archivePath, absForeign, entries, filter, options, start)
+}
+
+// detectForeignFormat 根据文件开头的字节识别外部归档格式："zip"、"tar.gz" 或 "tar"
+func detectForeignFormat(foreignPath string) (string, error) {
+	f, err := os.Open(foreignPath)
+	if err != nil {
+		return "", fmt.Errorf("打开外部归档失败: %v", err)
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("读取外部归档失败: %v", err)
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip", nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz", nil
+	case n >= 262 && string(head[257:262]) == "ustar":
+		return "tar", nil
+	default:
+		return "", fmt.Errorf("无法识别的归档格式（支持 tar、tar.gz、zip）: %s", foreignPath)
+	}
+}
+
+// foreignRelPath 将外部归档中的条目名称转换为规范的相对路径（目录以 "/" 结尾）
+// 返回空字符串表示根目录本身；包含 ".." 等逃逸路径时返回错误
+func foreignRelPath(name string, isDir bool) (string, error) {
+	cleaned := path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("不安全的路径: %s", name)
+		}
+	}
+	rel := strings.TrimPrefix(cleaned, "/")
+	if rel == "" {
+		return "", nil
+	}
+	if isDir {
+		rel += "/"
+	}
+	return rel, nil
+}
+
+// unixTime 将时间转换为 Unix 时间戳，零值返回 0
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// sniffMime 读取内容开头检测内容类型
+func sniffMime(r io.Reader) string {
+	head := make([]byte, mimeSniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ""
+	}
+	return DetectMime(head[:n])
+}
+
+// tarSource 顺序读取 tar / tar.gz 归档
+// 第一遍读取所有头部生成条目列表，第二遍写入时按条目顺序向后读取内容。写入顺序（路径顺序）与 tar 中的顺序不同时，
+// 向前读取途中经过的、之后还要写入的内容暂存到临时目录，读到时直接打开暂存的文件，整个 tar 流只解压一遍
+// （GNU tar 按目录项的顺序写入，不暂存时几乎每个文件都要从头解压）。暂存的内容最多为所有要写入的文件的大小，
+// 读取后立即删除；没有调用 plan 或读取次数超出计划时退回到重新打开文件
+type tarSource struct {
+	path     string
+	gzip     bool
+	file     *os.File
+	reader   *tar.Reader
+	pos      int            // 已读取的最后一个头部的序号，-1 表示尚未读取
+	content  map[string]int // 条目路径 -> 保存其内容的头部序号（硬链接指向目标文件的头部）
+	pending  map[int]int    // 头部序号 -> 还要读取其内容的次数（plan）
+	spooled  map[int]string // 头部序号 -> 暂存其内容的临时文件
+	spoolDir string         // 暂存内容的临时目录，需要时才创建
+}
+
+// plan 记录写入时要读取内容的条目（按写入顺序），之后向前读取时暂存经过的这些内容
+func (ts *tarSource) plan(entries []FileEntry) {
+	ts.pending = make(map[int]int)
+	ts.spooled = make(map[int]string)
+	for _, entry := range entries {
+		if entry.Type != TypeFile {
+			continue
+		}
+		if header, ok := ts.content[entry.RelPath]; ok {
+			ts.pending[header]++
+		}
+	}
+}
+
+// spool 把当前头部的内容暂存到临时文件
+func (ts *tarSource) spool() error {
+	if ts.spoolDir == "" {
+		dir, err := os.MkdirTemp("", "backup-import-")
+		if err != nil {
+			return fmt.Errorf("创建临时目录失败: %v", err)
+		}
+		ts.spoolDir = dir
+	}
+	path := filepath.Join(ts.spoolDir, strconv.Itoa(ts.pos))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	if _, err := io.Copy(f, ts.reader); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("暂存 tar 内容失败: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("暂存 tar 内容失败: %v", err)
+	}
+	ts.spooled[ts.pos] = path
+	return nil
+}
+
+// openSpooled 打开暂存的内容；计划中最后一次读取时立即删除临时文件（已打开的文件仍可读取）
+func (ts *tarSource) openSpooled(header int) (io.ReadCloser, error) {
+	path := ts.spooled[header]
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开暂存的内容失败: %v", err)
+	}
+	if ts.pending[header] <= 1 {
+		delete(ts.pending, header)
+		delete(ts.spooled, header)
+		os.Remove(path)
+	} else {
+		ts.pending[header]--
+	}
+	return f, nil
+}
+
+// reopen 从头打开 tar 流
+func (ts *tarSource) reopen() error {
+	ts.close()
+	f, err := os.Open(ts.path)
+	if err != nil {
+		return fmt.Errorf("打开外部归档失败: %v", err)
+	}
+	var r io.Reader = f
+	if ts.gzip {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("读取 gzip 数据失败: %v", err)
+		}
+		r = gz
+	}
+	ts.file = f
+	ts.reader = tar.NewReader(r)
+	ts.pos = -1
+	return nil
+}
+
+// close 关闭已打开的文件
+func (ts *tarSource) close() {
+	if ts.file != nil {
+		ts.file.Close()
+		ts.file = nil
+	}
+}
+
+// cleanup 关闭文件并删除暂存内容的临时目录
+func (ts *tarSource) cleanup() {
+	ts.close()
+	if ts.spoolDir != "" {
+		os.RemoveAll(ts.spoolDir)
+		ts.spoolDir = ""
+	}
+}
+
+// entries 读取所有头部，生成条目列表
+// 同名条目以后出现的为准（与 tar 解包的行为一致）
+func (ts *tarSource) entries(options PackOptions) ([]FileEntry, error) {
+	if err := ts.reopen(); err != nil {
+		return nil, err
+	}
+	ts.content = make(map[string]int)
+	index := make(map[string]int) // 条目路径 -> 在 entries 中的位置
+	var entries []FileEntry
+	for {
+		hdr, err := ts.reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("读取 tar 头部失败: %v", err)
+		}
+		ts.pos++
+
+		entry, ok, err := tarEntry(hdr)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// 根目录本身（"./"）静默跳过
+			if hdr.Typeflag != tar.TypeDir && options.Warn != nil {
+				options.Warn(fmt.Sprintf("跳过不支持的 tar 条目类型 %q: %s", hdr.Typeflag, hdr.Name))
+			}
+			continue
+		}
+		switch entry.Type {
+		case TypeFile:
+			ts.content[entry.RelPath] = ts.pos
+			if options.DetectMime {
+				entry.Mime = sniffMime(ts.reader)
+			}
+		case TypeHardlink:
+			target, exists := index[entry.LinkName]
+			if !exists || entries[target].Type != TypeFile {
+				return nil, fmt.Errorf("硬链接的目标不存在: %s -> %s", entry.RelPath, entry.LinkName)
+			}
+			ts.content[entry.RelPath] = ts.content[entry.LinkName]
+			entry.Size, entry.Blocks = entries[target].Size, entries[target].Blocks
+			entry.Mime = entries[target].Mime
+		}
+
+		if i, exists := index[entry.RelPath]; exists {
+			entries[i] = entry
+		} else {
+			index[entry.RelPath] = len(entries)
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// tarEntry 将 tar 头部转换为条目，不支持的类型返回 false
+func tarEntry(hdr *tar.Header) (FileEntry, bool, error) {
+	entry := FileEntry{
+		Mode:       uint32(hdr.FileInfo().Mode()),
+		ModTime:    unixTime(hdr.ModTime),
+		AccessTime: unixTime(hdr.AccessTime),
+		ChangeTime: unixTime(hdr.ChangeTime),
+		UID:        hdr.Uid,
+		GID:        hdr.Gid,
+		Xattrs:     tarXattrs(hdr.PAXRecords),
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		entry.Type = TypeFile
+		entry.Size = hdr.Size
+		entry.Blocks = estimatedBlocks(hdr.Size)
+	case tar.TypeDir:
+		entry.Type = TypeDir
+	case tar.TypeSymlink:
+		entry.Type = TypeSymlink
+		entry.LinkTarget = hdr.Linkname
+	case tar.TypeLink:
+		entry.Type = TypeHardlink
+		target, err := foreignRelPath(hdr.Linkname, false)
+		if err != nil || target == "" {
+			return entry, false, fmt.Errorf("不安全的硬链接目标: %s -> %s", hdr.Name, hdr.Linkname)
+		}
+		entry.LinkName = target
+	case tar.TypeChar:
+		entry.Type = TypeCharDevice
+		entry.DevMajor = hdr.Devmajor
+		entry.DevMinor = hdr.Devminor
+	case tar.TypeBlock:
+		entry.Type = TypeBlockDevice
+		entry.DevMajor = hdr.Devmajor
+		entry.DevMinor = hdr.Devminor
+	case tar.TypeFifo:
+		entry.Type = TypeFifo
+	default:
+		return entry, false, nil
+	}
+
+	rel, err := foreignRelPath(hdr.Name, entry.Type == TypeDir)
+	if err != nil {
+		return entry, false, err
+	}
+	if rel == "" {
+		return entry, false, nil
+	}
+	entry.RelPath = rel
+	return entry, true, nil
+}
+
+// open 返回普通文件条目的内容
+func (ts *tarSource) open(entry FileEntry) (io.ReadCloser, error) {
+	want, ok := ts.content[entry.RelPath]
+	if !ok {
+		return nil, fmt.Errorf("外部归档中没有该文件: %s", entry.RelPath)
+	}
+	if _, ok := ts.spooled[want]; ok {
+		return ts.openSpooled(want)
+	}
+	if ts.reader == nil || want <= ts.pos {
+		if err := ts.reopen(); err != nil {
+			return nil, err
+		}
+	}
+	for ts.pos < want {
+		if _, err := ts.reader.Next(); err != nil {
+			return nil, fmt.Errorf("读取 tar 头部失败: %v", err)
+		}
+		ts.pos++
+		// 途中经过之后还要写入的内容，以及还要再次读取的这个内容，先暂存
+		if ts.pending[ts.pos] > 1 || (ts.pos < want && ts.pending[ts.pos] > 0) {
+			if err := ts.spool(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, ok := ts.spooled[want]; ok {
+		return ts.openSpooled(want)
+	}
+	delete(ts.pending, want)
+	return io.NopCloser(ts.reader), nil
+}
+
+// zipEntries 读取 zip 的目录，生成条目列表和路径到文件的映射
+// 属主取自 Info-ZIP 的 Unix 扩展字段（PackZip 和 Info-ZIP zip 写入），没有时为当前用户
+func zipEntries(zr *zip.ReadCloser, options PackOptions) ([]FileEntry, map[string]*zip.File, error) {
+	files := make(map[string]*zip.File)
+	index := make(map[string]int)
+	var entries []FileEntry
+	for _, f := range zr.File {
+		info := f.FileInfo()
+		mode := info.Mode()
+		rel, err := foreignRelPath(f.Name, info.IsDir())
+		if err != nil {
+			return nil, nil, err
+		}
+		if rel == "" {
+			continue
+		}
+
+		entry := FileEntry{
+			RelPath: rel,
+			Mode:    uint32(mode),
+			ModTime: unixTime(f.Modified),
+			UID:     os.Getuid(),
+			GID:     os.Getgid(),
+		}
+		if uid, gid, ok := zipUnixOwner(f.Extra); ok {
+			entry.UID, entry.GID = uid, gid
+		}
+		switch {
+		case info.IsDir():
+			entry.Type = TypeDir
+		case mode&os.ModeSymlink != 0:
+			// zip 中符号链接的目标保存为文件内容
+			rc, err := f.Open()
+			if err != nil {
+				return nil, nil, fmt.Errorf("读取符号链接失败 (%s): %v", f.Name, err)
+			}
+			target, err := io.ReadAll(io.LimitReader(rc, int64(options.Limits.maxPathLen())))
+			rc.Close()
+			if err != nil {
+				return nil, nil, fmt.Errorf("读取符号链接失败 (%s): %v", f.Name, err)
+			}
+			entry.Type = TypeSymlink
+			entry.LinkTarget = string(target)
+		case mode.IsRegular():
+			entry.Type = TypeFile
+			entry.Size = int64(f.UncompressedSize64)
+			entry.Blocks = estimatedBlocks(entry.Size)
+			files[rel] = f
+			if options.DetectMime {
+				if rc, err := f.Open(); err == nil {
+					entry.Mime = sniffMime(rc)
+					rc.Close()
+				}
+			}
+		default:
+			if options.Warn != nil {
+				options.Warn(fmt.Sprintf("跳过不支持的 zip 条目: %s", f.Name))
+			}
+			continue
+		}
+
+		if i, exists := index[rel]; exists {
+			entries[i] = entry
+		} else {
+			index[rel] = len(entries)
+			entries = append(entries, entry)
+		}
+	}
+	return entries, files, nil
+}
@@ -0,0 +1,432 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 增量备份：以上一个归档（基准）的条目元信息为清单，与当前的目录树比较，
+// 只写入新增或有变化的普通文件；目录、符号链接、设备等没有内容的条目总是写入（很小，且让归档可以单独列目录）。
+// 基准中存在而当前已删除（或类型改变）的路径记录在根目录条目的 TLV 中，解包时先删除这些路径，
+// 按顺序把完整归档和各增量归档解包到同一目录即可还原最后一次备份时的目录树。
+//
+// 基准本身也可以是增量归档：比较时按链依次合并各归档的条目和删除记录，得到基准备份时的完整清单。
+// 链中的归档按文件名引用，必须放在同一目录中。增量信息是可选的 TLV，旧版本程序读取时跳过
+// （只解包增量归档本身的条目，不执行删除）。
+//
+// 差异备份（DifferentialBase）使用同样的比较和记录方式，但基准必须是完整归档：每个差异归档包含自完整备份以来的全部变化，
+// 还原只需要完整归档和最新的一个差异归档。解包差异归档时先自动解包其基准，再在其上写入变化和执行删除。
+
+// tlvIncremental 根目录条目上的增量信息（JSON）
+const tlvIncremental = uint16(4)
+
+// maxIncrementalChain 增量链的最大长度（防止归档相互引用时无限递归）
+const maxIncrementalChain = 1000
+
+// ErrNotIncremental 归档不是增量归档
+var ErrNotIncremental = errors.New("归档不是增量归档")
+
+// 增量信息的类型：增量归档相对于上一个归档（可以也是增量归档），差异归档相对于一个完整归档
+const (
+	KindIncremental  = "incremental"
+	KindDifferential = "differential"
+)
+
+// IncrementalInfo 增量或差异归档记录的基准和删除的路径
+type IncrementalInfo struct {
+	Kind     string   `json:"kind"`              // KindIncremental 或 KindDifferential
+	Base     string   `json:"base"`              // 基准归档的文件名（与本归档位于同一目录）
+	BaseSize int64    `json:"base_size"`         // 基准归档的大小，用于发现基准被替换
+	Deleted  []string `json:"deleted,omitempty"` // 基准中存在而本次已删除或类型改变的路径（已删除目录下的路径不再单独列出）
+}
+
+// IncrementalStats 增量打包的统计（写入摘要文件）
+type IncrementalStats struct {
+	Kind      string `json:"kind"`      // KindIncremental 或 KindDifferential
+	Base      string `json:"base"`      // 基准归档
+	Unchanged int    `json:"unchanged"` // 未变化而没有写入的普通文件
+	Deleted   int    `json:"deleted"`   // 删除记录的数量
+}
+
+// manifestEntry 清单中一个路径的元信息（比较是否变化所需的字段）
+type manifestEntry struct {
+	typ     FileType
+	encrypt bool
+	mode    uint32
+	size    int64
+	mtime   int64
+	ctime   int64
+	uid     int
+	gid     int
+	link    string             // 符号链接的目标或硬链接链接的路径（归档比较用）
+	hash    *[sha256.Size]byte // 内容的 SHA-256（只在按内容比较时读取）
+}
+
+func newManifestEntry(entry FileEntry) manifestEntry {
+	return manifestEntry{
+		typ:     entry.Type,
+		encrypt: entry.Encrypt,
+		mode:    entry.Mode,
+		size:    entry.Size,
+		mtime:   entry.ModTime,
+		ctime:   entry.ChangeTime,
+		uid:     entry.UID,
+		gid:     entry.GID,
+		link:    entry.LinkTarget + entry.LinkName,
+	}
+}
+
+// ReadIncremental 读取归档的增量信息（位于第一个条目，不需要读取整个归档）
+// 归档不是增量归档时返回 ErrNotIncremental
+func ReadIncremental(archivePath string, options PackOptions) (*IncrementalInfo, error) {
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.Close()
+
+	entry, err := ar.next()
+	if err == io.EOF {
+		return nil, ErrNotIncremental
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseIncremental(entry)
+}
+
+// parseIncremental 解析根目录条目上的增量信息
+func parseIncremental(entry *entryData) (*IncrementalInfo, error) {
+	if entry.incremental == nil {
+		return nil, ErrNotIncremental
+	}
+	var info IncrementalInfo
+	if err := json.Unmarshal(entry.incremental, &info); err != nil {
+		return nil, fmt.Errorf("增量信息已损坏: %v", err)
+	}
+	return &info, nil
+}
+
+// incrementalBasePath 返回增量归档引用的基准归档的路径，并检查其大小与记录的一致
+func incrementalBasePath(archivePath string, info *IncrementalInfo) (string, error) {
+	if info.Base == "" || info.Base != filepath.Base(info.Base) {
+		return "", fmt.Errorf("增量归档 %s 中的基准文件名无效: %q", archivePath, info.Base)
+	}
+	var basePath string
+	if IsURL(archivePath) {
+		basePath = archivePath[:len(archivePath)-len(filepath.Base(archivePath))] + info.Base
+	} else {
+		basePath = filepath.Join(filepath.Dir(archivePath), info.Base)
+		stat, err := os.Stat(basePath)
+		if err != nil {
+			return "", fmt.Errorf("找不到增量归档 %s 的基准归档: %v", archivePath, err)
+		}
+		if stat.Size() != info.BaseSize {
+			return "", fmt.Errorf("基准归档 %s 的大小 (%d) 与增量归档记录的 (%d) 不一致，可能已被替换", basePath, stat.Size(), info.BaseSize)
+		}
+	}
+	return basePath, nil
+}
+
+// loadManifest 读取归档备份时的完整清单：增量归档先读取其基准的清单，删除记录中的路径，再合并本归档的条目
+// withHashes: 同时读取普通文件和镜像内容的 SHA-256（需要解码整个归档）
+func loadManifest(archivePath string, options PackOptions, withHashes bool, depth int) (map[string]manifestEntry, error) {
+	if depth > maxIncrementalChain {
+		return nil, fmt.Errorf("增量链超过 %d 个归档，基准归档可能相互引用", maxIncrementalChain)
+	}
+	manifest := make(map[string]manifestEntry)
+	info, err := ReadIncremental(archivePath, options)
+	if err != nil && err != ErrNotIncremental {
+		return nil, err
+	}
+	if info != nil {
+		basePath, err := incrementalBasePath(archivePath, info)
+		if err != nil {
+			return nil, err
+		}
+		if manifest, err = loadManifest(basePath, options, withHashes, depth+1); err != nil {
+			return nil, err
+		}
+		applyDeletions(manifest, info.Deleted)
+	}
+
+	if !withHashes {
+		table, err := ArchiveEntryTable(archivePath, options)
+		if err != nil {
+			return nil, err
+		}
+		defer table.Close()
+		for i := 0; i < table.Len(); i++ {
+			entry := table.Entry(i)
+			manifest[entry.RelPath] = newManifestEntry(entry)
+		}
+		return manifest, nil
+	}
+
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.Close()
+	for {
+		if err := checkCanceled(options); err != nil {
+			return nil, err
+		}
+		entry, err := ar.Next()
+		if err == io.EOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		item := newManifestEntry(*entry)
+		if (entry.Type == TypeFile || entry.Type == TypeImage) && ar.locked == nil {
+			h := sha256.New()
+			if _, err := io.Copy(h, withCancel(ar, options)); err != nil {
+				return nil, fmt.Errorf("读取归档 %s 中的 %s 失败: %v", archivePath, entry.RelPath, err)
+			}
+			item.hash = new([sha256.Size]byte)
+			h.Sum(item.hash[:0])
+		}
+		manifest[entry.RelPath] = item
+	}
+}
+
+// applyDeletions 从清单中删除记录的路径及已删除目录下的全部路径
+func applyDeletions(manifest map[string]manifestEntry, deleted []string) {
+	if len(deleted) == 0 {
+		return
+	}
+	set := make(map[string]bool, len(deleted))
+	for _, path := range deleted {
+		set[path] = true
+	}
+	for path := range manifest {
+		if deletedBy(path, set) {
+			delete(manifest, path)
+		}
+	}
+}
+
+// deletedBy 路径本身或其所在的某一级目录是否在删除集合中（目录路径以 "/" 结尾）
+func deletedBy(path string, deleted map[string]bool) bool {
+	if deleted[path] {
+		return true
+	}
+	for i := 0; i < len(path)-1; i++ {
+		if path[i] == '/' && deleted[path[:i+1]] {
+			return true
+		}
+	}
+	return false
+}
+
+// applyIncremental 按 options.IncrementalFrom（或 DifferentialBase）与基准的清单比较，去掉未变化的普通文件，并生成删除记录
+// 被硬链接引用的文件总是写入，使归档中的硬链接都能找到目标
+func applyIncremental(archivePath string, absRoot string, entries []FileEntry, options PackOptions) ([]FileEntry, PackOptions, error) {
+	basePath, kind := options.IncrementalFrom, KindIncremental
+	if options.DifferentialBase != "" {
+		if basePath != "" {
+			return nil, options, fmt.Errorf("增量备份和差异备份不能同时使用")
+		}
+		basePath, kind = options.DifferentialBase, KindDifferential
+	}
+	if basePath == "" {
+		return entries, options, nil
+	}
+	if len(entries) == 0 || entries[0].RelPath != "." {
+		return nil, options, fmt.Errorf("增量和差异备份只能用于打包目录")
+	}
+	if IsURL(basePath) {
+		return nil, options, fmt.Errorf("增量和差异备份的基准归档必须是本地文件")
+	}
+	stat, err := os.Stat(basePath)
+	if err != nil {
+		return nil, options, fmt.Errorf("基准归档不存在或无法访问: %v", err)
+	}
+	// 解包时按文件名在归档所在的目录中查找基准
+	absBase, err1 := filepath.Abs(basePath)
+	absArchive, err2 := filepath.Abs(archivePath)
+	if err1 != nil || err2 != nil || filepath.Dir(absBase) != filepath.Dir(absArchive) {
+		return nil, options, fmt.Errorf("基准归档 %s 必须与新归档位于同一目录", basePath)
+	}
+	if kind == KindDifferential {
+		if _, err := ReadIncremental(basePath, options); err != ErrNotIncremental {
+			if err != nil {
+				return nil, options, err
+			}
+			return nil, options, fmt.Errorf("差异备份的基准必须是完整备份，%s 是增量或差异归档", basePath)
+		}
+	}
+	manifest, err := loadManifest(basePath, options, options.IncrementalChecksum, 0)
+	if err != nil {
+		return nil, options, fmt.Errorf("读取基准归档的清单失败: %v", err)
+	}
+
+	linked := make(map[string]bool)
+	current := make(map[string]FileType, len(entries))
+	for _, entry := range entries {
+		current[entry.RelPath] = entry.Type
+		if entry.Type == TypeHardlink {
+			linked[entry.LinkName] = true
+		}
+	}
+
+	stats := &IncrementalStats{Kind: kind, Base: basePath}
+	kept := entries[:0:0]
+	for _, entry := range entries {
+		if entry.Type == TypeFile && !linked[entry.RelPath] {
+			previous, ok := manifest[entry.RelPath]
+			unchanged, err := unchangedFile(absRoot, entry, previous, ok, options)
+			if err != nil {
+				return nil, options, err
+			}
+			if unchanged {
+				stats.Unchanged++
+				continue
+			}
+		}
+		kept = append(kept, entry)
+	}
+
+	// 已删除或类型改变的路径：按路径排序后，已删除目录下的路径不再单独记录
+	var removed []string
+	for path, previous := range manifest {
+		if typ, ok := current[path]; !ok || typ != previous.typ {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+	info := IncrementalInfo{Kind: kind, Base: filepath.Base(basePath), BaseSize: stat.Size()}
+	set := make(map[string]bool)
+	for _, path := range removed {
+		if !deletedBy(path, set) {
+			set[path] = true
+			info.Deleted = append(info.Deleted, path)
+		}
+	}
+	stats.Deleted = len(info.Deleted)
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, options, fmt.Errorf("生成增量信息失败: %v", err)
+	}
+	if len(data) > maxTLVLen {
+		return nil, options, fmt.Errorf("删除记录过多（%d 个路径，%d 字节），请改为完整备份", len(info.Deleted), len(data))
+	}
+	options.incremental = data
+	options.incrementalStats = stats
+	return kept, options, nil
+}
+
+// unchangedFile 判断普通文件与基准清单中的记录相比是否没有变化
+// 默认比较大小、修改时间、状态改变时间、权限和属主；IncrementalChecksum 时比较大小、权限、属主和内容的 SHA-256
+// （不依赖时间戳，适合时间戳不可靠的源，但需要读取大小相同的每个文件）
+func unchangedFile(absRoot string, entry FileEntry, previous manifestEntry, ok bool, options PackOptions) (bool, error) {
+	if !ok || previous.typ != TypeFile || previous.encrypt != entry.Encrypt || previous.size != entry.Size ||
+		previous.mode != entry.Mode || previous.uid != entry.UID || previous.gid != entry.GID {
+		return false, nil
+	}
+	if !options.IncrementalChecksum || previous.hash == nil {
+		return previous.mtime == entry.ModTime && previous.ctime == entry.ChangeTime, nil
+	}
+	if err := checkCanceled(options); err != nil {
+		return false, err
+	}
+	f, err := openEntryContent(entry, absRoot, options)
+	if err != nil {
+		// 无法读取的文件照常写入，由打包报告错误
+		return false, nil
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, nil
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum == *previous.hash, nil
+}
+
+// applyIncrementalDeletions 解包增量归档时，在写入条目之前删除基准备份之后已删除的路径
+func applyIncrementalDeletions(absRestoreRoot string, info *IncrementalInfo) error {
+	for _, path := range info.Deleted {
+		// 与条目相同的路径安全检查，且不能删除目标目录本身
+		target := filepath.Join(absRestoreRoot, path)
+		rel, err := filepath.Rel(absRestoreRoot, target)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("增量归档中的删除记录无效: %s", path)
+		}
+		// 逐级打开父目录且不跟随符号链接：之前解包的符号链接（如 link -> /etc）不能把 link/x 引到目标目录之外
+		at, err := openParentNoFollow(absRestoreRoot, rel)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // 父目录已经不存在，路径也不存在
+		}
+		if errors.Is(err, errSymlinkComponent) {
+			return fmt.Errorf("增量归档中的删除记录经过符号链接，拒绝删除: %s", path)
+		}
+		if err != nil {
+			return fmt.Errorf("删除已删除的路径失败 (%s): %v", path, err)
+		}
+		err = removeAllAt(at.dirfd, at.name)
+		at.close()
+		if err != nil {
+			return fmt.Errorf("删除已删除的路径失败 (%s): %v", path, err)
+		}
+	}
+	return nil
+}
+
+// restoreIncremental 解包增量或差异归档的根目录条目：差异归档先解包其基准（SkipBase 时除外）；
+// 目标目录为空时提醒需要先解包基准；然后删除记录中的路径。
+// 差异归档的基准在打包时已确认是完整归档，但基准可能在之后被替换（大小相同的增量或差异归档），
+// 所以解包前再次确认，并限制递归的层数，防止被改动过的归档相互引用时无限递归
+func restoreIncremental(archivePath string, absRestoreRoot string, entry *entryData, options PackOptions) error {
+	info, err := parseIncremental(entry)
+	if err != nil {
+		return err
+	}
+	if info.Kind == KindDifferential && !options.SkipBase {
+		basePath, err := incrementalBasePath(archivePath, info)
+		if err != nil {
+			return err
+		}
+		if options.baseDepth >= maxIncrementalChain {
+			return fmt.Errorf("差异归档的基准超过 %d 层，基准归档可能相互引用", maxIncrementalChain)
+		}
+		if _, err := ReadIncremental(basePath, options); err != ErrNotIncremental {
+			if err != nil {
+				return fmt.Errorf("读取基准归档 %s 失败: %v", basePath, err)
+			}
+			return fmt.Errorf("差异归档的基准必须是完整备份，%s 是增量或差异归档", basePath)
+		}
+		baseOptions := options
+		baseOptions.SHA256 = "" // 摘要是差异归档本身的
+		baseOptions.baseDepth++
+		if err := UnpackWithOptions(basePath, absRestoreRoot, baseOptions); err != nil {
+			return fmt.Errorf("解包基准归档 %s 失败: %v", basePath, err)
+		}
+	} else if names, err := os.ReadDir(absRestoreRoot); err == nil && len(names) == 0 {
+		if info.Kind == KindDifferential {
+			warn(options, "这是相对于 %s 的差异归档，只包含变化的文件；完整还原需要先把基准归档解包到同一目录", info.Base)
+		} else {
+			warn(options, "这是相对于 %s 的增量归档，只包含变化的文件；完整还原需要先把基准归档（及之前的增量归档）依次解包到同一目录", info.Base)
+		}
+	}
+	if options.selector != nil {
+		info.Deleted = options.selector.deletions(info.Deleted)
+	}
+	// 删除记录只有路径，无法按过滤条件判断（见 restorefilter.go）
+	if options.RestoreFilter != nil && len(info.Deleted) > 0 {
+		warn(options, "按过滤条件还原，不应用归档中的 %d 条删除记录", len(info.Deleted))
+		info.Deleted = nil
+	}
+	return applyIncrementalDeletions(absRestoreRoot, info)
+}
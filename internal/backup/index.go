@@ -0,0 +1,466 @@
+package backup
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// indexSuffix 索引文件的后缀，写在归档文件旁边
+const indexSuffix = ".idx"
+
+const (
+	// 索引文件的魔数和版本：版本1为 JSON 行（默认写入），版本2为按列存储（EntryTable，PackOptions.ColumnarIndex）
+	indexMagic     = "BKIX"
+	indexVersion   = uint32(2)
+	indexVersionV1 = uint32(1)
+)
+
+// indexHeader 索引内容的第一行，记录对应归档的信息
+type indexHeader struct {
+	FormatVersion int    `json:"format_version"`   // 归档格式版本
+	ArchiveBytes  int64  `json:"archive_bytes"`    // 归档文件大小，用于判断索引是否与归档一致
+	SHA256        string `json:"sha256,omitempty"` // 归档文件的 SHA-256 摘要（写入归档时同时计算，旧版本只在启用摘要时记录）
+	Entries       int    `json:"entries"`          // 条目数
+}
+
+// 索引文件格式：
+//   文件头（16字节）：魔数 "BKIX"、版本号、标志位（flagEncrypt）、保留字段
+//   版本1（默认）：[加密时：nonce + 分块 AES-GCM 密文] flate 压缩的 JSON 行，
+//     第一行为 indexHeader，之后每行一个 FileEntry
+//   版本2（ColumnarIndex）：条目数(8) + indexHeader 的 JSON 长度(4) + JSON + 列数(4) + 每列的字节数(8×列数) + 各列数据（见 EntryTable）
+//     未加密时直接写在文件头之后，读取本地索引时映射到内存；
+//     加密时先 flate 压缩，再与归档相同地分块 AES-GCM 加密（nonce + 密文），读取时解密到内存
+// 未加密的版本2索引不压缩才能映射到内存，大小约为版本1的 10–20 倍，旧版本程序也不能读取，所以只在指定时写入，
+// 适合在本地反复读取的大型归档；两种版本都可以读取。
+// 归档加密时索引也用同一密码加密，避免通过索引泄露文件名
+
+// 加密索引的密钥派生方式，记录在文件头保留字段的第一个字节：
+// indexKeySHA256（旧版本程序写入）的密钥是密码的 SHA-256，nonce 之后直接是密文；
+// indexKeyScrypt 与 versionKDF 起的归档相同，nonce 之后是派生参数和密码校验值（与归档共用盐和密钥）
+const (
+	indexKeySHA256 = byte(0)
+	indexKeyScrypt = byte(1)
+)
+
+// indexGCM 从密码生成旧版本索引（indexKeySHA256）加解密使用的 AES-GCM
+func indexGCM(password string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("创建加密器失败: %v", err)
+	}
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("创建GCM失败: %v", err)
+	}
+	return aesGCM, nil
+}
+
+// writeIndex 在归档旁写入索引文件，包含归档中全部条目的元信息
+// 远程归档列目录、查找文件时只需下载这个小文件
+func writeIndex(archivePath string, entries []FileEntry, options PackOptions) (err error) {
+	header := indexHeader{FormatVersion: int(formatVersion)}
+	if options.stats != nil && options.stats.file.hash != nil {
+		header.ArchiveBytes = options.stats.file.bytes
+		header.SHA256 = fmt.Sprintf("%x", options.stats.file.hash.Sum(nil))
+	} else {
+		info, err := os.Stat(archivePath)
+		if err != nil {
+			return fmt.Errorf("读取归档文件信息失败: %v", err)
+		}
+		header.ArchiveBytes = info.Size()
+	}
+	for _, entry := range entries {
+		if entry.Type != TypeSocket {
+			header.Entries++
+		}
+	}
+
+	// 与归档相同：先写入临时文件，完成后再重命名
+	indexPath := archivePath + indexSuffix
+	partialPath := indexPath + partialSuffix
+	outFile, err := os.Create(partialPath)
+	if err != nil {
+		return fmt.Errorf("创建索引文件失败: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			outFile.Close()
+			os.Remove(partialPath)
+		}
+	}()
+
+	// 写入文件头
+	var flags byte
+	if options.Encrypt {
+		flags |= flagEncrypt
+	}
+	version := indexVersionV1
+	if options.ColumnarIndex {
+		version = indexVersion
+	}
+	fileHeader := make([]byte, headerSize)
+	copy(fileHeader, indexMagic)
+	binary.LittleEndian.PutUint32(fileHeader[4:], version)
+	fileHeader[8] = flags
+	var encrypt writeLayer
+	if options.Encrypt {
+		fileHeader[9] = indexKeyScrypt
+		encrypt = encryptLayer(options.archiveKey.gcm, options.archiveKey.preamble)
+	}
+	if _, err := outFile.Write(fileHeader); err != nil {
+		return fmt.Errorf("写入索引文件头失败: %v", err)
+	}
+
+	if !options.ColumnarIndex {
+		err = writeIndexPayload(outFile, encrypt, func(w io.Writer) error {
+			return writeIndexV1(w, header, entries)
+		})
+	} else {
+		err = writeColumnarIndex(outFile, header, entries, encrypt)
+	}
+	if err != nil {
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("关闭索引文件失败: %v", err)
+	}
+	if err := os.Rename(partialPath, indexPath); err != nil {
+		return fmt.Errorf("重命名索引文件失败: %v", err)
+	}
+	return nil
+}
+
+// writeIndexV1 写入版本1索引的内容（JSON 行，不含文件头）
+func writeIndexV1(w io.Writer, header indexHeader, entries []FileEntry) error {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(header); err != nil {
+		return fmt.Errorf("写入索引失败: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Type == TypeSocket {
+			continue
+		}
+		// 与从归档中读取的条目保持一致
+		entry.Compress = false
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("写入索引失败 (%s): %v", entry.RelPath, err)
+		}
+	}
+	return nil
+}
+
+// writeColumnarIndex 写入版本2索引的内容：未加密时不压缩，加密时压缩后加密
+func writeColumnarIndex(outFile *os.File, header indexHeader, entries []FileEntry, encrypt writeLayer) error {
+	table := &EntryTable{}
+	for _, entry := range entries {
+		if entry.Type == TypeSocket {
+			continue
+		}
+		table.Append(entry)
+	}
+	if encrypt != nil {
+		return writeIndexPayload(outFile, encrypt, func(w io.Writer) error {
+			return writeEntryTable(w, header, table)
+		})
+	}
+	bufWriter := bufio.NewWriter(outFile)
+	if err := writeEntryTable(bufWriter, header, table); err != nil {
+		return err
+	}
+	if err := bufWriter.Flush(); err != nil {
+		return fmt.Errorf("写入索引失败: %v", err)
+	}
+	return nil
+}
+
+// writeIndexPayload 写入索引内容：归档加密时先经过加密层（nonce 和分块 AES-GCM），之后是 flate 压缩的内容
+// encrypt: 加密层，nil 表示不加密；write: 写入未压缩的内容
+func writeIndexPayload(w io.Writer, encrypt writeLayer, write func(w io.Writer) error) error {
+	var layers []writeLayer
+	if encrypt != nil {
+		layers = append(layers, encrypt)
+	}
+	// 压缩层：JSON 行中的字段名、按列存储的时间和属主都大量重复，压缩率很高
+	layers = append(layers, func(w io.Writer) (io.WriteCloser, error) {
+		flateWriter, err := flate.NewWriter(w, flate.BestCompression)
+		if err != nil {
+			return nil, fmt.Errorf("创建压缩器失败: %v", err)
+		}
+		return layerWriter{flateWriter, "关闭压缩器失败"}, nil
+	})
+	stack, err := newWriteStack(w, layers)
+	if err != nil {
+		return err
+	}
+	bufWriter := bufio.NewWriter(stack)
+	if err := write(bufWriter); err != nil {
+		return err
+	}
+	if err := bufWriter.Flush(); err != nil {
+		return fmt.Errorf("刷新缓冲区失败: %v", err)
+	}
+	return stack.Close()
+}
+
+// newIndexPayloadReader 读取 writeIndexPayload 写入的内容，返回解压后的内容和需要关闭的读取层
+// decrypt: 解密层，nil 表示内容未加密
+func newIndexPayloadReader(r io.Reader, decrypt readLayer) (io.Reader, io.Closer, error) {
+	var layers []readLayer
+	if decrypt != nil {
+		layers = append(layers, decrypt)
+	}
+	layers = append(layers, func(r io.Reader) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	})
+	stack, err := newReadStack(r, layers)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bufio.NewReader(stack), stack, nil
+}
+
+// writeEntryTable 写入版本2索引的内容（不含文件头）
+func writeEntryTable(w io.Writer, header indexHeader, table *EntryTable) error {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("写入索引失败: %v", err)
+	}
+	columns := table.columns()
+	prefix := binary.LittleEndian.AppendUint64(nil, uint64(table.Len()))
+	prefix = binary.LittleEndian.AppendUint32(prefix, uint32(len(headerJSON)))
+	prefix = append(prefix, headerJSON...)
+	prefix = binary.LittleEndian.AppendUint32(prefix, uint32(len(columns)))
+	for _, column := range columns {
+		prefix = binary.LittleEndian.AppendUint64(prefix, uint64(len(*column.data)))
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return fmt.Errorf("写入索引失败: %v", err)
+	}
+	for _, column := range columns {
+		if _, err := w.Write(*column.data); err != nil {
+			return fmt.Errorf("写入索引失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// parseEntryTable 解析版本2索引的内容，返回的表直接引用 payload 中的数据
+func parseEntryTable(payload []byte, limits ReadLimits) (*EntryTable, indexHeader, error) {
+	var header indexHeader
+	corrupt := fmt.Errorf("索引内容不完整，索引可能已损坏")
+	if len(payload) < 12 {
+		return nil, header, corrupt
+	}
+	n := binary.LittleEndian.Uint64(payload)
+	headerLen := uint64(binary.LittleEndian.Uint32(payload[8:]))
+	rest := payload[12:]
+	if headerLen > uint64(len(rest)) {
+		return nil, header, corrupt
+	}
+	if err := json.Unmarshal(rest[:headerLen], &header); err != nil {
+		return nil, header, fmt.Errorf("读取索引失败: %v", err)
+	}
+	rest = rest[headerLen:]
+	// 每个条目至少占用几十字节，条目数不会超过内容的字节数
+	if n > uint64(len(payload)) || header.Entries < 0 || uint64(header.Entries) != n {
+		return nil, header, fmt.Errorf("索引条目数异常 (%d)，索引可能已损坏", n)
+	}
+
+	table := &EntryTable{n: int(n)}
+	columns := table.columns()
+	if len(rest) < 4 || binary.LittleEndian.Uint32(rest) != uint32(len(columns)) {
+		return nil, header, fmt.Errorf("索引的列数不匹配，索引可能已损坏")
+	}
+	rest = rest[4:]
+	if uint64(len(rest)) < uint64(len(columns))*8 {
+		return nil, header, corrupt
+	}
+	lengths := rest[:len(columns)*8]
+	rest = rest[len(columns)*8:]
+	for i, column := range columns {
+		length := binary.LittleEndian.Uint64(lengths[i*8:])
+		if length > uint64(len(rest)) {
+			return nil, header, corrupt
+		}
+		*column.data = rest[:length:length]
+		rest = rest[length:]
+	}
+	if err := table.check(limits); err != nil {
+		return nil, header, err
+	}
+	return table, header, nil
+}
+
+// ReadIndex 读取归档旁的索引文件（"<归档>.idx"），返回归档中全部条目的元信息
+// archivePath: 归档的本地路径或 http:// / https:// 地址（不是索引文件本身的路径）
+// options: 归档加密时需要提供密码
+// 索引文件不存在时返回的错误满足 os.IsNotExist
+// 条目很多时使用 ReadIndexTable，不必为每个条目生成 FileEntry
+func ReadIndex(archivePath string, options PackOptions) ([]FileEntry, error) {
+	table, err := ReadIndexTable(archivePath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer table.Close()
+	return table.Entries(), nil
+}
+
+// ReadIndexTable 读取归档旁的索引文件，返回按列存储的条目表，用完后调用 Close
+// 本地未加密的版本2索引直接映射到内存，不需要读入和解码
+func ReadIndexTable(archivePath string, options PackOptions) (*EntryTable, error) {
+	table, _, err := readIndex(archivePath, options)
+	return table, err
+}
+
+// readIndex 读取索引文件，同时返回索引记录的归档信息
+func readIndex(archivePath string, options PackOptions) (*EntryTable, indexHeader, error) {
+	var header indexHeader
+	indexPath := archivePath + indexSuffix
+	var source io.ReadCloser
+	if IsURL(archivePath) {
+		hr, err := openURL(indexPath)
+		if err != nil {
+			return nil, header, err
+		}
+		source = hr
+	} else {
+		inFile, err := os.Open(indexPath)
+		if err != nil {
+			return nil, header, err
+		}
+		source = inFile
+	}
+	defer source.Close()
+
+	// 读取并验证文件头
+	fileHeader := make([]byte, headerSize)
+	if _, err := io.ReadFull(source, fileHeader); err != nil {
+		return nil, header, fmt.Errorf("读取索引文件头失败: %v", err)
+	}
+	if string(fileHeader[:4]) != indexMagic {
+		return nil, header, fmt.Errorf("无效的索引文件格式，魔数不匹配")
+	}
+	version := binary.LittleEndian.Uint32(fileHeader[4:])
+	var decrypt readLayer
+	if fileHeader[8]&flagEncrypt != 0 {
+		var err error
+		if decrypt, err = indexDecryptLayer(fileHeader[9], options); err != nil {
+			return nil, header, err
+		}
+	}
+	switch {
+	case version == indexVersionV1:
+		return readIndexV1(source, decrypt, options)
+	case version != indexVersion:
+		return nil, header, fmt.Errorf("不支持的索引文件版本: %d", version)
+	case decrypt != nil:
+		payload, closer, err := newIndexPayloadReader(source, decrypt)
+		if err != nil {
+			return nil, header, err
+		}
+		defer closer.Close()
+		data, err := io.ReadAll(payload)
+		if err != nil {
+			return nil, header, fmt.Errorf("读取索引失败: %v", err)
+		}
+		return parseEntryTable(data, options.Limits)
+	}
+
+	if inFile, ok := source.(*os.File); ok {
+		return mapIndex(inFile, options)
+	}
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return nil, header, fmt.Errorf("读取索引失败: %v", err)
+	}
+	return parseEntryTable(data, options.Limits)
+}
+
+// mapIndex 将未加密的版本2索引文件映射到内存
+func mapIndex(inFile *os.File, options PackOptions) (*EntryTable, indexHeader, error) {
+	var header indexHeader
+	info, err := inFile.Stat()
+	if err != nil {
+		return nil, header, fmt.Errorf("读取索引文件信息失败: %v", err)
+	}
+	if info.Size() <= headerSize || info.Size() != int64(int(info.Size())) {
+		return nil, header, fmt.Errorf("索引文件大小异常 (%d 字节)", info.Size())
+	}
+	mapped, err := syscall.Mmap(int(inFile.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, header, fmt.Errorf("映射索引文件失败: %v", err)
+	}
+	table, header, err := parseEntryTable(mapped[headerSize:], options.Limits)
+	if err != nil {
+		syscall.Munmap(mapped)
+		return nil, header, err
+	}
+	table.mapped = mapped
+	return table, header, nil
+}
+
+// indexDecryptLayer 按索引文件头记录的密钥派生方式返回解密层
+func indexDecryptLayer(keyScheme byte, options PackOptions) (readLayer, error) {
+	if options.Password == "" {
+		return nil, fmt.Errorf("索引已加密，需要提供密码")
+	}
+	switch keyScheme {
+	case indexKeySHA256:
+		aesGCM, err := indexGCM(options.Password)
+		if err != nil {
+			return nil, err
+		}
+		return decryptLayer(aesGCM), nil
+	case indexKeyScrypt:
+		// 与 versionKDF 起的归档相同：nonce、派生参数和密码校验值，密码错误时立即失败
+		return func(r io.Reader) (io.ReadCloser, error) {
+			aesGCM, nonce, err := openDecryption(r, versionKDF, options)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(&decryptReader{reader: r, gcm: aesGCM, nonce: nonce}), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("不支持的索引密钥派生方式: %d，需要更新版本的程序", keyScheme)
+}
+
+// readIndexV1 读取版本1索引（JSON 行），逐个条目解码后追加到表中
+// decrypt: 解密层，nil 表示索引未加密
+func readIndexV1(source io.Reader, decrypt readLayer, options PackOptions) (*EntryTable, indexHeader, error) {
+	var header indexHeader
+	payload, closer, err := newIndexPayloadReader(source, decrypt)
+	if err != nil {
+		return nil, header, err
+	}
+	defer closer.Close()
+	decoder := json.NewDecoder(payload)
+
+	if err := decoder.Decode(&header); err != nil {
+		return nil, header, fmt.Errorf("读取索引失败: %v", err)
+	}
+	if header.Entries < 0 {
+		return nil, header, fmt.Errorf("索引条目数异常 (%d)，索引可能已损坏", header.Entries)
+	}
+	table := &EntryTable{}
+	for i := 0; i < header.Entries; i++ {
+		var entry FileEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, header, fmt.Errorf("读取索引失败（第 %d 个条目）: %v", i+1, err)
+		}
+		if len(entry.RelPath) > int(options.Limits.maxPathLen()) {
+			return nil, header, fmt.Errorf("路径长度异常 (%d 字节)，索引可能已损坏", len(entry.RelPath))
+		}
+		table.Append(entry)
+	}
+	return table, header, nil
+}
@@ -0,0 +1,88 @@
+package backup
+
+import "fmt"
+
+// 读取归档时的默认资源限制：足够大多数备份使用，更大的归档需要调用方提高（或设为负数取消限制）
+const (
+	defaultMaxPathLen   = 64 * 1024 // 路径、链接目标等字符串字段
+	defaultMaxEntries   = 10000000  // 条目数
+	defaultMaxEntrySize = 256 << 30 // 单个文件或镜像的内容（256G）
+	defaultMaxTotalSize = 1 << 40   // 所有内容的总和（1T）
+
+	defaultMaxDecoderMemory = 256 << 20 // 解压缩器的窗口或字典（xz -9 为 64M，zstd --ultra -22 为 128M）
+)
+
+// ReadLimits 读取归档时的资源限制
+// 归档中的长度字段不可信：损坏或恶意构造的归档可能声明数 GB 的路径或内容，压缩的归档解包后也可能远大于归档本身，
+// 这些限制保证读取时的内存分配和写入量有上限。零值使用默认限制
+type ReadLimits struct {
+	MaxPathLen   int   // 路径、链接目标等字符串字段的最大长度，0 表示默认值（64K）
+	MaxEntries   int64 // 最大条目数，0 表示默认值（1000 万），< 0 表示不限制
+	MaxEntrySize int64 // 单个文件内容的最大字节数，0 表示默认值（256G），< 0 表示不限制
+	MaxTotalSize int64 // 所有文件内容的总字节数上限，0 表示默认值（1T），< 0 表示不限制
+
+	MaxDecoderMemory int64 // 解压缩器的窗口（zstd）或字典（xz）的最大字节数，0 表示默认值（256M），< 0 表示不限制
+}
+
+// maxPathLen 返回字符串字段的最大长度
+func (l ReadLimits) maxPathLen() uint32 {
+	if l.MaxPathLen > 0 {
+		return uint32(l.MaxPathLen)
+	}
+	return defaultMaxPathLen
+}
+
+// limitOrDefault 返回限制值：0 为默认值，< 0 为不限制（返回 0）
+func limitOrDefault(limit, def int64) int64 {
+	switch {
+	case limit == 0:
+		return def
+	case limit < 0:
+		return 0
+	}
+	return limit
+}
+
+// maxEntries、maxEntrySize、maxTotalSize 返回实际使用的限制，0 表示不限制
+func (l ReadLimits) maxEntries() int64   { return limitOrDefault(l.MaxEntries, defaultMaxEntries) }
+func (l ReadLimits) maxEntrySize() int64 { return limitOrDefault(l.MaxEntrySize, defaultMaxEntrySize) }
+func (l ReadLimits) maxTotalSize() int64 { return limitOrDefault(l.MaxTotalSize, defaultMaxTotalSize) }
+
+// maxDecoderMemory 返回解压缩器的内存限制，0 表示不限制
+func (l ReadLimits) maxDecoderMemory() int64 {
+	return limitOrDefault(l.MaxDecoderMemory, defaultMaxDecoderMemory)
+}
+
+// checkStringLen 检查字符串字段的长度
+func (l ReadLimits) checkStringLen(field string, length uint32) error {
+	if length > l.maxPathLen() {
+		return fmt.Errorf("%s长度异常 (%d 字节)，归档可能已损坏", field, length)
+	}
+	return nil
+}
+
+// limitCounter 统计已读取的条目数和内容大小
+type limitCounter struct {
+	limits  ReadLimits
+	entries int64
+	total   int64
+}
+
+// add 记录一个条目，超出限制时返回错误
+func (c *limitCounter) add(entry *entryData) error {
+	if entry.Size < 0 {
+		return fmt.Errorf("条目大小异常 (%s: %d)，归档可能已损坏", entry.RelPath, entry.Size)
+	}
+	c.entries++
+	if limit := c.limits.maxEntries(); limit > 0 && c.entries > limit {
+		return fmt.Errorf("条目数超过限制 (%d)，确认归档可信时可以提高 MaxEntries（-max-entries）", limit)
+	}
+	if limit := c.limits.maxEntrySize(); limit > 0 && entry.Size > limit {
+		return fmt.Errorf("条目 %s 的大小 %d 超过限制 (%d)，确认归档可信时可以提高 MaxEntrySize（-max-entry-size）", entry.RelPath, entry.Size, limit)
+	}
+	c.total += entry.Size
+	if limit := c.limits.maxTotalSize(); limit > 0 && c.total > limit {
+		return fmt.Errorf("内容总大小超过限制 (%d)，确认归档可信时可以提高 MaxTotalSize（-max-total-size）", limit)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// 归档合并：把多个 BKUP 归档合并为一个，例如把每周的完整备份整理为一个归档。
+// 第一遍读取每个归档的条目元信息，按合并策略为每个路径选定一个版本；第二遍按路径顺序写出选定的条目，
+// 内容从各自的归档中流式读取。各归档中选定的条目保持其在原归档中的相对顺序，逐个归档做多路归并：
+// 输入按路径排列（本程序打包的归档都是如此，见 order.go）时输出也按路径排列，且每个输入只需顺序读取一遍。
+// 硬链接和它链接的文件可能来自不同的归档：在每个归档中按 ApplyFilter 的规则修正（hardlinkFixer），
+// 目标被其他归档的版本替换时，第一个被选中的硬链接提升为普通文件，内容取自本归档中原来的目标。
+// 增量和差异归档只有变化的部分，不能合并；单独加密的条目用条目密码解密后按输出的选项重新加密，
+// 稀疏文件写出完整内容，块设备镜像写为普通文件。
+
+// MergePolicy 同一路径在多个归档中的版本不同时的处理方式
+type MergePolicy string
+
+const (
+	// MergeNewest 取修改时间最新的版本，相同时取参数中靠后的归档
+	MergeNewest MergePolicy = "newest"
+	// MergeError 报错（目录只有元数据，不算冲突，总是取修改时间最新的版本）
+	MergeError MergePolicy = "error"
+)
+
+// MergeStats 合并的统计
+type MergeStats struct {
+	Entries  int // 合并后的条目数
+	Replaced int // 在多个归档中版本不同、按策略选定其一的路径数
+}
+
+// mergeChoice 为一个路径选定的版本：所在的归档和在该归档中的序号
+type mergeChoice struct {
+	input int
+	index int
+}
+
+// MergeArchives 合并多个归档
+// inputs: 要合并的 BKUP 归档（路径或 http(s):// 地址），按参数顺序
+// outputPath: 输出的归档文件路径，写完后才从 .partial 重命名
+// policy: 同一路径版本不同时的处理方式
+// options: 读取（密码、条目密码、块存储）和写入（压缩、加密、索引等与 pack 相同）的选项
+func MergeArchives(inputs []string, outputPath string, policy MergePolicy, options PackOptions) (MergeStats, error) {
+	start := time.Now()
+	var stats MergeStats
+	if policy != MergeNewest && policy != MergeError {
+		return stats, fmt.Errorf("未知的合并策略: %s（可选 %s, %s）", policy, MergeNewest, MergeError)
+	}
+	if len(inputs) < 2 {
+		return stats, fmt.Errorf("至少需要两个归档")
+	}
+
+	absOutput, err := filepath.Abs(outputPath)
+	if err != nil {
+		return stats, fmt.Errorf("获取绝对路径失败: %v", err)
+	}
+
+	// 第一遍：读取各归档的条目，选定每个路径的版本
+	lists := make([][]FileEntry, len(inputs))
+	chosen := make(map[string]mergeChoice)
+	replaced := make(map[string]bool)
+	for i, input := range inputs {
+		if abs, err := filepath.Abs(input); err == nil && !IsURL(input) && abs == absOutput {
+			return stats, fmt.Errorf("输出文件不能是要合并的归档之一: %s", input)
+		}
+		entries, err := readMergeEntries(input, options)
+		if err != nil {
+			return stats, err
+		}
+		lists[i] = entries
+		for index, entry := range entries {
+			previous, exists := chosen[entry.RelPath]
+			if !exists {
+				chosen[entry.RelPath] = mergeChoice{i, index}
+				continue
+			}
+			old := lists[previous.input][previous.index]
+			differs := len(changedFields(newManifestEntry(old), newManifestEntry(entry))) > 0
+			if differs {
+				if policy == MergeError && entry.Type != TypeDir {
+					return stats, fmt.Errorf("%s 在 %s 和 %s 中的版本不同", entry.RelPath, inputs[previous.input], input)
+				}
+				replaced[entry.RelPath] = true
+			}
+			if entry.ModTime >= old.ModTime {
+				chosen[entry.RelPath] = mergeChoice{i, index}
+			}
+		}
+	}
+
+	// 每个归档中选定的条目（保持原有顺序），修正硬链接，并记录内容所在的条目序号
+	sources := make([]*archiveSource, len(inputs))
+	selected := make([][]FileEntry, len(inputs))
+	content := make(map[string]mergeChoice)
+	for i, entries := range lists {
+		sources[i] = &archiveSource{path: inputs[i], options: options}
+		defer sources[i].close()
+		files := make(map[string]int) // 普通文件路径 -> 序号
+		var links hardlinkFixer
+		for index, entry := range entries {
+			if entry.Type == TypeFile {
+				files[entry.RelPath] = index
+			}
+			if chosen[entry.RelPath] != (mergeChoice{i, index}) {
+				continue
+			}
+			switch entry.Type {
+			case TypeFile:
+				content[entry.RelPath] = mergeChoice{i, index}
+			case TypeHardlink:
+				content[entry.RelPath] = mergeChoice{i, files[entry.LinkName]}
+			case TypeImage:
+				warn(options, "块设备镜像 %s（%s）合并为普通文件", entry.RelPath, entry.LinkTarget)
+				entry.Type, entry.LinkTarget = TypeFile, ""
+				content[entry.RelPath] = mergeChoice{i, index}
+			}
+			// 内容读取时已解码，按输出的选项重新写入
+			entry.Encrypt, entry.Sparse = false, false
+			target := entry.LinkName
+			links.fix(&entry)
+			if entry.Type == TypeFile && target != "" {
+				// 提升为普通文件的硬链接：归档中的硬链接条目不记录大小，取原来的目标的大小
+				entry.Size = entries[files[target]].Size
+			}
+			selected[i] = append(selected[i], entry)
+		}
+	}
+	lists = nil
+	stats.Replaced = len(replaced)
+
+	merged := mergeByPath(selected)
+	options.quota = newQuotaTracker(options)
+	if options.quota != nil {
+		if err := options.quota.checkFiles(len(merged)); err != nil {
+			return stats, err
+		}
+	}
+	options.openContent = func(entry FileEntry) (io.ReadCloser, error) {
+		choice, ok := content[entry.RelPath]
+		if !ok {
+			return nil, fmt.Errorf("找不到 %s 的内容", entry.RelPath)
+		}
+		return sources[choice.input].open(choice.index)
+	}
+	if err := writeArchiveWithSidecars(outputPath, "", merged, nil, options, start); err != nil {
+		return stats, err
+	}
+	stats.Entries = len(merged)
+	return stats, nil
+}
+
+// readMergeEntries 读取归档的全部条目元信息（包括扩展属性），拒绝增量和差异归档
+func readMergeEntries(archivePath string, options PackOptions) ([]FileEntry, error) {
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.Close()
+	var entries []FileEntry
+	for {
+		if err := checkCanceled(options); err != nil {
+			return nil, err
+		}
+		entry, err := ar.next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("读取 %s 失败: %v", archivePath, err)
+		}
+		if entry.incremental != nil {
+			return nil, fmt.Errorf("%s 是增量或差异归档，只有相对于基准的变化，不能合并；请先解包到目录再打包", archivePath)
+		}
+		entries = append(entries, entry.fileEntry())
+	}
+}
+
+// mergeByPath 多路归并：每次取各列表当前条目中路径最小的一个，各列表内部的顺序不变
+func mergeByPath(lists [][]FileEntry) []FileEntry {
+	total := 0
+	for _, list := range lists {
+		total += len(list)
+	}
+	merged := make([]FileEntry, 0, total)
+	heads := make([]int, len(lists))
+	for len(merged) < total {
+		best := -1
+		for i, list := range lists {
+			if heads[i] == len(list) {
+				continue
+			}
+			if best < 0 || comparePaths(list[heads[i]].RelPath, lists[best][heads[best]].RelPath) < 0 {
+				best = i
+			}
+		}
+		merged = append(merged, lists[best][heads[best]])
+		heads[best]++
+	}
+	return merged
+}
+
+// archiveSource 按条目序号读取 BKUP 归档中普通文件的内容
+// 按序号递增读取时只需顺序读取一遍；需要读取已经过去的条目时（提升为普通文件的硬链接）重新打开归档
+type archiveSource struct {
+	path    string
+	options PackOptions
+	reader  *ArchiveReader
+	pos     int // 已读取的最后一个条目的序号
+}
+
+// open 返回第 index 个条目的内容
+func (s *archiveSource) open(index int) (io.ReadCloser, error) {
+	if s.reader == nil || index <= s.pos {
+		s.close()
+		ar, err := OpenArchive(s.path, s.options)
+		if err != nil {
+			return nil, err
+		}
+		s.reader, s.pos = ar, -1
+	}
+	for s.pos < index {
+		entry, err := s.reader.next()
+		if err != nil {
+			return nil, fmt.Errorf("读取 %s 失败: %v", s.path, err)
+		}
+		s.pos++
+		if s.pos == index && s.reader.locked != nil {
+			return nil, fmt.Errorf("%v (%s: %s)", s.reader.locked, s.path, entry.RelPath)
+		}
+	}
+	return io.NopCloser(s.reader), nil
+}
+
+// close 关闭已打开的归档
+func (s *archiveSource) close() {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+}
@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// mimeSniffLen 检测内容类型时读取的文件头字节数
+const mimeSniffLen = 512
+
+// mimeSignatures 标准库 http.DetectContentType 不识别、但备份场景中需要查找的内容特征
+var mimeSignatures = []struct {
+	prefix []byte
+	mime   string
+}{
+	{[]byte("-----BEGIN "), "application/x-pem-file"},
+	{[]byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte(magicNumber), "application/x-bkup"},
+}
+
+// detectMime 读取文件头部检测内容类型，无法读取时返回空字符串
+func detectMime(path string) string {
+	f, err := openSourceFile(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := make([]byte, mimeSniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ""
+	}
+	return DetectMime(head[:n])
+}
+
+// DetectMime 根据内容开头的字节检测内容类型
+func DetectMime(head []byte) string {
+	trimmed := bytes.TrimLeft(head, " \t\r\n")
+	for _, sig := range mimeSignatures {
+		if bytes.HasPrefix(trimmed, sig.prefix) {
+			return sig.mime
+		}
+	}
+	return http.DetectContentType(head)
+}
+
+// MatchMime 检查条目的内容类型是否匹配查询
+// 查询可以是完整类型（"application/x-pem-file"），忽略参数部分（"text/plain" 匹配 "text/plain; charset=utf-8"），
+// 也可以是以 "/" 结尾的大类（"image/"）
+func MatchMime(entryMime, query string) bool {
+	if entryMime == "" || query == "" {
+		return false
+	}
+	if strings.HasSuffix(query, "/") {
+		return strings.HasPrefix(entryMime, query)
+	}
+	if i := strings.IndexByte(entryMime, ';'); i >= 0 {
+		entryMime = strings.TrimSpace(entryMime[:i])
+	}
+	return strings.EqualFold(entryMime, query)
+}
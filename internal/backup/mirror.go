@@ -0,0 +1,278 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 同步归档目录：默认按名称、大小和修改时间比较（复制时保留修改时间，与 rsync 的默认方式相同），
+// 不读取未变化的文件；Checksum 时大小和修改时间都相同的文件再比较两侧的 SHA-256，需要读取两侧的全部内容。
+// 修改时间按秒比较，网络文件系统可能不保存纳秒。
+//
+// 目标只支持本地路径（包括挂载的网络文件系统，例如 sshfs 挂载的 SFTP 服务器）：程序没有 SSH/SFTP 客户端，
+// "sftp://" 等远程地址直接拒绝，不会按本地路径处理。
+//
+// Delete 时源目录中已不存在的文件（通常是按保留策略删除的旧归档）也从目标目录中删除；KeepWithin 指定目标目录的保留期，
+// 修改时间在保留期之内的文件即使源目录中已删除也保留，源目录的归档被误删或被破坏后，镜像中仍有最近的副本。
+// 源目录和目标目录不能相互包含，否则同步会把自己复制进自己，Delete 时还会删除源目录中的文件。
+
+// MirrorOptions 同步归档目录的选项
+type MirrorOptions struct {
+	Delete     bool            // 删除目标目录中源目录已不存在的文件
+	KeepWithin time.Duration   // Delete 时保留修改时间在这段时间之内的文件（0 表示不保留）
+	Checksum   bool            // 大小和修改时间相同的文件再比较 SHA-256
+	DryRun     bool            // 只列出将要执行的操作，不修改目标目录
+	Context    context.Context // 可选，取消时中止同步
+}
+
+// MirrorAction 同步时对一个文件执行的操作
+type MirrorAction struct {
+	Path   string // 相对于目录的路径，使用 "/" 分隔
+	Action string // "copy"（目标不存在）、"update"（大小或内容不同）或 "delete"
+	Size   int64  // 复制的字节数（删除时为被删除文件的大小）
+}
+
+// Mirror 将归档目录 src 同步到 dst：按名称、大小和修改时间比较，只复制新增或有变化的文件
+// 摘要文件、索引文件等与归档一起同步；未完成的 ".partial" 文件被忽略
+// dst 必须是本地路径（可以是挂载的网络文件系统）
+func Mirror(src, dst string, options MirrorOptions) ([]MirrorAction, error) {
+	if i := strings.Index(dst, "://"); i > 0 {
+		return nil, fmt.Errorf("不支持的目标地址: %s（只支持本地路径；SFTP 服务器请先用 sshfs 等挂载）", dst)
+	}
+	if err := checkMirrorOverlap(src, dst); err != nil {
+		return nil, err
+	}
+	srcFiles, err := listMirrorFiles(src)
+	if err != nil {
+		return nil, err
+	}
+	dstFiles, err := listMirrorFiles(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// 比较两侧的文件
+	var actions []MirrorAction
+	for _, rel := range sortedKeys(srcFiles) {
+		file := srcFiles[rel]
+		dstFile, exists := dstFiles[rel]
+		switch {
+		case !exists:
+			actions = append(actions, MirrorAction{Path: rel, Action: "copy", Size: file.size})
+		case dstFile.size != file.size || dstFile.modTime.Unix() != file.modTime.Unix():
+			actions = append(actions, MirrorAction{Path: rel, Action: "update", Size: file.size})
+		case options.Checksum:
+			same, err := sameContent(filepath.Join(src, filepath.FromSlash(rel)), filepath.Join(dst, filepath.FromSlash(rel)), options)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				actions = append(actions, MirrorAction{Path: rel, Action: "update", Size: file.size})
+			}
+		}
+	}
+	if options.Delete {
+		now := time.Now()
+		for _, rel := range sortedKeys(dstFiles) {
+			if _, ok := srcFiles[rel]; ok {
+				continue
+			}
+			// 保留期之内的文件不删除
+			if options.KeepWithin > 0 && now.Sub(dstFiles[rel].modTime) < options.KeepWithin {
+				continue
+			}
+			actions = append(actions, MirrorAction{Path: rel, Action: "delete", Size: dstFiles[rel].size})
+		}
+	}
+	if options.DryRun {
+		return actions, nil
+	}
+
+	// 执行：先复制后删除，中途失败时目标目录不会缺少源目录中仍存在的归档
+	for i, action := range actions {
+		if err := checkCanceled(PackOptions{Context: options.Context}); err != nil {
+			return actions[:i], err
+		}
+		from := filepath.Join(src, filepath.FromSlash(action.Path))
+		to := filepath.Join(dst, filepath.FromSlash(action.Path))
+		if action.Action == "delete" {
+			if err := os.Remove(to); err != nil {
+				return actions[:i], fmt.Errorf("删除 %s 失败: %v", to, err)
+			}
+			continue
+		}
+		if err := copyMirrorFile(from, to, options); err != nil {
+			return actions[:i], err
+		}
+	}
+	return actions, nil
+}
+
+// checkMirrorOverlap 确认源目录和目标目录互不包含（按解析符号链接之后的路径；目标目录可以还不存在）
+func checkMirrorOverlap(src, dst string) error {
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return fmt.Errorf("无法解析源目录: %v", err)
+	}
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return fmt.Errorf("无法解析目标目录: %v", err)
+	}
+	absSrc, absDst = resolveExisting(absSrc), resolveExisting(absDst)
+	if pathWithin(absDst, absSrc) {
+		return fmt.Errorf("目标目录不能位于源目录之内: %s", dst)
+	}
+	if pathWithin(absSrc, absDst) {
+		return fmt.Errorf("源目录不能位于目标目录之内: %s", src)
+	}
+	return nil
+}
+
+// resolveExisting 解析路径中已存在部分的符号链接，不存在的部分原样接在后面
+func resolveExisting(path string) string {
+	var rest []string
+	for {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(append([]string{path}, rest...)...)
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+// pathWithin path 是否就是 dir 或位于 dir 之内（都是绝对路径）
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && (rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))))
+}
+
+// mirrorFile 同步时比较的文件信息
+type mirrorFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// listMirrorFiles 列出目录下的所有普通文件及其大小和修改时间（跳过 ".partial" 文件）
+func listMirrorFiles(root string) (map[string]mirrorFile, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	files := make(map[string]mirrorFile)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(path, partialSuffix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = mirrorFile{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("读取目录失败 (%s): %v", root, err)
+	}
+	return files, nil
+}
+
+// sortedKeys 返回按路径排序的文件列表
+func sortedKeys(files map[string]mirrorFile) []string {
+	keys := make([]string, 0, len(files))
+	for rel := range files {
+		keys = append(keys, rel)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sameContent 比较两个文件的 SHA-256 摘要（MirrorOptions.Checksum）
+func sameContent(a, b string, options MirrorOptions) (bool, error) {
+	hashA, err := fileSHA256(a, options)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := fileSHA256(b, options)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hashA, hashB), nil
+}
+
+// fileSHA256 计算文件的 SHA-256 摘要
+func fileSHA256(path string, options MirrorOptions) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开文件失败: %v", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, withCancel(f, PackOptions{Context: options.Context})); err != nil {
+		return nil, fmt.Errorf("读取文件失败 (%s): %v", path, err)
+	}
+	return h.Sum(nil), nil
+}
+
+// copyMirrorFile 复制文件：先写入临时文件，完成后重命名，并保留修改时间
+func copyMirrorFile(from, to string, options MirrorOptions) (err error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("打开文件失败: %v", err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("读取文件信息失败: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return fmt.Errorf("创建目录失败: %v", err)
+	}
+	partialPath := to + partialSuffix
+	out, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("创建文件失败: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(partialPath)
+		}
+	}()
+
+	if _, err := io.Copy(out, withCancel(in, PackOptions{Context: options.Context})); err != nil {
+		return fmt.Errorf("复制 %s 失败: %v", from, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("写入 %s 失败: %v", to, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("关闭 %s 失败: %v", to, err)
+	}
+	if err := os.Chtimes(partialPath, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("设置修改时间失败: %v", err)
+	}
+	if err := os.Rename(partialPath, to); err != nil {
+		return fmt.Errorf("重命名 %s 失败: %v", to, err)
+	}
+	return nil
+}
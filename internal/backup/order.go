@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// orderSmallestFirst 还原顺序中表示“小文件优先”的关键字
+const orderSmallestFirst = "smallest-first"
+
+// RestoreOrder 条目的还原顺序
+// 归档按顺序读取，解包时按条目在归档中的顺序还原，因此顺序在打包时确定：
+// 匹配靠前模式的条目先写入，灾难恢复时关键路径（如 etc/**、db/**）最先可用
+type RestoreOrder struct {
+	Priority      []string // 优先还原的路径模式，按优先级从高到低
+	SmallestFirst bool     // 同一优先级内小文件优先
+}
+
+// ParseRestoreOrder 解析还原顺序，例如 "etc/**,db/**,smallest-first"
+// "smallest-first" 表示同一优先级内小文件优先，其余各项为按优先级从高到低排列的路径模式
+func ParseRestoreOrder(s string) (*RestoreOrder, error) {
+	order := &RestoreOrder{}
+	for _, item := range ParsePatterns(s) {
+		if strings.EqualFold(item, orderSmallestFirst) {
+			order.SmallestFirst = true
+			continue
+		}
+		order.Priority = append(order.Priority, item)
+	}
+	if len(order.Priority) == 0 && !order.SmallestFirst {
+		return nil, fmt.Errorf("还原顺序为空")
+	}
+	return order, nil
+}
+
+// rank 返回条目匹配的第一个优先模式的序号，都不匹配时排在最后
+func (o *RestoreOrder) rank(entry FileEntry) int {
+	isDir := entry.Type == TypeDir
+	for i, pattern := range o.Priority {
+		if matchPathPattern(pattern, entry.RelPath, isDir) {
+			return i
+		}
+	}
+	return len(o.Priority)
+}
+
+// Sort 按还原顺序排列条目
+// 目录条目保持原有（按路径的）顺序排在最前面（只有元数据，保证父目录先于内容创建）；
+// 硬链接排在其目标文件之后，使解包时链接目标已经存在
+func (o *RestoreOrder) Sort(entries []FileEntry) []FileEntry {
+	var dirs, others []FileEntry
+	for _, entry := range entries {
+		if entry.Type == TypeDir {
+			dirs = append(dirs, entry)
+		} else {
+			others = append(others, entry)
+		}
+	}
+
+	ranks := make(map[string]int, len(others))
+	for _, entry := range others {
+		ranks[entry.RelPath] = o.rank(entry)
+	}
+	sort.SliceStable(others, func(i, j int) bool {
+		ri, rj := ranks[others[i].RelPath], ranks[others[j].RelPath]
+		if ri != rj {
+			return ri < rj
+		}
+		if o.SmallestFirst {
+			return others[i].Size < others[j].Size
+		}
+		return false
+	})
+
+	return linksAfterTargets(dirs, others)
+}
+
+// linksAfterTargets 依次输出 head 和 others，others 中目标文件尚未输出的硬链接推迟到目标之后
+func linksAfterTargets(head, others []FileEntry) []FileEntry {
+	sorted := append(make([]FileEntry, 0, len(head)+len(others)), head...)
+	written := make(map[string]bool, len(others))
+	pending := make(map[string][]FileEntry)
+	var emit func(entry FileEntry)
+	emit = func(entry FileEntry) {
+		sorted = append(sorted, entry)
+		written[entry.RelPath] = true
+		links := pending[entry.RelPath]
+		delete(pending, entry.RelPath)
+		for _, link := range links {
+			emit(link)
+		}
+	}
+	for _, entry := range others {
+		if entry.Type == TypeHardlink && !written[entry.LinkName] {
+			pending[entry.LinkName] = append(pending[entry.LinkName], entry)
+			continue
+		}
+		emit(entry)
+	}
+	// 目标不在条目列表中的硬链接（不应出现）保持在末尾
+	for _, entry := range others {
+		if !written[entry.RelPath] {
+			sorted = append(sorted, entry)
+		}
+	}
+	return sorted
+}
+
+// 条目顺序：ScanPath 和 ApplyFilter 返回的条目（因而打包和导入写入归档的条目）都按路径排列：
+// 根目录 "." 最前，父目录在其内容之前，同一目录中按名称的字节序，即按名称排序的深度优先顺序，
+// 与文件系统返回目录项的顺序无关；硬链接总是在它链接的文件之后。
+// 解包依赖硬链接在目标之后：链接还原时目标已经存在。RestoreOrder 改变内容的顺序，但目录仍按路径排在最前面、
+// 硬链接仍在目标之后。外部归档中的条目可以是任意顺序，导入时同样按路径重新排列（见 tarSource）。
+// 解包时目录的权限和时间在最后按路径倒序设置（finishDirs），不依赖目录条目的位置。
+
+// sortByPath 按路径排列条目（见上面的条目顺序），已经有序时不重新排序；
+// 排序后目标在后面的硬链接推迟到目标之后
+func sortByPath(entries []FileEntry) []FileEntry {
+	less := func(i, j int) bool {
+		return comparePaths(entries[i].RelPath, entries[j].RelPath) < 0
+	}
+	if !sort.SliceIsSorted(entries, less) {
+		entries = append([]FileEntry(nil), entries...)
+		sort.SliceStable(entries, less)
+	}
+	return linksAfterTargets(nil, entries)
+}
+
+// comparePaths 逐级比较两个条目路径：根目录 "." 最前，父目录在其内容之前，同一级按名称的字节序
+func comparePaths(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "." {
+		return -1
+	}
+	if b == "." {
+		return 1
+	}
+	a, b = strings.TrimSuffix(a, "/"), strings.TrimSuffix(b, "/")
+	for {
+		ai, bi := strings.IndexByte(a, '/'), strings.IndexByte(b, '/')
+		ac, bc := a, b
+		if ai >= 0 {
+			ac = a[:ai]
+		}
+		if bi >= 0 {
+			bc = b[:bi]
+		}
+		if ac != bc {
+			return strings.Compare(ac, bc)
+		}
+		switch {
+		case ai < 0 && bi < 0:
+			return 0
+		case ai < 0:
+			return -1
+		case bi < 0:
+			return 1
+		}
+		a, b = a[ai+1:], b[bi+1:]
+	}
+}
@@ -1,26 +1,56 @@
 package backup
 
 import (
-	"compress/flate"
-	"crypto/aes"
+	"bufio"
+	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
 	// 文件格式魔数和版本
 	magicNumber = "BKUP"
-	formatVersion = uint32(2) // 版本2：支持压缩和加密
+	formatVersion = versionKDF // 当前写入的版本
+	
+	// 各格式版本的变化，读取时按归档的版本决定布局、允许的标志位和条目类型
+	// 版本1：最初的格式；版本2：支持压缩和加密，文件头带标志位
+	versionImage         = uint32(3) // 块设备镜像条目
+	versionBlockCompress = uint32(4) // 分块压缩标志
+	versionMime          = uint32(5) // 条目带内容类型字段（内容类型标志）
+	versionStreamHash    = uint32(6) // 流校验标志
+	versionTLV           = uint32(7) // 条目带可扩展的 TLV 元数据，内容类型移到 TLV 中
+	versionVerifier      = uint32(8) // 加密归档带密码校验值
+	versionContentHash   = uint32(9) // 文件内容之后带 SHA-256
+	versionCentralIndex  = uint32(10) // 可选的中央索引
+	versionCodec         = uint32(11) // 可选 zstd、xz 压缩，压缩算法记录在文件头保留字段中
+	versionKDF           = uint32(12) // 加密归档的密钥由 scrypt 派生，盐和参数写在密码校验值之前
 	
-	// 文件头标志位
+	// 文件头标志位：新增标志位或条目类型时必须提升格式版本，读取时按版本拒绝不认识的标志位和条目类型
+	// （knownFlags、knownEntryType），旧版本程序会报告需要升级而不是误读。
 	flagCompress = byte(0x01) // 压缩标志
 	flagEncrypt  = byte(0x02) // 加密标志
+	flagBlockCompress = byte(0x04) // 分块压缩标志（与压缩标志同时设置，数据按独立块压缩，可并行解压，versionBlockCompress 起）
+	flagMime     = byte(0x08) // 内容类型标志（每个条目带有 MIME 类型字段，versionMime 到 versionTLV 之前；versionTLV 起内容类型存放在 TLV 中）
+	flagStreamHash = byte(0x10) // 流校验标志（文件头之后的数据每 16 MiB 带一个链式校验值，versionStreamHash 起）
+	flagCentralIndex = byte(0x20) // 中央索引标志（条目数据之后是全部条目的偏移表，归档末尾是指向它的尾部，versionCentralIndex 起）
+	
+	// 文件头长度（版本2+）：魔数4 + 版本4 + 标志位1 + 保留7
+	// 保留字段的第一个字节为压缩级别（仅供诊断），第二个字节为压缩算法编号（versionCodec 起，设置了压缩标志时有效）
+	headerSize = 16
+	
+	// 文件头中的压缩算法编号（versionCodec 起）：0 为 flate，与旧版本的保留字段（全为 0）一致
+	headerCodecFlate = byte(0)
+	headerCodecZstd  = byte(1)
+	headerCodecXz    = byte(2)
 	
 	// 条目类型
 	entryTypeEnd      = byte(0) // 文件结束标记
@@ -31,6 +61,7 @@ const (
 	entryTypeFifo     = byte(5) // 命名管道
 	entryTypeCharDev  = byte(6) // 字符设备
 	entryTypeBlockDev = byte(7) // 块设备
+	entryTypeImage    = byte(8) // 块设备镜像（设备原始内容）
 )
 
 // Pack 将指定目录树打包到归档文件
@@ -49,115 +80,411 @@ func Pack(root string, archivePath string, filter *Filter) error {
 // options: 打包选项（压缩、加密等）
 // 返回: 可能的错误
 func PackWithOptions(root string, archivePath string, filter *Filter, options PackOptions) error {
-	// 扫描目录树
-	entries, err := ScanPath(root)
+	start := time.Now()
+	options.quota = newQuotaTracker(options)
+	absRoot, entries, err := collectEntries(root, filter, options)
 	if err != nil {
-		return fmt.Errorf("扫描路径失败: %v", err)
+		return err
+	}
+	if entries, options, err = applyIncremental(archivePath, absRoot, entries, options); err != nil {
+		return err
 	}
 	
-	// 应用过滤条件
-	if filter != nil {
-		entries = ApplyFilter(entries, filter)
+	return writeArchiveWithSidecars(archivePath, absRoot, entries, filter, options, start)
+}
+
+// writeArchiveWithSidecars 写入归档，并按选项在旁边写入摘要文件和索引文件
+// start: 打包开始时间（用于摘要中的耗时）
+func writeArchiveWithSidecars(archivePath string, absRoot string, entries []FileEntry, filter *Filter, options PackOptions, start time.Time) error {
+	defer releaseDeepDirs()
+	options = resolveCompression(options)
+	entries, options, err := applyReproducible(entries, options)
+	if err != nil {
+		return err
+	}
+	entries, options, cleanup, err := applyTransforms(absRoot, entries, options)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	entries, options, err = applyEntryEncryption(entries, options)
+	if err != nil {
+		return err
+	}
+	if options, err = applyPackageInventory(absRoot, entries, options); err != nil {
+		return err
+	}
+	if options, err = applyChunkStore(options); err != nil {
+		return err
+	}
+	if options, err = applyArchiveKey(options); err != nil {
+		return err
+	}
+	options = applyEncryptCompressPolicy(archivePath, entries, options)
+	if options.Summary || options.OnArchive != nil || options.Index {
+		options.stats = &archiveStats{}
+	}
+	// 写入时跳过的条目（套接字、扫描之后类型已改变的文件）不在归档中，摘要和索引只记录写入的条目
+	entries, skipped, err := writeArchive(archivePath, absRoot, entries, options)
+	if err != nil {
+		return err
+	}
+	if options.Summary || options.OnArchive != nil {
+		summary := buildPackSummary(archivePath, absRoot, entries, filter, options, start)
+		summary.Skipped = skipped
+		if options.Summary {
+			if err := writePackSummary(archivePath, summary); err != nil {
+				return err
+			}
+		}
+		if options.OnArchive != nil {
+			options.OnArchive(summary)
+		}
+	}
+	if options.Index {
+		if err := writeIndex(archivePath, entries, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectEntries 扫描源路径并得到最终要打包的条目（过滤、硬链接处理、敏感文件检查）
+// 返回: 源根目录的绝对路径、条目列表和可能的错误
+func collectEntries(root string, filter *Filter, options PackOptions) (string, []FileEntry, error) {
+	// 扫描目录树（扫描过程中检查条目数和耗时的限制）
+	entries, err := scanPath(root, options.quota.scanProgress(filter))
+	if err != nil {
+		return "", nil, fmt.Errorf("扫描路径失败: %v", err)
 	}
 	
-	// 创建输出文件
-	outFile, err := os.Create(archivePath)
+	// 应用过滤条件（同时保证条目按路径排列）
+	entries = ApplyFilter(entries, filter)
+	
+	// 标准化源路径
+	absRoot, err := filepath.Abs(root)
 	if err != nil {
-		return fmt.Errorf("创建归档文件失败: %v", err)
+		return "", nil, fmt.Errorf("获取绝对路径失败: %v", err)
 	}
-	defer outFile.Close()
 	
-	// 先写入文件头（不加密不压缩，以便解包时能直接读取）
-	if err := writeHeaderWithFlags(outFile, options.Compress, options.Encrypt); err != nil {
-		return fmt.Errorf("写入文件头失败: %v", err)
+	// 检查疑似敏感文件（在解引用之前：排除敏感文件时需要按硬链接关系一起排除链接到它的路径）
+	entries, err = applySecretPolicy(absRoot, entries, options)
+	if err != nil {
+		return "", nil, err
+	}
+	if options.quota != nil {
+		if err := options.quota.checkDuration(); err != nil {
+			return "", nil, err
+		}
 	}
 	
-	// 创建写入链：文件 -> 加密 -> 压缩 -> 实际写入
-	var finalWriter io.Writer = outFile
-	var encWriter *encryptWriter // 保存加密写入器的引用
+	// 硬链接解引用：每个路径都保存完整内容
+	if options.HardDereference {
+		entries = dereferenceHardlinks(entries)
+	}
 	
-	// 如果启用加密，添加加密层
-	var aesGCM cipher.AEAD
-	if options.Encrypt {
-		if options.Password == "" {
-			return fmt.Errorf("启用加密时必须提供密码")
+	// 检测文件内容类型（需要读取每个文件的开头，同时检查耗时）
+	if options.DetectMime {
+		for i := range entries {
+			if entries[i].Type == TypeFile && entries[i].Mime == "" {
+				entries[i].Mime = detectMime(filepath.Join(absRoot, entries[i].RelPath))
+				if options.quota != nil {
+					if err := options.quota.checkDuration(); err != nil {
+						return "", nil, err
+					}
+				}
+			}
 		}
-		// 从密码生成密钥
-		key := sha256.Sum256([]byte(options.Password))
-		block, err := aes.NewCipher(key[:])
-		if err != nil {
-			return fmt.Errorf("创建加密器失败: %v", err)
+	}
+	
+	// 检查条目数限制
+	if options.quota != nil {
+		if err := options.quota.checkFiles(len(entries)); err != nil {
+			return "", nil, err
 		}
-		aesGCM, err = cipher.NewGCM(block)
+	}
+	
+	// 按还原优先级排列条目
+	if options.RestoreOrder != nil {
+		entries = options.RestoreOrder.Sort(entries)
+	}
+	
+	return absRoot, entries, nil
+}
+
+// writeArchive 将条目列表写入归档文件（文件头、加密层、压缩层、条目和结束标记）
+// absRoot: 条目相对路径所基于的源根目录（绝对路径）
+// 归档先写入 "<archivePath>.partial"，全部写完后才重命名，失败或取消时删除，不会留下看似完整的截断归档
+// 返回实际写入的条目和跳过的条目路径（writeEntry 返回 errEntrySkipped 的条目，以及链接到它们的硬链接）
+func writeArchive(archivePath string, absRoot string, entries []FileEntry, options PackOptions) (written []FileEntry, skipped []string, err error) {
+	// 创建输出文件
+	partialPath := archivePath + partialSuffix
+	outFile, err := os.Create(partialPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建归档文件失败: %v", err)
+	}
+	defer func() {
+		outFile.Close()
 		if err != nil {
-			return fmt.Errorf("创建GCM失败: %v", err)
-		}
-		// 生成随机 nonce（12字节）
-		nonce := make([]byte, aesGCM.NonceSize())
-		if _, err := rand.Read(nonce); err != nil {
-			return fmt.Errorf("生成随机数失败: %v", err)
-		}
-		// 写入 nonce（在文件头之后）
-		if _, err := outFile.Write(nonce); err != nil {
-			return fmt.Errorf("写入 nonce 失败: %v", err)
+			os.Remove(partialPath)
 		}
-		// 创建加密写入器
-		encWriter = &encryptWriter{
-			writer: outFile,
-			gcm:    aesGCM,
-			nonce:  nonce,
-		}
-		finalWriter = encWriter
+	}()
+	
+	// 需要生成摘要文件或索引时，统计写入文件的字节数和摘要
+	var fileWriter io.Writer = outFile
+	if options.stats != nil {
+		fileWriter = options.stats.writer(outFile)
 	}
 	
-	// 如果启用压缩，添加压缩层
-	var flateWriter *flate.Writer
-	if options.Compress {
-		var err error
-		flateWriter, err = flate.NewWriter(finalWriter, flate.BestCompression)
-		if err != nil {
-			return fmt.Errorf("创建压缩器失败: %v", err)
+	// 先写入文件头（不加密不压缩，以便解包时能直接读取）
+	if err := writeHeaderWithFlags(fileWriter, headerFlags(options), headerLevel(options), headerCodec(options)); err != nil {
+		return nil, nil, fmt.Errorf("写入文件头失败: %v", err)
+	}
+	
+	// 创建写入链：文件 -> 流校验 -> 加密 -> 压缩 -> 实际写入
+	var rawWriter io.Writer = fileWriter
+	var position *offsetWriter // 写入中央索引时记录条目数据流的结束位置
+	if options.CentralIndex {
+		position = &offsetWriter{writer: fileWriter, offset: headerSize}
+		rawWriter = position
+		if options.Compress || options.StreamHash {
+			warn(options, "%s", warnNotSeekable)
 		}
-		finalWriter = flateWriter
 	}
+	if options.quota == nil {
+		options.quota = newQuotaTracker(options)
+	}
+	if options.quota != nil {
+		rawWriter = &quotaWriter{writer: rawWriter, tracker: options.quota}
+	}
+	baseWriter := rawWriter // 中央索引写在流校验层之下
 	
-	// 标准化源路径
-	absRoot, err := filepath.Abs(root)
+	// 叠加写入层：流校验 -> 加密 -> 压缩（见 pipeline.go）
+	layers, err := archiveWriteLayers(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	stack, err := newWriteStack(rawWriter, layers)
 	if err != nil {
-		return fmt.Errorf("获取绝对路径失败: %v", err)
+		return nil, nil, err
 	}
+	// 出错返回时停止并行压缩的后台协程
+	defer stack.abort()
+	
+	// 添加缓冲层：合并条目元数据的大量小写入和小文件内容，减少系统调用和加密/压缩层的调用次数
+	bufWriter := bufio.NewWriterSize(stack, bufferSize(options))
+	
+	// 写入中央索引时记录每个条目在条目数据流中的偏移
+	var entryWriter io.Writer = bufWriter
+	var logical *offsetWriter
+	var offsets []int64
+	if options.CentralIndex {
+		logical = &offsetWriter{writer: bufWriter}
+		entryWriter = logical
+		offsets = make([]int64, 0, len(entries))
+	}
+	
+	// 后台预读小文件，写入条目时直接取用
+	options.smallFiles = newSmallFileReader(absRoot, entries, options)
+	defer options.smallFiles.close()
 	
-	// 遍历所有条目并写入
+	// 遍历所有条目并写入，跳过的条目不计入 written 和 offsets
+	counter := newProgressCounter(entries, options.Progress)
+	written = make([]FileEntry, 0, len(entries))
+	skippedPaths := make(map[string]bool)
 	for _, entry := range entries {
-		if err := writeEntry(finalWriter, entry, absRoot); err != nil {
-			return fmt.Errorf("写入条目失败 (%s): %v", entry.RelPath, err)
+		if err := checkCanceled(options); err != nil {
+			return nil, nil, err
+		}
+		// 链接的文件被跳过时硬链接也跳过：归档中没有它的目标
+		if entry.Type == TypeHardlink && skippedPaths[entry.LinkName] {
+			warn(options, "跳过硬链接 %s：链接的文件 %s 已被跳过", entry.RelPath, entry.LinkName)
+			skippedPaths[entry.RelPath] = true
+			skipped = append(skipped, entry.RelPath)
+			continue
+		}
+		var offset int64
+		if logical != nil {
+			offset = logical.offset
+		}
+		var entryErr error
+		if options.EntryStats && options.stats != nil {
+			entryErr = writeEntryCounted(entryWriter, bufWriter, entry, absRoot, options, counter)
+		} else {
+			entryErr = writeEntry(entryWriter, entry, absRoot, options, counter)
+		}
+		if errors.Is(entryErr, errEntrySkipped) {
+			skippedPaths[entry.RelPath] = true
+			skipped = append(skipped, entry.RelPath)
+			continue
+		}
+		if entryErr != nil {
+			return nil, nil, fmt.Errorf("写入条目失败 (%s): %v", entry.RelPath, entryErr)
+		}
+		written = append(written, entry)
+		if logical != nil {
+			offsets = append(offsets, offset)
 		}
 	}
 	
 	// 写入结束标记
-	if err := writeEndMarker(finalWriter); err != nil {
-		return fmt.Errorf("写入结束标记失败: %v", err)
+	if err := writeEndMarker(bufWriter); err != nil {
+		return nil, nil, fmt.Errorf("写入结束标记失败: %v", err)
+	}
+	if err := bufWriter.Flush(); err != nil {
+		return nil, nil, fmt.Errorf("刷新缓冲区失败: %v", err)
 	}
 	
-	// 关闭顺序：先关闭压缩层（刷新压缩数据），再关闭加密层（刷新加密数据）
-	if flateWriter != nil {
-		if err := flateWriter.Close(); err != nil {
-			return fmt.Errorf("关闭压缩器失败: %v", err)
-		}
+	// 从最外层开始关闭：先刷新压缩数据，再刷新加密数据，最后写入流校验的末块校验值
+	if err := stack.Close(); err != nil {
+		return nil, nil, err
 	}
 	
-	// 如果使用了加密写入器，需要关闭它来刷新缓冲区
-	if encWriter != nil {
-		if err := encWriter.Close(); err != nil {
-			return fmt.Errorf("关闭加密写入器失败: %v", err)
+	// 条目数据流之后写入中央索引和尾部
+	if options.CentralIndex {
+		if err := writeCentralIndex(baseWriter, position.offset, written, offsets, options); err != nil {
+			return nil, nil, err
 		}
 	}
 	
+	// 写入完成，重命名为最终文件名
+	if err := outFile.Close(); err != nil {
+		return nil, nil, fmt.Errorf("关闭归档文件失败: %v", err)
+	}
+	if err := os.Rename(partialPath, archivePath); err != nil {
+		return nil, nil, fmt.Errorf("重命名归档文件失败: %v", err)
+	}
+	return written, skipped, nil
+}
+
+// writeEntryCounted 写入条目并记录它的字节数：写完后刷新缓冲区和压缩层，条目的数据全部经过各统计层
+func writeEntryCounted(w io.Writer, bufWriter *bufio.Writer, entry FileEntry, absRoot string, options PackOptions, counter *progressCounter) error {
+	st := options.stats
+	record := EntryBytes{Path: entry.RelPath, Stream: -st.stream.bytes}
+	if st.compressed != nil {
+		record.Compressed = -st.compressed.bytes
+	}
+	if err := writeEntry(w, entry, absRoot, options, counter); err != nil {
+		return err
+	}
+	if err := bufWriter.Flush(); err != nil {
+		return fmt.Errorf("刷新缓冲区失败: %v", err)
+	}
+	record.Stream += st.stream.bytes
+	if st.compressed != nil {
+		if err := st.compressor.flush(); err != nil {
+			return fmt.Errorf("刷新压缩器失败: %v", err)
+		}
+		record.Compressed += st.compressed.bytes
+	}
+	st.entries = append(st.entries, record)
 	return nil
 }
 
-// writeHeaderWithFlags 写入文件头（带压缩和加密标志）
-func writeHeaderWithFlags(w io.Writer, compress, encrypt bool) error {
+// newCompressWriter 按选项创建压缩层（分块压缩或单一 flate 流，都由 options.Threads 个 worker 并行压缩），不压缩时返回 nil
+func newCompressWriter(w io.Writer, options PackOptions) (io.WriteCloser, error) {
+	if !options.Compress {
+		return nil, nil
+	}
+	if err := options.Compression.checkLevel(options.CompressionLevel); err != nil {
+		return nil, err
+	}
+	if options.Compression == CodecZstd {
+		if options.BlockCompress {
+			return nil, fmt.Errorf("zstd 压缩不支持分块压缩（zstd 本身使用多个线程压缩）")
+		}
+		zstdWriter, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.CompressionLevel)),
+			zstd.WithEncoderConcurrency(compressionWorkers(options.Threads)))
+		if err != nil {
+			return nil, fmt.Errorf("创建压缩器失败: %v", err)
+		}
+		return zstdWriter, nil
+	}
+	if options.Compression == CodecXz {
+		if options.BlockCompress {
+			return nil, fmt.Errorf("xz 压缩不支持分块压缩")
+		}
+		xzWriter, err := newXzWriter(w, options.CompressionLevel)
+		if err != nil {
+			return nil, fmt.Errorf("创建压缩器失败: %v", err)
+		}
+		return xzWriter, nil
+	}
+	if options.BlockCompress {
+		return newBlockCompressWriter(w, options.CompressionLevel, options.CompressTarget, compressionWorkers(options.Threads)), nil
+	}
+	return newParallelFlateWriter(w, options.CompressionLevel, compressionWorkers(options.Threads)), nil
+}
+
+// dereferenceHardlinks 将所有硬链接条目转换为普通文件条目
+func dereferenceHardlinks(entries []FileEntry) []FileEntry {
+	for i := range entries {
+		if entries[i].Type == TypeHardlink {
+			entries[i].Type = TypeFile
+			entries[i].LinkName = ""
+		}
+	}
+	return entries
+}
+
+// defaultBufferSize 条目读写缓冲区的默认大小
+const defaultBufferSize = 256 * 1024
+
+// bufferSize 返回选项指定的缓冲区大小，未指定时使用默认值
+func bufferSize(options PackOptions) int {
+	if options.BufferSize > 0 {
+		return options.BufferSize
+	}
+	return defaultBufferSize
+}
+
+// headerFlags 根据打包选项计算文件头标志位
+func headerFlags(options PackOptions) byte {
+	var flags byte
+	if options.Compress {
+		flags |= flagCompress
+		if headerCodec(options) == headerCodecFlate && options.BlockCompress {
+			flags |= flagBlockCompress
+		}
+	}
+	if options.Encrypt {
+		flags |= flagEncrypt
+	}
+	if options.StreamHash {
+		flags |= flagStreamHash
+	}
+	if options.CentralIndex {
+		flags |= flagCentralIndex
+	}
+	return flags
+}
+
+// headerLevel 返回记录在文件头中的压缩级别（未压缩时为 0）
+func headerLevel(options PackOptions) byte {
+	if !options.Compress {
+		return 0
+	}
+	return byte(options.CompressionLevel)
+}
+
+// headerCodec 返回记录在文件头中的压缩算法编号（未压缩时为 0）
+func headerCodec(options PackOptions) byte {
+	if !options.Compress {
+		return headerCodecFlate
+	}
+	switch options.Compression {
+	case CodecZstd:
+		return headerCodecZstd
+	case CodecXz:
+		return headerCodecXz
+	}
+	return headerCodecFlate
+}
+
+// writeHeaderWithFlags 写入文件头（带压缩和加密等标志位）
+// level: 压缩级别，记录在第一个保留字节中，仅供诊断，读取时不需要
+// codec: 压缩算法编号，记录在第二个保留字节中
+func writeHeaderWithFlags(w io.Writer, flags byte, level byte, codec byte) error {
 	// 写入魔数（4字节）
 	if _, err := w.Write([]byte(magicNumber)); err != nil {
 		return err
@@ -169,19 +496,14 @@ func writeHeaderWithFlags(w io.Writer, compress, encrypt bool) error {
 	}
 	
 	// 写入标志位（1字节）
-	var flags byte
-	if compress {
-		flags |= flagCompress
-	}
-	if encrypt {
-		flags |= flagEncrypt
-	}
 	if err := binary.Write(w, binary.LittleEndian, flags); err != nil {
 		return err
 	}
 	
-	// 写入保留字段（7字节）
+	// 写入保留字段（7字节），第一个字节为压缩级别，第二个字节为压缩算法
 	reserved := make([]byte, 7)
+	reserved[0] = level
+	reserved[1] = codec
 	if _, err := w.Write(reserved); err != nil {
 		return err
 	}
@@ -251,7 +573,9 @@ func (ew *encryptWriter) Close() error {
 }
 
 // writeEntry 写入一个文件条目
-func writeEntry(w io.Writer, entry FileEntry, absRoot string) error {
+// options: 打包选项（MIME 检测等）
+// counter: 可选的进度计数器，写入文件内容时累加
+func writeEntry(w io.Writer, entry FileEntry, absRoot string, options PackOptions, counter *progressCounter) error {
 	// 根据文件类型确定条目类型
 	var entryType byte
 	switch entry.Type {
@@ -269,13 +593,63 @@ func writeEntry(w io.Writer, entry FileEntry, absRoot string) error {
 		entryType = entryTypeCharDev
 	case TypeBlockDevice:
 		entryType = entryTypeBlockDev
+	case TypeImage:
+		entryType = entryTypeImage
 	case TypeSocket:
 		// Socket 不支持，跳过
-		return nil
+		return errEntrySkipped
 	default:
 		return fmt.Errorf("未知的文件类型: %d", entry.Type)
 	}
 	
+	// 从源目录读取的普通文件在写入条目之前打开，同一个文件描述符用于读取内容：
+	// 扫描之后被替换为 FIFO 等其他类型时跳过并警告，不会阻塞在打开上（见 sourcefile.go）
+	// 预读的小文件（见 smallfile.go）不再打开，input 为读取内容用的 source 或预读的内容
+	var source *os.File
+	var input io.Reader
+	if entry.Type == TypeFile && options.openContent == nil {
+		var f *os.File
+		data, ok, err := options.smallFiles.take(entry, options)
+		if ok && err == nil {
+			input = bytes.NewReader(data)
+		} else if !ok {
+			f, err = openSourceFile(filepath.Join(absRoot, entry.RelPath))
+		}
+		if errors.Is(err, errSourceTypeChanged) {
+			warn(options, "跳过 %v", err)
+			return errEntrySkipped
+		}
+		// 空文件不需要读取内容，无法打开时照常写入
+		if err != nil && entry.Size > 0 {
+			return fmt.Errorf("打开源文件失败: %v", err)
+		}
+		if f != nil {
+			defer f.Close()
+			source = f
+			input = f
+		}
+	}
+	
+	// 内容保存在块存储中的条目：先切分并写入块，条目中的大小为块列表的长度
+	var recipe []byte
+	if chunkedEntry(entry, options) {
+		srcFile, err := openContent(entry, input, absRoot, options)
+		if err != nil {
+			return fmt.Errorf("打开源文件失败: %v", err)
+		}
+		recipe, err = options.chunkStore.storeChunks(withCancel(withProgress(srcFile, counter), options), entry.Size, options.dedupStats)
+		srcFile.Close()
+		if err != nil {
+			return fmt.Errorf("写入块存储失败: %v", err)
+		}
+	}
+	
+	// 稀疏文件：只保存有数据的区域，条目中的大小为数据区域的总长度
+	var extents []sparseExtent
+	if source != nil && sparseCandidate(entry, options) {
+		extents = fileSparseExtents(source, entry.Size)
+	}
+	
 	// 写入条目类型（1字节）
 	if err := binary.Write(w, binary.LittleEndian, entryType); err != nil {
 		return err
@@ -314,22 +688,19 @@ func writeEntry(w io.Writer, entry FileEntry, absRoot string) error {
 	// 根据文件类型写入特定数据
 	switch entry.Type {
 	case TypeFile:
-		// 写入文件大小
-		if err := binary.Write(w, binary.LittleEndian, entry.Size); err != nil {
-			return err
+		// 写入文件大小（单独加密的条目为密文长度，保存在块存储中的条目为块列表长度）
+		size := entry.Size
+		if entry.Encrypt && options.entryCipher != nil {
+			size = encryptedContentSize(entry.Size)
 		}
-		// 写入文件内容
-		if entry.Size > 0 {
-			srcPath := filepath.Join(absRoot, entry.RelPath)
-			srcFile, err := os.Open(srcPath)
-			if err != nil {
-				return fmt.Errorf("打开源文件失败: %v", err)
-			}
-			if _, err := io.CopyN(w, srcFile, entry.Size); err != nil {
-				srcFile.Close()
-				return fmt.Errorf("写入文件内容失败: %v", err)
-			}
-			srcFile.Close()
+		if recipe != nil {
+			size = int64(len(recipe))
+		}
+		if extents != nil {
+			size = sparseDataSize(extents)
+		}
+		if err := binary.Write(w, binary.LittleEndian, size); err != nil {
+			return err
 		}
 		
 	case TypeSymlink:
@@ -362,13 +733,155 @@ func writeEntry(w io.Writer, entry FileEntry, absRoot string) error {
 		if err := binary.Write(w, binary.LittleEndian, entry.DevMinor); err != nil {
 			return err
 		}
+		
+	case TypeImage:
+		// 写入源设备路径
+		devBytes := []byte(entry.LinkTarget)
+		devLen := uint32(len(devBytes))
+		if err := binary.Write(w, binary.LittleEndian, devLen); err != nil {
+			return err
+		}
+		if _, err := w.Write(devBytes); err != nil {
+			return err
+		}
+		// 写入镜像大小
+		if err := binary.Write(w, binary.LittleEndian, entry.Size); err != nil {
+			return err
+		}
+	}
+	
+	// 写入可选元数据（TLV）
+	if err := writeEntryTLVs(w, entry, extents, options); err != nil {
+		return err
+	}
+	
+	// 写入内容，内容之后是内容的 SHA-256
+	switch entry.Type {
+	case TypeFile:
+		cw := newChecksumWriter(w)
+		if recipe != nil {
+			if _, err := cw.Write(recipe); err != nil {
+				return err
+			}
+			return cw.finish()
+		}
+		if extents != nil {
+			if err := writeSparseContent(cw, source, entry.Size, extents, counter, options); err != nil {
+				return err
+			}
+			return cw.finish()
+		}
+		var content io.Writer = cw
+		var ew *entryEncryptWriter
+		if entry.Encrypt && options.entryCipher != nil {
+			ew = options.entryCipher.writer(cw, entry.RelPath)
+			content = ew
+		}
+		if entry.Size > 0 {
+			srcFile, err := openContent(entry, input, absRoot, options)
+			if err != nil {
+				return fmt.Errorf("打开源文件失败: %v", err)
+			}
+			if _, err := io.CopyN(content, withCancel(withProgress(srcFile, counter), options), entry.Size); err != nil {
+				srcFile.Close()
+				return fmt.Errorf("写入文件内容失败: %v", err)
+			}
+			srcFile.Close()
+		}
+		if ew != nil {
+			if err := ew.Close(); err != nil {
+				return fmt.Errorf("加密文件内容失败: %v", err)
+			}
+		}
+		return cw.finish()
+		
+	case TypeImage:
+		devFile, err := os.Open(entry.LinkTarget)
+		if err != nil {
+			return fmt.Errorf("打开设备失败: %v", err)
+		}
+		defer devFile.Close()
+		cw := newChecksumWriter(w)
+		if _, err := io.CopyN(cw, withCancel(withProgress(devFile, counter), options), entry.Size); err != nil {
+			return fmt.Errorf("写入设备内容失败: %v", err)
+		}
+		return cw.finish()
 	}
 	
 	return nil
 }
 
+// openEntryContent 打开普通文件条目的内容
+func openEntryContent(entry FileEntry, absRoot string, options PackOptions) (io.ReadCloser, error) {
+	if options.openContent != nil {
+		return options.openContent(entry)
+	}
+	return openSourceFile(filepath.Join(absRoot, entry.RelPath))
+}
+
+// openContent 返回 writeEntry 读取内容用的 input（打开的源文件或预读的小文件，关闭由 writeEntry 负责），
+// 没有时同 openEntryContent
+func openContent(entry FileEntry, input io.Reader, absRoot string, options PackOptions) (io.ReadCloser, error) {
+	if input != nil {
+		return io.NopCloser(input), nil
+	}
+	return openEntryContent(entry, absRoot, options)
+}
+
+// progressCounter 累计已写入的内容字节数并回调进度
+type progressCounter struct {
+	done     int64
+	total    int64
+	progress func(done, total int64)
+}
+
+// newProgressCounter 创建进度计数器，progress 为 nil 时返回 nil（不统计）
+func newProgressCounter(entries []FileEntry, progress func(done, total int64)) *progressCounter {
+	if progress == nil {
+		return nil
+	}
+	counter := &progressCounter{progress: progress}
+	for _, entry := range entries {
+		if entry.Type == TypeFile || entry.Type == TypeImage {
+			counter.total += entry.Size
+		}
+	}
+	return counter
+}
+
+// skip 将没有读取的内容（稀疏文件的空洞）计入进度
+func (c *progressCounter) skip(n int64) {
+	if c == nil || n <= 0 {
+		return
+	}
+	c.done += n
+	c.progress(c.done, c.total)
+}
+
+// progressReader 在读取时累加进度
+type progressReader struct {
+	reader  io.Reader
+	counter *progressCounter
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	if n > 0 {
+		pr.counter.done += int64(n)
+		pr.counter.progress(pr.counter.done, pr.counter.total)
+	}
+	return n, err
+}
+
+// withProgress 在计数器不为 nil 时为读取器添加进度统计
+func withProgress(r io.Reader, counter *progressCounter) io.Reader {
+	if counter == nil {
+		return r
+	}
+	return &progressReader{reader: r, counter: counter}
+}
+
 // writeEndMarker 写入结束标记
 func writeEndMarker(w io.Writer) error {
 	return binary.Write(w, binary.LittleEndian, entryTypeEnd)
 }
-
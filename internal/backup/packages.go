@@ -0,0 +1,202 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 软件包清单：打包系统根目录时读取其中的包管理器数据库（dpkg、rpm），
+// 把已安装的软件包及版本记录在根目录条目的 TLV 中，归档同时是当时所安装软件的记录。
+// 清单是可选的 TLV，旧版本程序读取时直接跳过
+
+// tlvPackages 根目录条目上的软件包清单（JSON 数组）
+const tlvPackages = uint16(3)
+
+// ErrNoPackageInventory 归档中没有软件包清单
+var ErrNoPackageInventory = errors.New("归档中没有软件包清单")
+
+// Package 已安装的一个软件包
+type Package struct {
+	Manager string `json:"manager"`        // 包管理器：dpkg 或 rpm
+	Name    string `json:"name"`           // 包名
+	Version string `json:"version"`        // 版本（dpkg 为 Version 字段原样，rpm 为 [epoch:]version-release）
+	Arch    string `json:"arch,omitempty"` // 架构
+}
+
+// dpkgStatusPath 和 rpmDBPath 包管理器数据库相对于系统根目录的位置
+const (
+	dpkgStatusPath = "var/lib/dpkg/status"
+	rpmDBPath      = "var/lib/rpm"
+)
+
+// DetectPackages 读取 root 下的包管理器数据库，返回已安装的软件包（按包管理器和包名排序）
+// 没有找到任何数据库时返回空列表；找到 rpm 数据库但系统中没有 rpm 命令时通过 options.Warn 警告并跳过
+func DetectPackages(root string, options PackOptions) ([]Package, error) {
+	var packages []Package
+	if f, err := os.Open(filepath.Join(root, dpkgStatusPath)); err == nil {
+		dpkg, err := parseDpkgStatus(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("读取 dpkg 数据库失败: %v", err)
+		}
+		packages = append(packages, dpkg...)
+	}
+	if info, err := os.Stat(filepath.Join(root, rpmDBPath)); err == nil && info.IsDir() {
+		rpm, err := queryRPM(root)
+		if err == exec.ErrNotFound {
+			warn(options, "找到 rpm 数据库 %s，但系统中没有 rpm 命令，清单中不包含 rpm 软件包", filepath.Join(root, rpmDBPath))
+		} else if err != nil {
+			return nil, fmt.Errorf("读取 rpm 数据库失败: %v", err)
+		}
+		packages = append(packages, rpm...)
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Manager != packages[j].Manager {
+			return packages[i].Manager < packages[j].Manager
+		}
+		return packages[i].Name < packages[j].Name
+	})
+	return packages, nil
+}
+
+// parseDpkgStatus 解析 dpkg 的 status 文件：以空行分隔的段落，只取状态为已安装的包
+func parseDpkgStatus(r io.Reader) ([]Package, error) {
+	var packages []Package
+	var pkg Package
+	installed := false
+	flush := func() {
+		if pkg.Name != "" && installed {
+			pkg.Manager = "dpkg"
+			packages = append(packages, pkg)
+		}
+		pkg = Package{}
+		installed = false
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		// 以空白开头的是上一个字段的续行（如 Description），不需要
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Package":
+			pkg.Name = value
+		case "Version":
+			pkg.Version = value
+		case "Architecture":
+			pkg.Arch = value
+		case "Status":
+			// 如 "install ok installed"；已删除但保留配置文件的包为 "deinstall ok config-files"
+			installed = strings.HasSuffix(value, " installed")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return packages, nil
+}
+
+// queryRPM 用 rpm 命令查询 root 下的 rpm 数据库（rpm 数据库的格式随版本变化，由 rpm 自己读取最可靠）
+func queryRPM(root string) ([]Package, error) {
+	path, err := exec.LookPath("rpm")
+	if err != nil {
+		return nil, exec.ErrNotFound
+	}
+	cmd := exec.Command(path, "--root", root, "-qa", "--queryformat", "%{NAME}\t%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\t%{ARCH}\n")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var packages []Package
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 || fields[0] == "" {
+			continue
+		}
+		pkg := Package{Manager: "rpm", Name: fields[0], Version: fields[1], Arch: fields[2]}
+		if pkg.Arch == "(none)" {
+			pkg.Arch = ""
+		}
+		packages = append(packages, pkg)
+	}
+	return packages, nil
+}
+
+// applyPackageInventory 按 options.PackageInventory 检测源目录中已安装的软件包，
+// 清单写在根目录条目上；归档中没有根目录条目（如只打包一个文件）时不记录
+func applyPackageInventory(absRoot string, entries []FileEntry, options PackOptions) (PackOptions, error) {
+	if !options.PackageInventory {
+		return options, nil
+	}
+	if len(entries) == 0 || entries[0].RelPath != "." {
+		warn(options, "归档中没有源根目录条目，不记录软件包清单")
+		return options, nil
+	}
+	packages, err := DetectPackages(absRoot, options)
+	if err != nil {
+		return options, err
+	}
+	if len(packages) == 0 {
+		warn(options, "源目录 %s 中没有找到包管理器数据库（dpkg、rpm），不记录软件包清单", absRoot)
+		return options, nil
+	}
+	data, err := json.Marshal(packages)
+	if err != nil {
+		return options, fmt.Errorf("生成软件包清单失败: %v", err)
+	}
+	if len(data) > maxTLVLen {
+		return options, fmt.Errorf("软件包清单过大 (%d 字节)", len(data))
+	}
+	options.packages = data
+	options.packageCount = len(packages)
+	return options, nil
+}
+
+// ReadPackages 读取归档中记录的软件包清单（位于第一个条目，不需要读取整个归档）
+// 归档打包时没有记录清单时返回 ErrNoPackageInventory
+func ReadPackages(archivePath string, options PackOptions) ([]Package, error) {
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.Close()
+
+	entry, err := ar.next()
+	if err == io.EOF {
+		return nil, ErrNoPackageInventory
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entry.packages == nil {
+		return nil, ErrNoPackageInventory
+	}
+	var packages []Package
+	if err := json.Unmarshal(entry.packages, &packages); err != nil {
+		return nil, fmt.Errorf("软件包清单已损坏: %v", err)
+	}
+	return packages, nil
+}
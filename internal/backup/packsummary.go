@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// summarySuffix 摘要文件的后缀，写在归档文件旁边
+const summarySuffix = ".summary.json"
+
+// PackSummary 打包完成后写在归档旁边的摘要（"<归档>.summary.json"），
+// 下游自动化程序无需再次运行本程序即可获取归档的信息
+type PackSummary struct {
+	Archive         string            `json:"archive"`                    // 归档文件路径
+	Source          string            `json:"source"`                     // 源目录的绝对路径
+	ToolVersion     string            `json:"tool_version,omitempty"`     // 程序版本
+	FormatVersion   int               `json:"format_version"`             // 归档格式版本
+	Created         time.Time         `json:"created"`                    // 完成时间
+	DurationSeconds float64           `json:"duration_seconds"`           // 打包耗时
+	Entries         int               `json:"entries"`                    // 条目数
+	TypeCounts      map[string]int    `json:"type_counts"`                // 各类型的条目数
+	ContentBytes    int64             `json:"content_bytes"`              // 文件内容的原始总字节数
+	ArchiveBytes    int64             `json:"archive_bytes"`              // 归档文件大小
+	StreamBytes     int64             `json:"stream_bytes"`               // 条目数据流（条目头部、元数据和内容）压缩和加密之前的字节数
+	CompressedBytes int64             `json:"compressed_bytes,omitempty"` // 条目数据流压缩后的字节数
+	EncryptedBytes  int64             `json:"encrypted_bytes,omitempty"`  // 条目数据流加密后的字节数（包括 nonce、认证标签和密码校验值）
+	SHA256          string            `json:"sha256"`                     // 归档文件的 SHA-256 摘要
+	Compress        bool              `json:"compress"`
+	Compression     string            `json:"compression"`                 // 压缩方式：none、flate、zstd 或 xz
+	Level           int               `json:"compression_level,omitempty"` // 压缩级别（分块压缩自适应时为初始级别）
+	Packages        int               `json:"packages,omitempty"`          // 软件包清单中的包数量
+	Incremental     *IncrementalStats `json:"incremental,omitempty"`       // 增量备份的基准和统计
+	Dedup           *DedupStats       `json:"dedup,omitempty"`             // 块存储去重的统计
+	BlockCompress   bool              `json:"block_compress"`
+	Encrypt         bool              `json:"encrypt"`
+	Filter          *Filter           `json:"filter,omitempty"`      // 打包时使用的过滤条件
+	EntryBytes      []EntryBytes      `json:"entry_bytes,omitempty"` // 每个条目写入的字节数（PackOptions.EntryStats 时）
+	Skipped         []string          `json:"skipped,omitempty"`     // 写入时跳过的条目（套接字、扫描之后已不是普通文件的文件及链接到它们的硬链接）
+}
+
+// EntryBytes 一个条目写入归档的字节数
+// 逐条目统计时每个条目结束都刷新压缩层，压缩后的字节数是准确的（压缩率比不刷新时略低）；
+// 加密层按 64KB 一块加密，不能在条目之间刷新，加密的开销（每块 28 字节）只计入总数
+type EntryBytes struct {
+	Path       string `json:"path"`
+	Stream     int64  `json:"stream_bytes"`               // 条目在条目数据流中的字节数（头部、元数据和内容，压缩和加密之前）
+	Compressed int64  `json:"compressed_bytes,omitempty"` // 条目压缩后的字节数（启用压缩时）
+}
+
+// archiveStats 写入归档时在读写链各处统计的字节数和归档文件的 SHA-256 摘要，避免打包后重新读取整个归档
+type archiveStats struct {
+	file       countWriter  // 整个归档文件（同时计算摘要）
+	stream     countWriter  // 条目数据流，压缩和加密之前
+	compressed *countWriter // 压缩层的输出，不压缩时为 nil
+	encrypted  *countWriter // 加密层的输出，不加密时为 nil
+	compressor layerWriter  // 压缩层，逐条目统计时在条目之间刷新
+	entries    []EntryBytes // 每个条目的字节数（仅 EntryStats 时）
+}
+
+// writer 返回统计写入文件的内容的写入器
+func (st *archiveStats) writer(w io.Writer) io.Writer {
+	st.file = countWriter{writer: w, hash: sha256.New()}
+	return &st.file
+}
+
+// buildPackSummary 生成归档的摘要
+// start: 打包开始时间
+func buildPackSummary(archivePath string, absRoot string, entries []FileEntry, filter *Filter, options PackOptions, start time.Time) PackSummary {
+	summary := PackSummary{
+		Archive:         archivePath,
+		Source:          absRoot,
+		ToolVersion:     options.ToolVersion,
+		FormatVersion:   int(formatVersion),
+		Created:         time.Now(),
+		DurationSeconds: time.Since(start).Seconds(),
+		Entries:         len(entries),
+		TypeCounts:      make(map[string]int),
+		Compress:        options.Compress,
+		Compression:     options.Compression.String(),
+		Level:           int(headerLevel(options)),
+		Packages:        options.packageCount,
+		Incremental:     options.incrementalStats,
+		Dedup:           options.dedupStats,
+		BlockCompress:   options.Compress && options.BlockCompress,
+		Encrypt:         options.Encrypt,
+		Filter:          filter,
+	}
+	for _, entry := range entries {
+		summary.TypeCounts[entry.Type.String()]++
+		if entry.Type == TypeFile || entry.Type == TypeImage {
+			summary.ContentBytes += entry.Size
+		}
+	}
+	if st := options.stats; st != nil && st.file.hash != nil {
+		summary.ArchiveBytes = st.file.bytes
+		summary.SHA256 = hex.EncodeToString(st.file.hash.Sum(nil))
+		summary.StreamBytes = st.stream.bytes
+		if st.compressed != nil {
+			summary.CompressedBytes = st.compressed.bytes
+		}
+		if st.encrypted != nil {
+			summary.EncryptedBytes = st.encrypted.bytes
+		}
+		summary.EntryBytes = st.entries
+	}
+	return summary
+}
+
+// writePackSummary 在归档旁写入摘要文件
+func writePackSummary(archivePath string, summary PackSummary) error {
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("生成摘要失败: %v", err)
+	}
+	if err := os.WriteFile(archivePath+summarySuffix, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("写入摘要文件失败: %v", err)
+	}
+	return nil
+}
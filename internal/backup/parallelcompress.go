@@ -0,0 +1,234 @@
+package backup
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// 并行压缩：flate 压缩器只能使用一个 CPU 核，打包大量数据时压缩是瓶颈。
+// 数据被切分为 blockCompressSize 字节的块，由多个 worker 同时压缩，再由一个写出协程按原来的顺序写出。
+//
+// 单一 flate 流（未启用分块压缩）使用与 pgzip 相同的方法：每块以前一块末尾的 32KB 作为预设字典压缩
+// （flate 的窗口只有 32KB，压缩率与顺序压缩几乎相同），除最后一块外都以同步刷新结束（字节对齐的空存储块），
+// 各块的输出直接拼接起来就是一个完整的 flate 流，解包时不需要任何改变，旧版本程序也能读取。
+// 块的边界只由数据决定，同样的数据和级别得到的输出与 worker 数量无关。
+// 逐条目统计（PackOptions.EntryStats）时每个条目结束都调用 flush，把不满一块的数据也作为一块提交并等待写出，
+// 块的边界随条目变化，输出仍然是一个完整的 flate 流。
+
+// flateWindowSize flate 的回溯窗口大小，也是预设字典的长度
+const flateWindowSize = 32 * 1024
+
+// compressJob 一个待压缩的块
+type compressJob struct {
+	block  []byte
+	dict   []byte // 预设字典（单一 flate 流时为前一块的末尾）
+	level  int
+	final  bool // 是否最后一块
+	result chan compressResult
+}
+
+// compressResult 一个块的压缩结果
+type compressResult struct {
+	data    []byte
+	rawLen  int
+	elapsed time.Duration // 压缩这一块所用的时间
+	err     error
+}
+
+// compressionWorkers 返回并行压缩的 worker 数量：threads <= 0 时使用 CPU 核数
+func compressionWorkers(threads int) int {
+	if threads <= 0 {
+		return runtime.NumCPU()
+	}
+	return threads
+}
+
+// parallelCompressor 用 worker 池压缩各块，按提交的顺序交给 emit 写出
+// 结果通道按提交顺序排队（与 blockDecompressReader 相同），队列的容量限制同时在处理中的块数
+type parallelCompressor struct {
+	jobs    chan compressJob
+	pending chan chan compressResult
+	done    chan struct{} // 写出协程结束时关闭
+	once    sync.Once
+	queued  sync.WaitGroup // 已提交但还没有写出的块
+	mu      sync.Mutex
+	err     error // 第一个压缩或写出错误，之后的提交都返回它
+}
+
+// newParallelCompressor 启动 workers 个压缩 worker 和一个写出协程
+func newParallelCompressor(workers int, compress func(job compressJob) ([]byte, error), emit func(result compressResult) error) *parallelCompressor {
+	pc := &parallelCompressor{
+		jobs:    make(chan compressJob, workers),
+		pending: make(chan chan compressResult, workers*2),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range pc.jobs {
+				start := time.Now()
+				data, err := compress(job)
+				job.result <- compressResult{data: data, rawLen: len(job.block), elapsed: time.Since(start), err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(pc.done)
+		for result := range pc.pending {
+			res := <-result
+			// 出错之后继续取出剩余的结果，使 worker 能够退出
+			if pc.failed() != nil {
+				pc.queued.Done()
+				continue
+			}
+			err := res.err
+			if err == nil {
+				err = emit(res)
+			}
+			if err != nil {
+				pc.fail(err)
+			}
+			pc.queued.Done()
+		}
+	}()
+	return pc
+}
+
+// submit 提交一个块；队列已满时等待
+func (pc *parallelCompressor) submit(job compressJob) error {
+	if err := pc.failed(); err != nil {
+		return err
+	}
+	job.result = make(chan compressResult, 1)
+	pc.queued.Add(1)
+	pc.pending <- job.result
+	pc.jobs <- job
+	return nil
+}
+
+// wait 等待已提交的块全部写出（不结束 worker），返回第一个错误
+func (pc *parallelCompressor) wait() error {
+	pc.queued.Wait()
+	return pc.failed()
+}
+
+// Close 等待已提交的块全部写出，返回第一个错误
+func (pc *parallelCompressor) Close() error {
+	pc.abort()
+	<-pc.done
+	return pc.failed()
+}
+
+// abort 不再提交新的块，让 worker 和写出协程在处理完已提交的块后退出（打包出错时调用，不等待）
+func (pc *parallelCompressor) abort() {
+	pc.once.Do(func() {
+		close(pc.jobs)
+		close(pc.pending)
+	})
+}
+
+func (pc *parallelCompressor) fail(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.err == nil {
+		pc.err = err
+	}
+}
+
+func (pc *parallelCompressor) failed() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err
+}
+
+// parallelFlateWriter 多核并行压缩，输出一个普通的 flate 流
+type parallelFlateWriter struct {
+	pc     *parallelCompressor
+	level  int
+	buffer []byte
+	dict   []byte // 上一块的末尾，作为下一块的预设字典
+}
+
+// newParallelFlateWriter 创建并行 flate 压缩写入器，workers 个块同时压缩
+func newParallelFlateWriter(w io.Writer, level int, workers int) *parallelFlateWriter {
+	emit := func(result compressResult) error {
+		_, err := w.Write(result.data)
+		return err
+	}
+	return &parallelFlateWriter{pc: newParallelCompressor(workers, compressFlateBlock, emit), level: level}
+}
+
+// compressFlateBlock 以预设字典压缩一块，不是最后一块时以同步刷新结束，使下一块的输出可以直接拼接
+func compressFlateBlock(job compressJob) ([]byte, error) {
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriterDict(&compressed, job.level, job.dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(job.block); err != nil {
+		return nil, err
+	}
+	if job.final {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func (pw *parallelFlateWriter) Write(p []byte) (int, error) {
+	pw.buffer = append(pw.buffer, p...)
+	for len(pw.buffer) >= blockCompressSize {
+		if err := pw.submit(pw.buffer[:blockCompressSize], false); err != nil {
+			return 0, err
+		}
+		pw.buffer = pw.buffer[blockCompressSize:]
+	}
+	return len(p), nil
+}
+
+// submit 复制一块数据并提交压缩（缓冲区之后会被覆盖）
+func (pw *parallelFlateWriter) submit(data []byte, final bool) error {
+	block := append([]byte(nil), data...)
+	err := pw.pc.submit(compressJob{block: block, dict: pw.dict, level: pw.level, final: final})
+	// 预设字典是之前全部数据的最后 32KB；flush 提交的块可能比窗口小，要接在原来的字典之后
+	if len(block) >= flateWindowSize {
+		pw.dict = block[len(block)-flateWindowSize:]
+	} else {
+		dict := append(append([]byte(nil), pw.dict...), block...)
+		pw.dict = dict[max(0, len(dict)-flateWindowSize):]
+	}
+	return err
+}
+
+// flush 把缓冲的数据作为一块（以同步刷新结束）提交，等待之前的全部数据写出
+func (pw *parallelFlateWriter) flush() error {
+	if len(pw.buffer) > 0 {
+		if err := pw.submit(pw.buffer, false); err != nil {
+			return err
+		}
+		pw.buffer = pw.buffer[:0]
+	}
+	return pw.pc.wait()
+}
+
+// Close 压缩剩余的数据（可能为空）作为最后一块，等待全部写出（不关闭底层写入器）
+func (pw *parallelFlateWriter) Close() error {
+	if err := pw.submit(pw.buffer, true); err != nil {
+		pw.pc.abort()
+		return err
+	}
+	pw.buffer = nil
+	return pw.pc.Close()
+}
+
+// abort 打包出错时停止后台协程
+func (pw *parallelFlateWriter) abort() {
+	pw.pc.abort()
+}
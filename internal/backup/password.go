@@ -0,0 +1,313 @@
+package backup
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// WeakPasswordBits 估算强度低于此值（比特）的密码视为弱密码，打包时给出警告
+const WeakPasswordBits = 40
+
+// commonPasswords 最常见的密码（小写），出现在其中或仅在其后加数字/符号的密码强度按极低计算
+var commonPasswords = []string{
+	"password", "passw0rd", "123456", "12345678", "123456789", "1234567890", "qwerty", "qwertyuiop",
+	"abc123", "111111", "000000", "iloveyou", "admin", "root", "letmein", "welcome", "monkey",
+	"dragon", "master", "login", "secret", "backup", "changeme", "default", "test", "guest",
+	"asdfgh", "zxcvbn", "1q2w3e4r", "qazwsx", "woaini", "5201314", "a123456", "aa123456",
+}
+
+// keyboardRows 键盘上相邻的字符序列，连续按键（如 "qwer"、"asdf"）几乎不增加强度
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"abcdefghijklmnopqrstuvwxyz",
+}
+
+// EstimatePasswordBits 粗略估算密码的强度（比特数），思路与 zxcvbn 类似：
+// 按字符种类计算每个字符的熵，重复字符、连续序列（abc、123、qwer）只计 1 比特，
+// 常见密码及其简单变形（加数字或符号后缀）按极低强度计算
+func EstimatePasswordBits(password string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+
+	// 字符集大小
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < 128 && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	charset := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if c.used {
+			charset += c.size
+		}
+	}
+	perChar := math.Log2(float64(charset))
+
+	// 重复和连续序列中的字符只计 1 比特
+	lowered := []rune(strings.ToLower(password))
+	bits := perChar
+	for i := 1; i < len(lowered); i++ {
+		if lowered[i] == lowered[i-1] || isSequence(lowered[i-1], lowered[i]) {
+			bits++
+		} else {
+			bits += perChar
+		}
+	}
+
+	// 常见密码及其简单变形
+	base := strings.TrimRightFunc(string(lowered), func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+	for _, common := range commonPasswords {
+		if string(lowered) == common || base == common {
+			suffix := len(lowered) - len([]rune(base))
+			return math.Min(bits, 10+float64(suffix)*math.Log2(10))
+		}
+	}
+	return bits
+}
+
+// isSequence 判断两个字符是否在字母表、数字或键盘行上相邻（正序或倒序）
+func isSequence(a, b rune) bool {
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		j := strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (j-i == 1 || i-j == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// MinPasswordBitsEnv 设置加密密码最低强度（比特）的环境变量，命令行和图形界面按同一个值拒绝弱密码
+const MinPasswordBitsEnv = "BACKUP_MIN_PASSWORD_BITS"
+
+// MinPasswordBits 返回环境变量 BACKUP_MIN_PASSWORD_BITS 设置的密码最低强度，未设置或无法解析时返回 0（只警告弱密码）
+func MinPasswordBits() float64 {
+	bits, err := strconv.ParseFloat(os.Getenv(MinPasswordBitsEnv), 64)
+	if err != nil {
+		return 0
+	}
+	return bits
+}
+
+// CheckPasswordStrength 检查加密密码的强度
+// minBits > 0 时强度低于 minBits 返回错误；否则低于 WeakPasswordBits 时返回警告信息，足够强时返回空字符串
+func CheckPasswordStrength(password string, minBits float64) (warning string, err error) {
+	bits := EstimatePasswordBits(password)
+	if minBits > 0 && bits < minBits {
+		return "", fmt.Errorf("密码强度不足：估算约 %.0f 比特，要求至少 %.0f 比特", bits, minBits)
+	}
+	if bits < WeakPasswordBits {
+		return fmt.Sprintf("密码很弱（估算约 %.0f 比特），建议使用更长、不常见的密码", bits), nil
+	}
+	return "", nil
+}
+
+// ErrWrongPassword 加密归档的密码校验值不匹配（格式版本 versionVerifier 起，读取文件头后立即检查）
+var ErrWrongPassword = errors.New("密码错误")
+
+// 密码校验值：格式版本 versionVerifier 起写在加密归档的初始 nonce 之后，
+// 由随机盐(16字节)和 HMAC-SHA256(密钥, 标签+盐) 的前 16 字节组成，
+// 读取时不用解密任何数据就能判断密码是否正确；校验值不泄露密钥本身
+//
+// versionVerifier 到 versionKDF 之前的密钥是密码的 SHA-256，没有盐，拿到归档的人每猜一次密码只需计算一次摘要。
+// versionKDF 起密钥由 scrypt 从密码派生，每个归档的盐随机生成，盐和代价参数（kdfRecordSize 字节）写在校验值之前：
+//
+//	nonce(12) + 派生方式版本(1) + 盐(16) + N(4) + r(4) + p(4) + 校验值(32)
+//
+// 每次尝试密码都要付出 scrypt 的代价，也不能对多个归档同时尝试；参数与快照仓库相同（RepositoryKDF），以后提高代价时新归档照常读取。
+// 使用加密块存储的归档（快照）派生方式记为 kdfRepository，密钥由仓库主密钥和盐派生（代价参数为 0），读取时需要同一个块存储
+const (
+	verifierSaltSize  = 16
+	verifierCheckSize = 16
+	verifierSize      = verifierSaltSize + verifierCheckSize
+	verifierLabel     = "BKUP password verifier"
+
+	kdfRecordSize = 1 + scryptSaltLen + 12
+)
+
+// verifierCheck 由加密密钥和盐计算校验值
+func verifierCheck(key []byte, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(verifierLabel))
+	mac.Write(salt)
+	return mac.Sum(nil)[:verifierCheckSize]
+}
+
+// newPasswordVerifier 生成密码校验值（盐 + 校验值）
+func newPasswordVerifier(key []byte) ([]byte, error) {
+	salt := make([]byte, verifierSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("生成随机数失败: %v", err)
+	}
+	return append(salt, verifierCheck(key, salt)...), nil
+}
+
+// checkPasswordVerifier 检查密码校验值，不匹配时返回 ErrWrongPassword
+func checkPasswordVerifier(key []byte, verifier []byte) error {
+	if len(verifier) != verifierSize {
+		return fmt.Errorf("密码校验值长度无效: %d", len(verifier))
+	}
+	salt, check := verifier[:verifierSaltSize], verifier[verifierSaltSize:]
+	if !hmac.Equal(check, verifierCheck(key, salt)) {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// passwordPreambleSize 加密归档中初始 nonce 之后、第一个密文块之前的字节数
+func passwordPreambleSize(version uint32) int64 {
+	switch {
+	case version >= versionKDF:
+		return kdfRecordSize + verifierSize
+	case version >= versionVerifier:
+		return verifierSize
+	}
+	return 0
+}
+
+// encodeKDF 编码密钥派生方式和参数（kdfRecordSize 字节）
+func encodeKDF(kdf *RepositoryKDF) []byte {
+	record := append([]byte{byte(kdf.Version)}, kdf.Salt...)
+	record = binary.LittleEndian.AppendUint32(record, uint32(kdf.N))
+	record = binary.LittleEndian.AppendUint32(record, uint32(kdf.R))
+	return binary.LittleEndian.AppendUint32(record, uint32(kdf.P))
+}
+
+// decodeKDF 解码 encodeKDF 的结果，参数是否可以接受由 passwordKey 检查
+func decodeKDF(record []byte) *RepositoryKDF {
+	params := record[1+scryptSaltLen:]
+	return &RepositoryKDF{
+		Version: int(record[0]),
+		Salt:    append([]byte(nil), record[1:1+scryptSaltLen]...),
+		N:       int(binary.LittleEndian.Uint32(params)),
+		R:       int(binary.LittleEndian.Uint32(params[4:])),
+		P:       int(binary.LittleEndian.Uint32(params[8:])),
+	}
+}
+
+// newPasswordKey 为新归档生成随机盐，由密码派生密钥，返回密钥和写在初始 nonce 之后的派生参数与密码校验值
+func newPasswordKey(password string) (key []byte, preamble []byte, err error) {
+	kdf, err := newScryptKDF()
+	if err != nil {
+		return nil, nil, err
+	}
+	if key, err = passwordKey(kdf, password); err != nil {
+		return nil, nil, err
+	}
+	verifier, err := newPasswordVerifier(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, append(encodeKDF(kdf), verifier...), nil
+}
+
+// newRepositoryKey 为使用加密块存储的新归档生成随机盐，由仓库主密钥派生密钥，返回值与 newPasswordKey 相同
+func newRepositoryKey(c *chunkCipher) (key []byte, preamble []byte, err error) {
+	kdf := &RepositoryKDF{Version: kdfRepository, Salt: make([]byte, scryptSaltLen)}
+	if _, err := rand.Read(kdf.Salt); err != nil {
+		return nil, nil, fmt.Errorf("生成随机数失败: %v", err)
+	}
+	key = c.archiveKey(kdf.Salt)
+	verifier, err := newPasswordVerifier(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, append(encodeKDF(kdf), verifier...), nil
+}
+
+// readPasswordKey 读取初始 nonce 之后的派生参数和密码校验值，按记录的派生方式生成密钥并核对，密码错误时返回 ErrWrongPassword
+// kdfRepository 的归档用 options 指定的块存储（以 options.Password 解锁）派生密钥，其他用 options.Password 派生
+func readPasswordKey(r io.Reader, options PackOptions) ([]byte, error) {
+	preamble := make([]byte, kdfRecordSize+verifierSize)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		return nil, fmt.Errorf("读取密码校验值失败: %v", err)
+	}
+	kdf := decodeKDF(preamble[:kdfRecordSize])
+	var key []byte
+	if kdf.Version == kdfRepository {
+		store, err := openChunkStore(options)
+		if err != nil {
+			return nil, err
+		}
+		if store == nil || store.cipher == nil {
+			return nil, fmt.Errorf("归档的密钥由加密仓库的主密钥派生，需要指定仓库目录（-chunk-store）和仓库密码")
+		}
+		key = store.cipher.archiveKey(kdf.Salt)
+	} else {
+		var err error
+		if key, err = passwordKey(kdf, options.Password); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkPasswordVerifier(key, preamble[kdfRecordSize:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// archiveKey 加密归档的密钥，以及写在初始 nonce 之后的派生参数和密码校验值
+type archiveKey struct {
+	gcm      cipher.AEAD
+	preamble []byte
+}
+
+// newArchiveKey 为新的加密归档生成密钥：使用加密的块存储时由仓库主密钥派生，否则由密码派生
+func newArchiveKey(options PackOptions) (*archiveKey, error) {
+	var key, preamble []byte
+	var err error
+	if store := options.chunkStore; store != nil && store.cipher != nil {
+		key, preamble, err = newRepositoryKey(store.cipher)
+	} else {
+		key, preamble, err = newPasswordKey(options.Password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveKey{gcm: aesGCM, preamble: preamble}, nil
+}
+
+// applyArchiveKey 打包加密归档时只派生一次密钥，条目数据、中央索引和索引文件共用同一个盐和密钥
+// 需要在 applyChunkStore 之后调用
+func applyArchiveKey(options PackOptions) (PackOptions, error) {
+	if !options.Encrypt || options.Password == "" || options.archiveKey != nil {
+		return options, nil
+	}
+	ak, err := newArchiveKey(options)
+	if err != nil {
+		return options, err
+	}
+	options.archiveKey = ak
+	return options, nil
+}
@@ -0,0 +1,293 @@
+package backup
+
+import (
+	"compress/flate"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// 读写链：条目数据流在文件头之后依次经过若干层（流校验、加密、压缩……），每一层包装下面的一层。
+// 写入时 archiveWriteLayers 按选项给出各层，从紧挨着文件的一层开始叠加；关闭时从最外层开始逐层关闭，
+// 刷新各层缓冲的数据，但不关闭文件（之后还要写中央索引）。读取时 archiveReadLayers 按文件头的标志位
+// 给出对应的解码层，顺序与写入时相同。新增压缩方式、校验、限速或统计时只需增加一层，
+// writeArchive 和 newArchiveReader 本身不需要修改。索引文件的内容（index.go）使用同样的加密层。
+// 需要统计时（options.stats），各层之间插入统计层，记录经过该位置的字节数：压缩前、压缩后、加密后，
+// 加上文件本身（同时计算 SHA-256），打包结束时就知道各阶段的准确大小和归档的摘要，不需要重新读取归档。
+
+// writeLayer 写入链的一层：包装下层写入器，Close 写出本层缓冲的数据，但不关闭下层
+type writeLayer func(w io.Writer) (io.WriteCloser, error)
+
+// readLayer 读取链的一层：包装下层读取器，Close 释放本层的资源（后台协程等），但不关闭下层
+type readLayer func(r io.Reader) (io.ReadCloser, error)
+
+// writeStack 由多层写入器组成的写入链，写入最外层
+type writeStack struct {
+	io.Writer
+	layers []io.WriteCloser // 从内到外
+}
+
+// newWriteStack 在 w 上依次叠加各层（layers[0] 紧挨着 w）；创建某一层失败时停止已创建的各层
+func newWriteStack(w io.Writer, layers []writeLayer) (*writeStack, error) {
+	stack := &writeStack{Writer: w}
+	for _, layer := range layers {
+		lw, err := layer(stack.Writer)
+		if err != nil {
+			stack.abort()
+			return nil, err
+		}
+		stack.layers = append(stack.layers, lw)
+		stack.Writer = lw
+	}
+	return stack, nil
+}
+
+// Close 从最外层开始逐层关闭，遇到错误时停止并返回
+func (s *writeStack) Close() error {
+	for i := len(s.layers) - 1; i >= 0; i-- {
+		if err := s.layers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort 出错返回时停止各层的后台协程（并行压缩），不写出缓冲的数据；Close 之后调用没有影响
+func (s *writeStack) abort() {
+	for _, layer := range s.layers {
+		if a, ok := layer.(interface{ abort() }); ok {
+			a.abort()
+		}
+	}
+}
+
+// readStack 由多层读取器组成的读取链，从最外层读取
+type readStack struct {
+	io.Reader
+	layers []io.ReadCloser // 从内到外
+}
+
+// newReadStack 在 r 上依次叠加各层（layers[0] 紧挨着 r）；创建某一层失败时关闭已创建的各层
+func newReadStack(r io.Reader, layers []readLayer) (*readStack, error) {
+	stack := &readStack{Reader: r}
+	for _, layer := range layers {
+		lr, err := layer(stack.Reader)
+		if err != nil {
+			stack.Close()
+			return nil, err
+		}
+		stack.layers = append(stack.layers, lr)
+		stack.Reader = lr
+	}
+	return stack, nil
+}
+
+// Close 从最外层开始逐层关闭
+func (s *readStack) Close() error {
+	for i := len(s.layers) - 1; i >= 0; i-- {
+		s.layers[i].Close()
+	}
+	return nil
+}
+
+// layerWriter 给写入层关闭时的错误加上说明，并保留并行压缩层的 abort
+type layerWriter struct {
+	io.WriteCloser
+	what string // 如 "关闭压缩器失败"
+}
+
+func (lw layerWriter) Close() error {
+	if err := lw.WriteCloser.Close(); err != nil {
+		return fmt.Errorf("%s: %v", lw.what, err)
+	}
+	return nil
+}
+
+func (lw layerWriter) abort() {
+	if a, ok := lw.WriteCloser.(interface{ abort() }); ok {
+		a.abort()
+	}
+}
+
+// flush 把压缩层缓冲的数据全部压缩写出（逐条目统计时在条目之间调用），压缩方式不支持时返回错误
+func (lw layerWriter) flush() error {
+	switch f := lw.WriteCloser.(type) {
+	case interface{ flush() error }:
+		return f.flush()
+	case interface{ Flush() error }: // zstd
+		return f.Flush()
+	}
+	return fmt.Errorf("%T 不能在条目之间刷新", lw.WriteCloser)
+}
+
+// layerReader 由读取器和释放其资源的 Closer 组成的读取层
+type layerReader struct {
+	io.Reader
+	io.Closer
+}
+
+// countWriter 统计经过读写链某个位置的字节数，需要时同时计算摘要；数据原样传给下层
+type countWriter struct {
+	writer io.Writer
+	bytes  int64
+	hash   hash.Hash // 可选
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.writer.Write(p)
+	cw.bytes += int64(n)
+	if cw.hash != nil {
+		cw.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+// Close 统计层没有缓冲的数据
+func (cw *countWriter) Close() error {
+	return nil
+}
+
+// countLayer 把 counter 插入写入链，统计从上一层流向下一层的字节数
+func countLayer(counter *countWriter) writeLayer {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		counter.writer = w
+		return counter, nil
+	}
+}
+
+// archiveWriteLayers 按打包选项返回条目数据流的写入层：流校验 -> 加密 -> 压缩，
+// options.stats 不为 nil 时在加密层、压缩层之下和最外层各插入一个统计层
+func archiveWriteLayers(options PackOptions) ([]writeLayer, error) {
+	var layers []writeLayer
+	stats := options.stats
+	if options.StreamHash {
+		layers = append(layers, func(w io.Writer) (io.WriteCloser, error) {
+			return layerWriter{newStreamHashWriter(w), "写入流校验值失败"}, nil
+		})
+	}
+	if options.Encrypt {
+		if options.Password == "" {
+			return nil, fmt.Errorf("启用加密时必须提供密码")
+		}
+		// 密钥由 applyArchiveKey 预先派生；nonce 之后写入派生参数和密码校验值，解包时据此立即判断密码是否正确
+		ak := options.archiveKey
+		if stats != nil {
+			stats.encrypted = &countWriter{}
+			layers = append(layers, countLayer(stats.encrypted))
+		}
+		layers = append(layers, encryptLayer(ak.gcm, ak.preamble))
+	}
+	if options.Compress {
+		if stats != nil {
+			if options.EntryStats && options.Compression == CodecXz {
+				return nil, fmt.Errorf("xz 压缩不能在条目之间刷新，不支持逐条目统计")
+			}
+			stats.compressed = &countWriter{}
+			layers = append(layers, countLayer(stats.compressed))
+		}
+		// 分块压缩、并行 flate、zstd 或 xz
+		layers = append(layers, func(w io.Writer) (io.WriteCloser, error) {
+			cw, err := newCompressWriter(w, options)
+			if err != nil {
+				return nil, err
+			}
+			lw := layerWriter{cw, "关闭压缩器失败"}
+			if stats != nil {
+				stats.compressor = lw
+			}
+			return lw, nil
+		})
+	}
+	if stats != nil {
+		layers = append(layers, countLayer(&stats.stream))
+	}
+	return layers, nil
+}
+
+// encryptLayer 分块 AES-GCM 加密层：先写入随机的初始 nonce 和 preamble（如密码校验值），之后的数据每 64KB 加密为一块
+func encryptLayer(aesGCM cipher.AEAD, preamble []byte) writeLayer {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		nonce := make([]byte, aesGCM.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("生成随机数失败: %v", err)
+		}
+		if _, err := w.Write(nonce); err != nil {
+			return nil, fmt.Errorf("写入 nonce 失败: %v", err)
+		}
+		if len(preamble) > 0 {
+			if _, err := w.Write(preamble); err != nil {
+				return nil, fmt.Errorf("写入密码校验值失败: %v", err)
+			}
+		}
+		return layerWriter{&encryptWriter{writer: w, gcm: aesGCM, nonce: nonce}, "关闭加密写入器失败"}, nil
+	}
+}
+
+// decryptLayer 解密 encryptLayer 写入的数据（没有 preamble 时）：先读取初始 nonce，之后逐块解密
+func decryptLayer(aesGCM cipher.AEAD) readLayer {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		nonce := make([]byte, aesGCM.NonceSize())
+		if _, err := io.ReadFull(r, nonce); err != nil {
+			return nil, fmt.Errorf("读取 nonce 失败: %v", err)
+		}
+		return io.NopCloser(&decryptReader{reader: r, gcm: aesGCM, nonce: nonce}), nil
+	}
+}
+
+// archiveReadLayers 按文件头的标志位和压缩方式返回条目数据流的读取层：流校验 -> 解密 -> 解压缩
+func archiveReadLayers(header archiveHeader, options PackOptions) []readLayer {
+	version, flags := header.version, header.flags
+	var layers []readLayer
+	if flags&flagStreamHash != 0 {
+		layers = append(layers, func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(newStreamHashReader(r, headerSize)), nil
+		})
+	}
+	if flags&flagEncrypt != 0 {
+		layers = append(layers, func(r io.Reader) (io.ReadCloser, error) {
+			aesGCM, nonce, err := openDecryption(r, version, options)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(&decryptReader{reader: r, gcm: aesGCM, nonce: nonce}), nil
+		})
+	}
+	if flags&(flagCompress|flagBlockCompress) != 0 {
+		layers = append(layers, decompressLayer(header.codec, flags, options))
+	}
+	return layers
+}
+
+// decompressLayer 按文件头的压缩方式和标志位创建解压缩层（分块压缩的数据由多个 worker 并行解压）
+func decompressLayer(codec Codec, flags byte, options PackOptions) readLayer {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		switch {
+		case codec == CodecZstd:
+			// 归档只有一个 zstd 流，解码器不需要并发；窗口大小来自不可信的帧头，按内存限制检查
+			zstdOptions := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+			if limit := options.Limits.maxDecoderMemory(); limit > 0 {
+				zstdOptions = append(zstdOptions, zstd.WithDecoderMaxWindow(uint64(limit)), zstd.WithDecoderMaxMemory(uint64(limit)))
+			}
+			zstdReader, err := zstd.NewReader(r, zstdOptions...)
+			if err != nil {
+				return nil, fmt.Errorf("创建解压缩器失败: %v", err)
+			}
+			return layerReader{zstdReader, zstdCloser{zstdReader}}, nil
+		case codec == CodecXz:
+			xzReader, err := xz.NewReader(newXzLimitReader(r, options.Limits.maxDecoderMemory()))
+			if err != nil {
+				return nil, fmt.Errorf("创建解压缩器失败: %v", err)
+			}
+			return io.NopCloser(xzReader), nil
+		case flags&flagBlockCompress != 0:
+			return newBlockDecompressReader(r, options.Threads), nil
+		default:
+			return flate.NewReader(r), nil
+		}
+	}
+}
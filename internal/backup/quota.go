@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// PackQuota 单次打包的安全限制，防止误把 -source 指向整个系统或失控增长的日志目录
+type PackQuota struct {
+	MaxArchiveSize int64         // 写入的归档总字节数上限（按目录拆分时为所有归档之和），0 表示不限制
+	MaxFiles       int           // 打包的条目数上限，0 表示不限制
+	MaxDuration    time.Duration // 打包的最长时间，0 表示不限制
+	WarnOnly       bool          // 超出限制时只警告（每项一次），不中止打包
+}
+
+// enabled 是否设置了任何限制
+func (q PackQuota) enabled() bool {
+	return q.MaxArchiveSize > 0 || q.MaxFiles > 0 || q.MaxDuration > 0
+}
+
+// quotaTracker 统计一次打包（可能包括多个并行写入的归档）的写入量和耗时
+type quotaTracker struct {
+	mu      sync.Mutex
+	quota   PackQuota
+	options PackOptions // 用于报告警告
+	start   time.Time
+	written int64
+	warned  map[string]bool
+}
+
+// newQuotaTracker 创建限制统计，未设置任何限制时返回 nil
+func newQuotaTracker(options PackOptions) *quotaTracker {
+	if !options.Quota.enabled() {
+		return nil
+	}
+	return &quotaTracker{
+		quota:   options.Quota,
+		options: options,
+		start:   time.Now(),
+		warned:  make(map[string]bool),
+	}
+}
+
+// exceeded 报告超出的限制：只警告时每项警告一次并返回 nil，否则返回错误
+func (qt *quotaTracker) exceeded(kind string, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if qt.quota.WarnOnly {
+		if !qt.warned[kind] {
+			qt.warned[kind] = true
+			warn(qt.options, "%s", msg)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s，已中止打包", msg)
+}
+
+// checkFiles 检查条目数
+func (qt *quotaTracker) checkFiles(count int) error {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	if qt.quota.MaxFiles > 0 && count > qt.quota.MaxFiles {
+		return qt.exceeded("files", "条目数 %d 超过限制 %d", count, qt.quota.MaxFiles)
+	}
+	return nil
+}
+
+// add 记录写入的字节数，并检查归档大小和耗时
+func (qt *quotaTracker) add(n int) error {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	qt.written += int64(n)
+	if qt.quota.MaxArchiveSize > 0 && qt.written > qt.quota.MaxArchiveSize {
+		if err := qt.exceeded("size", "归档大小超过限制 %d 字节", qt.quota.MaxArchiveSize); err != nil {
+			return err
+		}
+	}
+	return qt.durationLocked()
+}
+
+// checkDuration 检查耗时（扫描和准备条目的过程中调用，不必等到开始写入）
+func (qt *quotaTracker) checkDuration() error {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	return qt.durationLocked()
+}
+
+// durationLocked 检查耗时，调用方持有锁
+func (qt *quotaTracker) durationLocked() error {
+	if qt.quota.MaxDuration > 0 {
+		if elapsed := time.Since(qt.start); elapsed > qt.quota.MaxDuration {
+			return qt.exceeded("duration", "打包时间超过限制 %v", qt.quota.MaxDuration)
+		}
+	}
+	return nil
+}
+
+// scanProgress 返回扫描源目录时的检查：每个条目检查耗时；没有过滤条件时扫描到的条目都会打包，
+// 条目数超过限制即可中止，不必扫描完整个目录树（之后排除的敏感文件和跳过的套接字也计入，可能略早报告）。
+// 有过滤条件时扫描到的条目数不代表打包的条目数，条目数在过滤之后检查
+func (qt *quotaTracker) scanProgress(filter *Filter) scanProgress {
+	if qt == nil {
+		return nil
+	}
+	return func(count int) error {
+		if filter == nil {
+			if err := qt.checkFiles(count); err != nil {
+				return err
+			}
+		}
+		return qt.checkDuration()
+	}
+}
+
+// quotaWriter 统计写入归档文件的字节数
+type quotaWriter struct {
+	writer  io.Writer
+	tracker *quotaTracker
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	n, err := qw.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := qw.tracker.add(n); err != nil {
+		return n, err
+	}
+	return n, nil
+}
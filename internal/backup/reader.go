@@ -0,0 +1,401 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ArchiveReader 顺序读取归档文件中的条目（不解包到磁盘）
+// 用法:
+//
+//	ar, err := OpenArchive(path, options)
+//	defer ar.Close()
+//	for {
+//		entry, err := ar.Next()
+//		if err == io.EOF { break }
+//		// 对普通文件/镜像条目，可以从 ar 读取内容；未读取的内容会在下一次 Next 时自动跳过
+//	}
+type ArchiveReader struct {
+	file      io.ReadCloser // 归档数据源（本地文件或 HTTP 连接）
+	digest    *digestReader // 可选的整体摘要校验
+	reader    io.Reader     // 解密、解压缩、缓冲之后的读取器
+	closers   []io.Closer   // 需要在关闭时释放的读取层
+	content   io.Reader     // 当前条目尚未读取的内容
+	stored    io.Reader     // 当前条目在归档中的内容（密文或块列表），跳过内容时直接读取它
+	version   uint32        // 归档格式版本
+	flags     byte          // 文件头标志位
+	level     int           // 文件头记录的压缩级别（0 表示未记录）
+	codec     Codec         // 文件头记录的压缩方式
+	current   *entryData    // 当前条目
+	entryType byte          // 当前条目的类型字节
+	limits    limitCounter  // 资源限制和已读取的统计
+	entryKey  *entryCipher  // 单独加密条目的密钥（提供了条目密码时）
+	chunks    *ChunkStore   // 块存储（指定了块存储时）
+	locked    error         // 当前条目的内容不可读取的原因（ErrEntryLocked 或 ErrNoChunkStore），nil 表示可以读取
+}
+
+// OpenArchive 打开归档文件并读取文件头，建立解密和解压缩读取链
+// archivePath: 本地路径，或 http:// / https:// 地址（中断时断点续传）
+// options: 解包选项（密码、并行解压线程数、期望的 SHA-256 摘要等）
+func OpenArchive(archivePath string, options PackOptions) (*ArchiveReader, error) {
+	var source io.ReadCloser
+	if IsURL(archivePath) {
+		hr, err := openURL(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		source = hr
+	} else {
+		// 验证归档文件路径：必须是文件，不能是目录
+		fileInfo, err := os.Stat(archivePath)
+		if err != nil {
+			return nil, fmt.Errorf("归档文件不存在或无法访问: %v", err)
+		}
+		if fileInfo.IsDir() {
+			return nil, fmt.Errorf("归档路径是目录而不是文件: %s", archivePath)
+		}
+
+		// 打开归档文件
+		inFile, err := os.Open(archivePath)
+		if err != nil {
+			return nil, fmt.Errorf("打开归档文件失败: %v", err)
+		}
+		source = inFile
+	}
+
+	ar, err := newArchiveReader(source, options)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	return ar, nil
+}
+
+// newArchiveReader 在已打开的归档数据源上建立读取链
+func newArchiveReader(source io.ReadCloser, options PackOptions) (*ArchiveReader, error) {
+	entryKey, err := readEntryKey(options)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := openChunkStore(options)
+	if err != nil {
+		return nil, err
+	}
+	options.chunkStore = chunks // 快照归档的密钥由块存储的主密钥派生，解密时不必再次解锁
+	ar := &ArchiveReader{file: source, limits: limitCounter{limits: options.Limits}, entryKey: entryKey, chunks: chunks}
+
+	// 需要校验整个归档的摘要时，在最底层计算
+	var inFile io.Reader = source
+	if options.SHA256 != "" {
+		digest, err := newDigestReader(source, options.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		ar.digest = digest
+		inFile = digest
+	}
+
+	// 读取并验证文件头，获取标志位
+	header, err := readArchiveHeader(inFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取文件头失败: %w", err)
+	}
+	version, flags := header.version, header.flags
+	ar.version = version
+	ar.flags = flags
+	ar.level = header.level
+	ar.codec = header.codec
+
+	// 带中央索引的归档：条目数据流在索引块之前结束
+	// 加密层和流校验层不能自己判断数据流的结束位置，需要按尾部记录的偏移限定读取范围
+	if flags&flagCentralIndex != 0 {
+		at, size, err := sourceReaderAt(source)
+		if err != nil {
+			return nil, err
+		}
+		trailer, err := readCentralTrailer(at, size)
+		if err != nil {
+			return nil, err
+		}
+		inFile = io.LimitReader(inFile, trailer.indexOffset-headerSize)
+	}
+
+	// 叠加读取层：流校验 -> 解密 -> 解压缩（见 pipeline.go）
+	stack, err := newReadStack(inFile, archiveReadLayers(header, options))
+	if err != nil {
+		return nil, err
+	}
+	ar.closers = append(ar.closers, stack)
+
+	// 添加缓冲层：条目元数据由大量小读取组成
+	ar.reader = bufio.NewReaderSize(stack, bufferSize(options))
+	return ar, nil
+}
+
+// openDecryption 从密码生成解密器，读取文件头之后的初始 nonce、密钥派生参数（versionKDF 起）和密码校验值（versionVerifier 起）
+func openDecryption(r io.Reader, version uint32, options PackOptions) (cipher.AEAD, []byte, error) {
+	if options.Password == "" {
+		return nil, nil, fmt.Errorf("归档文件已加密，需要提供密码")
+	}
+	// 读取 nonce
+	nonce := make([]byte, 12) // AES-GCM 的标准 nonce 长度
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, nil, fmt.Errorf("读取 nonce 失败: %v", err)
+	}
+	// versionKDF 起由记录的盐和参数派生密钥；更早的版本密钥是密码的 SHA-256
+	var key []byte
+	if version >= versionKDF {
+		var err error
+		if key, err = readPasswordKey(r, options); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		sum := sha256.Sum256([]byte(options.Password))
+		key = sum[:]
+	}
+	// versionVerifier 起检查密码校验值，密码错误时立即失败，而不是在解密第一个数据块时才报错
+	if version >= versionVerifier && version < versionKDF {
+		verifier := make([]byte, verifierSize)
+		if _, err := io.ReadFull(r, verifier); err != nil {
+			return nil, nil, fmt.Errorf("读取密码校验值失败: %v", err)
+		}
+		if err := checkPasswordVerifier(key, verifier); err != nil {
+			return nil, nil, err
+		}
+	}
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aesGCM, nonce, nil
+}
+
+// Next 读取下一个条目的元信息，到达结束标记时返回 io.EOF
+// 上一个条目未读取完的内容会被跳过
+func (ar *ArchiveReader) Next() (*FileEntry, error) {
+	entry, err := ar.next()
+	if err != nil {
+		return nil, err
+	}
+	fileEntry := entry.fileEntry()
+	return &fileEntry, nil
+}
+
+// next 读取下一个条目（内部使用，返回原始条目数据）
+func (ar *ArchiveReader) next() (*entryData, error) {
+	// 跳过上一个条目未读取的内容
+	if ar.content != nil {
+		if _, err := io.Copy(io.Discard, ar.stored); err != nil {
+			return nil, fmt.Errorf("跳过条目内容失败 (%s): %v", ar.current.RelPath, err)
+		}
+		ar.content = nil
+		ar.stored = nil
+	}
+	ar.locked = nil
+
+	entryType, err := readEntryType(ar.reader)
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("读取条目类型失败: 文件意外结束，可能文件不完整或已损坏")
+		}
+		return nil, fmt.Errorf("读取条目类型失败: %v", err)
+	}
+
+	// 检查结束标记
+	if entryType == entryTypeEnd {
+		ar.current = nil
+		if ar.digest != nil {
+			if err := ar.digest.verify(); err != nil {
+				return nil, err
+			}
+		}
+		return nil, io.EOF
+	}
+
+	entry, err := readEntry(ar.reader, entryType, ar.version, ar.flags, ar.limits.limits)
+	if err != nil {
+		return nil, fmt.Errorf("读取条目失败: %v", err)
+	}
+	if err := ar.limits.add(entry); err != nil {
+		return nil, err
+	}
+	ar.current = entry
+	ar.entryType = entryType
+
+	// 普通文件和镜像条目后面紧跟内容
+	if entryType == entryTypeFile || entryType == entryTypeImage {
+		if hasContentChecksum(ar.version) {
+			// versionContentHash 起内容之后是 SHA-256，读完内容时校验
+			ar.content = newChecksumReader(ar.reader, entry.contentSize())
+		} else {
+			ar.content = io.LimitReader(ar.reader, entry.contentSize())
+		}
+		ar.stored = ar.content
+		if entry.Encrypted {
+			if ar.entryKey == nil {
+				// 没有条目密码：内容仍可跳过（并校验密文的摘要），但不能读取
+				ar.locked = ErrEntryLocked
+			} else {
+				if err := ar.entryKey.check(entry.keyRecord); err != nil {
+					return nil, fmt.Errorf("%v (%s)", err, entry.RelPath)
+				}
+				ar.content = ar.entryKey.reader(ar.content, entry.RelPath, entry.Size)
+			}
+		}
+		if entry.chunked {
+			if ar.chunks == nil {
+				// 没有指定块存储：块列表仍可跳过（并校验其摘要），但不能读取内容
+				ar.locked = ErrNoChunkStore
+			} else {
+				ar.content = newChunkReader(ar.content, ar.chunks, entry.Size)
+			}
+		}
+		if entry.sparse != nil {
+			ar.content = newSparseReader(ar.content, entry.sparse, entry.Size)
+		}
+	}
+	return entry, nil
+}
+
+// Compression 返回归档的压缩方式和文件头中记录的压缩级别（旧版本程序写入的归档级别为 0）
+func (ar *ArchiveReader) Compression() (Codec, int) {
+	if ar.codec == CodecNone {
+		return CodecNone, 0
+	}
+	return ar.codec, ar.level
+}
+
+// Read 读取当前条目的内容（仅普通文件和镜像条目有内容）
+func (ar *ArchiveReader) Read(p []byte) (int, error) {
+	if ar.content == nil {
+		return 0, io.EOF
+	}
+	if ar.locked != nil {
+		return 0, ar.locked
+	}
+	n, err := ar.content.Read(p)
+	if err == io.EOF && ar.current != nil && ar.current.Size > 0 {
+		// LimitReader 在读满后返回 EOF；如果底层提前结束，说明归档被截断
+		if lr, ok := ar.content.(*io.LimitedReader); ok && lr.N > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// Close 关闭归档文件和读取链
+func (ar *ArchiveReader) Close() error {
+	for _, c := range ar.closers {
+		c.Close()
+	}
+	return ar.file.Close()
+}
+
+// TestArchive 完整读取归档（包括所有文件内容）检查其是否完好，不写入任何文件
+// 返回: 读取的条目数
+func TestArchive(archivePath string, options PackOptions) (int, error) {
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return 0, err
+	}
+	defer ar.Close()
+
+	count := 0
+	for {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+		var content io.Reader = ar
+		if ar.locked != nil {
+			// 没有条目密码的单独加密条目、没有指定块存储的条目：只校验密文或块列表的摘要
+			content = ar.stored
+		}
+		if _, err := io.Copy(io.Discard, content); err != nil {
+			return count, fmt.Errorf("读取条目内容失败 (%s): %v", entry.RelPath, err)
+		}
+	}
+}
+
+// fileTypeOf 将归档中的条目类型字节转换为文件类型
+func fileTypeOf(entryType byte) FileType {
+	switch entryType {
+	case entryTypeDir:
+		return TypeDir
+	case entryTypeSymlink:
+		return TypeSymlink
+	case entryTypeHardlink:
+		return TypeHardlink
+	case entryTypeFifo:
+		return TypeFifo
+	case entryTypeCharDev:
+		return TypeCharDevice
+	case entryTypeBlockDev:
+		return TypeBlockDevice
+	case entryTypeImage:
+		return TypeImage
+	default:
+		return TypeFile
+	}
+}
+
+// fileEntry 将归档中读取的条目数据转换为 FileEntry
+func (e *entryData) fileEntry() FileEntry {
+	return FileEntry{
+		RelPath:    e.RelPath,
+		Type:       e.Type,
+		Mode:       e.Mode,
+		Size:       e.Size,
+		Blocks:     e.blocks(),
+		ModTime:    e.ModTime,
+		AccessTime: e.AccessTime,
+		ChangeTime: e.ChangeTime,
+		UID:        int(e.UID),
+		GID:        int(e.GID),
+		LinkTarget: e.LinkTarget,
+		LinkName:   e.LinkName,
+		DevMajor:   e.DevMajor,
+		DevMinor:   e.DevMinor,
+		Mime:       e.Mime,
+		Encrypt:    e.Encrypted,
+		Sparse:     e.sparse != nil,
+		Xattrs:     e.xattrs,
+	}
+}
+
+// blocks 估算普通文件解包后占用的磁盘空间（归档中没有记录占用的块）：按 4KB 的块向上取整，稀疏文件只计数据区域
+func (e *entryData) blocks() int64 {
+	if e.Type != TypeFile {
+		return 0
+	}
+	if e.sparse == nil {
+		return estimatedBlocks(e.Size)
+	}
+	var total int64
+	for _, extent := range e.sparse {
+		total += estimatedBlocks(extent.length)
+	}
+	return total
+}
+
+// contentSize 返回条目内容在归档中占用的长度（单独加密的条目为密文长度，保存在块存储中的条目为块列表长度，
+// 稀疏文件为数据区域的总长度）
+func (e *entryData) contentSize() int64 {
+	if e.encoded() {
+		return e.storedSize
+	}
+	return e.Size
+}
+
+// encoded 条目的内容在归档中是否以不同于原始内容的形式保存（单独加密、块列表或稀疏文件的数据区域）
+func (e *entryData) encoded() bool {
+	return e.Encrypted || e.chunked || e.sparse != nil
+}
@@ -0,0 +1,352 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// httpRetries 下载中断后按断点续传重试的最大次数
+const httpRetries = 5
+
+// httpRetryDelay 第一次重试前的等待时间，之后逐次加倍
+const httpRetryDelay = time.Second
+
+// 下载归档的超时：建立连接、TLS 握手和等待响应头各有上限，服务器停止响应时不会无限等待；
+// 传输中超过 httpIdleTimeout 没有收到数据时取消请求，按连接中断处理（断点续传重试）
+const (
+	httpDialTimeout     = 30 * time.Second
+	httpTLSTimeout      = 30 * time.Second
+	httpResponseTimeout = time.Minute
+	httpIdleTimeout     = time.Minute
+)
+
+// newHTTPClient 创建下载归档使用的 HTTP 客户端（代理等设置与默认客户端相同）
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: httpDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = httpTLSTimeout
+	transport.ResponseHeaderTimeout = httpResponseTimeout
+	return &http.Client{Transport: transport}
+}
+
+// IsURL 判断归档路径是否为 HTTP(S) 地址
+func IsURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// httpHeaders 从环境变量读取下载归档时附加的请求头
+// BACKUP_HTTP_TOKEN: 作为 "Authorization: Bearer <token>" 发送
+// BACKUP_HTTP_HEADERS: 任意请求头，每行一个 "名称: 值"
+func httpHeaders() (http.Header, error) {
+	header := make(http.Header)
+	if token := os.Getenv("BACKUP_HTTP_TOKEN"); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	for _, line := range strings.Split(os.Getenv("BACKUP_HTTP_HEADERS"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("无效的请求头: %s", line)
+		}
+		header.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	return header, nil
+}
+
+// httpReader 顺序读取 HTTP(S) 上的归档，连接中断时用 Range 请求从断点继续下载
+type httpReader struct {
+	url    string
+	header http.Header
+	client *http.Client
+	body   io.ReadCloser
+	cancel context.CancelFunc // 取消当前请求
+	idle   time.Duration      // 传输中没有收到数据的最长时间
+	offset int64              // 已读取的字节数
+	size   int64              // 归档的总字节数，服务器没有返回时为 -1
+}
+
+// idleReader 读取响应体，超过 timeout 没有收到数据时取消请求，使 Read 返回错误而不是一直等待
+type idleReader struct {
+	body    io.Reader
+	timeout time.Duration
+	cancel  context.CancelFunc
+}
+
+func (ir idleReader) Read(p []byte) (int, error) {
+	timer := time.AfterFunc(ir.timeout, ir.cancel)
+	n, err := ir.body.Read(p)
+	if !timer.Stop() && err != nil {
+		err = fmt.Errorf("超过 %v 没有收到数据: %v", ir.timeout, err)
+	}
+	return n, err
+}
+
+// openURL 打开 HTTP(S) 上的归档
+func openURL(url string) (*httpReader, error) {
+	header, err := httpHeaders()
+	if err != nil {
+		return nil, err
+	}
+	hr := &httpReader{url: url, header: header, client: newHTTPClient(), idle: httpIdleTimeout, size: -1}
+	if err := hr.connect(); err != nil {
+		return nil, err
+	}
+	return hr, nil
+}
+
+// connect 从当前偏移处发起请求
+func (hr *httpReader) connect() error {
+	req, err := http.NewRequest(http.MethodGet, hr.url, nil)
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	for name, values := range hr.header {
+		req.Header[name] = values
+	}
+	if hr.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", hr.offset))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("下载归档失败: %v", err)
+	}
+	body := idleReader{resp.Body, hr.idle, cancel}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && hr.offset > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != hr.offset {
+			resp.Body.Close()
+			cancel()
+			return fmt.Errorf("服务器返回的续传范围不正确: %s", resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		if hr.offset == 0 {
+			hr.size = resp.ContentLength
+		}
+		// 服务器不支持 Range 请求：重新下载并跳过已读取的部分
+		if hr.offset > 0 {
+			if _, err := io.CopyN(io.Discard, body, hr.offset); err != nil {
+				resp.Body.Close()
+				cancel()
+				return fmt.Errorf("跳过已下载部分失败: %v", err)
+			}
+		}
+	default:
+		resp.Body.Close()
+		cancel()
+		return fmt.Errorf("下载归档失败: %s", resp.Status)
+	}
+	hr.body = resp.Body
+	hr.cancel = cancel
+	return nil
+}
+
+// Read 读取归档数据，连接中断时自动重连续传
+func (hr *httpReader) Read(p []byte) (int, error) {
+	n, err := idleReader{hr.body, hr.idle, hr.cancel}.Read(p)
+	hr.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	delay := httpRetryDelay
+	for attempt := 1; ; attempt++ {
+		hr.body.Close()
+		hr.cancel()
+		time.Sleep(delay)
+		delay *= 2
+		reconnectErr := hr.connect()
+		if reconnectErr == nil {
+			return n, nil
+		}
+		if attempt == httpRetries {
+			return n, fmt.Errorf("下载在 %d 字节处中断，重试 %d 次失败: %v", hr.offset, httpRetries, reconnectErr)
+		}
+	}
+}
+
+// ReadAt 用单独的 Range 请求读取归档中的一段数据，不影响顺序读取的位置
+// 用于读取归档末尾的中央索引
+func (hr *httpReader) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, hr.url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("创建请求失败: %v", err)
+	}
+	for name, values := range hr.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("下载归档失败: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("服务器不支持 Range 请求，无法读取归档的指定范围: %s", resp.Status)
+	}
+	var start int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != off {
+		return 0, fmt.Errorf("服务器返回的范围不正确: %s", resp.Header.Get("Content-Range"))
+	}
+	n, err := io.ReadFull(idleReader{resp.Body, hr.idle, cancel}, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close 关闭连接
+func (hr *httpReader) Close() error {
+	defer hr.cancel()
+	return hr.body.Close()
+}
+
+// digestReader 计算读取内容的 SHA-256 摘要，读取结束后与期望值比较
+type digestReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+// newDigestReader 创建校验 SHA-256 摘要的读取器，expected 为十六进制摘要
+func newDigestReader(r io.Reader, expected string) (*digestReader, error) {
+	expected = strings.ToLower(strings.TrimSpace(expected))
+	if decoded, err := hex.DecodeString(expected); err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("无效的 SHA-256 摘要: %s", expected)
+	}
+	return &digestReader{reader: r, hash: sha256.New(), expected: expected}, nil
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.reader.Read(p)
+	dr.hash.Write(p[:n])
+	return n, err
+}
+
+// verify 读取剩余数据并校验摘要
+func (dr *digestReader) verify() error {
+	if _, err := io.Copy(io.Discard, dr); err != nil {
+		return fmt.Errorf("读取归档失败: %v", err)
+	}
+	actual := hex.EncodeToString(dr.hash.Sum(nil))
+	if actual != dr.expected {
+		return fmt.Errorf("归档 SHA-256 校验失败: 期望 %s，实际 %s", dr.expected, actual)
+	}
+	return nil
+}
+
+// RestoreRemote 下载、校验并解包归档
+// 带流校验的归档（pack -stream-hash）边下载边解包：每 16 MiB 块校验通过后才交给解包，传输中的损坏在所在的块处立即报错；
+// 整个归档的摘要在读完时校验，不匹配时返回错误（之前已写入目标目录的文件不会被删除）。
+// 不带流校验的归档先保存到 options.SpoolDir（空表示系统临时目录）中的临时文件，同时计算摘要，
+// 摘要匹配后才从该文件解包，校验通过之前目标目录中不会出现任何文件；临时文件占用与归档相同的磁盘空间，返回前删除。
+// 解包方式与 unpack 相同（已存在的目录按归档设置权限和时间，同名文件被覆盖）
+// archivePath: http(s) 地址或本地路径
+// options.SHA256: 必须提供的归档摘要
+func RestoreRemote(archivePath string, restoreRoot string, options PackOptions) error {
+	if options.SHA256 == "" {
+		return fmt.Errorf("需要提供归档的 SHA-256 摘要")
+	}
+	absRestoreRoot, err := filepath.Abs(restoreRoot)
+	if err != nil {
+		return fmt.Errorf("获取目标绝对路径失败: %v", err)
+	}
+
+	source, err := openRemoteSource(archivePath)
+	if err != nil {
+		return err
+	}
+	if !streamHashed(source) {
+		spool, err := downloadVerified(source, options.SpoolDir, options.SHA256)
+		source.Close()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spool.Name())
+		// 摘要已经校验，解包时不再计算
+		options.SHA256 = ""
+		source = spool
+	}
+
+	ar, err := newArchiveReader(source, options)
+	if err != nil {
+		source.Close()
+		return err
+	}
+	return unpackArchive(ar, archivePath, absRestoreRoot, options)
+}
+
+// openRemoteSource 打开 http(s) 地址或本地路径上的归档
+func openRemoteSource(archivePath string) (io.ReadCloser, error) {
+	if IsURL(archivePath) {
+		return openURL(archivePath)
+	}
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("打开归档文件失败: %v", err)
+	}
+	return f, nil
+}
+
+// streamHashed 判断归档是否带流校验：用随机读取查看文件头，不影响顺序读取的位置
+// 数据源不支持随机读取（例如服务器不支持 Range 请求）时按不带流校验处理
+func streamHashed(source io.Reader) bool {
+	at, _, err := sourceReaderAt(source)
+	if err != nil {
+		return false
+	}
+	header, err := readArchiveHeader(io.NewSectionReader(at, 0, headerSize))
+	return err == nil && header.flags&flagStreamHash != 0
+}
+
+// downloadVerified 读取归档并保存到 dir（空表示系统临时目录）中的临时文件，同时校验 SHA-256 摘要
+// 摘要匹配时返回定位到开头的临时文件，否则删除临时文件并返回错误
+func downloadVerified(source io.Reader, dir, expected string) (*os.File, error) {
+	digest, err := newDigestReader(source, expected)
+	if err != nil {
+		return nil, err
+	}
+	spool, err := os.CreateTemp(dir, "backup-download-*")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	fail := func(err error) (*os.File, error) {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, err
+	}
+	if _, err := io.Copy(spool, digest); err != nil {
+		return fail(fmt.Errorf("下载归档失败: %v", err))
+	}
+	if err := digest.verify(); err != nil {
+		return fail(err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fail(fmt.Errorf("读取临时文件失败: %v", err))
+	}
+	return spool, nil
+}
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestHTTPReaderStalledBody 服务器发送一部分数据后停止响应时，读取超时后续传，而不是一直等待
+func TestHTTPReaderStalledBody(t *testing.T) {
+	data := chunkTestData(64 << 10)
+	var stalled atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start:])
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		stalled.Store(true)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	hr, err := openURL(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hr.Close()
+	hr.idle = 100 * time.Millisecond
+
+	got, err := io.ReadAll(hr)
+	if err != nil {
+		t.Fatalf("读取失败: %v", err)
+	}
+	if !stalled.Load() {
+		t.Error("服务器没有停止响应")
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("续传后的内容与原始数据不同（%d 字节）", len(got))
+	}
+}
+
+// TestRestoreRemote 带流校验的归档边读取边解包，其他归档先保存到临时目录；摘要不符时报错，不带流校验时目标目录不被创建
+func TestRestoreRemote(t *testing.T) {
+	source, files := writeRepositorySource(t)
+	dir := t.TempDir()
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		streamHash bool
+	}{
+		{"带流校验", true},
+		{"不带流校验", false},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("stream-hash-%v.bkup", tt.streamHash)
+		archivePath := filepath.Join(dir, name)
+		if err := PackWithOptions(source, archivePath, nil, PackOptions{StreamHash: tt.streamHash}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+
+		for label, location := range map[string]string{"本地": archivePath, "HTTP": server.URL + "/" + name} {
+			t.Run(tt.name+"/"+label, func(t *testing.T) {
+				src, err := openRemoteSource(location)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if streamHashed(src) != tt.streamHash {
+					t.Errorf("streamHashed() = %v", !tt.streamHash)
+				}
+				src.Close()
+				spoolDir := t.TempDir()
+
+				target := filepath.Join(t.TempDir(), "restore")
+				wrong := strings.Repeat("0", 64)
+				if err := RestoreRemote(location, target, PackOptions{SHA256: wrong, SpoolDir: spoolDir}); err == nil {
+					t.Error("摘要不符时解包成功")
+				}
+				if _, err := os.Lstat(target); (err == nil) != tt.streamHash {
+					t.Errorf("摘要不符时目标目录: %v", err)
+				}
+
+				target = filepath.Join(t.TempDir(), "restore")
+				if err := RestoreRemote(location, target, PackOptions{SHA256: hex.EncodeToString(sum[:]), SpoolDir: spoolDir}); err != nil {
+					t.Fatal(err)
+				}
+				checkRestoredFiles(t, target, files)
+				if names, _ := os.ReadDir(spoolDir); len(names) != 0 {
+					t.Errorf("临时目录中留下了 %d 个文件", len(names))
+				}
+			})
+		}
+	}
+}
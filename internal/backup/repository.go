@@ -0,0 +1,288 @@
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 快照仓库：一个目录中保存多次备份，结构与 restic/borg 的仓库类似
+//
+//	repo.json                 仓库的格式版本、创建时间和块加密的设置（用仓库密码包装的主密钥、密钥派生的盐和参数）
+//	chunks/xx/<SHA-256>       块存储（chunkstore.go），全部快照共享，相同的数据只保存一次
+//	snapshots/<ID>.bkup       每个快照一个普通的 BKUP 归档：元数据和小文件的内容，较大文件的内容为块列表
+//	snapshots/<ID>.json       快照的元信息（时间、主机、源路径、标签、统计），在归档写完之后写入
+//
+// 快照归档就是使用块存储打包的归档（pack -chunk-store），list、verify、cat 等命令指定 -chunk-store 为仓库目录即可使用。
+// 只有元信息文件存在的快照才算完成；打包中断时留下的归档没有元信息文件，不会出现在快照列表中。
+// 加密的仓库（InitRepositoryWithOptions 指定块加密方式）中每个块单独加密（chunkcrypt.go），快照归档整体加密，
+// 密钥由仓库的主密钥和每个归档的随机盐派生，不直接由密码派生（只能通过 repo.json 尝试密码）；
+// 快照的元信息文件不加密（时间、主机、源路径、标签和统计）。
+
+// repositoryVersion 仓库格式版本：不加密的仓库为 1，加密的仓库为 2（旧版本程序拒绝打开，不会写入不加密的块）
+const (
+	repositoryVersion          = 1
+	repositoryEncryptedVersion = 2
+)
+
+// repositoryConfigName 仓库目录中的配置文件
+const repositoryConfigName = "repo.json"
+
+// RepositoryConfig 仓库的配置（repo.json）
+type RepositoryConfig struct {
+	Version    int                   `json:"version"`
+	Created    time.Time             `json:"created"`
+	Encryption *RepositoryEncryption `json:"encryption,omitempty"` // 块加密的设置，nil 表示不加密
+}
+
+// RepositoryEncryption 加密仓库的块加密设置
+type RepositoryEncryption struct {
+	Mode string         `json:"mode"` // ChunkEncryptionRandom 或 ChunkEncryptionConvergent
+	KDF  *RepositoryKDF `json:"kdf"`  // 由仓库密码派生包装密钥的方式、盐和代价参数
+	Key  []byte         `json:"key"`  // 用仓库密码包装的主密钥
+}
+
+// RepositoryOptions 创建仓库的选项
+type RepositoryOptions struct {
+	Encryption string // 块加密方式: ""（不加密）、ChunkEncryptionRandom、ChunkEncryptionConvergent
+	Password   string // 加密仓库的密码，之后创建和还原快照时都需要
+}
+
+// Repository 快照仓库
+type Repository struct {
+	Dir    string // 仓库目录
+	Config RepositoryConfig
+}
+
+// Snapshot 一个快照的元信息
+type Snapshot struct {
+	ID           string      `json:"id"`
+	Time         time.Time   `json:"time"`             // 快照完成的时间
+	Hostname     string      `json:"hostname"`         // 创建快照的主机
+	Source       string      `json:"source"`           // 源目录的绝对路径
+	Tags         []string    `json:"tags,omitempty"`   // 标签
+	Entries      int         `json:"entries"`          // 条目数
+	ContentBytes int64       `json:"content_bytes"`    // 文件内容的原始总字节数
+	ArchiveBytes int64       `json:"archive_bytes"`    // 快照归档的大小（不包括块存储中的数据）
+	Dedup        *DedupStats `json:"dedup,omitempty"`  // 块存储去重的统计
+	Filter       *Filter     `json:"filter,omitempty"` // 创建快照时使用的过滤条件
+}
+
+// InitRepository 在目录中创建新的不加密仓库（目录可以不存在，存在时必须为空）
+func InitRepository(dir string) (*Repository, error) {
+	return InitRepositoryWithOptions(dir, RepositoryOptions{})
+}
+
+// InitRepositoryWithOptions 在目录中创建新的仓库，可以选择块加密方式
+func InitRepositoryWithOptions(dir string, options RepositoryOptions) (*Repository, error) {
+	config := RepositoryConfig{Version: repositoryVersion, Created: time.Now().UTC()}
+	switch options.Encryption {
+	case "", "none":
+	case ChunkEncryptionRandom, ChunkEncryptionConvergent:
+		if options.Password == "" {
+			return nil, fmt.Errorf("加密的仓库需要密码")
+		}
+		encryption, err := newChunkMasterKey(options.Encryption, options.Password)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = repositoryEncryptedVersion
+		config.Encryption = encryption
+	default:
+		return nil, fmt.Errorf("不支持的块加密方式: %s（可选 none、%s、%s）", options.Encryption, ChunkEncryptionRandom, ChunkEncryptionConvergent)
+	}
+	if names, err := os.ReadDir(dir); err == nil && len(names) > 0 {
+		return nil, fmt.Errorf("目录 %s 不是空目录，不能在其中创建仓库", dir)
+	}
+	for _, sub := range []string{"chunks", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("创建仓库目录失败: %v", err)
+		}
+	}
+	repo := &Repository{Dir: dir, Config: config}
+	data, err := json.MarshalIndent(repo.Config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, repositoryConfigName), append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("写入仓库配置失败: %v", err)
+	}
+	return repo, nil
+}
+
+// OpenRepository 打开已有的仓库
+func OpenRepository(dir string) (*Repository, error) {
+	data, err := os.ReadFile(filepath.Join(dir, repositoryConfigName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s 不是仓库目录（没有 %s，请先运行 init-repo）", dir, repositoryConfigName)
+		}
+		return nil, fmt.Errorf("读取仓库配置失败: %v", err)
+	}
+	repo := &Repository{Dir: dir}
+	if err := json.Unmarshal(data, &repo.Config); err != nil {
+		return nil, fmt.Errorf("仓库配置已损坏: %v", err)
+	}
+	if repo.Config.Version != repositoryVersion && repo.Config.Version != repositoryEncryptedVersion {
+		return nil, fmt.Errorf("不支持的仓库格式版本 %d，需要更新版本的程序", repo.Config.Version)
+	}
+	if (repo.Config.Version == repositoryEncryptedVersion) != (repo.Config.Encryption != nil) {
+		return nil, fmt.Errorf("仓库配置已损坏: 格式版本与加密设置不符")
+	}
+	return repo, nil
+}
+
+// Encrypted 仓库是否加密（创建和还原快照时需要仓库密码）
+func (r *Repository) Encrypted() bool {
+	return r.Config.Encryption != nil
+}
+
+// readRepositoryEncryption 读取块存储目录所属仓库的块加密设置：不是仓库目录或仓库不加密时返回 nil
+func readRepositoryEncryption(dir string) (*RepositoryEncryption, error) {
+	data, err := os.ReadFile(filepath.Join(dir, repositoryConfigName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取仓库配置失败: %v", err)
+	}
+	var config RepositoryConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("仓库配置已损坏: %v", err)
+	}
+	return config.Encryption, nil
+}
+
+// SnapshotArchive 返回快照归档的路径
+func (r *Repository) SnapshotArchive(id string) string {
+	return filepath.Join(r.Dir, "snapshots", id+".bkup")
+}
+
+// CreateSnapshot 打包源目录，在仓库中创建一个新快照
+// options: 打包选项（压缩方式、过滤外的其他选项等）；块存储固定为仓库目录。
+// 不加密的仓库不支持整体加密；加密的仓库需要 options.Password 为仓库密码，用它解开主密钥后整体加密快照归档
+func (r *Repository) CreateSnapshot(source string, filter *Filter, tags []string, options PackOptions) (*Snapshot, error) {
+	if r.Encrypted() {
+		if options.Password == "" {
+			return nil, ErrChunkStoreLocked
+		}
+		options.Encrypt = true
+	}
+	var idBytes [8]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, fmt.Errorf("生成快照 ID 失败: %v", err)
+	}
+	snapshot := &Snapshot{ID: hex.EncodeToString(idBytes[:]), Tags: tags, Filter: filter}
+	snapshot.Hostname, _ = os.Hostname()
+
+	options.ChunkStore = r.Dir
+	next := options.OnArchive
+	options.OnArchive = func(summary PackSummary) {
+		snapshot.Source = summary.Source
+		snapshot.Entries = summary.Entries
+		snapshot.ContentBytes = summary.ContentBytes
+		snapshot.ArchiveBytes = summary.ArchiveBytes
+		snapshot.Dedup = summary.Dedup
+		if next != nil {
+			next(summary)
+		}
+	}
+	archivePath := r.SnapshotArchive(snapshot.ID)
+	if err := PackWithOptions(source, archivePath, filter, options); err != nil {
+		return nil, err
+	}
+
+	snapshot.Time = time.Now().UTC()
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(r.Dir, "snapshots", snapshot.ID+".json"), append(data, '\n')); err != nil {
+		os.Remove(archivePath)
+		return nil, fmt.Errorf("写入快照信息失败: %v", err)
+	}
+	return snapshot, nil
+}
+
+// Snapshots 返回仓库中的全部快照，按时间排序
+func (r *Repository) Snapshots() ([]Snapshot, error) {
+	paths, err := filepath.Glob(filepath.Join(r.Dir, "snapshots", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取快照信息失败: %v", err)
+		}
+		var snapshot Snapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("快照信息 %s 已损坏: %v", filepath.Base(path), err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// FindSnapshot 按 ID 查找快照：可以是 ID 的唯一前缀，"latest" 表示最近的快照
+func (r *Repository) FindSnapshot(id string) (*Snapshot, error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	if id == "latest" {
+		if len(snapshots) == 0 {
+			return nil, fmt.Errorf("仓库中还没有快照")
+		}
+		return &snapshots[len(snapshots)-1], nil
+	}
+	var found *Snapshot
+	for i := range snapshots {
+		if strings.HasPrefix(snapshots[i].ID, id) {
+			if found != nil {
+				return nil, fmt.Errorf("快照 ID 前缀 %s 不唯一", id)
+			}
+			found = &snapshots[i]
+		}
+	}
+	if id == "" || found == nil {
+		return nil, fmt.Errorf("仓库中没有快照 %s", id)
+	}
+	return found, nil
+}
+
+// RestoreSnapshot 将快照还原到目标目录
+// options: 解包选项（还原策略、资源限制等）；块存储固定为仓库目录，加密的仓库需要 options.Password 为仓库密码
+func (r *Repository) RestoreSnapshot(id string, target string, options PackOptions) (*Snapshot, error) {
+	snapshot, err := r.FindSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	options.ChunkStore = r.Dir
+	if err := UnpackWithOptions(r.SnapshotArchive(snapshot.ID), target, options); err != nil {
+		return snapshot, err
+	}
+	return snapshot, nil
+}
+
+// writeFileAtomic 写入临时文件后重命名，读取方不会看到写了一半的文件
+func writeFileAtomic(path string, data []byte) error {
+	partialPath := path + partialSuffix
+	if err := os.WriteFile(partialPath, data, 0644); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	if err := os.Rename(partialPath, path); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	return nil
+}
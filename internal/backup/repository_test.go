@@ -0,0 +1,256 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeRepositorySource 生成快照的源目录：一个切分为块的大文件和一个直接保存在归档中的小文件
+func writeRepositorySource(t *testing.T) (string, map[string][]byte) {
+	t.Helper()
+	source := t.TempDir()
+	files := map[string][]byte{
+		"big.bin":       chunkTestData(2 * chunkAvgSize),
+		"dir/small.txt": []byte("small file\n"),
+	}
+	for name, data := range files {
+		path := filepath.Join(source, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return source, files
+}
+
+// checkRestoredFiles 比较还原的文件与源文件
+func checkRestoredFiles(t *testing.T, target string, files map[string][]byte) {
+	t.Helper()
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Errorf("读取还原的 %s 失败: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("还原的 %s 与源文件不同", name)
+		}
+	}
+}
+
+// TestRepositorySnapshotRoundTrip 各种加密方式的仓库中创建的快照能还原出源目录，加密仓库中没有明文
+func TestRepositorySnapshotRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption string
+		password   string
+	}{
+		{"不加密", "", ""},
+		{"random", ChunkEncryptionRandom, "secret"},
+		{"convergent", ChunkEncryptionConvergent, "secret"},
+	}
+	source, files := writeRepositorySource(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			repo, err := InitRepositoryWithOptions(dir, RepositoryOptions{Encryption: tt.encryption, Password: tt.password})
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshot, err := repo.CreateSnapshot(source, nil, []string{"test"}, PackOptions{Password: tt.password})
+			if err != nil {
+				t.Fatalf("创建快照失败: %v", err)
+			}
+			if snapshot.Dedup == nil || snapshot.Dedup.Files != 1 {
+				t.Errorf("去重统计: %+v", snapshot.Dedup)
+			}
+
+			reopened, err := OpenRepository(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reopened.Encrypted() != (tt.encryption != "") {
+				t.Errorf("Encrypted() = %v", reopened.Encrypted())
+			}
+			target := t.TempDir()
+			if _, err := reopened.RestoreSnapshot("latest", target, PackOptions{Password: tt.password}); err != nil {
+				t.Fatalf("还原快照失败: %v", err)
+			}
+			checkRestoredFiles(t, target, files)
+
+			if tt.encryption != "" {
+				archive, err := os.ReadFile(repo.SnapshotArchive(snapshot.ID))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(archive, []byte("small file")) {
+					t.Error("加密仓库的快照归档中有明文")
+				}
+			}
+		})
+	}
+}
+
+// TestRepositoryWrongPassword 加密仓库没有密码或密码错误时不能创建或还原快照
+func TestRepositoryWrongPassword(t *testing.T) {
+	source, _ := writeRepositorySource(t)
+	dir := t.TempDir()
+	repo, err := InitRepositoryWithOptions(dir, RepositoryOptions{Encryption: ChunkEncryptionConvergent, Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := repo.CreateSnapshot(source, nil, nil, PackOptions{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  string
+	}{
+		{"没有密码", "", ErrChunkStoreLocked.Error()},
+		{"错误的密码", "wrong", "仓库密码错误"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := repo.CreateSnapshot(source, nil, nil, PackOptions{Password: tt.password}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("创建快照: %v，期望 %s", err, tt.wantErr)
+			}
+			target := t.TempDir()
+			if _, err := repo.RestoreSnapshot(snapshot.ID, target, PackOptions{Password: tt.password}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("还原快照: %v，期望 %s", err, tt.wantErr)
+			}
+			if names, _ := os.ReadDir(target); len(names) != 0 {
+				t.Errorf("密码错误时写入了 %d 个条目", len(names))
+			}
+		})
+	}
+
+	if _, err := InitRepositoryWithOptions(t.TempDir(), RepositoryOptions{Encryption: ChunkEncryptionRandom}); err == nil {
+		t.Error("没有密码时创建了加密仓库")
+	}
+}
+
+// TestRepositoryTamperedChunk 块存储中的块被调换后，还原快照失败
+func TestRepositoryTamperedChunk(t *testing.T) {
+	source, _ := writeRepositorySource(t)
+	for _, encryption := range []string{"", ChunkEncryptionRandom, ChunkEncryptionConvergent} {
+		t.Run(encryptionName(encryption), func(t *testing.T) {
+			dir := t.TempDir()
+			repo, err := InitRepositoryWithOptions(dir, RepositoryOptions{Encryption: encryption, Password: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			password := "secret"
+			if encryption == "" {
+				password = ""
+			}
+			if _, err := repo.CreateSnapshot(source, nil, nil, PackOptions{Password: password}); err != nil {
+				t.Fatal(err)
+			}
+			chunks, err := filepath.Glob(filepath.Join(dir, "chunks", "*", "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) < 2 {
+				t.Fatalf("块存储中只有 %d 个块", len(chunks))
+			}
+			first, err := os.ReadFile(chunks[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := os.ReadFile(chunks[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(chunks[0], second, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(chunks[1], first, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := repo.RestoreSnapshot("latest", t.TempDir(), PackOptions{Password: password}); err == nil {
+				t.Error("块被调换后还原成功")
+			}
+		})
+	}
+}
+
+// TestOpenRepositoryConfig 被改动的 repo.json：格式版本与加密设置不符、密钥派生参数超出上限时拒绝
+func TestOpenRepositoryConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(config *RepositoryConfig)
+		wantErr string
+	}{
+		{"未知的格式版本", func(c *RepositoryConfig) { c.Version = 3 }, "不支持的仓库格式版本"},
+		{"加密版本没有加密设置", func(c *RepositoryConfig) { c.Encryption = nil }, "格式版本与加密设置不符"},
+		{"不加密版本有加密设置", func(c *RepositoryConfig) { c.Version = repositoryVersion }, "格式版本与加密设置不符"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			repo, err := InitRepositoryWithOptions(dir, RepositoryOptions{Encryption: ChunkEncryptionRandom, Password: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := repo.Config
+			tt.modify(&config)
+			writeRepositoryConfig(t, dir, config)
+			if _, err := OpenRepository(dir); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("错误为 %v，期望 %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	kdfTests := []struct {
+		name   string
+		modify func(kdf *RepositoryKDF)
+	}{
+		{"内存超过上限", func(kdf *RepositoryKDF) { kdf.N = 1 << 24 }},
+		{"计算量超过上限", func(kdf *RepositoryKDF) { kdf.P = 1 << 10 }},
+		{"盐太短", func(kdf *RepositoryKDF) { kdf.Salt = kdf.Salt[:4] }},
+		{"未知的派生方式", func(kdf *RepositoryKDF) { kdf.Version = 99 }},
+	}
+	for _, tt := range kdfTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			repo, err := InitRepositoryWithOptions(dir, RepositoryOptions{Encryption: ChunkEncryptionRandom, Password: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := repo.Config
+			encryption := *config.Encryption
+			kdf := *encryption.KDF
+			tt.modify(&kdf)
+			encryption.KDF = &kdf
+			config.Encryption = &encryption
+			writeRepositoryConfig(t, dir, config)
+
+			_, err = openChunkStore(PackOptions{ChunkStore: dir, Password: "secret"})
+			if err == nil || errors.Is(err, ErrWrongPassword) {
+				t.Errorf("被改动的密钥派生参数: %v", err)
+			}
+		})
+	}
+}
+
+// writeRepositoryConfig 覆盖仓库的 repo.json
+func writeRepositoryConfig(t *testing.T, dir string, config RepositoryConfig) {
+	t.Helper()
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, repositoryConfigName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,53 @@
+package backup
+
+import "fmt"
+
+// 可重现的归档：内容、权限和链接关系相同的目录树，在任何机器、任何时间打包都得到逐字节相同的归档，
+// 用于构建产物的缓存和审计（比较归档的 SHA-256 即可判断产物是否变化）。PackOptions.Reproducible 时：
+//   - 条目按路径排序（sortByPath），与扫描或导入的顺序无关
+//   - 修改时间不晚于 SourceDateEpoch（默认 0，即全部为 0），访问时间和变更时间记为修改时间
+//   - 属主记为 0:0；目录的大小（取决于文件系统，记录在中央索引和索引文件中）记为 0；SELinux 标签取决于主机的策略，不保存，其他扩展属性（如文件能力）照常保存
+//   - 不检测稀疏文件（空洞的分布取决于文件系统和写入方式），按普通文件保存完整内容
+//   - 压缩使用固定的参数：并行 flate 和分块压缩的输出本来就与线程数无关，zstd 只用一个线程，
+//     不允许按吞吐量自适应调整级别；加密每次使用随机的 nonce，不能同时使用
+// 归档旁的摘要文件记录了完成时间，不在可重现的范围内。
+
+// applyReproducible 按可重现模式规范化条目和选项，不支持的选项组合返回错误
+func applyReproducible(entries []FileEntry, options PackOptions) ([]FileEntry, PackOptions, error) {
+	if !options.Reproducible {
+		return entries, options, nil
+	}
+	switch {
+	case options.Encrypt || len(options.EntryEncryptPatterns) > 0:
+		return nil, options, fmt.Errorf("加密每次使用随机的 nonce，不能与可重现模式同时使用")
+	case options.CompressTarget > 0:
+		return nil, options, fmt.Errorf("按吞吐量自适应调整的压缩级别取决于机器的速度，不能与可重现模式同时使用")
+	case options.RestoreOrder != nil:
+		return nil, options, fmt.Errorf("可重现模式按路径排列条目，不能同时指定还原顺序")
+	}
+	if options.Compression == CodecZstd {
+		options.Threads = 1
+	}
+
+	entries = sortByPath(entries)
+	epoch := options.SourceDateEpoch
+	for i := range entries {
+		entry := &entries[i]
+		if entry.ModTime > epoch {
+			entry.ModTime = epoch
+		}
+		entry.AccessTime, entry.ChangeTime = entry.ModTime, entry.ModTime
+		entry.UID, entry.GID = 0, 0
+		if entry.Type == TypeDir {
+			entry.Size = 0
+		}
+		entry.Sparse = false
+		if entry.Xattrs[selinuxXattr] != nil {
+			entry.Xattrs = restoredXattrs(entry.Xattrs, PackOptions{NoSELinux: true})
+			if len(entry.Xattrs) == 0 {
+				entry.Xattrs = nil
+			}
+		}
+	}
+	return entries, options, nil
+}
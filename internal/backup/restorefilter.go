@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// 按过滤条件还原（PackOptions.RestoreFilter）：解包时用与打包相同的 Filter 选择条目，
+// 例如只还原某个日期之后修改的 *.conf。条目按 Match 的规则匹配，大小按归档中记录的大小
+// （SizeMode 为 blocks 时按 entryData.blocks 的估算）；不匹配的条目顺序读过而不写入。
+// 匹配的条目的上级目录没有匹配时按需以 0755 创建；IncludeParents 时这些目录先暂存（parentKeeper），
+// 有匹配的条目时再按归档中的权限、属主和时间还原目录本身，与打包时的语义相同。
+// 硬链接链接的文件不匹配时与 ExtractPaths 相同，解包结束后把那个文件的内容还原到第一个匹配的硬链接。
+// 增量和差异归档的删除记录只有路径，无法判断是否匹配，按过滤条件还原时不应用。
+
+// restoreFilter 解包时按过滤条件选择条目
+type restoreFilter struct {
+	filter  *Filter
+	parents parentKeeper          // IncludeParents 时暂存的不匹配的目录
+	held    map[string]*entryData // 暂存的目录的完整条目（路径 -> 条目）
+}
+
+// newRestoreFilter 创建解包时的过滤，filter 为 nil 时返回 nil
+func newRestoreFilter(filter *Filter) *restoreFilter {
+	if filter == nil {
+		return nil
+	}
+	return &restoreFilter{filter: filter, held: make(map[string]*entryData)}
+}
+
+// match 条目是否匹配过滤条件；不匹配的目录在 IncludeParents 时暂存，直到确定其下是否有匹配的条目
+func (r *restoreFilter) match(entry *entryData) bool {
+	for _, dir := range r.parents.leave(entry.RelPath) {
+		delete(r.held, dir.RelPath)
+	}
+	if r.filter.Match(entry.fileEntry()) {
+		return true
+	}
+	if r.filter.IncludeParents && entry.Type == TypeDir {
+		r.parents.hold(entry.fileEntry())
+		r.held[entry.RelPath] = entry
+	}
+	return false
+}
+
+// take 返回匹配的条目需要的暂存上级目录（从外到内）并清空
+func (r *restoreFilter) take() []*entryData {
+	var dirs []*entryData
+	for _, dir := range r.parents.take() {
+		dirs = append(dirs, r.held[dir.RelPath])
+		delete(r.held, dir.RelPath)
+	}
+	return dirs
+}
+
+// restoreParents 还原暂存的上级目录（只还原目录本身，权限和时间在 finishDirs 中设置），
+// 被还原策略跳过的目录不还原，其下的条目按需以 0755 创建上级目录
+func restoreParents(parents []*entryData, absRestoreRoot string, dirs []restoredDir, options PackOptions) ([]restoredDir, error) {
+	for _, entry := range parents {
+		if options.RestorePolicy != nil && options.RestorePolicy.apply(entry) {
+			continue
+		}
+		targetPath := filepath.Join(absRestoreRoot, entry.RelPath)
+		if err := restoreDir(absRestoreRoot, entry); err != nil {
+			return dirs, err
+		}
+		dirs = append(dirs, restoredDir{absRestoreRoot, entry})
+		if err := restoreXattrs(targetPath, restoredXattrs(entry.xattrs, options)); err != nil {
+			warn(options, "%s: %v", entry.RelPath, err)
+		}
+		if options.OnEntryRestored != nil {
+			if err := options.OnEntryRestored(entry.fileEntry(), targetPath); err != nil {
+				return dirs, fmt.Errorf("条目还原后的回调失败 (%s): %v", entry.RelPath, err)
+			}
+		}
+		if options.selector != nil {
+			options.selector.restored[entry.RelPath] = true
+		}
+	}
+	return dirs, nil
+}
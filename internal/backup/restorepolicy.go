@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RestorePolicy 解包时按路径模式调整属主、权限或跳过条目的策略（YAML 策略文件）
+// 用于将标准镜像还原到配置不同的主机上（用户 ID 不同、目录需要更严格的权限等），不需要事后再运行脚本修改。
+//
+//	rules:
+//	  - path: "var/cache/**"     # 路径模式，语法与 -include 相同；省略时匹配所有条目
+//	    skip: true               # 不还原
+//	  - path: "srv/www/**"
+//	    owner: www-data          # 目标主机上的用户名或 UID
+//	    group: www-data
+//	  - path: "etc/ssl/private/**"
+//	    mode: "0600"             # 文件和其他非目录条目的权限
+//	    dir_mode: "0700"         # 目录的权限
+//	  - uid_map: {1000: 1001}    # 将归档中的 UID/GID 映射为目标主机上的值
+//	    gid_map: {1000: 1001}
+//
+// 规则按顺序对每个条目依次应用，后面匹配的规则可以覆盖前面规则的设置
+type RestorePolicy struct {
+	Rules []RestoreRule `yaml:"rules"`
+}
+
+// RestoreRule 一条还原规则
+type RestoreRule struct {
+	Path    string      `yaml:"path"`     // 路径模式，空表示匹配所有条目
+	Types   []FileType  `yaml:"types"`    // 只匹配这些类型的条目，空表示所有类型
+	Skip    *bool       `yaml:"skip"`     // 是否跳过
+	Owner   string      `yaml:"owner"`    // 属主（用户名或 UID）
+	Group   string      `yaml:"group"`    // 属组（组名或 GID）
+	Mode    string      `yaml:"mode"`     // 非目录条目的权限（八进制）
+	DirMode string      `yaml:"dir_mode"` // 目录的权限（八进制）
+	UIDMap  map[int]int `yaml:"uid_map"`  // 归档中的 UID -> 还原后的 UID
+	GIDMap  map[int]int `yaml:"gid_map"`  // 归档中的 GID -> 还原后的 GID
+
+	uid, gid      *int    // 解析后的属主和属组
+	mode, dirMode *uint32 // 解析后的权限
+}
+
+// LoadRestorePolicy 读取并解析 YAML 策略文件（JSON 也是合法的 YAML）
+// 用户名和组名在目标主机上解析，不存在时返回错误
+func LoadRestorePolicy(path string) (*RestorePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取还原策略失败: %v", err)
+	}
+	policy, err := ParseRestorePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("解析还原策略失败 (%s): %v", path, err)
+	}
+	return policy, nil
+}
+
+// ParseRestorePolicy 解析策略文件的内容
+func ParseRestorePolicy(data []byte) (*RestorePolicy, error) {
+	policy := &RestorePolicy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(policy); err != nil {
+		return nil, err
+	}
+	for i := range policy.Rules {
+		if err := policy.Rules[i].resolve(); err != nil {
+			return nil, fmt.Errorf("第 %d 条规则: %v", i+1, err)
+		}
+	}
+	return policy, nil
+}
+
+// resolve 解析规则中的用户名、组名和权限
+func (r *RestoreRule) resolve() error {
+	if r.Owner != "" {
+		id, err := lookupID(r.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("未知的用户: %s", r.Owner)
+		}
+		r.uid = &id
+	}
+	if r.Group != "" {
+		id, err := lookupID(r.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("未知的组: %s", r.Group)
+		}
+		r.gid = &id
+	}
+	for _, m := range []struct {
+		text   string
+		target **uint32
+	}{{r.Mode, &r.mode}, {r.DirMode, &r.dirMode}} {
+		if m.text == "" {
+			continue
+		}
+		mode, err := strconv.ParseUint(m.text, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("无效的权限: %s（应为 0000 到 0777 之间的八进制数，如 0640）", m.text)
+		}
+		value := uint32(mode)
+		*m.target = &value
+	}
+	return nil
+}
+
+// lookupID 将数字 ID 或名称解析为数字 ID
+func lookupID(s string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil && id >= 0 {
+		return id, nil
+	}
+	idText, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(idText)
+}
+
+// match 判断规则是否适用于条目
+func (r *RestoreRule) match(entry *entryData) bool {
+	if r.Path != "" && !matchPathPattern(r.Path, entry.RelPath, entry.Type == TypeDir) {
+		return false
+	}
+	if len(r.Types) == 0 {
+		return true
+	}
+	for _, t := range r.Types {
+		if entry.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// apply 依次应用匹配的规则，修改条目的属主和权限，返回是否跳过该条目
+func (p *RestorePolicy) apply(entry *entryData) bool {
+	skip := false
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.match(entry) {
+			continue
+		}
+		if r.Skip != nil {
+			skip = *r.Skip
+		}
+		if uid, ok := r.UIDMap[int(entry.UID)]; ok {
+			entry.UID = int32(uid)
+		}
+		if gid, ok := r.GIDMap[int(entry.GID)]; ok {
+			entry.GID = int32(gid)
+		}
+		if r.uid != nil {
+			entry.UID = int32(*r.uid)
+		}
+		if r.gid != nil {
+			entry.GID = int32(*r.gid)
+		}
+		switch {
+		case entry.Type == TypeDir && r.dirMode != nil:
+			entry.Mode = entry.Mode&^0777 | *r.dirMode
+		case entry.Type != TypeDir && entry.Type != TypeSymlink && r.mode != nil:
+			entry.Mode = entry.Mode&^0777 | *r.mode
+		}
+	}
+	return skip
+}
@@ -1,15 +1,31 @@
 package backup
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // ScanPath 扫描指定路径下的所有文件和目录，返回文件条目列表
 // root: 要扫描的根目录或文件路径
 // 返回: 文件条目列表和可能的错误
+// 条目按路径排列（父目录在其内容之前，同一目录中按名称的字节序，见 order.go）；
+// 同一 inode 按这个顺序的第一个路径为普通文件，其余路径为链接到它的硬链接
 func ScanPath(root string) ([]FileEntry, error) {
+	return scanPath(root, nil)
+}
+
+// scanProgress 扫描过程中每得到一个条目调用一次（count 为已扫描的条目数），返回错误时中止扫描
+type scanProgress func(count int) error
+
+// scanPath 与 ScanPath 相同，progress 不为 nil 时在扫描过程中调用（打包的限制检查）
+func scanPath(root string, progress scanProgress) ([]FileEntry, error) {
 	var entries []FileEntry
 	// 用于跟踪硬链接：inode -> 第一个文件路径
 	hardlinkMap := make(map[uint64]string)
@@ -32,66 +48,283 @@ func ScanPath(root string) ([]FileEntry, error) {
 		return []FileEntry{entry}, nil
 	}
 	
-	// 如果是目录，使用 WalkDir 遍历
-	err = filepath.WalkDir(absRoot, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			// 如果访问某个文件出错，记录但继续处理其他文件
-			return nil
-		}
-		
-		// 计算相对路径
-		relPath, err := filepath.Rel(absRoot, path)
-		if err != nil {
-			return nil
-		}
-		
-		// 根目录本身用 "." 表示
-		if relPath == "." {
-			relPath = "."
-		}
-		
-		// 获取文件信息
-		info, err := d.Info()
-		if err != nil {
-			return nil
-		}
-		
-		entry := createFileEntry(path, relPath, info)
-		
+	// 如果是目录，按目录的文件描述符逐层遍历（见 scanDirTree）
+	scanned, err := scanDirTree(absRoot, rootInfo, progress)
+	if err != nil {
+		return nil, err
+	}
+	assignRelPaths(scanned)
+	entries = make([]FileEntry, 0, len(scanned))
+	for _, item := range scanned {
+		entry := item.entry
 		// 检查硬链接
-		if sysInfo, ok := info.Sys().(*syscall.Stat_t); ok && sysInfo.Nlink > 1 && entry.Type == TypeFile {
+		if item.nlink > 1 && entry.Type == TypeFile {
 			// 这是一个可能有硬链接的文件
-			inode := sysInfo.Ino
-			if firstPath, exists := hardlinkMap[inode]; exists {
+			if firstPath, exists := hardlinkMap[item.ino]; exists {
 				// 这是一个硬链接，指向第一个文件
 				entry.Type = TypeHardlink
-				// 计算第一个文件的相对路径
-				firstRelPath, _ := filepath.Rel(absRoot, firstPath)
-				entry.LinkName = firstRelPath
+				entry.LinkName = firstPath
 			} else {
 				// 这是第一个文件，记录它的路径
-				hardlinkMap[inode] = path
+				hardlinkMap[item.ino] = entry.RelPath
+			}
+		}
+		entries = append(entries, entry)
+	}
+	
+	return entries, nil
+}
+
+// scannedEntry 遍历得到的一个条目：entry.RelPath 暂时只是条目名，遍历结束后由 assignRelPaths 填写完整路径
+type scannedEntry struct {
+	entry  FileEntry
+	parent int    // 所在目录在结果中的下标（根目录为 -1）
+	ino    uint64 // inode 和链接数，用于识别硬链接
+	nlink  uint64
+}
+
+// scanDir 遍历中的一个目录
+type scanDir struct {
+	index int      // 目录在结果中的下标
+	names []string // 目录中的条目名（按字典序）
+	next  int      // 下一个要处理的条目
+	dev   uint64   // 设备号和 inode，返回上一级时确认回到的是同一个目录
+	ino   uint64
+}
+
+// scanDirTree 从根目录开始（rootInfo 为其 Lstat 结果），以先序、按名称排序的顺序遍历目录树（与 filepath.WalkDir 相同）
+// 始终只打开当前目录：进入子目录时用 openat 相对于当前目录打开，处理完后用 ".." 返回上一级，
+// 系统调用的路径参数只有一个路径分量，任意深度的目录树都不会超过 PATH_MAX，也不会耗尽文件描述符。
+// 与 WalkDir 一样，无法访问的条目和目录内容被跳过；遍历过程中目录被移动或 progress 返回错误时返回错误
+func scanDirTree(absRoot string, rootInfo os.FileInfo, progress scanProgress) ([]scannedEntry, error) {
+	root := scannedEntry{entry: createFileEntry(absRoot, ".", rootInfo), parent: -1}
+	if sysInfo, ok := rootInfo.Sys().(*syscall.Stat_t); ok {
+		root.ino, root.nlink = sysInfo.Ino, uint64(sysInfo.Nlink)
+	}
+	scanned := []scannedEntry{root}
+	
+	dir, err := os.Open(absRoot)
+	if err != nil {
+		return scanned, nil
+	}
+	defer func() { dir.Close() }()
+	var rootStat unix.Stat_t
+	if err := unix.Fstat(int(dir.Fd()), &rootStat); err != nil {
+		return scanned, nil
+	}
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return scanned, nil
+	}
+	sort.Strings(names)
+	stack := []*scanDir{{index: 0, names: names, dev: rootStat.Dev, ino: rootStat.Ino}}
+	
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if top.next == len(top.names) {
+			// 当前目录处理完毕，返回上一级
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				break
 			}
+			parent, err := openDirAt(dir, "..")
+			if err != nil {
+				return nil, fmt.Errorf("返回上一级目录失败 (%s): %v", scannedPath(scanned, top.index), err)
+			}
+			dir.Close()
+			dir = parent
+			var st unix.Stat_t
+			up := stack[len(stack)-1]
+			if err := unix.Fstat(int(dir.Fd()), &st); err != nil || st.Dev != up.dev || st.Ino != up.ino {
+				return nil, fmt.Errorf("扫描过程中目录被移动 (%s)", scannedPath(scanned, top.index))
+			}
+			continue
 		}
+		name := top.names[top.next]
+		top.next++
 		
-		// 目录路径以 / 结尾，方便后续处理
-		if entry.Type == TypeDir && entry.RelPath != "." && entry.RelPath[len(entry.RelPath)-1] != '/' {
-			entry.RelPath += "/"
+		var st unix.Stat_t
+		if err := unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			continue
+		}
+		entry := fileEntryFromInfo(name, newStatInfo(name, &st))
+		if entry.Type == TypeSymlink {
+			if target, err := readlinkAt(int(dir.Fd()), name); err == nil {
+				entry.LinkTarget = target
+			}
+		}
+		entry.Xattrs = readXattrsAt(int(dir.Fd()), name)
+		scanned = append(scanned, scannedEntry{entry: entry, parent: top.index, ino: st.Ino, nlink: uint64(st.Nlink)})
+		if progress != nil {
+			if err := progress(len(scanned)); err != nil {
+				return nil, err
+			}
+		}
+		if entry.Type != TypeDir {
+			continue
 		}
 		
-		entries = append(entries, entry)
-		return nil
-	})
-	
+		// 进入子目录；无法打开或读取时跳过其内容
+		child, err := openDirAt(dir, name)
+		if err != nil {
+			continue
+		}
+		names, err := child.Readdirnames(-1)
+		if err != nil {
+			child.Close()
+			continue
+		}
+		sort.Strings(names)
+		dir.Close()
+		dir = child
+		stack = append(stack, &scanDir{index: len(scanned) - 1, names: names, dev: st.Dev, ino: st.Ino})
+	}
+	return scanned, nil
+}
+
+// assignRelPaths 由条目名和所在目录填写完整的相对路径（目录以 / 结尾，方便后续处理）
+// 先序结果中，目录后面紧跟的通常是它的第一个子条目：沿这样的一条链只生成一次最深条目的路径，
+// 链上的其他条目使用它的前缀（Go 的子串共享底层数据）。深度为 n 的目录链只占用 O(n) 而不是 O(n²) 的内存，
+// 普通的目录树中每个条目仍是一个独立的字符串
+func assignRelPaths(scanned []scannedEntry) {
+	ends := make([]int, 0, 16)
+	for i := 1; i < len(scanned); {
+		// 链：从 i 开始，每个条目都是前一个条目的子条目
+		j := i
+		for j+1 < len(scanned) && scanned[j+1].parent == j {
+			j++
+		}
+		var prefix string
+		if parent := scanned[i].parent; parent > 0 {
+			prefix = scanned[parent].entry.RelPath
+		}
+		var b strings.Builder
+		ends = ends[:0]
+		b.WriteString(prefix)
+		for k := i; k <= j; k++ {
+			b.WriteString(scanned[k].entry.RelPath)
+			if scanned[k].entry.Type == TypeDir {
+				b.WriteByte('/')
+			}
+			ends = append(ends, b.Len())
+		}
+		path := b.String()
+		for k := i; k <= j; k++ {
+			scanned[k].entry.RelPath = path[:ends[k-i]]
+		}
+		i = j + 1
+	}
+}
+
+// scannedPath 遍历过程中（assignRelPaths 之前）第 index 个条目的相对路径，用于错误信息
+func scannedPath(scanned []scannedEntry, index int) string {
+	var parts []string
+	for i := index; i > 0; i = scanned[i].parent {
+		parts = append(parts, scanned[i].entry.RelPath)
+	}
+	for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+		parts[l], parts[r] = parts[r], parts[l]
+	}
+	return strings.Join(parts, "/") + "/"
+}
+
+// openDirAt 相对于已打开的目录打开子目录（不跟随符号链接）
+func openDirAt(dir *os.File, name string) (*os.File, error) {
+	fd, err := unix.Openat(int(dir.Fd()), name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
 	if err != nil {
 		return nil, err
 	}
-	
-	return entries, nil
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// readlinkAt 读取相对于目录的符号链接的目标
+func readlinkAt(dirfd int, name string) (string, error) {
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(dirfd, name, buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// statInfo 用 fstatat 的结果实现 os.FileInfo，Sys() 与 os.Lstat 一样返回 *syscall.Stat_t
+type statInfo struct {
+	name string
+	sys  syscall.Stat_t
+}
+
+func newStatInfo(name string, st *unix.Stat_t) *statInfo {
+	return &statInfo{name: name, sys: syscall.Stat_t{
+		Dev:     st.Dev,
+		Ino:     st.Ino,
+		Nlink:   st.Nlink,
+		Mode:    st.Mode,
+		Uid:     st.Uid,
+		Gid:     st.Gid,
+		Rdev:    st.Rdev,
+		Size:    st.Size,
+		Blksize: st.Blksize,
+		Blocks:  st.Blocks,
+		Atim:    syscall.Timespec{Sec: st.Atim.Sec, Nsec: st.Atim.Nsec},
+		Mtim:    syscall.Timespec{Sec: st.Mtim.Sec, Nsec: st.Mtim.Nsec},
+		Ctim:    syscall.Timespec{Sec: st.Ctim.Sec, Nsec: st.Ctim.Nsec},
+	}}
+}
+
+func (si *statInfo) Name() string       { return si.name }
+func (si *statInfo) Size() int64        { return si.sys.Size }
+func (si *statInfo) ModTime() time.Time { return time.Unix(si.sys.Mtim.Sec, si.sys.Mtim.Nsec) }
+func (si *statInfo) IsDir() bool        { return si.Mode().IsDir() }
+func (si *statInfo) Sys() interface{}   { return &si.sys }
+
+// Mode 将 st_mode 转换为 os.FileMode（与 os.Lstat 的转换相同）
+func (si *statInfo) Mode() os.FileMode {
+	mode := os.FileMode(si.sys.Mode & 0777)
+	switch si.sys.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if si.sys.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if si.sys.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if si.sys.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
 }
 
 // createFileEntry 从文件信息创建 FileEntry
 func createFileEntry(fullPath, relPath string, info os.FileInfo) FileEntry {
+	entry := fileEntryFromInfo(relPath, info)
+	if entry.Type == TypeSymlink {
+		linkTarget, err := os.Readlink(fullPath)
+		if err == nil {
+			entry.LinkTarget = linkTarget
+		}
+	}
+	entry.Xattrs = readXattrs(fullPath)
+	return entry
+}
+
+// fileEntryFromInfo 从文件信息创建 FileEntry（不读取符号链接的目标）
+func fileEntryFromInfo(relPath string, info os.FileInfo) FileEntry {
 	entry := FileEntry{
 		RelPath: relPath,
 		Mode:    uint32(info.Mode()),
@@ -109,8 +342,8 @@ func createFileEntry(fullPath, relPath string, info os.FileInfo) FileEntry {
 		
 		// 设备文件的主次编号
 		if info.Mode()&os.ModeDevice != 0 {
-			entry.DevMajor = int64(sysInfo.Rdev >> 8)
-			entry.DevMinor = int64(sysInfo.Rdev & 0xff)
+			entry.DevMajor = devMajor(uint64(sysInfo.Rdev))
+			entry.DevMinor = devMinor(uint64(sysInfo.Rdev))
 		}
 	}
 	
@@ -122,10 +355,6 @@ func createFileEntry(fullPath, relPath string, info os.FileInfo) FileEntry {
 		
 	case mode&os.ModeSymlink != 0:
 		entry.Type = TypeSymlink
-		linkTarget, err := os.Readlink(fullPath)
-		if err == nil {
-			entry.LinkTarget = linkTarget
-		}
 		
 	case mode&os.ModeNamedPipe != 0:
 		entry.Type = TypeFifo
@@ -141,7 +370,24 @@ func createFileEntry(fullPath, relPath string, info os.FileInfo) FileEntry {
 		
 	default:
 		entry.Type = TypeFile
+		if sysInfo, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.Blocks = sysInfo.Blocks * 512
+			// 占用的磁盘块少于文件大小：可能有空洞，打包时用 SEEK_DATA/SEEK_HOLE 确认
+			entry.Sparse = entry.Blocks < entry.Size
+		}
 	}
 	
 	return entry
 }
+
+// devMajor 从设备号中提取主编号（与 glibc gnu_dev_major 一致）
+// 布局: 主编号低12位在 bit 8-19，高位在 bit 44 以上
+func devMajor(dev uint64) int64 {
+	return int64(((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000))
+}
+
+// devMinor 从设备号中提取次编号（与 glibc gnu_dev_minor 一致）
+// 布局: 次编号低8位在 bit 0-7，高位在 bit 20-43
+func devMinor(dev uint64) int64 {
+	return int64((dev & 0xff) | ((dev >> 12) & 0xffffff00))
+}
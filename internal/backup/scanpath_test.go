@@ -0,0 +1,260 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	deepTreeDepth = 100 // 目录链的层数
+	deepTreeMid   = 50  // mid.txt 所在的层
+)
+
+// deepTreeContent deep.txt 的内容
+var deepTreeContent = []byte("在 PATH_MAX 之外的文件\n")
+
+// deepTreeName 第 i 层目录的名称（90 字节，100 层的完整路径约 9KB，超过 PATH_MAX 的两倍）
+func deepTreeName(i int) string {
+	return fmt.Sprintf("d%02d-%s", i, strings.Repeat("x", 86))
+}
+
+// makeDeepTree 在 root 下创建超过 PATH_MAX 的目录链：每层用 openat/mkdirat 相对于上一层创建，
+// 第 deepTreeMid 层有 mid.txt，最深一层有 deep.txt 及其硬链接 deep.hard 和符号链接 deep.link，根目录有 z.txt
+func makeDeepTree(t *testing.T, root string) {
+	t.Helper()
+	writeAt := func(dirfd int, name string, data []byte) {
+		fd, err := unix.Openat(dirfd, name, unix.O_CREAT|unix.O_WRONLY|unix.O_CLOEXEC, 0644)
+		if err != nil {
+			t.Fatalf("创建 %s 失败: %v", name, err)
+		}
+		defer unix.Close(fd)
+		if _, err := unix.Write(fd, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirfd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAt(dirfd, "z.txt", []byte("z"))
+	for i := 0; i < deepTreeDepth; i++ {
+		if i == deepTreeMid {
+			writeAt(dirfd, "mid.txt", []byte("mid"))
+		}
+		if err := unix.Mkdirat(dirfd, deepTreeName(i), 0755); err != nil {
+			t.Fatalf("创建第 %d 层目录失败: %v", i, err)
+		}
+		next, err := unix.Openat(dirfd, deepTreeName(i), unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		unix.Close(dirfd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirfd = next
+	}
+	defer unix.Close(dirfd)
+	writeAt(dirfd, "deep.txt", deepTreeContent)
+	if err := unix.Linkat(dirfd, "deep.txt", dirfd, "deep.hard", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Symlinkat("deep.txt", dirfd, "deep.link"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deepTreeDir 第 i 层目录的相对路径（以 / 结尾）
+func deepTreeDir(i int) string {
+	var b strings.Builder
+	for k := 0; k <= i; k++ {
+		b.WriteString(deepTreeName(k))
+		b.WriteByte('/')
+	}
+	return b.String()
+}
+
+// deepTreeEntry 期望的条目
+type deepTreeEntry struct {
+	relPath string
+	typ     FileType
+	link    string // 硬链接的 LinkName 或符号链接的 LinkTarget
+}
+
+// deepTreeEntries makeDeepTree 的目录树按扫描顺序（先序、按名称排序）的条目，不含根目录
+func deepTreeEntries() []deepTreeEntry {
+	var want []deepTreeEntry
+	for i := 0; i < deepTreeDepth; i++ {
+		want = append(want, deepTreeEntry{relPath: deepTreeDir(i), typ: TypeDir})
+	}
+	bottom := deepTreeDir(deepTreeDepth - 1)
+	want = append(want,
+		deepTreeEntry{relPath: bottom + "deep.hard", typ: TypeFile},
+		deepTreeEntry{relPath: bottom + "deep.link", typ: TypeSymlink, link: "deep.txt"},
+		deepTreeEntry{relPath: bottom + "deep.txt", typ: TypeHardlink, link: bottom + "deep.hard"},
+	)
+	// mid.txt 在第 deepTreeMid 层的目录之后（它所在目录的子目录按名称排在前面）
+	want = append(want, deepTreeEntry{relPath: deepTreeDir(deepTreeMid-1) + "mid.txt", typ: TypeFile})
+	want = append(want, deepTreeEntry{relPath: "z.txt", typ: TypeFile})
+	return want
+}
+
+// checkDeepTreeEntries 检查扫描结果的相对路径、类型和链接
+func checkDeepTreeEntries(t *testing.T, entries []FileEntry) {
+	t.Helper()
+	want := deepTreeEntries()
+	if len(entries) != len(want)+1 {
+		t.Fatalf("扫描得到 %d 个条目，应为 %d 个", len(entries), len(want)+1)
+	}
+	if entries[0].Type != TypeDir {
+		t.Fatalf("第一个条目应为根目录，实际为 %s (%s)", entries[0].RelPath, entries[0].Type)
+	}
+	for i, w := range want {
+		got := entries[i+1]
+		if got.RelPath != w.relPath || got.Type != w.typ {
+			t.Fatalf("第 %d 个条目为 %.60s…（%d 字节，%s），应为 %.60s…（%d 字节，%s）",
+				i+1, got.RelPath, len(got.RelPath), got.Type, w.relPath, len(w.relPath), w.typ)
+		}
+		link := got.LinkName
+		if got.Type == TypeSymlink {
+			link = got.LinkTarget
+		}
+		if link != w.link {
+			t.Errorf("%s: 链接为 %.60s，应为 %.60s", filepath.Base(got.RelPath), link, w.link)
+		}
+	}
+}
+
+// TestScanPathDeepTree 扫描超过 PATH_MAX 的目录树，检查相对路径
+func TestScanPathDeepTree(t *testing.T) {
+	root := t.TempDir()
+	makeDeepTree(t, root)
+	if len(deepTreeDir(deepTreeDepth-1)) < 2*unix.PathMax {
+		t.Fatalf("目录树的深度 %d 字节不足以覆盖分段处理", len(deepTreeDir(deepTreeDepth-1)))
+	}
+
+	entries, err := ScanPath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDeepTreeEntries(t, entries)
+
+	// 目录链和它最深的第一个子条目共享同一个路径字符串（assignRelPaths 的前缀共享）
+	deepest := entries[deepTreeDepth+1].RelPath
+	for i := 1; i <= deepTreeDepth; i++ {
+		path := entries[i].RelPath
+		if !strings.HasPrefix(deepest, path) || unsafe.StringData(path) != unsafe.StringData(deepest) {
+			t.Fatalf("第 %d 层目录的路径没有共享最深条目的路径", i-1)
+		}
+	}
+}
+
+// TestAssignRelPaths 链上的条目共享路径，链断开处（兄弟条目、回到上级目录）重新开始
+func TestAssignRelPaths(t *testing.T) {
+	scanned := []scannedEntry{
+		{entry: FileEntry{RelPath: ".", Type: TypeDir}, parent: -1},
+		{entry: FileEntry{RelPath: "a", Type: TypeDir}, parent: 0},
+		{entry: FileEntry{RelPath: "b", Type: TypeDir}, parent: 1},
+		{entry: FileEntry{RelPath: "f", Type: TypeFile}, parent: 2},
+		{entry: FileEntry{RelPath: "g", Type: TypeFile}, parent: 2},
+		{entry: FileEntry{RelPath: "c", Type: TypeDir}, parent: 1},
+		{entry: FileEntry{RelPath: "h", Type: TypeFile}, parent: 5},
+		{entry: FileEntry{RelPath: "z", Type: TypeFile}, parent: 0},
+	}
+	assignRelPaths(scanned)
+	want := []string{".", "a/", "a/b/", "a/b/f", "a/b/g", "a/c/", "a/c/h", "z"}
+	for i, w := range want {
+		if got := scanned[i].entry.RelPath; got != w {
+			t.Errorf("第 %d 个条目的路径为 %q，应为 %q", i, got, w)
+		}
+	}
+}
+
+// TestDeepTreeRoundTrip 打包并解包超过 PATH_MAX 的目录树，还原后的目录树与原来相同
+func TestDeepTreeRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	makeDeepTree(t, root)
+	out := t.TempDir()
+	archive := filepath.Join(out, "deep.bkup")
+	target := filepath.Join(out, "restore")
+	if err := PackWithOptions(root, archive, nil, PackOptions{Compress: true}); err != nil {
+		t.Fatalf("打包失败: %v", err)
+	}
+	if err := UnpackWithOptions(archive, target, PackOptions{}); err != nil {
+		t.Fatalf("解包失败: %v", err)
+	}
+
+	entries, err := ScanPath(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDeepTreeEntries(t, entries)
+	original, err := ScanPath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range original {
+		want, got := original[i], entries[i]
+		if got.Mode != want.Mode || got.Size != want.Size || got.ModTime != want.ModTime {
+			t.Errorf("%s: 权限、大小或修改时间与原来不同", filepath.Base(got.RelPath))
+		}
+	}
+
+	bottom := filepath.Join(target, deepTreeDir(deepTreeDepth-1))
+	for _, name := range []string{"deep.txt", "deep.hard", "deep.link"} {
+		f, err := openDeep(filepath.Join(bottom, name), unix.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("打开还原的 %s 失败: %v", name, err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(deepTreeContent) {
+			t.Errorf("还原的 %s 内容为 %q，应为 %q", name, data, deepTreeContent)
+		}
+	}
+}
+
+// TestDeviceNumbers 设备号的拆分与构造：合成的 Stat_t 经 fileEntryFromInfo 得到主次编号，mkdev 还原出原来的 st_rdev
+func TestDeviceNumbers(t *testing.T) {
+	tests := []struct {
+		name         string
+		rdev         uint64
+		major, minor int64
+	}{
+		{"零", 0, 0, 0},
+		{"sda1", 0x801, 8, 1},
+		{"pts", 0x8805, 136, 5},
+		{"旧布局的上限", 0xfffff, 0xfff, 0xff},
+		{"主编号超过 12 位", 0x100000000000, 0x1000, 0},
+		{"次编号超过 8 位", 0x100000, 0, 0x100},
+		{"device mapper 的大次编号", 0xfff0fdff, 253, 0xfffff},
+		{"次编号超过 20 位", 0x12300145, 1, 0x12345},
+		{"主次编号都为 32 位最大值", 0xffffffffffffffff, 0xffffffff, 0xffffffff},
+		{"主编号高位", 0xabcde00000000000 | 0x12300 | 0x45, 0xabcde123, 0x45},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []uint32{unix.S_IFCHR | 0620, unix.S_IFBLK | 0660} {
+				entry := fileEntryFromInfo("dev", newStatInfo("dev", &unix.Stat_t{Mode: mode, Rdev: tt.rdev}))
+				if entry.DevMajor != tt.major || entry.DevMinor != tt.minor {
+					t.Errorf("st_rdev 0x%x (mode 0%o): 主次编号为 (%d, %d)，应为 (%d, %d)",
+						tt.rdev, mode, entry.DevMajor, entry.DevMinor, tt.major, tt.minor)
+				}
+			}
+			if got := mkdev(tt.major, tt.minor); got != tt.rdev {
+				t.Errorf("mkdev(%d, %d) = 0x%x，应为 0x%x", tt.major, tt.minor, got, tt.rdev)
+			}
+			// 与 golang.org/x/sys/unix 的实现（同为 glibc 的布局）一致
+			if major, minor := unix.Major(tt.rdev), unix.Minor(tt.rdev); int64(major) != tt.major || int64(minor) != tt.minor {
+				t.Errorf("unix.Major/Minor(0x%x) = (%d, %d)，应为 (%d, %d)", tt.rdev, major, minor, tt.major, tt.minor)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// SecretPolicy 打包时对疑似敏感文件（私钥、凭据等）的处理策略
+type SecretPolicy int
+
+const (
+	SecretsIgnore  SecretPolicy = iota // 不检查（默认）
+	SecretsWarn                        // 检查并警告，照常打包
+	SecretsExclude                     // 检查并从归档中排除
+	SecretsDeny                        // 检查，发现敏感文件时拒绝打包（除非 AllowSecrets）
+)
+
+// ParseSecretPolicy 解析敏感文件处理策略名称: ignore, warn, exclude, deny
+func ParseSecretPolicy(s string) (SecretPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "ignore":
+		return SecretsIgnore, nil
+	case "warn":
+		return SecretsWarn, nil
+	case "exclude":
+		return SecretsExclude, nil
+	case "deny":
+		return SecretsDeny, nil
+	default:
+		return SecretsIgnore, fmt.Errorf("未知的敏感文件策略: %s", s)
+	}
+}
+
+// SecretFinding 一个疑似敏感文件
+type SecretFinding struct {
+	RelPath string // 条目路径
+	Reason  string // 判定原因
+}
+
+// secretNamePatterns 按文件名（或路径后缀）识别的敏感文件
+var secretNamePatterns = []struct {
+	pattern string
+	reason  string
+}{
+	{".env", "环境变量文件"},
+	{".env.*", "环境变量文件"},
+	{"id_rsa", "SSH 私钥"},
+	{"id_dsa", "SSH 私钥"},
+	{"id_ecdsa", "SSH 私钥"},
+	{"id_ed25519", "SSH 私钥"},
+	{"*.pem", "PEM 证书或密钥"},
+	{"*.key", "密钥文件"},
+	{"*.p12", "PKCS#12 密钥库"},
+	{"*.pfx", "PKCS#12 密钥库"},
+	{"*.jks", "Java 密钥库"},
+	{".netrc", "网络登录凭据"},
+	{".pgpass", "PostgreSQL 密码文件"},
+	{".git-credentials", "Git 凭据"},
+	{".aws/credentials", "AWS 凭据"},
+	{".docker/config.json", "Docker 仓库凭据"},
+	{".kube/config", "Kubernetes 凭据"},
+	{"application_default_credentials.json", "Google Cloud 凭据"},
+}
+
+// secretContentPatterns 按内容识别的敏感信息
+var secretContentPatterns = []struct {
+	re     *regexp.Regexp
+	reason string
+}{
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`), "包含私钥"},
+	{regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`), "包含 AWS 访问密钥"},
+	{regexp.MustCompile(`"type":\s*"service_account"`), "包含 Google Cloud 服务账号密钥"},
+}
+
+// secretScanLen 按内容检查时读取的最大字节数
+const secretScanLen = 64 * 1024
+
+// FindSecrets 检查条目列表中的疑似敏感文件
+// absRoot: 条目相对路径所基于的源根目录，用于读取文件内容
+func FindSecrets(absRoot string, entries []FileEntry) []SecretFinding {
+	var findings []SecretFinding
+	for _, entry := range entries {
+		if entry.Type != TypeFile && entry.Type != TypeHardlink {
+			continue
+		}
+		if reason := secretReason(absRoot, entry); reason != "" {
+			findings = append(findings, SecretFinding{RelPath: entry.RelPath, Reason: reason})
+		}
+	}
+	return findings
+}
+
+// secretReason 返回条目被判定为敏感文件的原因，不是敏感文件时返回空字符串
+func secretReason(absRoot string, entry FileEntry) string {
+	name := filepath.Base(entry.RelPath)
+	for _, p := range secretNamePatterns {
+		if strings.Contains(p.pattern, "/") {
+			if entry.RelPath == p.pattern || strings.HasSuffix(entry.RelPath, "/"+p.pattern) {
+				return p.reason
+			}
+			continue
+		}
+		if match, _ := filepath.Match(p.pattern, name); match {
+			return p.reason
+		}
+	}
+
+	f, err := openSourceFile(filepath.Join(absRoot, entry.RelPath))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, secretScanLen)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	// 跳过二进制文件
+	if bytes.IndexByte(head, 0) >= 0 {
+		return ""
+	}
+	for _, p := range secretContentPatterns {
+		if p.re.Match(head) {
+			return p.reason
+		}
+	}
+	return ""
+}
+
+// applySecretPolicy 按策略检查并处理疑似敏感文件
+func applySecretPolicy(absRoot string, entries []FileEntry, options PackOptions) ([]FileEntry, error) {
+	if options.SecretPolicy == SecretsIgnore {
+		return entries, nil
+	}
+	findings := FindSecrets(absRoot, entries)
+	if len(findings) == 0 {
+		return entries, nil
+	}
+
+	if options.SecretPolicy == SecretsDeny && !options.AllowSecrets {
+		var lines []string
+		for _, f := range findings {
+			lines = append(lines, fmt.Sprintf("  %s（%s）", f.RelPath, f.Reason))
+		}
+		return nil, fmt.Errorf("发现 %d 个疑似敏感文件，拒绝打包（确认无误后可允许打包敏感文件）:\n%s",
+			len(findings), strings.Join(lines, "\n"))
+	}
+
+	excluded := make(map[string]bool)
+	for _, f := range findings {
+		if options.SecretPolicy == SecretsExclude {
+			excluded[f.RelPath] = true
+			warn(options, "排除疑似敏感文件: %s（%s）", f.RelPath, f.Reason)
+		} else {
+			warn(options, "疑似敏感文件: %s（%s）", f.RelPath, f.Reason)
+		}
+	}
+	if len(excluded) == 0 {
+		return entries, nil
+	}
+
+	// 链接到被排除的文件的硬链接与它是同一个 inode、内容相同，一起排除，
+	// 否则 fixHardlinks 会把第一个硬链接提升为普通文件，敏感内容换个名字仍然写入归档
+	var kept []FileEntry
+	for _, entry := range entries {
+		if entry.Type == TypeHardlink && excluded[entry.LinkName] && !excluded[entry.RelPath] {
+			warn(options, "排除疑似敏感文件的硬链接: %s（链接到 %s）", entry.RelPath, entry.LinkName)
+			continue
+		}
+		if !excluded[entry.RelPath] {
+			kept = append(kept, entry)
+		}
+	}
+	// 被排除的硬链接可能是其他硬链接的目标（导入的外部归档）
+	return fixHardlinks(kept), nil
+}
+
+// warn 通过选项中的回调报告警告信息
+func warn(options PackOptions, format string, args ...interface{}) {
+	if options.Warn != nil {
+		options.Warn(fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,162 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// 小文件批量读取：打包大量很小的文件时，逐个 open/read/close 的系统调用和等待磁盘的时间远多于写入数据本身。
+// 写入归档必须按条目顺序进行，小文件的内容因此由后台的一组 worker 提前并行读入内存，
+// 写入条目时直接取用（smallFileReader.take），不再同步打开文件；预读的文件数有上限（smallFileWindow），
+// 内存占用不超过 smallFileWindow × smallFileLimit。
+// 只有一个 CPU 时 worker 的系统调用不能与写入重叠，预读反而增加协程切换的开销，默认不预读。
+// 预读同样用 openSourceFile 打开，扫描之后类型改变的文件照常跳过并警告；只读取扫描时记录的大小，
+// 文件变短时写入内容时与直接读取一样报错。转换、导入（openContent）、块存储和稀疏文件不预读。
+
+const (
+	smallFileLimit     = 16 * 1024 // 预读的文件大小上限
+	smallFileBatchSize = 64        // 每个 worker 一次读取的文件数（减少协程之间传递的次数）
+	smallFileWindow    = 16        // 已预读但还没有写入的批次数上限
+	smallFileWorkers   = 8         // 默认的预读 worker 数量（多核时）
+)
+
+// smallFile 一个预读的小文件
+type smallFile struct {
+	relPath string
+	size    int64
+	data    []byte
+	err     error
+}
+
+// smallFileBatch 一批按条目顺序连续的预读文件
+type smallFileBatch struct {
+	files []smallFile
+	done  chan struct{} // 整批读取完成时关闭
+}
+
+// smallFileReader 按条目顺序预读小文件
+type smallFileReader struct {
+	queue chan *smallFileBatch // 按条目顺序排队的批次
+	batch *smallFileBatch      // 正在取用的批次
+	pos   int                  // batch 中下一个要取用的文件
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// smallFileCandidate 条目是否由后台预读
+func smallFileCandidate(entry FileEntry, options PackOptions) bool {
+	return entry.Type == TypeFile && entry.Size > 0 && entry.Size <= smallFileLimit &&
+		options.openContent == nil && !chunkedEntry(entry, options) && !sparseCandidate(entry, options)
+}
+
+// newSmallFileReader 开始预读 entries 中的小文件，不预读或没有小文件时返回 nil
+func newSmallFileReader(absRoot string, entries []FileEntry, options PackOptions) *smallFileReader {
+	workers := options.ReadAhead
+	if workers == 0 && runtime.GOMAXPROCS(0) > 1 {
+		workers = smallFileWorkers
+	}
+	if workers <= 0 {
+		return nil
+	}
+	var batches []*smallFileBatch
+	var batch *smallFileBatch
+	for _, entry := range entries {
+		if !smallFileCandidate(entry, options) {
+			continue
+		}
+		if batch == nil || len(batch.files) == smallFileBatchSize {
+			batch = &smallFileBatch{files: make([]smallFile, 0, smallFileBatchSize), done: make(chan struct{})}
+			batches = append(batches, batch)
+		}
+		batch.files = append(batch.files, smallFile{relPath: entry.RelPath, size: entry.Size})
+	}
+	if len(batches) == 0 {
+		return nil
+	}
+
+	sr := &smallFileReader{
+		queue: make(chan *smallFileBatch, smallFileWindow),
+		stop:  make(chan struct{}),
+	}
+	jobs := make(chan *smallFileBatch)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for batch := range jobs {
+				for i := range batch.files {
+					file := &batch.files[i]
+					file.data, file.err = readSmallFile(filepath.Join(absRoot, file.relPath), file.size)
+				}
+				close(batch.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(sr.queue)
+		defer close(jobs)
+		for _, batch := range batches {
+			// 先排队再分发：队列满（写入跟不上）时暂停预读
+			select {
+			case sr.queue <- batch:
+			case <-sr.stop:
+				return
+			}
+			select {
+			case jobs <- batch:
+			case <-sr.stop:
+				close(batch.done)
+				return
+			}
+		}
+	}()
+	return sr
+}
+
+// readSmallFile 读取源文件的前 size 字节（文件变短时返回已读到的部分）
+func readSmallFile(path string, size int64) ([]byte, error) {
+	f, err := openSourceFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	n, err := io.ReadFull(f, data)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// take 取出条目预读的内容；条目不预读或不是队列中的下一个时 ok 为 false，由调用方直接读取
+func (sr *smallFileReader) take(entry FileEntry, options PackOptions) (data []byte, ok bool, err error) {
+	if sr == nil || !smallFileCandidate(entry, options) {
+		return nil, false, nil
+	}
+	if sr.batch == nil || sr.pos == len(sr.batch.files) {
+		batch, open := <-sr.queue
+		if !open {
+			sr.batch = nil
+			return nil, false, nil
+		}
+		sr.batch, sr.pos = batch, 0
+	}
+	file := &sr.batch.files[sr.pos]
+	if file.relPath != entry.RelPath {
+		return nil, false, nil
+	}
+	<-sr.batch.done
+	sr.pos++
+	data, err = file.data, file.err
+	file.data = nil
+	return data, true, err
+}
+
+// close 停止预读，已经开始的读取完成后 worker 退出
+func (sr *smallFileReader) close() {
+	if sr == nil {
+		return
+	}
+	sr.once.Do(func() { close(sr.stop) })
+}
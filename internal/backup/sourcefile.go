@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// 打包时读取源文件：扫描和打包之间源目录可能被修改，扫描时的普通文件可能被替换为 FIFO、套接字、
+// 设备或符号链接。普通的 open(2) 打开没有写入方的 FIFO 会一直阻塞，无人值守的备份因此挂起。
+// 所有读取源文件内容的地方都用 openSourceFile：以 O_NONBLOCK 打开（FIFO 立即返回，普通文件的读取不受影响），
+// O_NOFOLLOW 拒绝被替换为符号链接的路径，打开后用 fstat 确认仍是普通文件。
+// writeEntry 在写入条目之前这样打开源文件，之后的稀疏区域检测和内容读取都使用这个文件描述符；
+// 类型改变的条目跳过并警告，与套接字相同返回 errEntrySkipped，writeArchive 把它从条目列表中去掉，
+// 中央索引、.idx 和摘要文件都不包含它。
+
+// errSourceTypeChanged 源文件在扫描之后不再是普通文件
+var errSourceTypeChanged = errors.New("扫描之后已不是普通文件")
+
+// errEntrySkipped writeEntry 没有写入条目（套接字、扫描之后类型已改变的文件）
+var errEntrySkipped = errors.New("条目已跳过")
+
+// openSourceFile 打开源目录中的普通文件，类型已改变时返回包装 errSourceTypeChanged 的错误
+func openSourceFile(path string) (*os.File, error) {
+	f, err := openDeep(path, os.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		if errors.Is(err, unix.ELOOP) {
+			return nil, fmt.Errorf("%s %w（现在是 symlink）", path, errSourceTypeChanged)
+		}
+		if errors.Is(err, unix.ENXIO) {
+			// Unix 套接字不能打开（ENXIO）
+			return nil, fmt.Errorf("%s %w", path, errSourceTypeChanged)
+		}
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%s %w（现在是 %s）", path, errSourceTypeChanged, sourceTypeName(info.Mode()))
+	}
+	return f, nil
+}
+
+// sourceTypeName 返回文件模式对应的类型名称（与 FileType.String 一致）
+func sourceTypeName(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return TypeDir.String()
+	case mode&os.ModeNamedPipe != 0:
+		return TypeFifo.String()
+	case mode&os.ModeSocket != 0:
+		return TypeSocket.String()
+	case mode&os.ModeCharDevice != 0:
+		return TypeCharDevice.String()
+	case mode&os.ModeDevice != 0:
+		return TypeBlockDevice.String()
+	}
+	return mode.Type().String()
+}
@@ -0,0 +1,230 @@
+package backup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// 稀疏文件：扫描时占用的块少于文件大小的普通文件标记为 FileEntry.Sparse，
+// 打包时用 SEEK_DATA/SEEK_HOLE 找出有数据的区域，归档中只保存这些区域的内容（按顺序拼接），
+// 条目的大小字段为数据区域的总长度，文件大小和数据区域表记录在必需的 tlvSparse 元数据中。
+// 读取时空洞部分以 0 填充（test、verify、cat 看到的是完整的内容）；解包时只写入数据区域，
+// 再把文件截断到原来的大小，空洞不占用磁盘空间。
+// 文件系统不支持 SEEK_DATA、没有空洞或区域过多时按普通文件保存；保存在块存储中和单独加密的条目不按稀疏文件保存。
+
+// tlvSparse 稀疏文件：值为文件大小（uint64）+ 数据区域表（每个区域为偏移 uint64 + 长度 uint64）
+const tlvSparse = uint16(6) | tlvCritical
+
+// maxSparseExtents 数据区域数的上限，超过时按普通文件保存
+const maxSparseExtents = 65536
+
+// sparseExtent 稀疏文件中一个有数据的区域
+type sparseExtent struct {
+	offset int64
+	length int64
+}
+
+// findSparseExtents 找出文件中有数据的区域（只考虑前 size 字节）
+// 返回 nil 表示不按稀疏文件保存：不支持 SEEK_DATA、没有空洞或区域过多
+func findSparseExtents(path string, size int64) ([]sparseExtent, error) {
+	file, err := openSourceFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开源文件失败: %v", err)
+	}
+	defer file.Close()
+	return fileSparseExtents(file, size), nil
+}
+
+// fileSparseExtents 同 findSparseExtents，文件已经打开（打包时与读取内容共用一个文件描述符）
+func fileSparseExtents(file *os.File, size int64) []sparseExtent {
+	fd := int(file.Fd())
+	// 查找会移动文件位置，结束后回到开头，按普通文件保存时从头读取内容
+	defer unix.Seek(fd, 0, io.SeekStart)
+
+	extents := []sparseExtent{}
+	var dataSize int64
+	offset := int64(0)
+	for offset < size {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break // 之后全部是空洞
+		}
+		if err != nil {
+			return nil
+		}
+		if start >= size {
+			break
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil
+		}
+		if end > size {
+			end = size
+		}
+		if len(extents) == maxSparseExtents {
+			return nil
+		}
+		extents = append(extents, sparseExtent{offset: start, length: end - start})
+		dataSize += end - start
+		offset = end
+	}
+	if dataSize == size {
+		return nil
+	}
+	return extents
+}
+
+// sparseEntryExtents 返回打包时条目的数据区域，nil 表示按普通文件保存
+func sparseEntryExtents(entry FileEntry, absRoot string, options PackOptions) ([]sparseExtent, error) {
+	if !sparseCandidate(entry, options) {
+		return nil, nil
+	}
+	return findSparseExtents(filepath.Join(absRoot, entry.RelPath), entry.Size)
+}
+
+// sparseCandidate 条目是否可能按稀疏文件保存：保存在块存储中和单独加密的条目、不是从源目录读取的内容除外
+func sparseCandidate(entry FileEntry, options PackOptions) bool {
+	return entry.Sparse && entry.Type == TypeFile && options.openContent == nil &&
+		!chunkedEntry(entry, options) && !(entry.Encrypt && options.entryCipher != nil)
+}
+
+// sparseDataSize 返回数据区域的总长度
+func sparseDataSize(extents []sparseExtent) int64 {
+	var total int64
+	for _, extent := range extents {
+		total += extent.length
+	}
+	return total
+}
+
+// sparseTLV 返回 tlvSparse 的值
+func sparseTLV(size int64, extents []sparseExtent) []byte {
+	value := make([]byte, 0, 8+16*len(extents))
+	value = binary.LittleEndian.AppendUint64(value, uint64(size))
+	for _, extent := range extents {
+		value = binary.LittleEndian.AppendUint64(value, uint64(extent.offset))
+		value = binary.LittleEndian.AppendUint64(value, uint64(extent.length))
+	}
+	return value
+}
+
+// parseSparseTLV 解析 tlvSparse 的值，检查区域按顺序排列、互不重叠、不超出文件大小，且总长度等于 dataSize
+func parseSparseTLV(value []byte, dataSize int64) (int64, []sparseExtent, error) {
+	if len(value) < 8 || (len(value)-8)%16 != 0 {
+		return 0, nil, fmt.Errorf("稀疏文件信息长度无效 (%d 字节)", len(value))
+	}
+	size := int64(binary.LittleEndian.Uint64(value))
+	if size < 0 {
+		return 0, nil, fmt.Errorf("稀疏文件的大小无效")
+	}
+	extents := make([]sparseExtent, 0, (len(value)-8)/16)
+	var end, total int64
+	for i := 8; i < len(value); i += 16 {
+		extent := sparseExtent{
+			offset: int64(binary.LittleEndian.Uint64(value[i:])),
+			length: int64(binary.LittleEndian.Uint64(value[i+8:])),
+		}
+		if extent.offset < end || extent.length <= 0 || extent.length > size-extent.offset {
+			return 0, nil, fmt.Errorf("稀疏文件的数据区域表无效")
+		}
+		end = extent.offset + extent.length
+		total += extent.length
+		extents = append(extents, extent)
+	}
+	if total != dataSize {
+		return 0, nil, fmt.Errorf("稀疏文件的数据区域总长度与内容长度不符")
+	}
+	return size, extents, nil
+}
+
+// writeSparseContent 按顺序写入已打开的源文件中各数据区域的内容，size 为文件大小（空洞计入进度）
+func writeSparseContent(w io.Writer, file *os.File, size int64, extents []sparseExtent, counter *progressCounter, options PackOptions) error {
+	var offset int64
+	for _, extent := range extents {
+		counter.skip(extent.offset - offset)
+		section := io.NewSectionReader(file, extent.offset, extent.length)
+		if _, err := io.CopyN(w, withCancel(withProgress(section, counter), options), extent.length); err != nil {
+			return fmt.Errorf("写入文件内容失败: %v", err)
+		}
+		offset = extent.offset + extent.length
+	}
+	counter.skip(size - offset)
+	return nil
+}
+
+// sparseReader 读取稀疏文件条目的完整内容：数据区域之间以 0 填充
+type sparseReader struct {
+	data    io.Reader // 归档中拼接的数据区域
+	extents []sparseExtent
+	size    int64
+	offset  int64 // 已读取的逻辑位置
+}
+
+// newSparseReader 创建稀疏文件内容的读取器
+func newSparseReader(data io.Reader, extents []sparseExtent, size int64) *sparseReader {
+	return &sparseReader{data: data, extents: extents, size: size}
+}
+
+func (sr *sparseReader) Read(p []byte) (int, error) {
+	if sr.offset >= sr.size {
+		// 读完数据区域之后的内容校验值
+		if _, err := io.Copy(io.Discard, sr.data); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(sr.extents) > 0 && sr.offset >= sr.extents[0].offset+sr.extents[0].length {
+		sr.extents = sr.extents[1:]
+	}
+	// 空洞：填充 0 直到下一个数据区域或文件结尾
+	next := sr.size
+	if len(sr.extents) > 0 {
+		next = sr.extents[0].offset
+	}
+	if sr.offset < next {
+		n := len(p)
+		if int64(n) > next-sr.offset {
+			n = int(next - sr.offset)
+		}
+		clear(p[:n])
+		sr.offset += int64(n)
+		return n, nil
+	}
+	extent := sr.extents[0]
+	if remaining := extent.offset + extent.length - sr.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := sr.data.Read(p)
+	sr.offset += int64(n)
+	if err == io.EOF {
+		// 数据区域提前结束说明归档被截断；读到数据时下一次再判断
+		err = nil
+		if n == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// restoreSparseContent 只写入数据区域，再把文件截断到原来的大小，空洞不占用磁盘空间
+// r 为归档中拼接的数据区域
+func restoreSparseContent(file *os.File, r io.Reader, entry *entryData) error {
+	for _, extent := range entry.sparse {
+		if _, err := file.Seek(extent.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(file, r, extent.length); err != nil {
+			return err
+		}
+	}
+	return file.Truncate(entry.Size)
+}
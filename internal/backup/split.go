@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// splitRootName 源根目录下直接存放的文件（不属于任何子目录）所在归档的名称
+const splitRootName = "_root"
+
+// SplitArchive 按目录拆分打包时的一个归档
+type SplitArchive struct {
+	Name        string      // 一级子目录名称（根目录下的文件为 "_root"）
+	ArchivePath string      // 归档文件路径
+	Entries     []FileEntry // 归档中的条目
+}
+
+// PackSplitByDir 为源目录的每个一级子目录分别生成一个归档
+// outputTemplate: 归档路径模板，"{name}" 会被替换为子目录名；
+// 不含 "{name}" 时在扩展名前插入 "-子目录名"，例如 home.bkup -> home-alice.bkup
+// 条目路径仍相对于源目录，所有归档解包到同一目标目录即可还原完整目录树
+// 返回: 生成的归档文件路径列表
+func PackSplitByDir(root string, outputTemplate string, filter *Filter, options PackOptions) ([]string, error) {
+	start := time.Now()
+	options.quota = newQuotaTracker(options)
+	absRoot, splits, err := planSplitByDir(root, outputTemplate, filter, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeSplitArchives(absRoot, splits, filter, options, start)
+}
+
+// writeSplitArchives 生成各个拆分归档
+// options.Jobs > 1 时并行生成（并发数受 MemoryBudget 限制），各归档的进度汇总后回调 options.Progress
+// options.Summary、options.Index 时每个归档旁各写一个摘要文件、索引文件
+func writeSplitArchives(absRoot string, splits []SplitArchive, filter *Filter, options PackOptions, start time.Time) ([]string, error) {
+	jobs := splitJobs(options)
+
+	// 汇总进度：记录每个归档的已写入字节数
+	var mu sync.Mutex
+	done := make([]int64, len(splits))
+	var total, doneSum int64
+	for _, split := range splits {
+		if counter := newProgressCounter(split.Entries, func(int64, int64) {}); counter != nil {
+			total += counter.total
+		}
+	}
+
+	type result struct {
+		index int
+		err   error
+	}
+	indexes := make(chan int)
+	results := make(chan result)
+	for w := 0; w < jobs; w++ {
+		go func() {
+			for i := range indexes {
+				splitOptions := options
+				if options.Progress != nil {
+					i := i
+					splitOptions.Progress = func(d, _ int64) {
+						mu.Lock()
+						defer mu.Unlock()
+						doneSum += d - done[i]
+						done[i] = d
+						options.Progress(doneSum, total)
+					}
+				}
+				err := writeArchiveWithSidecars(splits[i].ArchivePath, absRoot, splits[i].Entries, filter, splitOptions, start)
+				results <- result{index: i, err: err}
+			}
+		}()
+	}
+	go func() {
+		for i := range splits {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	// 收集结果，返回已成功生成的归档（按拆分顺序）
+	succeeded := make([]bool, len(splits))
+	var firstErr error
+	for range splits {
+		res := <-results
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("打包 %s 失败: %v", splits[res.index].Name, res.err)
+			}
+			continue
+		}
+		succeeded[res.index] = true
+	}
+
+	var paths []string
+	for i, split := range splits {
+		if succeeded[i] {
+			paths = append(paths, split.ArchivePath)
+		}
+	}
+	return paths, firstErr
+}
+
+// splitJobs 计算拆分打包的并发数：不超过 Jobs，并受内存预算限制，至少为 1
+func splitJobs(options PackOptions) int {
+	jobs := options.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	if options.MemoryBudget > 0 {
+		if byBudget := int(options.MemoryBudget / pipelineMemory(options)); byBudget < jobs {
+			jobs = byBudget
+		}
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	return jobs
+}
+
+// pipelineMemory 估算一个打包流水线占用的内存（缓冲区、压缩器和加密缓冲）
+func pipelineMemory(options PackOptions) int64 {
+	mem := int64(bufferSize(options))
+	if options.Compress {
+		// 并行压缩时同时在处理中的块（明文和压缩结果），以及每个 worker 的压缩器（窗口和哈希表）
+		workers := int64(compressionWorkers(options.Threads))
+		mem += (2*workers+1)*2*blockCompressSize + workers*1024*1024
+	}
+	if options.Encrypt {
+		// 加密缓冲块和密文
+		mem += 2 * 64 * 1024
+	}
+	return mem
+}
+
+// planSplitByDir 扫描源目录并按一级子目录分组，返回每个分组的归档计划
+func planSplitByDir(root string, outputTemplate string, filter *Filter, options PackOptions) (string, []SplitArchive, error) {
+	absRoot, entries, err := collectEntries(root, filter, options)
+	if err != nil {
+		return "", nil, err
+	}
+
+	groups := make(map[string][]FileEntry)
+	for _, entry := range entries {
+		name := topLevelName(entry)
+		groups[name] = append(groups[name], entry)
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	splits := make([]SplitArchive, 0, len(names))
+	for _, name := range names {
+		splits = append(splits, SplitArchive{
+			Name:        name,
+			ArchivePath: splitArchivePath(outputTemplate, name),
+			// 跨子目录的硬链接在各自的归档中需要独立成立
+			Entries: fixHardlinks(groups[name]),
+		})
+	}
+	return absRoot, splits, nil
+}
+
+// topLevelName 返回条目所属的一级子目录名，根目录本身和根目录下的非目录条目归入 "_root"
+func topLevelName(entry FileEntry) string {
+	path := strings.TrimSuffix(entry.RelPath, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	if entry.Type == TypeDir && path != "." {
+		return path
+	}
+	return splitRootName
+}
+
+// splitArchivePath 根据模板生成子目录对应的归档路径
+func splitArchivePath(template, name string) string {
+	if strings.Contains(template, "{name}") {
+		return strings.ReplaceAll(template, "{name}", name)
+	}
+	ext := filepath.Ext(template)
+	return strings.TrimSuffix(template, ext) + "-" + name + ext
+}
@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// streamHashInterval 流校验的块大小：每写入这么多字节插入一个校验值
+const streamHashInterval = 16 * 1024 * 1024
+
+// streamHashSize 每个校验值的长度（SHA-256）
+const streamHashSize = sha256.Size
+
+// 流校验层位于文件头之后、加密层之下，对归档文件的原始字节分块校验：
+// 每 streamHashInterval 字节数据之后跟一个链式 SHA-256 校验值
+// hash[i] = SHA-256(hash[i-1] || data[i])，hash[-1] 为全零；
+// 最后一块（可能为空）之后总是有一个校验值，用于发现截断。
+// 读取时每读完一块立即校验，传输中或磁盘上的损坏可以尽早发现并报告大致的偏移位置
+
+// streamHashWriter 写入带分块校验值的数据流
+type streamHashWriter struct {
+	writer  io.Writer
+	prev    [streamHashSize]byte // 上一块的校验值
+	written int                  // 当前块已写入的字节数
+	hash    hash.Hash
+}
+
+// newStreamHashWriter 创建流校验写入器
+func newStreamHashWriter(w io.Writer) *streamHashWriter {
+	sw := &streamHashWriter{writer: w, hash: sha256.New()}
+	sw.hash.Write(sw.prev[:])
+	return sw
+}
+
+func (sw *streamHashWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n := streamHashInterval - sw.written
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := sw.writer.Write(p[:n]); err != nil {
+			return total, err
+		}
+		sw.hash.Write(p[:n])
+		sw.written += n
+		total += n
+		p = p[n:]
+
+		if sw.written == streamHashInterval {
+			if err := sw.writeHash(); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// writeHash 结束当前块，写入校验值
+func (sw *streamHashWriter) writeHash() error {
+	sum := sw.hash.Sum(nil)
+	if _, err := sw.writer.Write(sum); err != nil {
+		return err
+	}
+	copy(sw.prev[:], sum)
+	sw.hash.Reset()
+	sw.hash.Write(sw.prev[:])
+	sw.written = 0
+	return nil
+}
+
+// Close 写入最后一块的校验值（不关闭底层写入器）
+func (sw *streamHashWriter) Close() error {
+	return sw.writeHash()
+}
+
+// streamHashReader 读取并逐块校验带校验值的数据流
+type streamHashReader struct {
+	reader io.Reader
+	prev   [streamHashSize]byte
+	block  []byte // 当前块中尚未返回的数据
+	buffer []byte
+	index  int64 // 下一块的序号
+	offset int64 // 流校验层在归档文件中的起始偏移
+	done   bool
+}
+
+// newStreamHashReader 创建流校验读取器，offset 为流校验数据在归档文件中的起始位置（用于报告损坏位置）
+func newStreamHashReader(r io.Reader, offset int64) *streamHashReader {
+	return &streamHashReader{
+		reader: r,
+		buffer: make([]byte, streamHashInterval+streamHashSize),
+		offset: offset,
+	}
+}
+
+func (sr *streamHashReader) Read(p []byte) (int, error) {
+	for len(sr.block) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+		if err := sr.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, sr.block)
+	sr.block = sr.block[n:]
+	return n, nil
+}
+
+// nextBlock 读取并校验下一块
+func (sr *streamHashReader) nextBlock() error {
+	start := sr.offset + sr.index*int64(len(sr.buffer))
+	n, err := io.ReadFull(sr.reader, sr.buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("读取第 %d 块（偏移 %d）失败: %v", sr.index, start, err)
+	}
+	if n < streamHashSize {
+		return fmt.Errorf("归档在偏移 %d 处被截断（缺少第 %d 块的校验值）", start+int64(n), sr.index)
+	}
+	if n < len(sr.buffer) {
+		// 不满一块：最后一块
+		sr.done = true
+	}
+
+	data := sr.buffer[:n-streamHashSize]
+	h := sha256.New()
+	h.Write(sr.prev[:])
+	h.Write(data)
+	sum := h.Sum(nil)
+	if !bytes.Equal(sum, sr.buffer[n-streamHashSize:n]) {
+		return fmt.Errorf("归档损坏: 第 %d 块校验失败（偏移 %d - %d）", sr.index, start, start+int64(n))
+	}
+	copy(sr.prev[:], sum)
+	sr.block = data
+	sr.index++
+	return nil
+}
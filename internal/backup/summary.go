@@ -0,0 +1,301 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 大小统计的规则（scan、du 的汇总与 pack 的进度、摘要一致）：只统计普通文件和块设备镜像的内容，
+// 目录、符号链接、设备文件、FIFO 和套接字计为 0 字节，只计入条目数。符号链接从不跟随，既不计链接目标的大小，
+// 也不计链接本身；硬链接的多个路径共享一份内容，只在第一个路径（普通文件条目）计算一次，其余的硬链接条目计为 0，与 du 相同。
+// 文件的大小有两种统计方式（UsageMode）：
+//   - apparent：文件大小（st_size），对应 du --apparent-size
+//   - blocks：实际占用的磁盘块（st_blocks × 512），对应 du 的默认方式：稀疏文件的空洞和文件系统压缩节省的空间不计入，
+//     小文件按块向上取整。归档中没有记录占用的块，按 4KB 的块估算解包后占用的空间（FileEntry.Blocks；
+//     du 使用的条目表中没有稀疏文件的数据区域，稀疏文件按完整大小估算）
+// du 还计入目录本身和符号链接本身占用的空间，因此 du 报告的总量略大。
+
+// summaryTopN ScanSummary 中保留的最大文件数和最深路径数
+const summaryTopN = 10
+
+// usageBlockSize 估算归档中的文件占用的磁盘块时使用的块大小
+const usageBlockSize = 4096
+
+// UsageMode 文件大小的统计方式
+type UsageMode string
+
+const (
+	// UsageApparent 文件大小（st_size）
+	UsageApparent UsageMode = "apparent"
+	// UsageBlocks 实际占用的磁盘块（st_blocks × 512）
+	UsageBlocks UsageMode = "blocks"
+)
+
+// ParseUsageMode 解析统计方式，空串为 apparent
+func ParseUsageMode(s string) (UsageMode, error) {
+	switch mode := UsageMode(s); mode {
+	case "":
+		return UsageApparent, nil
+	case UsageApparent, UsageBlocks:
+		return mode, nil
+	}
+	return "", fmt.Errorf("未知的统计方式: %s（可选 %s, %s）", s, UsageApparent, UsageBlocks)
+}
+
+// UnmarshalText 解析过滤文件中的 size_mode，未知的统计方式返回错误
+func (m *UsageMode) UnmarshalText(text []byte) error {
+	mode, err := ParseUsageMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// entryUsage 返回扫描得到的条目按统计方式计入的字节数
+func entryUsage(entry FileEntry, mode UsageMode) int64 {
+	switch {
+	case entry.Type == TypeFile && mode == UsageBlocks:
+		return entry.Blocks
+	case entry.Type == TypeFile:
+		return entry.Size
+	case entry.Type == TypeImage && mode == UsageBlocks:
+		return estimatedBlocks(entry.Size)
+	case entry.Type == TypeImage:
+		return entry.Size
+	}
+	return 0
+}
+
+// estimatedBlocks 按 4KB 的块向上取整，估算写出 size 字节的文件占用的磁盘空间
+func estimatedBlocks(size int64) int64 {
+	return (size + usageBlockSize - 1) / usageBlockSize * usageBlockSize
+}
+
+// ScanSummary 扫描结果的汇总统计
+type ScanSummary struct {
+	Mode         UsageMode        // 文件大小的统计方式
+	TotalEntries int              // 条目总数
+	TypeCounts   map[FileType]int // 各文件类型的条目数
+	TotalBytes   int64            // 普通文件的总字节数（硬链接只计一次）
+	LargestFiles []FileUsage      // 最大的文件（按大小降序）
+	MaxDepth     int              // 最大目录深度（根目录下的条目深度为 1）
+	DeepestPaths []string         // 最深的路径（按深度降序）
+}
+
+// Summarize 计算扫描得到的条目列表的汇总统计
+func Summarize(entries []FileEntry, mode UsageMode) ScanSummary {
+	summary := ScanSummary{
+		Mode:         mode,
+		TotalEntries: len(entries),
+		TypeCounts:   make(map[FileType]int),
+	}
+
+	var files []FileEntry
+	type pathDepth struct {
+		path  string
+		depth int
+	}
+	var depths []pathDepth
+
+	for _, entry := range entries {
+		summary.TypeCounts[entry.Type]++
+		if entry.Type == TypeFile || entry.Type == TypeImage {
+			summary.TotalBytes += entryUsage(entry, mode)
+			files = append(files, entry)
+		}
+		if entry.RelPath == "." {
+			continue
+		}
+		depth := pathDepthOf(entry.RelPath)
+		if depth > summary.MaxDepth {
+			summary.MaxDepth = depth
+		}
+		depths = append(depths, pathDepth{entry.RelPath, depth})
+	}
+
+	summary.LargestFiles, _ = TopUsage(files, summaryTopN, mode)
+
+	sort.SliceStable(depths, func(i, j int) bool {
+		return depths[i].depth > depths[j].depth
+	})
+	for i := 0; i < len(depths) && i < summaryTopN; i++ {
+		summary.DeepestPaths = append(summary.DeepestPaths, depths[i].path)
+	}
+
+	return summary
+}
+
+// FileUsage 文件占用的空间
+type FileUsage struct {
+	Path string // 文件的规范路径
+	Size int64  // 按统计方式计入的字节数
+}
+
+// DirUsage 目录占用的空间（目录下所有文件大小之和，递归统计）
+type DirUsage struct {
+	Path  string // 目录的规范路径，例如 "sub/"
+	Size  int64  // 目录下所有文件的总字节数
+	Files int    // 目录下的文件数（包括只计一次内容的硬链接）
+}
+
+// TopUsage 返回扫描得到的条目中最大的 n 个文件和占用空间最大的 n 个目录（均按大小降序）
+// 目录大小按其下所有文件计入的字节数递归累加；blocks 方式使用扫描时记录的 FileEntry.Blocks
+func TopUsage(entries []FileEntry, n int, mode UsageMode) ([]FileUsage, []DirUsage) {
+	return topUsage(entrySlice(entries), n, func(i int) int64 {
+		return entryUsage(entries[i], mode)
+	})
+}
+
+// TopUsageTable 与 TopUsage 相同，统计按列存储的归档条目表（只保留最大的 n 个文件，不复制全部条目）
+// 归档中没有记录占用的块，blocks 方式按 4KB 的块估算
+func TopUsageTable(table *EntryTable, n int, mode UsageMode) ([]FileUsage, []DirUsage) {
+	return topUsage(table, n, func(i int) int64 {
+		switch t := table.Type(i); {
+		case t != TypeFile && t != TypeImage:
+			return 0
+		case mode == UsageBlocks:
+			return estimatedBlocks(table.Size(i))
+		}
+		return table.Size(i)
+	})
+}
+
+// usageSource topUsage 统计的条目（[]FileEntry 或 EntryTable）
+type usageSource interface {
+	Len() int
+	Type(i int) FileType
+	Path(i int) string
+}
+
+// entrySlice 将 []FileEntry 适配为 usageSource
+type entrySlice []FileEntry
+
+func (es entrySlice) Len() int            { return len(es) }
+func (es entrySlice) Type(i int) FileType { return es[i].Type }
+func (es entrySlice) Path(i int) string   { return es[i].RelPath }
+
+// topUsage 统计文件（普通文件、硬链接和镜像），sizeOf 返回第 i 个条目计入的字节数
+// 硬链接计入所在目录的文件数，但不列入最大的文件（内容已经计入链接到的文件）
+func topUsage(source usageSource, n int, sizeOf func(i int) int64) ([]FileUsage, []DirUsage) {
+	var top []FileUsage // 目前最大的文件（按大小降序，大小相同时先出现的在前）
+	dirs := make(map[string]*DirUsage)
+
+	for i := 0; i < source.Len(); i++ {
+		t := source.Type(i)
+		if t != TypeFile && t != TypeHardlink && t != TypeImage {
+			continue
+		}
+		size := sizeOf(i)
+		if t != TypeHardlink {
+			if pos := sort.Search(len(top), func(j int) bool { return top[j].Size < size }); pos < n {
+				top = append(top, FileUsage{})
+				copy(top[pos+1:], top[pos:])
+				top[pos] = FileUsage{Path: source.Path(i), Size: size}
+				if len(top) > n {
+					top = top[:n]
+				}
+			}
+		}
+
+		// 累加到所有祖先目录
+		path := strings.TrimSuffix(source.Path(i), "/")
+		for cut := strings.LastIndex(path, "/"); cut >= 0; cut = strings.LastIndex(path, "/") {
+			path = path[:cut]
+			usage, exists := dirs[path]
+			if !exists {
+				usage = &DirUsage{Path: path + "/"}
+				dirs[path] = usage
+			}
+			usage.Size += size
+			usage.Files++
+		}
+	}
+
+	dirList := make([]DirUsage, 0, len(dirs))
+	for _, usage := range dirs {
+		dirList = append(dirList, *usage)
+	}
+	sort.Slice(dirList, func(i, j int) bool {
+		if dirList[i].Size != dirList[j].Size {
+			return dirList[i].Size > dirList[j].Size
+		}
+		return dirList[i].Path < dirList[j].Path
+	})
+	if len(dirList) > n {
+		dirList = dirList[:n]
+	}
+
+	return top, dirList
+}
+
+// ArchiveEntries 读取归档中所有条目的元信息（不解包内容），支持的格式与 WalkArchive 相同
+// options: 解包选项（加密归档需要密码）
+// 归档旁有索引文件（"<归档>.idx"）时直接读取索引：远程归档只需下载索引，
+// 本地归档的大小与索引记录的不一致时视为索引过期；要求校验摘要时总是读取整个归档
+// 条目很多时使用 ArchiveEntryTable，内存占用小得多
+func ArchiveEntries(archivePath string, options PackOptions) ([]FileEntry, error) {
+	table, err := ArchiveEntryTable(archivePath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer table.Close()
+	return table.Entries(), nil
+}
+
+// ArchiveEntryTable 与 ArchiveEntries 相同，但返回按列存储的条目表，用完后调用 Close
+// 本地未加密的索引直接映射到内存；没有索引时逐个条目读取并追加到表中
+func ArchiveEntryTable(archivePath string, options PackOptions) (*EntryTable, error) {
+	if options.SHA256 == "" {
+		if table, ok := tableFromIndex(archivePath, options); ok {
+			return table, nil
+		}
+	}
+
+	table := &EntryTable{}
+	err := WalkArchive(archivePath, options, func(entry FileEntry) error {
+		table.Append(entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// ScanSummaryOf 扫描路径并返回汇总统计
+// filter: 可选的过滤条件，统计的是过滤后实际会被打包的条目
+// mode: 文件大小的统计方式
+func ScanSummaryOf(root string, filter *Filter, mode UsageMode) (ScanSummary, error) {
+	entries, err := ScanPath(root)
+	if err != nil {
+		return ScanSummary{}, err
+	}
+	if filter != nil {
+		entries = ApplyFilter(entries, filter)
+	}
+	return Summarize(entries, mode), nil
+}
+
+// pathDepthOf 计算规范路径的深度，例如 "a/b/c.txt" 为 3，"a/" 为 1
+func pathDepthOf(relPath string) int {
+	return strings.Count(strings.TrimSuffix(relPath, "/"), "/") + 1
+}
+
+// tableFromIndex 尝试从索引文件读取条目，索引不存在、无法读取或已过期时返回 false
+func tableFromIndex(archivePath string, options PackOptions) (*EntryTable, bool) {
+	table, header, err := readIndex(archivePath, options)
+	if err != nil {
+		return nil, false
+	}
+	if !IsURL(archivePath) {
+		info, err := os.Stat(archivePath)
+		if err != nil || info.Size() != header.ArchiveBytes {
+			table.Close()
+			return nil, false
+		}
+	}
+	return table, true
+}
@@ -0,0 +1,190 @@
+package backup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// 格式版本 versionTLV 起，每个条目的固定字段之后是一组可选的 TLV 元数据块，之后才是文件内容：
+//
+//	标签(uint16) 长度(uint32) 值(长度字节) ... 标签 0（结束）
+//
+// 新的元数据只需要分配新标签，不改变固定字段的布局。
+// 读取时跳过不认识的标签；但设置了 tlvCritical 位的标签会改变内容的解释方式，
+// 不认识时必须报错，而不是还原出错误的文件。
+// 其他标签与使用它们的功能定义在一起：tlvEntryCipher（entryencrypt.go）、tlvPackages（packages.go）、tlvIncremental（incremental.go）、tlvChunked（chunkstore.go）、tlvSparse（sparse.go）、tlvXattrs（xattr.go）。
+const (
+	tlvEnd      = uint16(0)      // TLV 列表结束
+	tlvMime     = uint16(1)      // 内容类型（字符串）
+	tlvCritical = uint16(0x8000) // 必需标签位：读取方不认识时不能跳过
+)
+
+// maxTLVLen 单个 TLV 值的最大长度，防止损坏的归档导致超大内存分配
+const maxTLVLen = 16 * 1024 * 1024
+
+// writeTLV 写入一个 TLV 块
+func writeTLV(w io.Writer, tag uint16, value []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, tag); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(value))); err != nil {
+		return err
+	}
+	_, err := w.Write(value)
+	return err
+}
+
+// writeEntryTLVs 写入条目的 TLV 元数据块和结束标签
+// extents: 稀疏文件的数据区域，nil 表示不是按稀疏文件保存的条目
+func writeEntryTLVs(w io.Writer, entry FileEntry, extents []sparseExtent, options PackOptions) error {
+	if entry.Mime != "" {
+		if err := writeTLV(w, tlvMime, []byte(entry.Mime)); err != nil {
+			return err
+		}
+	}
+	if entry.Encrypt && options.entryCipher != nil {
+		if err := writeTLV(w, tlvEntryCipher, options.entryCipher.tlv(entry.Size)); err != nil {
+			return err
+		}
+	}
+	if chunkedEntry(entry, options) {
+		value := binary.LittleEndian.AppendUint64(nil, uint64(entry.Size))
+		if err := writeTLV(w, tlvChunked, value); err != nil {
+			return err
+		}
+	}
+	if extents != nil {
+		if err := writeTLV(w, tlvSparse, sparseTLV(entry.Size, extents)); err != nil {
+			return err
+		}
+	}
+	if len(entry.Xattrs) > 0 && entry.Type != TypeHardlink {
+		if err := writeTLV(w, tlvXattrs, xattrsTLV(entry.Xattrs)); err != nil {
+			return err
+		}
+	}
+	if entry.RelPath == "." && options.packages != nil {
+		if err := writeTLV(w, tlvPackages, options.packages); err != nil {
+			return err
+		}
+	}
+	if entry.RelPath == "." && options.incremental != nil {
+		if err := writeTLV(w, tlvIncremental, options.incremental); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, tlvEnd)
+}
+
+// readEntryTLVs 读取条目的 TLV 元数据块直到结束标签
+func readEntryTLVs(r io.Reader, entry *entryData) error {
+	for {
+		var tag uint16
+		if err := binary.Read(r, binary.LittleEndian, &tag); err != nil {
+			return err
+		}
+		if tag == tlvEnd {
+			return nil
+		}
+		var length uint32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return err
+		}
+		if length > maxTLVLen {
+			return fmt.Errorf("元数据块过大 (标签 %#x, %d 字节)，归档可能已损坏", tag, length)
+		}
+
+		switch tag {
+		case tlvMime:
+			value := make([]byte, length)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			entry.Mime = string(value)
+		case tlvPackages:
+			value := make([]byte, length)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			entry.packages = value
+		case tlvIncremental:
+			value := make([]byte, length)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			entry.incremental = value
+		case tlvXattrs:
+			value := make([]byte, length)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			xattrs, err := parseXattrsTLV(value)
+			if err != nil {
+				return fmt.Errorf("条目 %s 的%v，归档可能已损坏", entry.RelPath, err)
+			}
+			entry.xattrs = xattrs
+		case tlvEntryCipher:
+			if entry.encoded() {
+				return fmt.Errorf("条目 %s 的内容编码信息重复，归档可能已损坏", entry.RelPath)
+			}
+			if length != entryCipherLen && length != entryCipherLegacyLen {
+				return fmt.Errorf("条目 %s 的加密信息长度无效 (%d 字节)", entry.RelPath, length)
+			}
+			value := make([]byte, length)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			// 大小字段记录的是密文长度
+			entry.storedSize = entry.Size
+			entry.Size = int64(binary.LittleEndian.Uint64(value))
+			entry.Encrypted = true
+			entry.keyRecord = value[8:]
+			if entry.Size < 0 || encryptedContentSize(entry.Size) != entry.storedSize {
+				return fmt.Errorf("条目 %s 的明文大小与密文长度不符，归档可能已损坏", entry.RelPath)
+			}
+		case tlvChunked:
+			if entry.encoded() {
+				return fmt.Errorf("条目 %s 的内容编码信息重复，归档可能已损坏", entry.RelPath)
+			}
+			if length != 8 {
+				return fmt.Errorf("条目 %s 的块存储信息长度无效 (%d 字节)", entry.RelPath, length)
+			}
+			value := make([]byte, length)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			// 大小字段记录的是块列表的长度
+			entry.storedSize = entry.Size
+			entry.Size = int64(binary.LittleEndian.Uint64(value))
+			entry.chunked = true
+			if entry.Size < 0 || entry.storedSize%chunkRefSize != 0 || entry.storedSize/chunkRefSize*chunkMaxSize < entry.Size {
+				return fmt.Errorf("条目 %s 的明文大小与块列表长度不符，归档可能已损坏", entry.RelPath)
+			}
+		case tlvSparse:
+			if entry.encoded() {
+				return fmt.Errorf("条目 %s 的内容编码信息重复，归档可能已损坏", entry.RelPath)
+			}
+			value := make([]byte, length)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			// 大小字段记录的是数据区域的总长度
+			size, extents, err := parseSparseTLV(value, entry.Size)
+			if err != nil {
+				return fmt.Errorf("条目 %s 的%v，归档可能已损坏", entry.RelPath, err)
+			}
+			entry.storedSize = entry.Size
+			entry.Size = size
+			entry.sparse = extents
+		default:
+			if tag&tlvCritical != 0 {
+				return fmt.Errorf("条目 %s 包含不支持的必需元数据 (标签 %#x)，需要更新版本的程序", entry.RelPath, tag)
+			}
+			// 跳过不认识的可选元数据
+			if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+				return err
+			}
+		}
+	}
+}
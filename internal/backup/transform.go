@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrDropEntry 由 TransformFunc 返回，表示不打包该条目
+var ErrDropEntry = errors.New("丢弃条目")
+
+// TransformFunc 打包时改写一个普通文件的内容：从 src 读取原始内容，将改写后的内容写入 dst
+// 返回 ErrDropEntry 时不打包该条目（指向它的硬链接也一起丢弃），返回其他错误时中止打包
+type TransformFunc func(entry FileEntry, src io.Reader, dst io.Writer) error
+
+// TransformFilter 为每个普通文件选择内容转换（例如清除配置文件中的密钥、只保留日志的最后 N 行），
+// 返回 nil 表示按原样打包
+type TransformFilter func(entry FileEntry) TransformFunc
+
+// 转换后的内容先写入临时目录，得到实际大小后再写入归档：条目的大小字段位于内容之前，
+// 而转换结果的长度在转换完成之前未知。只有被转换的文件占用临时空间
+
+// applyTransforms 按 options.Transform 转换条目内容
+// 返回: 转换后的条目列表、读取转换结果的打包选项，以及删除临时文件的清理函数
+func applyTransforms(absRoot string, entries []FileEntry, options PackOptions) ([]FileEntry, PackOptions, func(), error) {
+	noop := func() {}
+	if options.Transform == nil {
+		return entries, options, noop, nil
+	}
+
+	var spoolDir string
+	cleanup := func() {
+		if spoolDir != "" {
+			os.RemoveAll(spoolDir)
+		}
+	}
+	spooled := make(map[string]string) // 条目路径 -> 转换结果的临时文件
+	sizes := make(map[string]int64)     // 条目路径 -> 转换后的大小
+	dropped := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Type != TypeFile {
+			continue
+		}
+		transform := options.Transform(entry)
+		if transform == nil {
+			continue
+		}
+		if spoolDir == "" {
+			dir, err := os.MkdirTemp("", "backup-transform-")
+			if err != nil {
+				return nil, options, noop, fmt.Errorf("创建临时目录失败: %v", err)
+			}
+			spoolDir = dir
+		}
+		spoolPath := filepath.Join(spoolDir, strconv.Itoa(len(spooled)))
+		size, err := transformEntry(entry, absRoot, spoolPath, transform, options)
+		if err == ErrDropEntry {
+			os.Remove(spoolPath)
+			dropped[entry.RelPath] = true
+			continue
+		}
+		if err != nil {
+			cleanup()
+			return nil, options, noop, fmt.Errorf("转换文件内容失败 (%s): %v", entry.RelPath, err)
+		}
+		spooled[entry.RelPath] = spoolPath
+		sizes[entry.RelPath] = size
+	}
+
+	result := make([]FileEntry, 0, len(entries))
+	for _, entry := range entries {
+		if dropped[entry.RelPath] {
+			continue
+		}
+		if entry.Type == TypeHardlink {
+			if dropped[entry.LinkName] {
+				warn(options, "跳过硬链接 %s：链接的文件 %s 已被转换丢弃", entry.RelPath, entry.LinkName)
+				continue
+			}
+			if size, ok := sizes[entry.LinkName]; ok {
+				entry.Size = size
+			}
+		}
+		if size, ok := sizes[entry.RelPath]; ok {
+			entry.Size = size
+		}
+		result = append(result, entry)
+	}
+
+	// 转换过的文件从临时文件读取，其他文件仍按原来的方式读取
+	open := options.openContent
+	options.openContent = func(entry FileEntry) (io.ReadCloser, error) {
+		if path, ok := spooled[entry.RelPath]; ok {
+			return os.Open(path)
+		}
+		if open != nil {
+			return open(entry)
+		}
+		return openSourceFile(filepath.Join(absRoot, entry.RelPath))
+	}
+	return result, options, cleanup, nil
+}
+
+// transformEntry 转换一个文件的内容并写入 spoolPath，返回转换后的大小
+func transformEntry(entry FileEntry, absRoot string, spoolPath string, transform TransformFunc, options PackOptions) (int64, error) {
+	src, err := openEntryContent(entry, absRoot, options)
+	if err != nil {
+		return 0, fmt.Errorf("打开源文件失败: %v", err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(spoolPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	counter := &offsetWriter{writer: dst}
+	if err := transform(entry, io.LimitReader(src, entry.Size), counter); err != nil {
+		dst.Close()
+		return 0, err
+	}
+	if err := dst.Close(); err != nil {
+		return 0, fmt.Errorf("写入临时文件失败: %v", err)
+	}
+	return counter.offset, nil
+}
@@ -1,5 +1,11 @@
 package backup
 
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
 // FileType 表示文件类型
 type FileType int
 
@@ -12,30 +18,136 @@ const (
 	TypeCharDevice           // 字符设备
 	TypeBlockDevice          // 块设备
 	TypeSocket               // Unix 套接字
+	TypeImage                // 块设备镜像（设备的原始内容）
 )
 
+// String 返回文件类型名称（与命令行 -types 参数使用的名称一致）
+func (t FileType) String() string {
+	switch t {
+	case TypeFile:
+		return "file"
+	case TypeDir:
+		return "dir"
+	case TypeSymlink:
+		return "symlink"
+	case TypeHardlink:
+		return "hardlink"
+	case TypeFifo:
+		return "fifo"
+	case TypeCharDevice:
+		return "chardev"
+	case TypeBlockDevice:
+		return "blockdev"
+	case TypeSocket:
+		return "socket"
+	case TypeImage:
+		return "image"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// MarshalText 以类型名称编码（JSON 中输出 "file" 而不是数字）
+func (t FileType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText 从类型名称解码
+func (t *FileType) UnmarshalText(text []byte) error {
+	parsed, ok := fileTypeNames[string(text)]
+	if !ok {
+		return fmt.Errorf("未知的文件类型: %s", text)
+	}
+	*t = parsed
+	return nil
+}
+
 // FileEntry 表示一个文件/目录的元信息
 type FileEntry struct {
-	RelPath    string   // 相对于扫描根目录的相对路径，例如 "sub/a.txt"
+	RelPath    string   // 相对于扫描根目录的相对路径（规范形式：使用 "/" 分隔，目录以 "/" 结尾，根目录为 "."），例如 "sub/a.txt"、"sub/"
 	Type       FileType // 文件类型
 	Mode       uint32   // 权限（从 os.FileMode 转换而来）
 	Size       int64    // 文件大小（目录、链接、设备文件为 0）
+	Blocks     int64    // 普通文件实际占用的磁盘空间：扫描时为 st_blocks × 512 字节；归档中不保存，从归档读取或导入的条目按 4KB 的块估算
 	ModTime    int64    // 修改时间（Unix 时间戳，秒）
 	AccessTime int64    // 访问时间（Unix 时间戳，秒）
 	ChangeTime int64    // 状态改变时间（Unix 时间戳，秒）
 	UID        int      // 用户ID（属主）
 	GID        int      // 组ID（属组）
-	LinkTarget string   // 若为符号链接，记录链接目标
+	LinkTarget string   // 若为符号链接，记录链接目标；若为块设备镜像，记录源设备路径
 	LinkName   string   // 若为硬链接，记录链接到的文件路径（相对于根目录）
 	DevMajor   int64    // 设备主编号（设备文件）
 	DevMinor   int64    // 设备次编号（设备文件）
+	Mime       string   // 内容类型（打包时启用 MIME 检测才会记录），例如 "application/x-pem-file"
 	Compress   bool     // 压缩标记
-	Encrypt    bool     // 加密标记
+	Encrypt    bool     // 加密标记：内容用条目密码单独加密（EntryEncryptPatterns）
+	Sparse     bool     // 稀疏文件：占用的磁盘块少于文件大小，打包时只保存有数据的区域
+	Xattrs     map[string][]byte // 扩展属性（user.*、security.*、trusted.*），nil 表示没有
 }
 
 type PackOptions struct {
     Compress bool      // 是否压缩
     Encrypt  bool	   // 是否加密
     Password string    //密码串
+    archiveKey *archiveKey // 加密归档的密钥（打包时由 Password 派生，条目数据、中央索引和索引文件共用）
+    HardDereference bool // 硬链接的每个路径都保存为完整文件（用于不支持硬链接的目标文件系统）
+    Progress func(done, total int64) // 可选的进度回调（已写入的文件内容字节数 / 总字节数）
+    Compression Codec  // 压缩方式（none/flate/zstd/xz），未指定时由 Compress 决定（启用时为 flate）
+    CompressionLevel int // 压缩级别（flate、xz 为 1~9，zstd 为 1~22），0 表示默认级别（flate 9、zstd 3、xz 6）；记录在文件头中供诊断
+    BlockCompress bool // 分块压缩（每块独立压缩，解包时可多核并行解压），需同时启用 Compress
+    Threads int        // 并行压缩（flate、zstd）和并行解压（分块压缩的归档）的 worker 数量，0 表示使用 CPU 核数
+    CompressTarget int64 // 目标压缩吞吐量（字节/秒），> 0 时自适应调整压缩级别，需启用 BlockCompress
+    BufferSize int     // 条目读写缓冲区大小（字节），0 表示使用默认值 256KB
+    ReadAhead int      // 后台并行预读小文件（≤ 16KB）的 worker 数量，0 表示默认（多核时 8 个，单核时不预读），< 0 表示不预读（见 smallfile.go）
+    smallFiles *smallFileReader // 打包时预读的小文件
+    DetectMime bool    // 检测并记录每个文件的内容类型（MIME）
+    SecretPolicy SecretPolicy // 疑似敏感文件（私钥、凭据等）的处理策略，默认不检查
+    AllowSecrets bool  // SecretsDeny 策略下仍允许打包敏感文件（只警告）
+    Warn func(msg string) // 可选的警告回调
+    EncryptCompress EncryptCompressPolicy // 同时启用压缩和加密时的策略，默认 auto（包含不可信数据类别时不压缩）
+    UntrustedPatterns []string // 不可信数据类别：内容可能被攻击者影响的文件的路径模式，加密时按 EncryptCompress 策略决定是否压缩
+    Transform TransformFilter // 可选，打包时改写或丢弃普通文件的内容，条目大小按转换后的内容记录
+    EntryEncryptPatterns []string // 单独加密的普通文件的路径模式，内容用 EntryPassword 加密（归档其余部分可以不加密）
+    EntryPassword string // 单独加密条目的密码；解包时提供才能还原这些条目，否则跳过
+    entryCipher *entryCipher // 单独加密条目的密钥（打包时由 EntryPassword 生成）
+    PackageInventory bool // 检测源目录中的包管理器数据库（dpkg、rpm），把已安装的软件包清单记录在归档中
+    packages []byte // 软件包清单（JSON），写在根目录条目的 TLV 中
+    packageCount int // 软件包清单中的包数量
+    IncrementalFrom string // 增量备份的基准归档：只写入相对于它新增或有变化的文件，并记录已删除的路径
+    DifferentialBase string // 差异备份的基准（完整归档）：写入自它以来新增或有变化的文件，并记录已删除的路径
+    IncrementalChecksum bool // 增量和差异备份按内容的 SHA-256 判断文件是否变化（不依赖修改时间，需要读取基准归档和大小相同的文件）
+    SkipBase bool // 解包差异归档时不先解包其基准，只写入差异归档本身的条目并执行删除
+    incremental []byte // 增量信息（JSON），写在根目录条目的 TLV 中
+    incrementalStats *IncrementalStats // 增量打包的统计
+    baseDepth int // 解包差异归档时已递归解包的基准层数（限制为 maxIncrementalChain）
+    ChunkStore string // 块存储目录：较大的普通文件按内容切分为块保存在其中（相同的数据只保存一次），归档中只记录块列表；解包时需要同一个块存储
+    chunkStore *ChunkStore // 打开的块存储
+    dedupStats *DedupStats // 块存储去重的统计
+    Jobs int            // 拆分打包时同时生成的归档数量，0 或 1 表示逐个生成
+    MemoryBudget int64  // 拆分并行打包的内存预算（字节），限制同时运行的打包流水线数量，0 表示不限制
+    Context context.Context // 可选，被取消时打包/解包尽快停止并返回 ErrCanceled，未完成的归档文件会被删除
+    StreamHash bool     // 每 16 MiB 写入一个链式校验值，读取时可尽早发现损坏并报告偏移
+    Quota PackQuota     // 单次打包的安全限制（归档大小、条目数、耗时）
+    quota *quotaTracker // 单次打包的限制统计（拆分打包时多个归档共享）
+    Summary bool        // 在归档旁写入 "<归档>.summary.json"（条目统计、大小、耗时、摘要、过滤条件）
+    ToolVersion string  // 写入摘要文件的程序版本
+    OnArchive func(summary PackSummary) // 可选，每个归档写入完成后回调其摘要（拆分并行打包时可能被并发调用）
+    Index bool          // 在归档旁写入 "<归档>.idx" 索引（全部条目的元信息），远程归档列目录时只需下载索引
+    ColumnarIndex bool  // 索引写为按列存储的版本2：本地读取时直接映射到内存，但未加密时不压缩（约为默认的 10–20 倍），旧版本程序不能读取
+    CentralIndex bool   // 在归档末尾写入中央索引（全部条目的偏移表和尾部指针），可以只读取单个文件而不必顺序读取整个归档（格式版本 versionCentralIndex）
+    EntryStats bool     // 在 PackSummary.EntryBytes 中记录每个条目写入的字节数（需要 Summary 或 OnArchive）
+    stats *archiveStats // 写入归档时读写链各处的字节数和归档的摘要（Summary、OnArchive 或 Index 时）
+    Limits ReadLimits   // 读取归档时的资源限制
+    SHA256 string       // 解包时校验整个归档文件的 SHA-256 摘要（十六进制），空表示不校验
+    SpoolDir string     // restore-remote 保存不带流校验的归档的临时目录（需要与归档大小相同的空间），空表示系统临时目录
+    RestoreOrder *RestoreOrder // 可选的条目写入顺序（解包按归档中的顺序还原），nil 表示按路径顺序（见 order.go）
+    Reproducible bool   // 可重现的归档：条目按路径排序，时间不晚于 SourceDateEpoch，属主记为 0，同样的目录树总是得到相同的归档（见 reproducible.go）
+    SourceDateEpoch int64 // 可重现模式中修改时间的上限（Unix 时间戳，秒），0 表示全部时间记为 0
+    RestorePolicy *RestorePolicy // 解包时按路径调整属主、权限或跳过条目，nil 表示按归档原样还原
+    RestoreFilter *Filter // 解包时只还原匹配过滤条件的条目（与打包的过滤条件相同），nil 表示还原全部条目
+    NoSELinux bool      // 解包时不设置 SELinux 安全上下文（security.selinux），由目标系统按自己的策略重新标记
+    OnEntryRestored func(entry FileEntry, path string) error // 可选，解包时每个条目写入磁盘后回调（path 为还原后的绝对路径），返回错误时中止解包
+    openContent func(entry FileEntry) (io.ReadCloser, error) // 提供普通文件的内容（导入外部归档时），nil 表示从源目录读取
+    selector *pathSelector // 解包时只还原选中的路径（ExtractPaths），nil 表示还原全部条目
 }
 
@@ -1,18 +1,19 @@
 package backup
 
 import (
-	"compress/flate"
-	"crypto/aes"
 	"crypto/cipher"
-	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // Unpack 从归档文件解包到指定目录
@@ -29,66 +30,19 @@ func Unpack(archivePath string, restoreRoot string) error {
 // options: 解包选项（密码等）
 // 返回: 可能的错误
 func UnpackWithOptions(archivePath string, restoreRoot string, options PackOptions) error {
-	// 验证归档文件路径：必须是文件，不能是目录
-	fileInfo, err := os.Stat(archivePath)
-	if err != nil {
-		return fmt.Errorf("归档文件不存在或无法访问: %v", err)
-	}
-	if fileInfo.IsDir() {
-		return fmt.Errorf("归档路径是目录而不是文件: %s", archivePath)
-	}
-	
-	// 打开归档文件
-	inFile, err := os.Open(archivePath)
-	if err != nil {
-		return fmt.Errorf("打开归档文件失败: %v", err)
-	}
-	defer inFile.Close()
-	
-	// 读取并验证文件头，获取标志位
-	compress, encrypt, err := readHeaderWithFlags(inFile)
+	// 打开归档文件并建立读取链
+	ar, err := OpenArchive(archivePath, options)
 	if err != nil {
-		return fmt.Errorf("读取文件头失败: %v", err)
-	}
-	
-	// 创建读取链：文件 -> 解密 -> 解压缩 -> 实际读取
-	var finalReader io.Reader = inFile
-	
-	// 如果启用加密，添加解密层
-	if encrypt {
-		if options.Password == "" {
-			return fmt.Errorf("归档文件已加密，需要提供密码")
-		}
-		// 从密码生成密钥
-		key := sha256.Sum256([]byte(options.Password))
-		block, err := aes.NewCipher(key[:])
-		if err != nil {
-			return fmt.Errorf("创建解密器失败: %v", err)
-		}
-		aesGCM, err := cipher.NewGCM(block)
-		if err != nil {
-			return fmt.Errorf("创建GCM失败: %v", err)
-		}
-		// 读取 nonce
-		nonceSize := aesGCM.NonceSize()
-		nonce := make([]byte, nonceSize)
-		if _, err := io.ReadFull(inFile, nonce); err != nil {
-			return fmt.Errorf("读取 nonce 失败: %v", err)
-		}
-		// 创建解密读取器
-		finalReader = &decryptReader{
-			reader: inFile,
-			gcm:    aesGCM,
-			nonce:  nonce,
-		}
-	}
-	
-	// 如果启用压缩，添加解压缩层
-	if compress {
-		flateReader := flate.NewReader(finalReader)
-		defer flateReader.Close()
-		finalReader = flateReader
+		return err
 	}
+	return unpackArchive(ar, archivePath, restoreRoot, options)
+}
+
+// unpackArchive 从已打开的归档解包到指定目录，返回前关闭归档
+// archivePath: 归档的路径或地址，差异归档据此查找基准归档
+func unpackArchive(ar *ArchiveReader, archivePath string, restoreRoot string, options PackOptions) error {
+	defer ar.Close()
+	defer releaseDeepDirs()
 	
 	// 确保目标目录存在
 	if err := os.MkdirAll(restoreRoot, 0755); err != nil {
@@ -101,32 +55,37 @@ func UnpackWithOptions(archivePath string, restoreRoot string, options PackOptio
 		return fmt.Errorf("获取目标绝对路径失败: %v", err)
 	}
 	
-	// 用于硬链接处理的映射（路径 -> 实际文件路径）
-	hardlinkMap := make(map[string]string)
+	// 按还原策略跳过的条目
+	skipped := make(map[string]bool)
+	// 提取指定路径或按过滤条件还原时没有选中的普通文件，以及链接到它们的选中的硬链接（见 extract.go）
+	unselected := make(map[string]bool)
+	promoted := make(map[string][]string)
+	filter := newRestoreFilter(options.RestoreFilter)
+	// 已创建的目录，权限和时间在全部条目还原之后设置（见 finishDirs）
+	var dirs []restoredDir
 	
 	// 循环读取条目
 	for {
-		entryType, err := readEntryType(finalReader)
-		if err != nil {
-			if err == io.EOF {
-				return fmt.Errorf("读取条目类型失败: 文件意外结束，可能文件不完整或已损坏")
-			}
-			return fmt.Errorf("读取条目类型失败: %v", err)
+		if err := checkCanceled(options); err != nil {
+			return err
 		}
-		
-		// 检查结束标记
-		if entryType == entryTypeEnd {
+		entry, err := ar.next()
+		if err == io.EOF {
 			break
 		}
-		
-		// 读取条目
-		entry, err := readEntry(finalReader, entryType)
 		if err != nil {
-			return fmt.Errorf("读取条目失败: %v", err)
+			return err
 		}
+		entryType := ar.entryType
 		
 		// 处理路径
 		if entry.RelPath == "." {
+			// 增量或差异归档：差异归档先解包基准，再删除基准备份之后已删除的路径
+			if entry.incremental != nil {
+				if err := restoreIncremental(archivePath, absRestoreRoot, entry, options); err != nil {
+					return err
+				}
+			}
 			continue // 跳过根目录
 		}
 		
@@ -141,94 +100,254 @@ func UnpackWithOptions(archivePath string, restoreRoot string, options PackOptio
 			return fmt.Errorf("检测到非法路径逃逸: %s", entry.RelPath)
 		}
 		
+		// 提取指定路径时跳过没有选中的条目，选中路径的上级目录只还原目录本身
+		if options.selector != nil && !options.selector.match(entry.RelPath) &&
+			!(entryType == entryTypeDir && options.selector.ancestor(entry.RelPath)) {
+			if entryType == entryTypeFile {
+				unselected[entry.RelPath] = true
+			}
+			continue
+		}
+		// 按过滤条件还原时跳过不匹配的条目，匹配的条目先还原暂存的上级目录（见 restorefilter.go）
+		if filter != nil {
+			if !filter.match(entry) {
+				if entryType == entryTypeFile {
+					unselected[entry.RelPath] = true
+				}
+				continue
+			}
+			if dirs, err = restoreParents(filter.take(), absRestoreRoot, dirs, options); err != nil {
+				return err
+			}
+		}
+		
+		// 按还原策略调整属主和权限，或跳过条目（未读取的内容在读取下一个条目时跳过）
+		if options.RestorePolicy != nil && options.RestorePolicy.apply(entry) {
+			skipped[entry.RelPath] = true
+			continue
+		}
+		// 没有指定块存储时不能还原内容保存在块存储中的条目
+		if ar.locked == ErrNoChunkStore {
+			return fmt.Errorf("%v (%s)", ErrNoChunkStore, entry.RelPath)
+		}
+		// 没有条目密码时跳过单独加密的条目，其余数据照常还原
+		if ar.locked != nil {
+			warn(options, "跳过单独加密的条目 %s（需要条目密码）", entry.RelPath)
+			skipped[entry.RelPath] = true
+			continue
+		}
+		if entryType == entryTypeHardlink && skipped[entry.LinkName] {
+			warn(options, "跳过硬链接 %s：链接的文件 %s 已被跳过", entry.RelPath, entry.LinkName)
+			skipped[entry.RelPath] = true
+			continue
+		}
+		// 链接的文件没有选中：解包结束后再还原为普通文件
+		if entryType == entryTypeHardlink && unselected[entry.LinkName] {
+			promoted[entry.LinkName] = append(promoted[entry.LinkName], entry.RelPath)
+			continue
+		}
+		// 硬链接总是排在它链接的文件之后（见 order.go），目标不存在说明归档中的条目顺序不正确
+		if entryType == entryTypeHardlink && !existsNoFollow(absRestoreRoot, entry.LinkName) {
+			warn(options, "跳过硬链接 %s：链接的文件 %s 不在它之前", entry.RelPath, entry.LinkName)
+			skipped[entry.RelPath] = true
+			continue
+		}
+		
 		// 根据文件类型处理
 		switch entryType {
 		case entryTypeFile:
-			if err := restoreFile(finalReader, targetPath, entry); err != nil {
+			// 稀疏文件直接读取归档中的数据区域，只写入有数据的部分
+			content := withCancel(ar, options)
+			if entry.sparse != nil {
+				content = withCancel(ar.stored, options)
+			}
+			if err := restoreFile(content, absRestoreRoot, entry); err != nil {
 				return err
 			}
 			
 		case entryTypeDir:
-			if err := restoreDir(targetPath, entry); err != nil {
+			if err := restoreDir(absRestoreRoot, entry); err != nil {
 				return err
 			}
+			dirs = append(dirs, restoredDir{absRestoreRoot, entry})
 			
 		case entryTypeSymlink:
-			if err := restoreSymlink(targetPath, entry); err != nil {
+			if err := restoreSymlink(absRestoreRoot, entry); err != nil {
 				return err
 			}
 			
 		case entryTypeHardlink:
-			if err := restoreHardlink(targetPath, entry, absRestoreRoot, hardlinkMap); err != nil {
+			if err := restoreHardlink(absRestoreRoot, entry); err != nil {
 				return err
 			}
 			
 		case entryTypeFifo:
-			if err := restoreFifo(targetPath, entry); err != nil {
+			if err := restoreFifo(absRestoreRoot, entry); err != nil {
 				return err
 			}
 			
 		case entryTypeCharDev:
-			if err := restoreCharDev(targetPath, entry); err != nil {
+			if err := restoreCharDev(absRestoreRoot, entry); err != nil {
 				return err
 			}
 			
 		case entryTypeBlockDev:
-			if err := restoreBlockDev(targetPath, entry); err != nil {
+			if err := restoreBlockDev(absRestoreRoot, entry); err != nil {
+				return err
+			}
+			
+		case entryTypeImage:
+			// 镜像条目还原为普通文件
+			if err := restoreFile(withCancel(ar, options), absRestoreRoot, entry); err != nil {
 				return err
 			}
 			
 		default:
 			return fmt.Errorf("未知的条目类型: %d", entryType)
 		}
+		
+		// 扩展属性在写完内容、恢复属主之后设置（修改属主会清除 security.capability），失败只警告
+		if err := restoreXattrs(targetPath, restoredXattrs(entry.xattrs, options)); err != nil {
+			warn(options, "%s: %v", entry.RelPath, err)
+		}
+		
+		// 条目还原后立即回调（例如 restorecon、病毒扫描），不必等到整个归档解包完成
+		if options.OnEntryRestored != nil {
+			if err := options.OnEntryRestored(entry.fileEntry(), targetPath); err != nil {
+				return fmt.Errorf("条目还原后的回调失败 (%s): %v", entry.RelPath, err)
+			}
+		}
+		if options.selector != nil {
+			options.selector.restored[entry.RelPath] = true
+		}
 	}
 	
+	if len(promoted) > 0 {
+		if err := restorePromotedLinks(archivePath, absRestoreRoot, promoted, options); err != nil {
+			return err
+		}
+	}
+	finishDirs(dirs, options)
 	return nil
 }
 
-// readHeaderWithFlags 读取并验证文件头，返回压缩和加密标志
-func readHeaderWithFlags(r io.Reader) (compress, encrypt bool, err error) {
+// readHeaderWithFlags 读取并验证文件头，返回格式版本和标志位（压缩、加密等）
+func readHeaderWithFlags(r io.Reader) (version uint32, flags byte, level int, err error) {
+	header, err := readArchiveHeader(r)
+	return header.version, header.flags, header.level, err
+}
+
+// archiveHeader 归档文件头的内容
+type archiveHeader struct {
+	version uint32
+	flags   byte  // 标志位
+	level   int   // 记录的压缩级别（0 表示未记录）
+	codec   Codec // 压缩方式：未设置压缩标志时为 CodecNone
+}
+
+// readArchiveHeader 读取并验证文件头，得到版本、标志位、压缩级别和压缩方式
+// versionCodec 起压缩算法记录在第二个保留字节中，之前的版本只有 flate
+func readArchiveHeader(r io.Reader) (header archiveHeader, err error) {
+	version, flags, level, codecID, err := readRawHeader(r)
+	if err != nil {
+		return header, err
+	}
+	if unknown := flags &^ knownFlags(version); unknown != 0 {
+		return header, fmt.Errorf("文件头含有版本%d不认识的标志位 0x%02x，归档可能已损坏或由不兼容的程序写入", version, unknown)
+	}
+	header = archiveHeader{version: version, flags: flags, level: level, codec: CodecNone}
+	if version < versionCodec {
+		codecID = headerCodecFlate
+	}
+	if flags&flagCompress == 0 {
+		return header, nil
+	}
+	switch codecID {
+	case headerCodecFlate:
+		header.codec = CodecFlate
+	case headerCodecZstd:
+		header.codec = CodecZstd
+	case headerCodecXz:
+		header.codec = CodecXz
+	default:
+		return header, fmt.Errorf("不支持的压缩算法编号 %d，归档可能已损坏或由更新版本的程序写入", codecID)
+	}
+	return header, nil
+}
+
+// knownFlags 返回各格式版本定义的文件头标志位
+func knownFlags(version uint32) byte {
+	if version < 2 {
+		return 0
+	}
+	known := flagCompress | flagEncrypt
+	if version >= versionBlockCompress {
+		known |= flagBlockCompress
+	}
+	if version >= versionMime && version < versionTLV {
+		known |= flagMime
+	}
+	if version >= versionStreamHash {
+		known |= flagStreamHash
+	}
+	if version >= versionCentralIndex {
+		known |= flagCentralIndex
+	}
+	return known
+}
+
+// knownEntryType 条目类型在该格式版本中是否有定义（镜像条目自 versionImage 起）
+func knownEntryType(entryType byte, version uint32) bool {
+	if entryType == entryTypeImage {
+		return version >= versionImage
+	}
+	return entryType >= entryTypeFile && entryType <= entryTypeBlockDev
+}
+
+// readRawHeader 读取文件头的各个字段
+func readRawHeader(r io.Reader) (version uint32, flags byte, level int, codec byte, err error) {
 	// 读取魔数
 	magic := make([]byte, 4)
 	if _, err := io.ReadFull(r, magic); err != nil {
-		return false, false, err
+		return 0, 0, 0, 0, err
 	}
 	if string(magic) != magicNumber {
-		return false, false, fmt.Errorf("无效的归档文件格式，魔数不匹配")
+		return 0, 0, 0, 0, fmt.Errorf("无效的归档文件格式，魔数不匹配")
 	}
 	
 	// 读取版本号
-	var version uint32
 	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
-		return false, false, err
+		return 0, 0, 0, 0, err
+	}
+	if version > formatVersion {
+		return 0, 0, 0, 0, &NewerFormatError{Version: version}
 	}
-	if version < 1 || version > formatVersion {
-		return false, false, fmt.Errorf("不支持的归档文件版本: %d", version)
+	if version < minReadVersion {
+		return 0, 0, 0, 0, fmt.Errorf("不支持的归档文件版本: %d", version)
 	}
 	
 	// 读取标志位（版本2+）
 	if version >= 2 {
-		var flags byte
 		if err := binary.Read(r, binary.LittleEndian, &flags); err != nil {
-			return false, false, err
+			return 0, 0, 0, 0, err
 		}
-		compress = (flags & flagCompress) != 0
-		encrypt = (flags & flagEncrypt) != 0
 		
-		// 跳过保留字段（7字节）
+		// 读取保留字段（7字节），第一个字节为压缩级别（0 表示未记录），第二个字节为压缩算法（versionCodec 起）
 		reserved := make([]byte, 7)
 		if _, err := io.ReadFull(r, reserved); err != nil {
-			return false, false, err
+			return 0, 0, 0, 0, err
 		}
+		level = int(reserved[0])
+		codec = reserved[1]
 	} else {
 		// 版本1：跳过保留字段（8字节）
 		reserved := make([]byte, 8)
 		if _, err := io.ReadFull(r, reserved); err != nil {
-			return false, false, err
+			return 0, 0, 0, 0, err
 		}
 	}
 	
-	return compress, encrypt, nil
+	return version, flags, level, codec, nil
 }
 
 // decryptReader 实现解密读取
@@ -338,17 +457,34 @@ type entryData struct {
 	LinkName   string
 	DevMajor   int64
 	DevMinor   int64
+	Mime       string
+	Encrypted  bool   // 内容单独加密（Size 为明文大小）
+	chunked    bool   // 内容保存在块存储中（Size 为明文大小）
+	sparse     []sparseExtent // 稀疏文件的数据区域（Size 为文件大小）
+	storedSize int64  // 单独加密的条目在归档中的内容长度（密文），保存在块存储中的条目的块列表长度，或稀疏文件数据区域的总长度
+	keyRecord  []byte // 单独加密的条目的密钥派生参数和密码校验值
+	packages   []byte // 软件包清单（JSON，仅根目录条目）
+	incremental []byte // 增量信息（JSON，仅根目录条目）
+	xattrs     map[string][]byte // 扩展属性
 }
 
-// readEntry 读取一个条目
-func readEntry(r io.Reader, entryType byte) (*entryData, error) {
-	entry := &entryData{}
+// readEntry 读取一个条目（不包括内容）
+// version, flags: 文件头中的格式版本和标志位，决定条目中包含哪些字段
+// limits: 字符串字段的长度限制
+func readEntry(r io.Reader, entryType byte, version uint32, flags byte, limits ReadLimits) (*entryData, error) {
+	if !knownEntryType(entryType, version) {
+		return nil, fmt.Errorf("未知的条目类型: %d（版本%d）", entryType, version)
+	}
+	entry := &entryData{Type: fileTypeOf(entryType)}
 	
 	// 读取路径
 	var pathLen uint32
 	if err := binary.Read(r, binary.LittleEndian, &pathLen); err != nil {
 		return nil, err
 	}
+	if err := limits.checkStringLen("路径", pathLen); err != nil {
+		return nil, err
+	}
 	pathBytes := make([]byte, pathLen)
 	if _, err := io.ReadFull(r, pathBytes); err != nil {
 		return nil, err
@@ -375,6 +511,19 @@ func readEntry(r io.Reader, entryType byte) (*entryData, error) {
 		return nil, err
 	}
 	
+	// 读取内容类型（versionMime 到 versionTLV 之前的可选字段，knownFlags 已经检查过版本）
+	if version < versionTLV && flags&flagMime != 0 {
+		var mimeLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &mimeLen); err != nil {
+			return nil, err
+		}
+		mimeBytes := make([]byte, mimeLen)
+		if _, err := io.ReadFull(r, mimeBytes); err != nil {
+			return nil, err
+		}
+		entry.Mime = string(mimeBytes)
+	}
+	
 	// 根据条目类型读取特定数据
 	switch entryType {
 	case entryTypeFile:
@@ -387,6 +536,9 @@ func readEntry(r io.Reader, entryType byte) (*entryData, error) {
 		if err := binary.Read(r, binary.LittleEndian, &linkLen); err != nil {
 			return nil, err
 		}
+		if err := limits.checkStringLen("链接目标", linkLen); err != nil {
+			return nil, err
+		}
 		linkBytes := make([]byte, linkLen)
 		if _, err := io.ReadFull(r, linkBytes); err != nil {
 			return nil, err
@@ -398,11 +550,18 @@ func readEntry(r io.Reader, entryType byte) (*entryData, error) {
 		if err := binary.Read(r, binary.LittleEndian, &linkLen); err != nil {
 			return nil, err
 		}
+		if err := limits.checkStringLen("链接目标", linkLen); err != nil {
+			return nil, err
+		}
 		linkBytes := make([]byte, linkLen)
 		if _, err := io.ReadFull(r, linkBytes); err != nil {
 			return nil, err
 		}
 		entry.LinkName = string(linkBytes)
+		// 与条目路径相同的安全检查：链接的文件必须在目标目录之内
+		if !insideRoot(entry.LinkName) {
+			return nil, fmt.Errorf("检测到非法路径逃逸: %s -> %s", entry.RelPath, entry.LinkName)
+		}
 		
 	case entryTypeCharDev, entryTypeBlockDev:
 		if err := binary.Read(r, binary.LittleEndian, &entry.DevMajor); err != nil {
@@ -411,208 +570,320 @@ func readEntry(r io.Reader, entryType byte) (*entryData, error) {
 		if err := binary.Read(r, binary.LittleEndian, &entry.DevMinor); err != nil {
 			return nil, err
 		}
+		
+	case entryTypeImage:
+		var devLen uint32
+		if err := binary.Read(r, binary.LittleEndian, &devLen); err != nil {
+			return nil, err
+		}
+		if err := limits.checkStringLen("设备路径", devLen); err != nil {
+			return nil, err
+		}
+		devBytes := make([]byte, devLen)
+		if _, err := io.ReadFull(r, devBytes); err != nil {
+			return nil, err
+		}
+		entry.LinkTarget = string(devBytes)
+		if err := binary.Read(r, binary.LittleEndian, &entry.Size); err != nil {
+			return nil, err
+		}
+	}
+	
+	// 读取可选元数据（versionTLV 起）
+	if version >= versionTLV {
+		if err := readEntryTLVs(r, entry); err != nil {
+			return nil, err
+		}
 	}
 	
 	return entry, nil
 }
 
+// existsNoFollow 目标目录中的路径是否存在（逐级打开父目录，不跟随符号链接）
+func existsNoFollow(absRestoreRoot, relPath string) bool {
+	at, err := openParentNoFollow(absRestoreRoot, relPath)
+	if err != nil {
+		return false
+	}
+	defer at.close()
+	return lstatAt(at) != 0
+}
+
+// entryParent 创建条目的上级目录并打开其父目录，用完后调用 close。
+// 逐级打开且不跟随符号链接：归档中先还原的符号链接（如 evil -> /etc）不能把之后的条目（evil/x）引到目标目录之外
+func entryParent(absRestoreRoot string, entry *entryData) (atPath, error) {
+	at, err := createParentNoFollow(absRestoreRoot, entry.RelPath)
+	if errors.Is(err, errSymlinkComponent) {
+		return at, fmt.Errorf("检测到经过符号链接的路径，拒绝写入 (%s): %v", entry.RelPath, err)
+	}
+	if err != nil {
+		return at, fmt.Errorf("创建父目录失败 (%s): %v", entry.RelPath, err)
+	}
+	return at, nil
+}
+
+// lstatAt 返回父目录中条目的类型（不跟随符号链接），不存在时返回 0
+func lstatAt(at atPath) uint32 {
+	var st unix.Stat_t
+	if err := unix.Fstatat(at.dirfd, at.name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return 0
+	}
+	return st.Mode & unix.S_IFMT
+}
+
+// removeAt 删除已存在的同名条目（目录只在为空时删除），新条目不会经过原有的符号链接写入
+func removeAt(at atPath) {
+	if err := unix.Unlinkat(at.dirfd, at.name, 0); err == unix.EISDIR {
+		unix.Unlinkat(at.dirfd, at.name, unix.AT_REMOVEDIR)
+		// 缓存的文件描述符可能指向刚删除的目录
+		releaseDeepDirs()
+	}
+}
+
+// insideRoot 相对路径拼接到目标目录之后是否仍在目标目录之内（与解包时对条目路径的检查相同）
+func insideRoot(relPath string) bool {
+	rel, err := filepath.Rel("root", filepath.Join("root", relPath))
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
 // restoreFile 恢复普通文件
-func restoreFile(r io.Reader, targetPath string, entry *entryData) error {
+func restoreFile(r io.Reader, absRestoreRoot string, entry *entryData) error {
 	// 创建父目录
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return fmt.Errorf("创建父目录失败 (%s): %v", entry.RelPath, err)
+	at, err := entryParent(absRestoreRoot, entry)
+	if err != nil {
+		return err
 	}
+	defer at.close()
 	
-	// 创建文件
-	outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(entry.Mode))
+	// 已存在的符号链接等先删除；O_NOFOLLOW 保证不会写入链接指向的文件
+	if kind := lstatAt(at); kind != 0 && kind != unix.S_IFREG {
+		removeAt(at)
+	}
+	fd, err := unix.Openat(at.dirfd, at.name, unix.O_CREAT|unix.O_WRONLY|unix.O_TRUNC|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(os.FileMode(entry.Mode).Perm()))
 	if err != nil {
 		return fmt.Errorf("创建文件失败 (%s): %v", entry.RelPath, err)
 	}
+	outFile := os.NewFile(uintptr(fd), entry.RelPath)
 	
 	// 读取并写入文件内容
-	if entry.Size > 0 {
+	if entry.sparse != nil {
+		if err := restoreSparseContent(outFile, r, entry); err != nil {
+			outFile.Close()
+			return fmt.Errorf("写入文件内容失败 (%s): %v", entry.RelPath, err)
+		}
+	} else if entry.Size > 0 {
 		if _, err := io.CopyN(outFile, r, entry.Size); err != nil {
 			outFile.Close()
 			return fmt.Errorf("写入文件内容失败 (%s): %v", entry.RelPath, err)
 		}
 	}
+	// 读到内容结尾：versionContentHash 起在此校验内容的 SHA-256
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		outFile.Close()
+		unix.Unlinkat(at.dirfd, at.name, 0)
+		return fmt.Errorf("校验文件内容失败 (%s): %v", entry.RelPath, err)
+	}
 	
 	outFile.Close()
 	
 	// 恢复属主和时间戳
-	restoreOwnership(targetPath, int(entry.UID), int(entry.GID))
-	restoreTimes(targetPath, entry)
+	restoreOwnership(at, int(entry.UID), int(entry.GID))
+	restoreTimes(at, entry)
 	
 	return nil
 }
 
-// restoreDir 恢复目录
-func restoreDir(targetPath string, entry *entryData) error {
-	if err := os.MkdirAll(targetPath, os.FileMode(entry.Mode)); err != nil {
+// restoreDir 创建目录并恢复属主；目录先以属主可读写的权限创建，使其内容可以写入，
+// 归档中的权限和时间由 finishDirs 在全部条目还原之后设置
+func restoreDir(absRestoreRoot string, entry *entryData) error {
+	at, err := entryParent(absRestoreRoot, entry)
+	if err != nil {
+		return err
+	}
+	defer at.close()
+	
+	// 已存在的同名符号链接或文件替换为目录
+	if kind := lstatAt(at); kind != 0 && kind != unix.S_IFDIR {
+		removeAt(at)
+	}
+	if err := unix.Mkdirat(at.dirfd, at.name, uint32((os.FileMode(entry.Mode) | 0700).Perm())); err != nil && err != unix.EEXIST {
 		return fmt.Errorf("创建目录失败 (%s): %v", entry.RelPath, err)
 	}
-	restoreOwnership(targetPath, int(entry.UID), int(entry.GID))
-	restoreTimes(targetPath, entry)
+	restoreOwnership(at, int(entry.UID), int(entry.GID))
 	return nil
 }
 
+// restoredDir 已创建、尚未设置权限和时间的目录
+type restoredDir struct {
+	root  string // 目标目录
+	entry *entryData
+}
+
+// finishDirs 设置已还原目录的权限和时间：目录中的条目写入时会修改目录的修改时间，只读目录也不能再写入内容，
+// 所以在全部条目还原之后进行。按路径倒序处理使子目录先于父目录，父目录去掉写权限或搜索权限时不影响子目录的设置；
+// 归档中目录已经按路径排列（见 order.go），排序只是防止被改动过的归档中目录在其内容之后。
+// 目录同样不跟随符号链接打开：之后的条目把目录替换为符号链接时跳过。设置权限失败只警告
+func finishDirs(dirs []restoredDir, options PackOptions) {
+	less := func(i, j int) bool {
+		return comparePaths(dirs[i].entry.RelPath, dirs[j].entry.RelPath) < 0
+	}
+	if !sort.SliceIsSorted(dirs, less) {
+		sort.SliceStable(dirs, less)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		if err := finishDir(dir); err != nil {
+			warn(options, "设置目录权限失败 (%s): %v", dir.entry.RelPath, err)
+		}
+	}
+}
+
+// finishDir 设置一个目录的权限（包括 setgid/sticky）和时间
+func finishDir(dir restoredDir) error {
+	at, err := openParentNoFollow(dir.root, dir.entry.RelPath)
+	if err != nil {
+		return err
+	}
+	defer at.close()
+	fd, err := unix.Openat(at.dirfd, at.name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	err = unix.Fchmod(fd, chmodBits(os.FileMode(dir.entry.Mode)))
+	unix.Close(fd)
+	restoreTimes(at, dir.entry)
+	return err
+}
+
 // restoreSymlink 恢复符号链接
-func restoreSymlink(targetPath string, entry *entryData) error {
+func restoreSymlink(absRestoreRoot string, entry *entryData) error {
 	// 创建父目录
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return fmt.Errorf("创建父目录失败 (%s): %v", entry.RelPath, err)
+	at, err := entryParent(absRestoreRoot, entry)
+	if err != nil {
+		return err
 	}
+	defer at.close()
 	
 	// 如果目标路径已存在，先删除
-	if _, err := os.Lstat(targetPath); err == nil {
-		os.Remove(targetPath)
-	}
+	removeAt(at)
 	
 	// 创建符号链接
-	if err := os.Symlink(entry.LinkTarget, targetPath); err != nil {
+	if err := unix.Symlinkat(entry.LinkTarget, at.dirfd, at.name); err != nil {
 		return fmt.Errorf("创建符号链接失败 (%s -> %s): %v", entry.RelPath, entry.LinkTarget, err)
 	}
 	
-	restoreOwnership(targetPath, int(entry.UID), int(entry.GID))
+	restoreOwnership(at, int(entry.UID), int(entry.GID))
 	return nil
 }
 
-// restoreHardlink 恢复硬链接
-func restoreHardlink(targetPath string, entry *entryData, absRestoreRoot string, hardlinkMap map[string]string) error {
+// restoreHardlink 恢复硬链接（调用方已确认链接的文件存在，读取条目时已确认 LinkName 在目标目录之内）
+func restoreHardlink(absRestoreRoot string, entry *entryData) error {
 	// 创建父目录
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return fmt.Errorf("创建父目录失败 (%s): %v", entry.RelPath, err)
+	at, err := entryParent(absRestoreRoot, entry)
+	if err != nil {
+		return err
 	}
+	defer at.close()
 	
-	// 构造链接目标路径
-	linkTarget := filepath.Join(absRestoreRoot, entry.LinkName)
-	
-	// 检查目标文件是否存在
-	if _, err := os.Stat(linkTarget); err != nil {
-		// 如果目标文件还不存在，跳过（后续会被处理）
-		hardlinkMap[entry.RelPath] = entry.LinkName
-		return nil
+	// 链接的文件同样逐级打开父目录，不跟随符号链接
+	source, err := openParentNoFollow(absRestoreRoot, entry.LinkName)
+	if err != nil {
+		return fmt.Errorf("创建硬链接失败 (%s -> %s): %v", entry.RelPath, entry.LinkName, err)
 	}
+	defer source.close()
 	
 	// 如果目标路径已存在，先删除
-	if _, err := os.Lstat(targetPath); err == nil {
-		os.Remove(targetPath)
-	}
+	removeAt(at)
 	
-	// 创建硬链接
-	if err := os.Link(linkTarget, targetPath); err != nil {
+	// 创建硬链接（不跟随链接的文件本身是符号链接的情形）
+	if err := unix.Linkat(source.dirfd, source.name, at.dirfd, at.name, 0); err != nil {
 		// 硬链接创建失败可能是跨文件系统，降级为复制文件
-		if err := copyFile(linkTarget, targetPath); err != nil {
+		if err := copyFileAt(source, at); err != nil {
 			return fmt.Errorf("创建硬链接失败 (%s -> %s): %v", entry.RelPath, entry.LinkName, err)
 		}
 	}
 	
-	restoreOwnership(targetPath, int(entry.UID), int(entry.GID))
+	restoreOwnership(at, int(entry.UID), int(entry.GID))
 	return nil
 }
 
 // restoreFifo 恢复命名管道
-func restoreFifo(targetPath string, entry *entryData) error {
-	// 创建父目录
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return fmt.Errorf("创建父目录失败 (%s): %v", entry.RelPath, err)
-	}
-	
-	// 如果目标路径已存在，先删除
-	if _, err := os.Lstat(targetPath); err == nil {
-		os.Remove(targetPath)
-	}
-	
-	// 创建命名管道
-	if err := syscall.Mkfifo(targetPath, uint32(entry.Mode)); err != nil {
-		return fmt.Errorf("创建命名管道失败 (%s): %v", entry.RelPath, err)
-	}
-	
-	restoreOwnership(targetPath, int(entry.UID), int(entry.GID))
-	return nil
+func restoreFifo(absRestoreRoot string, entry *entryData) error {
+	return restoreNode(absRestoreRoot, entry, syscall.S_IFIFO, 0, "命名管道")
 }
 
 // restoreCharDev 恢复字符设备
-func restoreCharDev(targetPath string, entry *entryData) error {
-	// 创建父目录
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return fmt.Errorf("创建父目录失败 (%s): %v", entry.RelPath, err)
-	}
-	
-	// 如果目标路径已存在，先删除
-	if _, err := os.Lstat(targetPath); err == nil {
-		os.Remove(targetPath)
-	}
-	
-	// 创建字符设备
-	if err := syscall.Mknod(targetPath, syscall.S_IFCHR|uint32(entry.Mode), int(mkdev(entry.DevMajor, entry.DevMinor))); err != nil {
-		return fmt.Errorf("创建字符设备失败 (%s): %v", entry.RelPath, err)
-	}
-	
-	restoreOwnership(targetPath, int(entry.UID), int(entry.GID))
-	return nil
+func restoreCharDev(absRestoreRoot string, entry *entryData) error {
+	return restoreNode(absRestoreRoot, entry, syscall.S_IFCHR, int(mkdev(entry.DevMajor, entry.DevMinor)), "字符设备")
 }
 
 // restoreBlockDev 恢复块设备
-func restoreBlockDev(targetPath string, entry *entryData) error {
+func restoreBlockDev(absRestoreRoot string, entry *entryData) error {
+	return restoreNode(absRestoreRoot, entry, syscall.S_IFBLK, int(mkdev(entry.DevMajor, entry.DevMinor)), "块设备")
+}
+
+// restoreNode 用 mknod 恢复命名管道或设备，kind 用于错误信息
+func restoreNode(absRestoreRoot string, entry *entryData, fileType uint32, dev int, kind string) error {
 	// 创建父目录
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return fmt.Errorf("创建父目录失败 (%s): %v", entry.RelPath, err)
+	at, err := entryParent(absRestoreRoot, entry)
+	if err != nil {
+		return err
 	}
+	defer at.close()
 	
 	// 如果目标路径已存在，先删除
-	if _, err := os.Lstat(targetPath); err == nil {
-		os.Remove(targetPath)
-	}
+	removeAt(at)
 	
-	// 创建块设备
-	if err := syscall.Mknod(targetPath, syscall.S_IFBLK|uint32(entry.Mode), int(mkdev(entry.DevMajor, entry.DevMinor))); err != nil {
-		return fmt.Errorf("创建块设备失败 (%s): %v", entry.RelPath, err)
+	if err := unix.Mknodat(at.dirfd, at.name, fileType|uint32(entry.Mode), dev); err != nil {
+		return fmt.Errorf("创建%s失败 (%s): %v", kind, entry.RelPath, err)
 	}
 	
-	restoreOwnership(targetPath, int(entry.UID), int(entry.GID))
+	restoreOwnership(at, int(entry.UID), int(entry.GID))
 	return nil
 }
 
-// restoreOwnership 恢复文件属主（需要 root 权限）
-func restoreOwnership(path string, uid, gid int) {
+// restoreOwnership 恢复属主（需要 root 权限），不跟随符号链接
+func restoreOwnership(at atPath, uid, gid int) {
 	if uid > 0 || gid > 0 {
 		// 尝试恢复属主，失败不影响主要功能
-		_ = os.Chown(path, uid, gid)
+		_ = unix.Fchownat(at.dirfd, at.name, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
 	}
 }
 
-// restoreTimes 恢复文件时间戳
-func restoreTimes(path string, entry *entryData) {
+// restoreTimes 恢复时间戳，不跟随符号链接
+func restoreTimes(at atPath, entry *entryData) {
 	atime := time.Unix(entry.ModTime, 0)
 	if entry.AccessTime > 0 {
 		atime = time.Unix(entry.AccessTime, 0)
 	}
 	mtime := time.Unix(entry.ModTime, 0)
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
 	// 尝试恢复时间戳，失败不影响主要功能
-	_ = os.Chtimes(path, atime, mtime)
+	_ = unix.UtimesNanoAt(at.dirfd, at.name, times, unix.AT_SYMLINK_NOFOLLOW)
 }
 
-// mkdev 构造设备号
+// mkdev 构造设备号（与 glibc gnu_dev_makedev 一致，是 devMajor/devMinor 的逆运算）
 func mkdev(major, minor int64) uint64 {
-	return uint64((major << 8) | (minor & 0xff) | ((minor & 0xfff00) << 12))
+	ma, mi := uint64(major), uint64(minor)
+	return (mi & 0xff) | ((ma & 0xfff) << 8) | ((mi & 0xffffff00) << 12) | ((ma & 0xfffff000) << 32)
 }
 
-// copyFile 复制文件（用于硬链接降级）
-func copyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
+// copyFileAt 复制文件（用于硬链接降级），两端都不跟随符号链接
+func copyFileAt(src, dst atPath) error {
+	srcFd, err := unix.Openat(src.dirfd, src.name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
 	if err != nil {
 		return err
 	}
+	srcFile := os.NewFile(uintptr(srcFd), src.name)
 	defer srcFile.Close()
 	
-	dstFile, err := os.Create(dst)
+	dstFd, err := unix.Openat(dst.dirfd, dst.name, unix.O_RDWR|unix.O_CREAT|unix.O_TRUNC|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0666)
 	if err != nil {
 		return err
 	}
+	dstFile := os.NewFile(uintptr(dstFd), dst.name)
 	defer dstFile.Close()
 	
 	_, err = io.Copy(dstFile, srcFile)
 	return err
 }
-
@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeCraftedArchive 按给定的条目写入归档（条目可以与源目录的实际内容不符，模拟被构造的归档）
+func writeCraftedArchive(t *testing.T, source string, entries []FileEntry) string {
+	t.Helper()
+	archivePath := filepath.Join(t.TempDir(), "crafted.bkup")
+	entries = append([]FileEntry{{RelPath: ".", Type: TypeDir, Mode: 0755}}, entries...)
+	if _, _, err := writeArchive(archivePath, source, entries, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+// TestUnpackThroughSymlink 先还原的符号链接不能把之后的条目引到目标目录之外
+func TestUnpackThroughSymlink(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "target"), []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 源目录中 evil 是目录，归档中记录为指向 outside 的符号链接
+	source := t.TempDir()
+	if err := os.Mkdir(filepath.Join(source, "evil"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"evil/x", "link"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte("payload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		entries []FileEntry
+		wantErr bool
+	}{
+		{"经过符号链接的文件", []FileEntry{
+			{RelPath: "evil", Type: TypeSymlink, Mode: 0777, LinkTarget: outside},
+			{RelPath: "evil/x", Type: TypeFile, Mode: 0644, Size: 7},
+		}, true},
+		{"经过符号链接的目录", []FileEntry{
+			{RelPath: "evil", Type: TypeSymlink, Mode: 0777, LinkTarget: outside},
+			{RelPath: "evil/sub/", Type: TypeDir, Mode: 0755},
+		}, true},
+		{"经过符号链接的符号链接", []FileEntry{
+			{RelPath: "evil", Type: TypeSymlink, Mode: 0777, LinkTarget: outside},
+			{RelPath: "evil/x", Type: TypeSymlink, Mode: 0777, LinkTarget: "/"},
+		}, true},
+		{"经过符号链接的命名管道", []FileEntry{
+			{RelPath: "evil", Type: TypeSymlink, Mode: 0777, LinkTarget: outside},
+			{RelPath: "evil/x", Type: TypeFifo, Mode: 0644},
+		}, true},
+		{"同名的文件替换符号链接", []FileEntry{
+			{RelPath: "link", Type: TypeSymlink, Mode: 0777, LinkTarget: filepath.Join(outside, "target")},
+			{RelPath: "link", Type: TypeFile, Mode: 0644, Size: 7},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archivePath := writeCraftedArchive(t, source, tt.entries)
+			target := t.TempDir()
+			err := UnpackWithOptions(archivePath, target, PackOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("解包: %v", err)
+			}
+			names, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 1 {
+				t.Errorf("目标目录之外出现了 %d 个条目", len(names)-1)
+			}
+			if data, _ := os.ReadFile(filepath.Join(outside, "target")); string(data) != "keep" {
+				t.Errorf("目标目录之外的文件被改写: %q", data)
+			}
+		})
+	}
+}
+
+// TestUnpackHardlinkEscape 硬链接不能链接到目标目录之外的文件
+func TestUnpackHardlinkEscape(t *testing.T) {
+	parent := t.TempDir()
+	secret := filepath.Join(parent, "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := writeCraftedArchive(t, t.TempDir(), []FileEntry{
+		{RelPath: "leak", Type: TypeHardlink, Mode: 0644, LinkName: "../secret.txt"},
+	})
+	target := filepath.Join(parent, "restore")
+	if err := UnpackWithOptions(archivePath, target, PackOptions{}); err == nil {
+		t.Error("链接到目标目录之外的硬链接被接受")
+	}
+	if _, err := os.Lstat(filepath.Join(target, "leak")); err == nil {
+		t.Error("还原了链接到目标目录之外的硬链接")
+	}
+}
+
+// TestIncrementalDeletionThroughSymlink 增量归档的删除记录不能经过符号链接删除目标目录之外的文件
+func TestIncrementalDeletionThroughSymlink(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "x"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "d/e"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyIncrementalDeletions(root, &IncrementalInfo{Deleted: []string{"link/x"}}); err == nil {
+		t.Error("经过符号链接的删除记录被接受")
+	}
+	if err := applyIncrementalDeletions(root, &IncrementalInfo{Deleted: []string{"d/e", "missing/a", "link"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"d/e", "link"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+			t.Errorf("%s 没有被删除", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "x")); err != nil {
+		t.Errorf("目标目录之外的文件被删除: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// VerifyProblem 校验归档时发现的一个问题
+type VerifyProblem struct {
+	Path    string // 出问题的条目路径；条目头部无法读取时为空
+	After   string // 条目头部无法读取时，最后一个完好条目的路径（第一个条目就损坏时为空）
+	Fatal   bool   // 数据损坏或截断，之后的内容无法继续读取
+	Message string
+}
+
+// String 返回问题的描述，如 "a/b.txt: 读取内容失败: ..." 或 "a/b.txt 之后: 读取条目失败: ..."
+func (p VerifyProblem) String() string {
+	switch {
+	case p.Path != "":
+		return p.Path + ": " + p.Message
+	case p.After != "":
+		return p.After + " 之后: " + p.Message
+	default:
+		return "第一个条目: " + p.Message
+	}
+}
+
+// VerifyResult 归档的校验结果
+type VerifyResult struct {
+	Entries      int             // 完整读取的条目数
+	ContentBytes int64           // 读取的文件内容字节数
+	Problems     []VerifyProblem // 发现的问题，为空表示归档完好
+	Compression  Codec           // 归档的压缩方式
+	Level        int             // 文件头记录的压缩级别（0 表示未记录）
+}
+
+// OK 归档是否完好
+func (r *VerifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// VerifyArchive 逐个读取归档中的条目，解密、解压并读取全部内容，检查结构和数据是否完好，不写入任何文件
+// 除数据损坏和截断外，还检查不会导致读取失败、但解包时会出错或被拒绝的结构问题：
+// 不规范或逃逸的路径、重复的路径、指向不存在的文件的硬链接
+// 返回的错误只表示无法开始读取（文件不存在、文件头无效、密码错误等）或已取消；
+// 读取过程中发现的问题记录在结果中，数据损坏时停止读取
+func VerifyArchive(archivePath string, options PackOptions) (*VerifyResult, error) {
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.Close()
+
+	result := &VerifyResult{}
+	result.Compression, result.Level = ar.Compression()
+	types := make(map[string]FileType) // 已读取的条目路径 -> 类型
+	last := ""
+	for {
+		if err := checkCanceled(options); err != nil {
+			return result, err
+		}
+		entry, err := ar.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			result.Problems = append(result.Problems, VerifyProblem{After: last, Fatal: true, Message: err.Error()})
+			return result, nil
+		}
+
+		var content io.Reader = ar
+		size := entry.Size
+		if ar.locked != nil {
+			// 没有条目密码的单独加密条目、没有指定块存储的条目：只校验密文或块列表的摘要
+			content = ar.stored
+			size = ar.current.contentSize()
+		}
+		n, err := io.Copy(io.Discard, withCancel(content, options))
+		result.ContentBytes += n
+		if err != nil {
+			if canceled := checkCanceled(options); canceled != nil {
+				return result, canceled
+			}
+			result.Problems = append(result.Problems, VerifyProblem{
+				Path: entry.RelPath, Fatal: true,
+				Message: fmt.Sprintf("读取内容失败（已读取 %d / %d 字节）: %v", n, size, err),
+			})
+			return result, nil
+		}
+		result.Entries++
+		last = entry.RelPath
+
+		if msg := checkEntryStructure(*entry, types); msg != "" {
+			result.Problems = append(result.Problems, VerifyProblem{Path: entry.RelPath, Message: msg})
+		}
+		types[entry.RelPath] = entry.Type
+	}
+}
+
+// checkEntryStructure 检查条目的路径和链接关系，没有问题时返回空字符串
+// seen: 之前读取的条目路径和类型
+func checkEntryStructure(entry FileEntry, seen map[string]FileType) string {
+	rel := entry.RelPath
+	if rel == "" {
+		return "路径为空"
+	}
+	if rel != "." {
+		trimmed := strings.TrimSuffix(rel, "/")
+		if strings.HasPrefix(rel, "/") || trimmed == "" || path.Clean(trimmed) != trimmed {
+			return "路径不规范"
+		}
+		for _, part := range strings.Split(trimmed, "/") {
+			if part == ".." {
+				return "路径包含 \"..\"，解包时会被拒绝"
+			}
+		}
+		if (entry.Type == TypeDir) != strings.HasSuffix(rel, "/") {
+			return "路径结尾的 \"/\" 与条目类型不符"
+		}
+	}
+	if _, dup := seen[rel]; dup {
+		return "路径重复"
+	}
+	if entry.Type == TypeHardlink {
+		target, ok := seen[entry.LinkName]
+		if !ok {
+			return fmt.Sprintf("硬链接指向的文件不在它之前: %s", entry.LinkName)
+		}
+		if target != TypeFile && target != TypeHardlink {
+			return fmt.Sprintf("硬链接指向的不是普通文件: %s（%s）", entry.LinkName, target)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ArchiveFormat 返回归档的格式："bkup"、"tar"、"tar.gz" 或 "zip"（按文件内容识别，与扩展名无关）
+// http(s):// 地址总是视为 BKUP 归档
+func ArchiveFormat(archivePath string) (string, error) {
+	if IsURL(archivePath) {
+		return "bkup", nil
+	}
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("归档文件不存在或无法访问: %v", err)
+	}
+	magic := make([]byte, len(magicNumber))
+	n, _ := io.ReadFull(f, magic)
+	f.Close()
+	if n == len(magicNumber) && string(magic) == magicNumber {
+		return "bkup", nil
+	}
+	return detectForeignFormat(archivePath)
+}
+
+// WalkArchive 按顺序对归档中的每个条目调用 fn（只读取元信息，不解包内容）
+// 支持 BKUP 归档以及 tar、tar.gz、zip；外部归档的条目与 pack -import 转换后得到的条目相同
+// （路径规范化，同名条目以后出现的为准，硬链接的大小取自目标文件）
+// fn 返回错误时停止遍历并返回该错误
+func WalkArchive(archivePath string, options PackOptions, fn func(entry FileEntry) error) error {
+	format, err := ArchiveFormat(archivePath)
+	if err != nil {
+		return err
+	}
+
+	if format == "bkup" {
+		return walkBKUP(archivePath, options, fn)
+	}
+	if options.SHA256 != "" {
+		return fmt.Errorf("只能校验 BKUP 归档的 SHA-256 摘要，%s 是 %s 归档", archivePath, format)
+	}
+
+	var entries []FileEntry
+	switch format {
+	case "zip":
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return fmt.Errorf("打开 zip 归档失败: %v", err)
+		}
+		defer zr.Close()
+		if entries, _, err = zipEntries(zr, options); err != nil {
+			return err
+		}
+	default:
+		source := &tarSource{path: archivePath, gzip: format == "tar.gz"}
+		defer source.close()
+		if entries, err = source.entries(options); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkBKUP 遍历 BKUP 归档的条目：有中央索引时只读取索引，否则流式读取整个归档
+// 需要校验整个归档的 SHA-256 时总是流式读取
+func walkBKUP(archivePath string, options PackOptions, fn func(entry FileEntry) error) error {
+	if options.SHA256 == "" {
+		err := WalkCentralIndex(archivePath, options, func(entry IndexedEntry) error {
+			return fn(entry.FileEntry)
+		})
+		if err != ErrNoCentralIndex {
+			return err
+		}
+	}
+
+	ar, err := OpenArchive(archivePath, options)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+
+	for {
+		entry, err := ar.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(*entry); err != nil {
+			return err
+		}
+	}
+}
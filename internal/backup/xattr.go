@@ -0,0 +1,210 @@
+package backup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// 扩展属性（xattr）：扫描时用 llistxattr/lgetxattr 读取每个条目（不跟随符号链接）的
+// user.*、security.*（SELinux 标签、文件能力 security.capability 等）和 trusted.* 属性，
+// 写在条目的可选 tlvXattrs 元数据中；旧版本程序读取时跳过，只是不还原这些属性。
+// 解包时在写完内容、恢复属主之后用 lsetxattr 设置（修改属主会清除 security.capability），
+// 设置失败（目标文件系统不支持、没有权限设置 trusted.* 等）只警告。
+// SELinux 系统上 security.selinux 记录了每个条目的安全上下文，解包时原样设置，还原的系统目录不会被错误标记；
+// 还原到策略不同的系统时可以用 NoSELinux 跳过，由目标系统按自己的策略重新标记（restorecon）。
+// 其他名字空间（system.posix_acl_* 等）不保存；硬链接条目的属性属于它链接的文件，不重复保存。
+
+// selinuxXattr SELinux 安全上下文所在的扩展属性
+const selinuxXattr = "security.selinux"
+
+// tlvXattrs 扩展属性：值为按名称排序的属性列表，每个属性为名称长度 uint16 + 名称 + 值长度 uint32 + 值
+const tlvXattrs = uint16(7)
+
+// xattrNamespaces 保存的扩展属性名字空间
+var xattrNamespaces = []string{"user.", "security.", "trusted."}
+
+// savedXattr 扩展属性是否属于保存的名字空间
+func savedXattr(name string) bool {
+	for _, prefix := range xattrNamespaces {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SELinuxContext 返回条目记录的 SELinux 安全上下文（如 "system_u:object_r:etc_t:s0"），没有记录时返回空字符串
+func (e FileEntry) SELinuxContext() string {
+	return strings.TrimRight(string(e.Xattrs[selinuxXattr]), "\x00")
+}
+
+// restoredXattrs 返回解包时要设置的扩展属性：NoSELinux 时去掉 security.selinux
+func restoredXattrs(xattrs map[string][]byte, options PackOptions) map[string][]byte {
+	if !options.NoSELinux || xattrs[selinuxXattr] == nil {
+		return xattrs
+	}
+	filtered := make(map[string][]byte, len(xattrs))
+	for name, value := range xattrs {
+		if name != selinuxXattr {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
+
+// readXattrs 读取路径的扩展属性（不跟随符号链接），没有属性、文件系统不支持或无法读取时返回 nil
+func readXattrs(path string) map[string][]byte {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	list := make([]byte, size)
+	if size, err = unix.Llistxattr(path, list); err != nil {
+		return nil
+	}
+	var xattrs map[string][]byte
+	for _, name := range strings.Split(string(list[:size]), "\x00") {
+		if !savedXattr(name) {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if err != nil {
+			continue // 读取时被删除，或没有权限读取（trusted.* 需要 CAP_SYS_ADMIN）
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = value
+	}
+	return xattrs
+}
+
+// readXattrsAt 读取相对于目录的条目的扩展属性：通过 /proc/self/fd 访问，路径总长度不受 PATH_MAX 限制
+func readXattrsAt(dirfd int, name string) map[string][]byte {
+	return readXattrs(procFdPath(dirfd, name))
+}
+
+// procFdPath 返回通过 /proc/self/fd 访问目录中条目的路径（xattr 系统调用没有 *at 版本）
+func procFdPath(dirfd int, name string) string {
+	return "/proc/self/fd/" + strconv.Itoa(dirfd) + "/" + name
+}
+
+// getXattr 读取一个扩展属性的值（读取期间值变长时重试）
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		n, err := unix.Lgetxattr(path, name, value)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+}
+
+// xattrsTLV 返回 tlvXattrs 的值
+func xattrsTLV(xattrs map[string][]byte) []byte {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var value []byte
+	for _, name := range names {
+		value = binary.LittleEndian.AppendUint16(value, uint16(len(name)))
+		value = append(value, name...)
+		value = binary.LittleEndian.AppendUint32(value, uint32(len(xattrs[name])))
+		value = append(value, xattrs[name]...)
+	}
+	return value
+}
+
+// parseXattrsTLV 解析 tlvXattrs 的值
+func parseXattrsTLV(value []byte) (map[string][]byte, error) {
+	xattrs := make(map[string][]byte)
+	for len(value) > 0 {
+		if len(value) < 2 {
+			return nil, fmt.Errorf("扩展属性列表被截断")
+		}
+		nameLen := int(binary.LittleEndian.Uint16(value))
+		if nameLen == 0 || len(value) < 2+nameLen+4 {
+			return nil, fmt.Errorf("扩展属性列表被截断")
+		}
+		name := string(value[2 : 2+nameLen])
+		value = value[2+nameLen:]
+		valueLen := int64(binary.LittleEndian.Uint32(value))
+		if int64(len(value)-4) < valueLen {
+			return nil, fmt.Errorf("扩展属性 %s 的值被截断", name)
+		}
+		if strings.ContainsRune(name, 0) {
+			return nil, fmt.Errorf("扩展属性名称无效")
+		}
+		xattrs[name] = value[4 : 4+valueLen]
+		value = value[4+valueLen:]
+	}
+	return xattrs, nil
+}
+
+// tarXattrs 从 tar 头部的 PAX 记录（SCHILY.xattr.<名称>，GNU tar --xattrs 和 bsdtar 使用的格式）中提取扩展属性
+func tarXattrs(records map[string]string) map[string][]byte {
+	const prefix = "SCHILY.xattr."
+	var xattrs map[string][]byte
+	for key, value := range records {
+		name, ok := strings.CutPrefix(key, prefix)
+		if !ok || !savedXattr(name) {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = []byte(value)
+	}
+	return xattrs
+}
+
+// restoreXattrs 设置解包后条目的扩展属性，失败时返回设置失败的属性名及原因
+func restoreXattrs(path string, xattrs map[string][]byte) error {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	if isLongPath(path) {
+		return deepAt("lsetxattr", path, func(dirfd int, name string) error {
+			return setXattrs(procFdPath(dirfd, name), xattrs)
+		})
+	}
+	return setXattrs(path, xattrs)
+}
+
+// setXattrs 按名称顺序设置扩展属性，设置完全部属性后返回第一个错误
+func setXattrs(path string, xattrs map[string][]byte) error {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var failed []string
+	var first error
+	for _, name := range names {
+		if err := unix.Lsetxattr(path, name, xattrs[name], 0); err != nil {
+			failed = append(failed, name)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("设置扩展属性 %s 失败: %v", strings.Join(failed, ", "), first)
+	}
+	return nil
+}
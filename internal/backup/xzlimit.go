@@ -0,0 +1,226 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// xz 解压缩器按每个块头声明的字典大小分配内存（最大 4G），ReaderConfig.DictCap 只是下限，不能限制内存；
+// xzLimitReader 在数据交给解压缩器之前跟踪 xz 容器的结构（流头、块头、LZMA2 数据块、索引、流尾），
+// 块头声明的字典超过限制时直接报错。只解析长度字段，数据本身和校验值由解压缩器检查
+
+// xz 容器结构中的位置
+const (
+	xzStreamStart  = iota // 流头的前 4 字节，或流之间的填充（4 个零字节）
+	xzStreamRest          // 流头的其余 8 字节
+	xzBlockStart          // 块头的长度字节，为 0 时是索引标识
+	xzBlockHeader         // 块头的其余部分
+	xzChunkControl        // LZMA2 数据块的控制字节
+	xzChunkHeader         // LZMA2 数据块的长度字段
+	xzIndexCount          // 索引的记录数（变长整数）
+	xzIndexRecords        // 索引记录（每条两个变长整数）
+)
+
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+// xzLimitReader 检查 xz 数据中每个块的字典大小
+type xzLimitReader struct {
+	reader  io.Reader
+	maxDict int64
+
+	state    int
+	field    []byte // 正在收集的字段
+	need     int    // 当前字段的长度
+	skip     int64  // 需要跳过的字节数（压缩数据、填充、校验值）
+	check    int64  // 每个块之后校验值的长度
+	control  byte   // 当前 LZMA2 数据块的控制字节
+	blockLen int64  // 当前块已读取的字节数（块头和压缩数据，用于计算块填充）
+	indexLen int64  // 索引已读取的字节数
+	value    uint64 // 正在读取的变长整数
+	shift    uint
+	records  uint64 // 索引中剩余的变长整数个数
+}
+
+// newXzLimitReader 创建检查字典大小的读取器，maxDict 为 0 时不检查
+func newXzLimitReader(r io.Reader, maxDict int64) io.Reader {
+	if maxDict <= 0 {
+		return r
+	}
+	return &xzLimitReader{reader: r, maxDict: maxDict, state: xzStreamStart, need: 4}
+}
+
+func (xr *xzLimitReader) Read(p []byte) (int, error) {
+	n, err := xr.reader.Read(p)
+	if scanErr := xr.scan(p[:n]); scanErr != nil {
+		return 0, scanErr
+	}
+	return n, err
+}
+
+// scan 按容器结构处理读到的数据
+func (xr *xzLimitReader) scan(p []byte) error {
+	for len(p) > 0 {
+		if xr.skip > 0 {
+			n := min(int64(len(p)), xr.skip)
+			xr.skip -= n
+			p = p[n:]
+			continue
+		}
+		n := min(len(p), xr.need-len(xr.field))
+		xr.field = append(xr.field, p[:n]...)
+		p = p[n:]
+		if len(xr.field) == xr.need {
+			field := xr.field
+			xr.field = xr.field[:0]
+			if err := xr.next(field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expect 设置下一个字段
+func (xr *xzLimitReader) expect(state, need int) {
+	xr.state, xr.need = state, need
+}
+
+// next 处理收集完整的字段，确定下一个字段
+func (xr *xzLimitReader) next(field []byte) error {
+	switch xr.state {
+	case xzStreamStart:
+		if bytes.Equal(field, []byte{0, 0, 0, 0}) {
+			return nil
+		}
+		if !bytes.Equal(field, xzMagic[:4]) {
+			return fmt.Errorf("xz 数据的流头无效")
+		}
+		xr.expect(xzStreamRest, 8)
+	case xzStreamRest:
+		if !bytes.Equal(field[:2], xzMagic[4:]) {
+			return fmt.Errorf("xz 数据的流头无效")
+		}
+		// 校验方式 0 没有校验值，其余每 3 种一组，长度依次为 4、8、16、32、64 字节
+		if id := field[3] & 0x0f; id == 0 {
+			xr.check = 0
+		} else {
+			xr.check = 4 << ((id - 1) / 3)
+		}
+		xr.expect(xzBlockStart, 1)
+	case xzBlockStart:
+		if field[0] == 0 {
+			xr.indexLen, xr.value, xr.shift = 1, 0, 0
+			xr.expect(xzIndexCount, 1)
+			return nil
+		}
+		xr.blockLen = (int64(field[0]) + 1) * 4
+		xr.expect(xzBlockHeader, int(xr.blockLen)-1)
+	case xzBlockHeader:
+		if err := xr.checkBlockHeader(field); err != nil {
+			return err
+		}
+		xr.expect(xzChunkControl, 1)
+	case xzChunkControl:
+		xr.blockLen++
+		xr.control = field[0]
+		switch c := field[0]; {
+		case c == 0:
+			// 块结束：块填充到 4 字节的整数倍，之后是校验值
+			xr.skip = (4-xr.blockLen%4)%4 + xr.check
+			xr.expect(xzBlockStart, 1)
+		case c == 1 || c == 2:
+			xr.expect(xzChunkHeader, 2)
+		case c >= 0xc0:
+			// 重置压缩参数的数据块多一个参数字节
+			xr.expect(xzChunkHeader, 5)
+		case c >= 0x80:
+			xr.expect(xzChunkHeader, 4)
+		default:
+			return fmt.Errorf("xz 数据损坏: 无效的 LZMA2 控制字节 0x%02x", c)
+		}
+	case xzChunkHeader:
+		size := field
+		if xr.control >= 0x80 {
+			size = field[2:4]
+		}
+		xr.skip = int64(binary.BigEndian.Uint16(size)) + 1
+		xr.blockLen += int64(len(field)) + xr.skip
+		xr.expect(xzChunkControl, 1)
+	case xzIndexCount, xzIndexRecords:
+		xr.indexLen++
+		if xr.state == xzIndexCount {
+			xr.value |= uint64(field[0]&0x7f) << xr.shift
+			xr.shift += 7
+			if xr.shift > 63 {
+				return fmt.Errorf("xz 数据的索引损坏")
+			}
+			if field[0]&0x80 != 0 {
+				return nil
+			}
+			xr.records = 2 * xr.value
+		} else if field[0]&0x80 == 0 {
+			xr.records--
+		}
+		if xr.records > 0 {
+			xr.expect(xzIndexRecords, 1)
+			return nil
+		}
+		// 索引结束：填充到 4 字节的整数倍，之后是 CRC32 和 12 字节的流尾
+		xr.skip = (4-xr.indexLen%4)%4 + 4 + 12
+		xr.expect(xzStreamStart, 4)
+	}
+	return nil
+}
+
+// checkBlockHeader 解析块头（不含长度字节）中的过滤器，检查 LZMA2 的字典大小
+func (xr *xzLimitReader) checkBlockHeader(header []byte) error {
+	invalid := fmt.Errorf("xz 数据的块头损坏")
+	flags := header[0]
+	rest := header[1 : len(header)-4] // 末尾是块头的 CRC32
+	uvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return 0, false
+		}
+		rest = rest[n:]
+		return v, true
+	}
+	// 可选的压缩大小和原始大小
+	for _, bit := range []byte{0x40, 0x80} {
+		if flags&bit != 0 {
+			if _, ok := uvarint(); !ok {
+				return invalid
+			}
+		}
+	}
+	for i := 0; i <= int(flags&0x03); i++ {
+		id, ok := uvarint()
+		if !ok {
+			return invalid
+		}
+		size, ok := uvarint()
+		if !ok || size > uint64(len(rest)) {
+			return invalid
+		}
+		props := rest[:size]
+		rest = rest[size:]
+		if id != 0x21 { // 只有 LZMA2 过滤器有字典
+			continue
+		}
+		if len(props) != 1 {
+			return invalid
+		}
+		dict, err := lzma.DecodeDictCap(props[0])
+		if err != nil {
+			return invalid
+		}
+		if dict > xr.maxDict {
+			return fmt.Errorf("xz 数据的字典大小 (%d) 超过解压缩内存限制 (%d)，确认归档可信时可以提高 MaxDecoderMemory（-max-decoder-memory）", dict, xr.maxDict)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// xzTestData 压缩测试数据：可压缩的文本与不可压缩的随机数据交替（LZMA2 中分别为压缩块和未压缩块）
+func xzTestData() []byte {
+	var b bytes.Buffer
+	random := chunkTestData(64 << 10)
+	for i := 0; i < 4; i++ {
+		b.WriteString(strings.Repeat("backup archive ", 4096))
+		b.Write(random[i*16<<10 : (i+1)*16<<10])
+	}
+	return b.Bytes()
+}
+
+// compressXz 按给定配置压缩为一个 xz 流
+func compressXz(t *testing.T, config xz.WriterConfig, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := config.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// TestDecoderMemoryLimit 压缩数据声明的窗口或字典超过限制时在解压缩之前报错，限制之内的各种 xz 结构都能正常解压
+func TestDecoderMemoryLimit(t *testing.T) {
+	data := xzTestData()
+	single := compressXz(t, xz.WriterConfig{DictCap: 8 << 20}, data)
+	var zstdData bytes.Buffer
+	zw, err := zstd.NewWriter(&zstdData, zstd.WithWindowSize(8<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(data)
+	zw.Close()
+
+	tests := []struct {
+		name       string
+		codec      Codec
+		compressed []byte
+		limit      int64
+		wantErr    bool
+	}{
+		{"xz 字典超过限制", CodecXz, single, 4 << 20, true},
+		{"xz 字典等于限制", CodecXz, single, 8 << 20, false},
+		{"xz 不限制", CodecXz, single, -1, false},
+		{"xz 多个块和 SHA-256 校验", CodecXz, compressXz(t, xz.WriterConfig{DictCap: 1 << 20, BlockSize: 20 << 10, CheckSum: xz.SHA256}, data), 1 << 20, false},
+		{"xz 没有校验值", CodecXz, compressXz(t, xz.WriterConfig{NoCheckSum: true}, data), 0, false},
+		{"xz 多个流和流填充", CodecXz, bytes.Join([][]byte{single, {0, 0, 0, 0}, compressXz(t, xz.WriterConfig{CheckSum: xz.CRC32}, data)}, nil), 0, false},
+		{"xz 后一个流的字典超过限制", CodecXz, append(compressXz(t, xz.WriterConfig{DictCap: 1 << 20}, data), single...), 4 << 20, true},
+		{"zstd 窗口超过限制", CodecZstd, zstdData.Bytes(), 4 << 20, true},
+		{"zstd 窗口在限制之内", CodecZstd, zstdData.Bytes(), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := PackOptions{Limits: ReadLimits{MaxDecoderMemory: tt.limit}}
+			r, err := decompressLayer(tt.codec, flagCompress, options)(bytes.NewReader(tt.compressed))
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(r)
+				r.Close()
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Error("超过限制的数据解压成功")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("解压失败: %v", err)
+			}
+			want := data
+			if bytes.Count(tt.compressed, xzMagic) == 2 {
+				want = bytes.Repeat(data, 2)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("解压结果与原始数据不同（%d 字节）", len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// zip 输出：给没有本程序的用户（Windows 资源管理器、macOS 归档实用工具都能直接打开）。
+// 使用 archive/zip 写出标准 zip：内容用 deflate（启用压缩时）或不压缩保存，超过 4GB 的文件和条目数自动使用 zip64，
+// 非 ASCII 文件名按 UTF-8 标记。zip 能表示的元数据有：修改时间（DOS 时间和扩展时间戳 0x5455）、
+// Unix 权限位和文件类型（外部属性，创建系统为 Unix）、属主（Info-ZIP 的 Unix 扩展字段 0x7875，ImportArchive 读取时还原）。
+// 符号链接按 Info-ZIP 的约定以链接目标为内容保存（Windows 上解压为内容是目标路径的普通文件）；
+// 硬链接没有对应的表示，每个路径都保存完整内容；FIFO、设备和套接字跳过；扩展属性不保存。
+
+// zipUnixExtraID Info-ZIP 的 Unix UID/GID 扩展字段（"ux"）
+const zipUnixExtraID = 0x7875
+
+// PackZip 将源路径打包为标准 zip 归档
+// root: 要打包的源目录或文件
+// zipPath: 输出的 zip 文件路径，写完后才从 .partial 重命名
+// filter: 可选的过滤条件
+// options: 打包选项，使用其中的压缩（只支持 flate，即 zip 的 deflate）、敏感文件策略、还原顺序、限额、进度和取消；
+// 加密、块存储、增量等 BKUP 特有的选项不适用，调用方应事先拒绝
+func PackZip(root string, zipPath string, filter *Filter, options PackOptions) (err error) {
+	defer releaseDeepDirs()
+	options = resolveCompression(options)
+	if options.Compress && options.Compression != CodecFlate {
+		return fmt.Errorf("zip 输出只支持 deflate 压缩，不支持 %s", options.Compression)
+	}
+	if options.Encrypt {
+		return fmt.Errorf("zip 输出不支持加密")
+	}
+	options.quota = newQuotaTracker(options)
+	absRoot, entries, err := collectEntries(root, filter, options)
+	if err != nil {
+		return err
+	}
+
+	partialPath := zipPath + partialSuffix
+	outFile, err := os.Create(partialPath)
+	if err != nil {
+		return fmt.Errorf("创建归档文件失败: %v", err)
+	}
+	defer func() {
+		outFile.Close()
+		if err != nil {
+			os.Remove(partialPath)
+		}
+	}()
+	var w io.Writer = outFile
+	if options.quota != nil {
+		w = &quotaWriter{writer: outFile, tracker: options.quota}
+	}
+	bufWriter := bufio.NewWriterSize(w, bufferSize(options))
+	zw := zip.NewWriter(bufWriter)
+	if options.Compress {
+		level := options.CompressionLevel
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	}
+
+	counter := newProgressCounter(entries, options.Progress)
+	for _, entry := range entries {
+		if err := checkCanceled(options); err != nil {
+			return err
+		}
+		if err := writeZipEntry(zw, entry, absRoot, options, counter); err != nil {
+			return fmt.Errorf("写入条目失败 (%s): %v", entry.RelPath, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("写入 zip 目录失败: %v", err)
+	}
+	if err := bufWriter.Flush(); err != nil {
+		return fmt.Errorf("刷新缓冲区失败: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("关闭归档文件失败: %v", err)
+	}
+	if err := os.Rename(partialPath, zipPath); err != nil {
+		return fmt.Errorf("重命名归档文件失败: %v", err)
+	}
+	return nil
+}
+
+// writeZipEntry 写入一个条目的 zip 头部和内容；根目录条目和 zip 不能表示的类型跳过
+func writeZipEntry(zw *zip.Writer, entry FileEntry, absRoot string, options PackOptions, counter *progressCounter) error {
+	if entry.RelPath == "." {
+		return nil
+	}
+	hdr := &zip.FileHeader{
+		Name:     entry.RelPath,
+		Modified: time.Unix(entry.ModTime, 0),
+		Method:   zip.Store,
+		Extra:    zipUnixExtra(entry.UID, entry.GID),
+	}
+	mode := os.FileMode(entry.Mode)
+	switch entry.Type {
+	case TypeDir:
+		hdr.Name = strings.TrimSuffix(hdr.Name, "/") + "/"
+		hdr.SetMode(mode&^os.ModeType | os.ModeDir)
+		_, err := zw.CreateHeader(hdr)
+		return err
+	case TypeSymlink:
+		hdr.SetMode(mode&^os.ModeType | os.ModeSymlink)
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(fw, entry.LinkTarget)
+		return err
+	case TypeFile, TypeHardlink:
+		// 硬链接在 zip 中没有对应的表示，读取链接本身的路径（与目标是同一个文件）保存完整内容
+		hdr.SetMode(mode &^ os.ModeType)
+		if options.Compress {
+			hdr.Method = zip.Deflate
+		}
+		src, err := openEntryContent(entry, absRoot, options)
+		if err != nil {
+			return fmt.Errorf("打开源文件失败: %v", err)
+		}
+		defer src.Close()
+		if entry.Type == TypeHardlink {
+			counter = nil // 进度的总量只计算普通文件
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fw, withCancel(withProgress(src, counter), options)); err != nil {
+			return fmt.Errorf("写入文件内容失败: %v", err)
+		}
+		return nil
+	default:
+		warn(options, "zip 不支持 %s，跳过: %s", entry.Type, entry.RelPath)
+		return nil
+	}
+}
+
+// zipUnixExtra 返回记录属主的 Info-ZIP Unix 扩展字段：版本 1、UID 和 GID 各 4 字节
+func zipUnixExtra(uid, gid int) []byte {
+	extra := binary.LittleEndian.AppendUint16(nil, zipUnixExtraID)
+	extra = binary.LittleEndian.AppendUint16(extra, 11)
+	extra = append(extra, 1, 4)
+	extra = binary.LittleEndian.AppendUint32(extra, uint32(uid))
+	extra = append(extra, 4)
+	return binary.LittleEndian.AppendUint32(extra, uint32(gid))
+}
+
+// zipUnixOwner 从 zip 条目的扩展字段中读取 Info-ZIP Unix 扩展字段记录的属主，没有时返回 false
+func zipUnixOwner(extra []byte) (uid, gid int, ok bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return 0, 0, false
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != zipUnixExtraID || len(field) < 2 || field[0] != 1 {
+			continue
+		}
+		ids := make([]int, 0, 2)
+		field = field[1:]
+		for len(ids) < 2 && len(field) > 0 {
+			n := int(field[0])
+			if n == 0 || n > 8 || len(field) < 1+n {
+				return 0, 0, false
+			}
+			var value uint64
+			for i := n - 1; i >= 0; i-- {
+				value = value<<8 | uint64(field[1+i])
+			}
+			ids = append(ids, int(value))
+			field = field[1+n:]
+		}
+		if len(ids) == 2 {
+			return ids[0], ids[1], true
+		}
+	}
+	return 0, 0, false
+}